@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/lima-vm/go-qcow2reader"
+	"github.com/lima-vm/go-qcow2reader/image/qcow2"
+	"github.com/lima-vm/go-qcow2reader/log"
+)
+
+func cmdCheck(args []string) error {
+	var (
+		// Required
+		filename string
+
+		// Options
+		debug bool
+	)
+
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s check [OPTIONS...] FILE\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.BoolVar(&debug, "debug", false, "enable printing debug messages")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if debug {
+		log.SetDebugFunc(logDebug)
+	}
+
+	switch len(fs.Args()) {
+	case 0:
+		return errors.New("no file was specified")
+	case 1:
+		filename = fs.Arg(0)
+	default:
+		return errors.New("too many files specified")
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	img, err := qcow2reader.Open(f)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
+	q, ok := img.(*qcow2.Qcow2)
+	if !ok {
+		return fmt.Errorf("checking image type %q is not supported", img.Type())
+	}
+	res, err := q.Check()
+	if err != nil {
+		return err
+	}
+
+	j, err := json.MarshalIndent(res, "", "    ")
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Println(string(j)); err != nil {
+		return err
+	}
+
+	switch {
+	case res.CheckErrors > 0:
+		return fmt.Errorf("%d errors occurred during the check", res.CheckErrors)
+	case res.Corruptions > 0:
+		return fmt.Errorf("%d errors were found on the image", res.Corruptions)
+	case res.Leaks > 0:
+		return fmt.Errorf("%d leaked clusters were found on the image", res.Leaks)
+	}
+	return nil
+}
@@ -1,14 +1,19 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
 
 	"github.com/cheggaaa/pb/v3"
 	"github.com/lima-vm/go-qcow2reader"
 	"github.com/lima-vm/go-qcow2reader/convert"
+	"github.com/lima-vm/go-qcow2reader/image"
+	"github.com/lima-vm/go-qcow2reader/image/qcow2"
 	"github.com/lima-vm/go-qcow2reader/log"
 )
 
@@ -18,19 +23,27 @@ func cmdConvert(args []string) error {
 		source, target string
 
 		// Options
-		debug   bool
-		options convert.Options
+		debug           bool
+		snapshot        string
+		format          string
+		compressionType string
+		options         convert.Options
 	)
 
 	fs := flag.NewFlagSet("convert", flag.ExitOnError)
 	fs.Usage = func() {
-		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s convert [OPTIONS...] SOURCE TARGET\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s convert [OPTIONS...] SOURCE TARGET\n\nUse \"-\" as TARGET to write a raw image to stdout.\n", os.Args[0])
 		flag.PrintDefaults()
 	}
 	fs.BoolVar(&debug, "debug", false, "enable printing debug messages")
+	fs.StringVar(&snapshot, "snapshot", "", "convert the internal snapshot with this ID or name (qcow2 only)")
+	fs.StringVar(&format, "O", "raw", "target image format (raw, qcow2)")
+	fs.BoolVar(&options.Compress, "c", false, "compress the target image (qcow2 only)")
+	fs.StringVar(&compressionType, "compression-type", "zlib", "compression type of the target image (zlib, zstd)")
 	fs.Int64Var(&options.SegmentSize, "segment-size", convert.SegmentSize, "worker segment size in bytes")
 	fs.IntVar(&options.BufferSize, "buffer-size", convert.BufferSize, "buffer size in bytes")
 	fs.IntVar(&options.Workers, "workers", convert.Workers, "number of workers")
+	fs.Int64Var(&options.StreamWindow, "stream-window", convert.StreamWindow, "maximum bytes read ahead when writing to stdout")
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
@@ -57,20 +70,78 @@ func cmdConvert(args []string) error {
 	}
 	defer f.Close()
 
-	img, err := qcow2reader.Open(f)
+	var img image.Image
+	img, err = qcow2reader.Open(f)
 	if err != nil {
 		return err
 	}
 	defer img.Close()
 
+	if snapshot != "" {
+		q, ok := img.(*qcow2.Qcow2)
+		if !ok {
+			return fmt.Errorf("snapshots are not supported for image type %q", img.Type())
+		}
+		if img, err = q.OpenSnapshot(snapshot); err != nil {
+			return err
+		}
+		defer img.Close()
+	}
+
+	// Stop on interrupt, and remove the incomplete target.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if target == "-" {
+		if format != "raw" || options.Compress {
+			return errors.New("only raw images can be written to stdout")
+		}
+		bar := newProgressBar(img.Size())
+		bar.Start()
+		defer bar.Finish()
+		options.Progress = bar
+		return convert.ConvertStreamContext(ctx, os.Stdout, img, options)
+	}
+
 	t, err := os.Create(target)
 	if err != nil {
 		return err
 	}
 	defer t.Close()
 
-	if err := t.Truncate(img.Size()); err != nil {
-		return err
+	var wa io.WriterAt
+	switch format {
+	case "raw":
+		if options.Compress {
+			return errors.New("compression is not supported for raw images")
+		}
+		if err := t.Truncate(img.Size()); err != nil {
+			return err
+		}
+		wa = t
+	case "qcow2":
+		// Round up to a multiple of 512 bytes, like qemu-img.
+		opts := qcow2.CreateOptions{Size: (uint64(img.Size()) + 511) &^ 511}
+		switch compressionType {
+		case "zlib":
+			opts.CompressionType = qcow2.CompressionTypeZlib
+		case "zstd":
+			opts.CompressionType = qcow2.CompressionTypeZstd
+		default:
+			return fmt.Errorf("unknown compression type %q", compressionType)
+		}
+		if err := qcow2.Create(t, opts); err != nil {
+			return err
+		}
+		w, err := qcow2.OpenWritable(t, nil)
+		if err != nil {
+			return err
+		}
+		// Closes the target file on errors; Close is idempotent.
+		defer w.Close()
+		wa = w
+	default:
+		return fmt.Errorf("unknown target format %q", format)
 	}
 
 	bar := newProgressBar(img.Size())
@@ -78,10 +149,17 @@ func cmdConvert(args []string) error {
 	defer bar.Finish()
 	options.Progress = bar
 
-	if err := convert.Convert(t, img, options); err != nil {
+	if err := convert.ConvertContext(ctx, wa, img, options); err != nil {
+		if ctx.Err() != nil {
+			_ = os.Remove(target)
+		}
 		return err
 	}
 
+	if w, ok := wa.(*qcow2.WritableQcow2); ok {
+		return w.Close()
+	}
+
 	if err := t.Sync(); err != nil {
 		return err
 	}
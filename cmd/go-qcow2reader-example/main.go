@@ -35,14 +35,20 @@ func newZstdDecompressor(r io.Reader) (io.ReadCloser, error) {
 	return &zstdDecompressor{dec}, nil
 }
 
+func newZstdCompressor(w io.Writer) (io.WriteCloser, error) {
+	// Each cluster is compressed separately, in parallel.
+	return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+}
+
 func usage() {
 	usage := `Usage: %s COMMAND [OPTIONS...]
 
 Available commands:
   info		show image information
   read		read image data and print to stdout
-  convert	convert image to raw format
+  convert	convert image to raw or qcow2 format
   map		print image extents
+  check		check image consistency
 `
 	fmt.Fprintf(os.Stderr, usage, os.Args[0])
 	os.Exit(1)
@@ -51,8 +57,10 @@ Available commands:
 func main() {
 	log.SetWarnFunc(logWarn)
 
-	// zlib (deflate) decompressor is registered by default, but zstd is not.
+	// zlib (deflate) decompressor and compressor are registered by default, but
+	// zstd is not.
 	qcow2.SetDecompressor(qcow2.CompressionTypeZstd, newZstdDecompressor)
+	qcow2.SetCompressor(qcow2.CompressionTypeZstd, newZstdCompressor)
 
 	var err error
 
@@ -74,6 +82,8 @@ func main() {
 		err = cmdConvert(args)
 	case "map":
 		err = cmdMap(args)
+	case "check":
+		err = cmdCheck(args)
 	default:
 		usage()
 	}
@@ -2,6 +2,7 @@ package convert
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -32,6 +33,11 @@ const SegmentSize = 32 * BufferSize
 // results with lima default Ubuntu image.
 const Workers = 8
 
+// ConvertStream writes segments in order, so it keeps the segments read ahead
+// of the writer in memory. StreamWindow limits the memory used for the data of
+// these segments.
+const StreamWindow = 4 * SegmentSize
+
 // Updater is an interface for tracking conversion progress.
 type Updater interface {
 	// Called from multiple goroutines after a byte range of length was converted.
@@ -54,6 +60,34 @@ type Options struct {
 
 	// If set, update progress during conversion.
 	Progress Updater
+
+	// If set, write compressed clusters. The target must implement
+	// CompressedWriterAt and BufferSize must be aligned to its cluster size.
+	Compress bool
+
+	// If set, ConvertStream skips zero ranges by seeking when the writer
+	// implements io.Seeker, instead of writing zeros. The writer must be a new
+	// empty file or a file full of zeros.
+	SeekZeros bool
+
+	// StreamWindow is the maximum size in bytes of the segments read ahead of
+	// the writer by ConvertStream, rounded down to whole segments but at least
+	// one segment. If not set, use the default value (128 MiB).
+	StreamWindow int64
+}
+
+// CompressedWriterAt is a target image that can store compressed clusters,
+// such as a qcow2 image opened with qcow2.OpenWritable.
+type CompressedWriterAt interface {
+	io.WriterAt
+
+	// ClusterSize returns the size of a compressed cluster in bytes.
+	ClusterSize() int
+
+	// WriteCompressedAt compresses and writes a whole cluster at a cluster
+	// aligned offset. The last cluster may be shorter. Must be safe for
+	// concurrent use.
+	WriteCompressedAt(p []byte, off int64) (int, error)
 }
 
 // Validate validates options and set default values. Returns an error for
@@ -80,6 +114,13 @@ func (o *Options) Validate() error {
 		o.Workers = Workers
 	}
 
+	if o.StreamWindow < 0 {
+		return errors.New("stream window must be positive")
+	}
+	if o.StreamWindow == 0 {
+		o.StreamWindow = StreamWindow
+	}
+
 	// This is not stritcly required, but there is no reason support unaligned
 	// segment size.
 	if o.SegmentSize%int64(o.BufferSize) != 0 {
@@ -136,10 +177,42 @@ func (c *conversion) setError(err error) {
 // get a sparse target image, the image must be a new empty file, since Convert
 // does not punch holes for zero ranges even if the underlying file system
 // supports hole punching.
+//
+// The target may be a qcow2 image opened with qcow2.OpenWritable. Zero ranges
+// are left unallocated in the target image, and if opts.Compress is set, the
+// clusters are compressed by the workers.
 func Convert(wa io.WriterAt, img image.Image, opts Options) error {
+	return ConvertContext(context.Background(), wa, img, opts)
+}
+
+// ConvertContext is like [Convert], but stops when ctx is done. The workers
+// check ctx before each segment and each buffer, and ConvertContext returns
+// ctx.Err() once all workers have stopped.
+//
+// When the conversion is stopped, no write is in progress, but the target is
+// incomplete: some ranges were written, in no specific order, and others were
+// not. The target should be removed.
+func ConvertContext(ctx context.Context, wa io.WriterAt, img image.Image, opts Options) error {
 	if err := opts.Validate(); err != nil {
 		return err
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var (
+		cw          CompressedWriterAt
+		clusterSize int64
+	)
+	if opts.Compress {
+		var ok bool
+		if cw, ok = wa.(CompressedWriterAt); !ok {
+			return errors.New("target does not support compression")
+		}
+		clusterSize = int64(cw.ClusterSize())
+		if opts.BufferSize%int(clusterSize) != 0 {
+			return fmt.Errorf("buffer size not aligned to cluster size (%d bytes)", clusterSize)
+		}
+	}
 	c := conversion{size: img.Size(), segmentSize: opts.SegmentSize}
 	zero := make([]byte, opts.BufferSize)
 	var wg sync.WaitGroup
@@ -157,12 +230,19 @@ func Convert(wa io.WriterAt, img image.Image, opts Options) error {
 				}
 
 				for start < end {
+					if err := ctx.Err(); err != nil {
+						c.setError(err)
+						return
+					}
 					// Get next extent in this segment.
 					extent, err := img.Extent(start, end-start)
 					if err != nil {
 						c.setError(err)
 						return
 					}
+					if cw != nil {
+						extent = alignExtent(extent, clusterSize, end)
+					}
 					if extent.Zero {
 						start += extent.Length
 						if opts.Progress != nil {
@@ -173,6 +253,11 @@ func Convert(wa io.WriterAt, img image.Image, opts Options) error {
 
 					// Consume data from this extent.
 					for extent.Length > 0 {
+						if err := ctx.Err(); err != nil {
+							c.setError(err)
+							return
+						}
+
 						// The last read may be shorter.
 						n := len(buf)
 						if extent.Length < int64(len(buf)) {
@@ -197,7 +282,12 @@ func Convert(wa io.WriterAt, img image.Image, opts Options) error {
 
 						// If the data is all zeros we skip it to create a hole. Otherwise
 						// write the data.
-						if !bytes.Equal(buf[:nr], zero[:nr]) {
+						if cw != nil {
+							if err := writeCompressed(cw, buf[:nr], start, clusterSize, zero); err != nil {
+								c.setError(err)
+								return
+							}
+						} else if !bytes.Equal(buf[:nr], zero[:nr]) {
 							if nw, err := wa.WriteAt(buf[:nr], start); err != nil {
 								c.setError(err)
 								return
@@ -223,3 +313,39 @@ func Convert(wa io.WriterAt, img image.Image, opts Options) error {
 	wg.Wait()
 	return c.err
 }
+
+// alignExtent aligns an extent starting at a cluster boundary to whole
+// clusters, since a compressed cluster must be written at once. A zero extent
+// is shortened to the clusters it covers entirely, or becomes a data extent if
+// it does not cover any. A data extent is extended to the end of its last
+// cluster, but not beyond end.
+func alignExtent(extent image.Extent, clusterSize, end int64) image.Extent {
+	extentEnd := extent.Start + extent.Length
+	if extent.Zero {
+		if n := extentEnd/clusterSize*clusterSize - extent.Start; n > 0 {
+			extent.Length = n
+			return extent
+		}
+		extent.Zero = false
+	}
+	extent.Length = min((extentEnd+clusterSize-1)/clusterSize*clusterSize, end) - extent.Start
+	return extent
+}
+
+// writeCompressed writes the clusters of buf at off, skipping clusters which
+// are all zeros.
+func writeCompressed(cw CompressedWriterAt, buf []byte, off, clusterSize int64, zero []byte) error {
+	for len(buf) > 0 {
+		n := min(len(buf), int(clusterSize))
+		if !bytes.Equal(buf[:n], zero[:n]) {
+			if nw, err := cw.WriteCompressedAt(buf[:n], off); err != nil {
+				return err
+			} else if nw != n {
+				return fmt.Errorf("read %d, but wrote %d bytes", n, nw)
+			}
+		}
+		buf = buf[n:]
+		off += int64(n)
+	}
+	return nil
+}
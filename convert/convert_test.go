@@ -0,0 +1,134 @@
+package convert
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lima-vm/go-qcow2reader/image"
+)
+
+// testImage is an image filled with the low byte of the offset. If hole is set,
+// odd ranges of hole bytes are unallocated. onRead is called before each read.
+type testImage struct {
+	size   int64
+	hole   int64
+	reads  atomic.Int64
+	onRead func()
+}
+
+func (img *testImage) allocated(off int64) bool {
+	return img.hole == 0 || off/img.hole%2 == 0
+}
+
+func (img *testImage) ReadAt(p []byte, off int64) (int, error) {
+	img.reads.Add(1)
+	if img.onRead != nil {
+		img.onRead()
+	}
+	for i := range p {
+		if img.allocated(off + int64(i)) {
+			p[i] = byte(off + int64(i))
+		} else {
+			p[i] = 0
+		}
+	}
+	return len(p), nil
+}
+
+func (img *testImage) Extent(start, length int64) (image.Extent, error) {
+	if img.hole != 0 {
+		length = min(length, img.hole-start%img.hole)
+	}
+	allocated := img.allocated(start)
+	return image.Extent{Start: start, Length: length, Allocated: allocated, Zero: !allocated}, nil
+}
+
+func (img *testImage) Close() error     { return nil }
+func (img *testImage) Type() image.Type { return "test" }
+func (img *testImage) Size() int64      { return img.size }
+func (img *testImage) Readable() error  { return nil }
+
+// memTarget is an in-memory io.WriterAt.
+type memTarget struct {
+	mutex sync.Mutex
+	data  []byte
+}
+
+func (t *memTarget) WriteAt(p []byte, off int64) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return copy(t.data[off:], p), nil
+}
+
+// discardTarget is an io.WriterAt discarding data.
+type discardTarget struct{}
+
+func (discardTarget) WriteAt(p []byte, off int64) (int, error) {
+	return len(p), nil
+}
+
+var testOptions = Options{SegmentSize: 4 * 4096, BufferSize: 4096, Workers: 4}
+
+func TestConvert(t *testing.T) {
+	img := &testImage{size: 100*4096 + 512}
+	target := &memTarget{data: make([]byte, img.size)}
+	if err := ConvertContext(context.Background(), target, img, testOptions); err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, img.size)
+	if _, err := img.ReadAt(want, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(target.data, want) {
+		t.Fatal("unexpected data")
+	}
+}
+
+func TestConvertCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	img := &testImage{size: 1 << 30}
+	if err := ConvertContext(ctx, discardTarget{}, img, testOptions); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if n := img.reads.Load(); n != 0 {
+		t.Fatalf("expected no reads, got %d", n)
+	}
+}
+
+func TestConvertCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Cancel during the 10th read of a 1 GiB image.
+	img := &testImage{size: 1 << 30}
+	img.onRead = func() {
+		if img.reads.Load() == 10 {
+			cancel()
+		}
+	}
+	if err := ConvertContext(ctx, discardTarget{}, img, testOptions); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	// Each worker may complete the read in progress.
+	if n := img.reads.Load(); n > 10+int64(testOptions.Workers) {
+		t.Fatalf("expected at most %d reads, got %d", 10+testOptions.Workers, n)
+	}
+}
+
+func TestConvertDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	img := &testImage{size: 1 << 30, onRead: func() { time.Sleep(time.Millisecond) }}
+	start := time.Now()
+	if err := ConvertContext(ctx, discardTarget{}, img, testOptions); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("the conversion stopped after %v", elapsed)
+	}
+}
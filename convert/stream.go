@@ -0,0 +1,278 @@
+package convert
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/lima-vm/go-qcow2reader/image"
+)
+
+// piece is a range of a segment: data, or a number of zero bytes.
+type piece struct {
+	data  []byte
+	zeros int64
+}
+
+// segment is a segment read by a worker, waiting to be written.
+type segment struct {
+	index  int64
+	pieces []piece
+	err    error
+}
+
+// ConvertStream copies image to io.Writer sequentially. Like Convert, segments
+// are read by multiple workers, but they are written in order. Zero ranges are
+// written as zeros, or skipped by seeking if opts.SeekZeros is set and the
+// writer implements io.Seeker.
+//
+// Segments read ahead of the writer are kept in memory, up to
+// opts.StreamWindow bytes (128 MiB by default) of data, plus a buffer of
+// opts.BufferSize bytes per worker. Zero ranges use no memory. Buffers are
+// reused once written. opts.Compress is not supported.
+func ConvertStream(w io.Writer, img image.Image, opts Options) error {
+	return ConvertStreamContext(context.Background(), w, img, opts)
+}
+
+// ConvertStreamContext is like [ConvertStream], but stops when ctx is done,
+// like [ConvertContext]. When the conversion is stopped, the writer has
+// received a prefix of the image.
+func ConvertStreamContext(ctx context.Context, w io.Writer, img image.Image, opts Options) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	if opts.Compress {
+		return errors.New("compression is not supported by ConvertStream")
+	}
+	size := img.Size()
+	if size < 0 {
+		return errors.New("image size is unknown")
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// A worker takes a token before reading a segment, and the token is
+	// returned when the segment is written, so segments are read at most
+	// window segments ahead of the writer.
+	window := max(1, opts.StreamWindow/opts.SegmentSize)
+	tokens := make(chan struct{}, window)
+	results := make(chan *segment, window)
+	segments := (size + opts.SegmentSize - 1) / opts.SegmentSize
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	buffers := newBufferPool(opts.BufferSize)
+
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case tokens <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+				index := next.Add(1) - 1
+				if index >= segments {
+					<-tokens
+					return
+				}
+				start := index * opts.SegmentSize
+				end := min(start+opts.SegmentSize, size)
+				seg := &segment{index: index}
+				seg.pieces, seg.err = readSegment(ctx, img, start, end, buffers)
+				results <- seg
+				if seg.err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	err := writeSegments(ctx, w, segments, results, tokens, buffers, opts)
+	cancel()
+	wg.Wait()
+	return err
+}
+
+// bufferPool reuses the buffers of pieces once they are written.
+type bufferPool struct {
+	size int
+	pool sync.Pool
+	zero []byte
+}
+
+func newBufferPool(size int) *bufferPool {
+	return &bufferPool{size: size, zero: make([]byte, size)}
+}
+
+func (bp *bufferPool) get() []byte {
+	if b, ok := bp.pool.Get().(*[]byte); ok {
+		return *b
+	}
+	return make([]byte, bp.size)
+}
+
+func (bp *bufferPool) put(b []byte) {
+	b = b[:cap(b)]
+	bp.pool.Put(&b)
+}
+
+// readSegment reads the segment from start to end, in pieces of up to the
+// buffer size. Zero extents and buffers which are all zeros are zero pieces.
+func readSegment(ctx context.Context, img image.Image, start, end int64, buffers *bufferPool) ([]piece, error) {
+	var pieces []piece
+	addZeros := func(n int64) {
+		if len(pieces) > 0 && pieces[len(pieces)-1].data == nil {
+			pieces[len(pieces)-1].zeros += n
+		} else {
+			pieces = append(pieces, piece{zeros: n})
+		}
+	}
+	for start < end {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		extent, err := img.Extent(start, end-start)
+		if err != nil {
+			return nil, err
+		}
+		if extent.Zero {
+			addZeros(extent.Length)
+			start += extent.Length
+			continue
+		}
+		for extent.Length > 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			buf := buffers.get()
+			buf = buf[:min(extent.Length, int64(len(buf)))]
+			nr, err := img.ReadAt(buf, start)
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					buffers.put(buf)
+					return nil, err
+				}
+				// See Convert.
+				if nr == 0 {
+					buffers.put(buf)
+					return nil, errors.New("unexpected EOF")
+				}
+			}
+			if bytes.Equal(buf[:nr], buffers.zero[:nr]) {
+				buffers.put(buf)
+				addZeros(int64(nr))
+			} else {
+				pieces = append(pieces, piece{data: buf[:nr]})
+			}
+			extent.Length -= int64(nr)
+			start += int64(nr)
+		}
+	}
+	return pieces, nil
+}
+
+// writeSegments writes the segments received from results in order, returning
+// a token for each segment written.
+func writeSegments(ctx context.Context, w io.Writer, segments int64, results <-chan *segment, tokens <-chan struct{}, buffers *bufferPool, opts Options) error {
+	sw := &streamWriter{w: w, zero: buffers.zero}
+	if opts.SeekZeros {
+		sw.seeker, _ = w.(io.Seeker)
+	}
+	pending := make(map[int64]*segment)
+	for index := int64(0); index < segments; {
+		seg, ok := pending[index]
+		if !ok {
+			select {
+			case seg := <-results:
+				if seg.err != nil {
+					return seg.err
+				}
+				pending[seg.index] = seg
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		delete(pending, index)
+		for _, p := range seg.pieces {
+			n := p.zeros
+			if p.data != nil {
+				if err := sw.write(p.data); err != nil {
+					return err
+				}
+				n = int64(len(p.data))
+				buffers.put(p.data)
+			} else if err := sw.writeZeros(p.zeros); err != nil {
+				return err
+			}
+			if opts.Progress != nil {
+				opts.Progress.Update(n)
+			}
+		}
+		<-tokens
+		index++
+	}
+	return sw.finish()
+}
+
+// streamWriter writes data and zeros sequentially. If seeker is set, zeros are
+// skipped by seeking.
+type streamWriter struct {
+	w      io.Writer
+	seeker io.Seeker
+	zero   []byte
+	// skipped is the number of zero bytes to skip before the next write.
+	skipped int64
+}
+
+func (sw *streamWriter) write(p []byte) error {
+	if sw.skipped > 0 {
+		if _, err := sw.seeker.Seek(sw.skipped, io.SeekCurrent); err != nil {
+			return err
+		}
+		sw.skipped = 0
+	}
+	if nw, err := sw.w.Write(p); err != nil {
+		return err
+	} else if nw != len(p) {
+		return fmt.Errorf("read %d, but wrote %d bytes", len(p), nw)
+	}
+	return nil
+}
+
+func (sw *streamWriter) writeZeros(n int64) error {
+	if sw.seeker != nil {
+		sw.skipped += n
+		return nil
+	}
+	for n > 0 {
+		m := min(n, int64(len(sw.zero)))
+		if err := sw.write(sw.zero[:m]); err != nil {
+			return err
+		}
+		n -= m
+	}
+	return nil
+}
+
+// finish writes the last skipped byte, since seeking does not extend the
+// target to the size of the image.
+func (sw *streamWriter) finish() error {
+	if sw.skipped == 0 {
+		return nil
+	}
+	sw.skipped--
+	return sw.write([]byte{0})
+}
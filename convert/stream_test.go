@@ -0,0 +1,118 @@
+package convert
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConvertStream(t *testing.T) {
+	// Reads complete in random order.
+	r := rand.New(rand.NewSource(1))
+	var mutex sync.Mutex
+	img := &testImage{size: 100*4096 + 512, hole: 3 * 4096, onRead: func() {
+		mutex.Lock()
+		d := time.Duration(r.Intn(100)) * time.Microsecond
+		mutex.Unlock()
+		time.Sleep(d)
+	}}
+	want := make([]byte, img.size)
+	if _, err := img.ReadAt(want, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := ConvertStream(&buf, img, testOptions); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatal("unexpected data")
+	}
+
+	// Zeros are skipped by seeking, including at the end of the image.
+	for _, size := range []int64{img.size, 4 * 4096} {
+		img.size = size
+		f, err := os.Create(filepath.Join(t.TempDir(), "disk.img"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close() //nolint:errcheck
+		opts := testOptions
+		opts.SeekZeros = true
+		if err := ConvertStream(f, img, opts); err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(io.NewSectionReader(f, 0, 1<<30))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, want[:size]) {
+			t.Fatalf("size %d: unexpected data", size)
+		}
+	}
+}
+
+func TestConvertStreamCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Cancel during the 10th read of a 1 GiB image.
+	img := &testImage{size: 1 << 30}
+	img.onRead = func() {
+		if img.reads.Load() == 10 {
+			cancel()
+		}
+	}
+	if err := ConvertStreamContext(ctx, io.Discard, img, testOptions); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if n := img.reads.Load(); n > 10+int64(testOptions.Workers) {
+		t.Fatalf("expected at most %d reads, got %d", 10+testOptions.Workers, n)
+	}
+}
+
+// failingWriter fails after n bytes.
+type failingWriter struct {
+	n int
+}
+
+var errWrite = errors.New("write failed")
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		return 0, errWrite
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestConvertStreamWriteError(t *testing.T) {
+	// The window is rounded down to whole segments, but at least one segment.
+	for _, tc := range []struct {
+		streamWindow int64
+		segments     int64
+	}{
+		{streamWindow: 4096, segments: 1},
+		{streamWindow: testOptions.SegmentSize, segments: 1},
+		{streamWindow: 2*testOptions.SegmentSize + 4096, segments: 2},
+		{streamWindow: 8 * testOptions.SegmentSize, segments: 8},
+	} {
+		img := &testImage{size: 1 << 30}
+		opts := testOptions
+		opts.StreamWindow = tc.streamWindow
+		if err := ConvertStream(&failingWriter{n: 10 * 4096}, img, opts); !errors.Is(err, errWrite) {
+			t.Fatalf("window %d: expected errWrite, got %v", tc.streamWindow, err)
+		}
+		// Workers stop reading within the window of segments.
+		window := tc.segments * opts.SegmentSize / int64(opts.BufferSize)
+		if n := img.reads.Load(); n > 10+window+int64(opts.Workers) {
+			t.Fatalf("window %d: expected at most %d reads, got %d", tc.streamWindow, 10+window+int64(opts.Workers), n)
+		}
+	}
+}
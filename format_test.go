@@ -0,0 +1,213 @@
+package qcow2reader_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lima-vm/go-qcow2reader"
+	"github.com/lima-vm/go-qcow2reader/image"
+	"github.com/lima-vm/go-qcow2reader/image/qcow2"
+	"github.com/lima-vm/go-qcow2reader/image/qed"
+	"github.com/lima-vm/go-qcow2reader/image/raw"
+)
+
+const (
+	testType  = image.Type("test")
+	testMagic = "TESTIMG\x00"
+)
+
+// testImage is an image of testType: testMagic followed by raw data.
+type testImage struct {
+	*raw.Raw
+}
+
+func (img *testImage) Type() image.Type {
+	return testType
+}
+
+func init() {
+	err := qcow2reader.Register(qcow2reader.Format{
+		Type: testType,
+		Probe: func(ra io.ReaderAt) bool {
+			b := make([]byte, len(testMagic))
+			_, err := ra.ReadAt(b, 0)
+			return err == nil && string(b) == testMagic
+		},
+		Open: func(ra io.ReaderAt, _ qcow2reader.FormatOptions) (image.Image, error) {
+			r, err := raw.Open(io.NewSectionReader(ra, int64(len(testMagic)), 1<<20))
+			if err != nil {
+				return nil, err
+			}
+			return &testImage{r}, nil
+		},
+		Priority: 1,
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	data := append([]byte(testMagic), bytes.Repeat([]byte{'x'}, 1<<20)...)
+	img, err := qcow2reader.Open(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Type() != testType {
+		t.Fatalf("expected type %q, got %q", testType, img.Type())
+	}
+	if formats := qcow2reader.Formats(); formats[0].Type != testType || formats[len(formats)-1].Type != raw.Type {
+		t.Fatal("unexpected probing order")
+	}
+	if err := qcow2reader.Register(qcow2reader.Format{Type: testType, Open: func(io.ReaderAt, qcow2reader.FormatOptions) (image.Image, error) {
+		return nil, nil
+	}}); err == nil {
+		t.Fatal("expected an error for a registered type")
+	}
+
+	// Backing files are opened with the registered formats.
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "base.test"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, format := range []image.Type{testType, ""} {
+		path := filepath.Join(dir, "disk.qcow2")
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := qcow2.Create(f, qcow2.CreateOptions{Size: 1 << 20, BackingFile: "base.test", BackingFileFormat: format}); err != nil {
+			t.Fatal(err)
+		}
+		img, err := qcow2reader.Open(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(io.NewSectionReader(img, 0, img.Size()))
+		_ = img.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, data[len(testMagic):]) {
+			t.Fatalf("format %q: unexpected data", format)
+		}
+	}
+}
+
+func TestDisable(t *testing.T) {
+	qcow2reader.Disable(raw.Type, testType)
+	t.Cleanup(func() { qcow2reader.Enable(raw.Type, testType) })
+
+	for _, data := range [][]byte{make([]byte, 4096), []byte(testMagic + "data")} {
+		if _, err := qcow2reader.Open(bytes.NewReader(data)); !errors.Is(err, qcow2reader.ErrUnknownType) {
+			t.Fatalf("expected ErrUnknownType, got %v", err)
+		}
+	}
+	if _, err := qcow2reader.OpenWithType(bytes.NewReader(nil), raw.Type); !errors.Is(err, qcow2reader.ErrDisabledType) {
+		t.Fatalf("expected ErrDisabledType, got %v", err)
+	}
+	if _, err := qcow2reader.OpenWithType(bytes.NewReader(nil), "unknown"); !errors.Is(err, qcow2reader.ErrUnknownType) {
+		t.Fatalf("expected ErrUnknownType, got %v", err)
+	}
+
+	qcow2reader.Enable(raw.Type)
+	img, err := qcow2reader.Open(bytes.NewReader(make([]byte, 4096)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Type() != raw.Type {
+		t.Fatalf("expected type %q, got %q", raw.Type, img.Type())
+	}
+}
+
+// createQed creates a QED image of 1 MiB at path, without allocated clusters.
+// The backing file format may be empty or raw.
+func createQed(t *testing.T, path, backingFile string, backingFileFormat image.Type) {
+	const qedClusterSize = 4096
+	h := qed.Header{
+		ClusterSize:   qedClusterSize,
+		TableSize:     1,
+		HeaderSize:    1,
+		L1TableOffset: qedClusterSize,
+		ImageSize:     1 << 20,
+	}
+	copy(h.Magic[:], qed.Magic)
+	if backingFile != "" {
+		h.Features |= qed.FeaturesBackingFile
+		h.BackingFilenameOffset = 1024
+		h.BackingFilenameSize = uint32(len(backingFile))
+		if backingFileFormat == raw.Type {
+			h.Features |= qed.FeaturesBackingFormatNoProbe
+		}
+	}
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, h); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 2*qedClusterSize)
+	copy(b, buf.Bytes())
+	copy(b[h.BackingFilenameOffset:], backingFile)
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestBackingChainAcrossFormats tests that loops and the depth of backing
+// chains are detected across formats.
+func TestBackingChainAcrossFormats(t *testing.T) {
+	dir := t.TempDir()
+	createQcow2(t, filepath.Join(dir, "a.qcow2"), "b.qed", qed.Type)
+	createQed(t, filepath.Join(dir, "b.qed"), "a.qcow2", "")
+	// A chain of alternating formats, one image deeper than the limit.
+	chainName := func(i int) string {
+		if i%2 == 0 {
+			return fmt.Sprintf("chain%02d.qcow2", i)
+		}
+		return fmt.Sprintf("chain%02d.qed", i)
+	}
+	depth := image.DefaultMaxBackingChainDepth + 1
+	for i := 0; i <= depth; i++ {
+		var backing string
+		if i < depth {
+			backing = chainName(i + 1)
+		}
+		if i%2 == 0 {
+			createQcow2(t, filepath.Join(dir, chainName(i)), backing, qed.Type)
+		} else {
+			createQed(t, filepath.Join(dir, chainName(i)), backing, "")
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		err  error
+	}{
+		{name: "a.qcow2", err: image.ErrBackingChainLoop},
+		{name: "b.qed", err: image.ErrBackingChainLoop},
+		{name: chainName(0), err: image.ErrBackingChainTooDeep},
+		{name: chainName(1)},
+	} {
+		f, err := os.Open(filepath.Join(dir, tc.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := qcow2reader.Open(f)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		err = img.Readable()
+		_ = img.Close()
+		if tc.err == nil && err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if !errors.Is(err, tc.err) {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.err, err)
+		}
+	}
+}
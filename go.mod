@@ -1,3 +1,8 @@
 module github.com/lima-vm/go-qcow2reader
 
-go 1.24
+go 1.24.0
+
+require (
+	golang.org/x/crypto v0.45.0
+	golang.org/x/sys v0.38.0
+)
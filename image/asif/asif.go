@@ -2,48 +2,216 @@ package asif
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 
 	"github.com/lima-vm/go-qcow2reader/image"
-	"github.com/lima-vm/go-qcow2reader/image/stub"
+	"github.com/lima-vm/go-qcow2reader/lru"
 )
 
 const Type = image.Type("asif")
 
-// Open returns an ASIF image.
+// maxDirectorySize is the maximum size of a directory. A directory of an image
+// with the maximum size (4 PiB) and 1 MiB chunks uses 266 KiB.
+const maxDirectorySize = 16 << 20
+
+// Each table maps about 126 GiB with 1 MiB chunks, using 1 MiB.
+const maxTables = 16
+
+var ErrNotAsif = fmt.Errorf("%w: image is not %s", image.ErrWrongType, Type)
+
+// Asif implements [image.Image] for Apple sparse images, created on macOS with
+// "diskutil image create blank --format ASIF".
+type Asif struct {
+	ra            io.ReaderAt
+	Header        *Header `json:"header"`
+	errUnreadable error
+	layout        *layout
+	// directory has the chunk number of each table, or 0.
+	directory  []uint64
+	tableCache *lru.Cache[int64, []uint64]
+}
+
+var _ image.Image = (*Asif)(nil)
+
+// Open opens an ASIF image.
+//
+// The format is not documented by Apple. Data chunks are read from the table
+// entries; the bitmaps of the blocks of each chunk are not used.
 func Open(ra io.ReaderAt) (*Asif, error) {
-	stub, err := stub.New(ra, Type, stub.SimpleProber([]byte("shdw")))
+	h, err := readHeader(ra)
 	if err != nil {
 		return nil, err
 	}
-	// Block count seems to be stored at offset 48 as a big-endian uint64.
-	bufToSectorCount := make([]byte, 8)
-	if _, err := ra.ReadAt(bufToSectorCount, 48); err != nil {
-		return nil, err
+	img := &Asif{ra: ra, Header: h}
+	img.errUnreadable = img.load()
+	return img, nil
+}
+
+func (img *Asif) load() error {
+	var err error
+	if img.layout, err = newLayout(img.Header); err != nil {
+		return err
 	}
-	sectorCount := binary.BigEndian.Uint64(bufToSectorCount)
-	// Block size
-	// ref: https://github.com/fox-it/dissect.hypervisor/blob/0c8976613a369923e69022304b2f0ed587e997e2/dissect/hypervisor/disk/c_asif.py#L19
-	bufToBlockSize := make([]byte, 2)
-	if _, err := ra.ReadAt(bufToBlockSize, 68); err != nil {
-		return nil, err
+	if img.layout.tables*8+8 > maxDirectorySize {
+		return fmt.Errorf("directory too large (%d tables)", img.layout.tables)
 	}
-	blockSize := binary.BigEndian.Uint16(bufToBlockSize)
-	return &Asif{
-		sectorCount: sectorCount,
-		blockSize:   blockSize,
-		Stub:        *stub,
-	}, nil
+	var version uint64
+	for i, off := range img.Header.DirectoryOffsets {
+		if off == 0 {
+			continue
+		}
+		v, directory, err := img.readDirectory(int64(off))
+		if err != nil {
+			return fmt.Errorf("directory %d: %w", i, err)
+		}
+		if img.directory == nil || v > version {
+			version, img.directory = v, directory
+		}
+	}
+	if img.directory == nil {
+		return errors.New("no directory")
+	}
+	img.tableCache = lru.New[int64, []uint64](maxTables)
+	return nil
 }
 
-type Asif struct {
-	sectorCount uint64
-	blockSize   uint16
-	stub.Stub
+// readDirectory reads the version and the table entries of a directory.
+func (img *Asif) readDirectory(off int64) (uint64, []uint64, error) {
+	b := make([]byte, 8+img.layout.tables*8)
+	if _, err := img.ra.ReadAt(b, off); err != nil {
+		return 0, nil, fmt.Errorf("failed to read the directory: %w", err)
+	}
+	directory := make([]uint64, img.layout.tables)
+	if _, err := binary.Decode(b[8:], binary.BigEndian, directory); err != nil {
+		return 0, nil, err
+	}
+	return binary.BigEndian.Uint64(b), directory, nil
 }
 
-var _ image.Image = (*Asif)(nil)
+func (img *Asif) table(index int64) ([]uint64, error) {
+	if table, ok := img.tableCache.Get(index); ok {
+		return table, nil
+	}
+	chunk := img.directory[index] & entryMask
+	if chunk == 0 {
+		return nil, nil
+	}
+	table := make([]uint64, img.layout.tableEntries)
+	off := int64(chunk) * img.layout.chunkSize
+	if err := binary.Read(io.NewSectionReader(img.ra, off, img.layout.tableEntries*8), binary.BigEndian, table); err != nil {
+		return nil, fmt.Errorf("failed to read table %d at offset %d: %w", index, off, err)
+	}
+	img.tableCache.Add(index, table)
+	return table, nil
+}
+
+// chunkOffset returns the file offset of the data at off, or 0 if the chunk
+// containing off is not allocated.
+func (img *Asif) chunkOffset(off int64) (int64, error) {
+	l := img.layout
+	table, err := img.table(off / l.tableSize)
+	if err != nil || table == nil {
+		return 0, err
+	}
+	inTable := off % l.tableSize
+	chunk := table[l.tableEntry(inTable/l.chunkSize)] & entryMask
+	if chunk == 0 {
+		return 0, nil
+	}
+	return int64(chunk)*l.chunkSize + inTable%l.chunkSize, nil
+}
+
+func (img *Asif) Close() error {
+	if closer, ok := img.ra.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (img *Asif) Type() image.Type {
+	return Type
+}
+
+func (img *Asif) Size() int64 {
+	return int64(img.Header.SectorCount) * int64(img.Header.BlockSize)
+}
+
+// Readable returns nil if the image is readable, otherwise returns an error.
+func (img *Asif) Readable() error {
+	return img.errUnreadable
+}
+
+// ReadAt implements [io.ReaderAt].
+func (img *Asif) ReadAt(p []byte, off int64) (int, error) {
+	if img.errUnreadable != nil {
+		return 0, img.errUnreadable
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	size := img.Size()
+	if off >= size {
+		return 0, io.EOF
+	}
+	var eof bool
+	if off+int64(len(p)) > size {
+		p = p[:size-off]
+		eof = true
+	}
+	var n int
+	for n < len(p) {
+		currentOff := off + int64(n)
+		dataOffset, err := img.chunkOffset(currentOff)
+		if err != nil {
+			return n, err
+		}
+		end := n + int(min(int64(len(p)-n), img.layout.chunkSize-currentOff%img.layout.chunkSize))
+		if dataOffset == 0 {
+			clear(p[n:end])
+		} else if _, err := img.ra.ReadAt(p[n:end], dataOffset); err != nil {
+			return n, fmt.Errorf("failed to read data at offset %d: %w", dataOffset, err)
+		}
+		n = end
+	}
+	if eof {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Extent returns the next extent starting at start, with the same allocation
+// and zero status, limited to length.
+func (img *Asif) Extent(start, length int64) (image.Extent, error) {
+	var current image.Extent
+	if img.errUnreadable != nil {
+		return current, img.errUnreadable
+	}
+	if start < 0 || start+length > img.Size() {
+		return current, errors.New("length out of bounds")
+	}
+	for length > 0 {
+		dataOffset, err := img.chunkOffset(start)
+		if err != nil {
+			return current, err
+		}
+		n := min(length, img.layout.chunkSize-start%img.layout.chunkSize)
+		status := image.Extent{Start: start, Length: n, Allocated: dataOffset != 0, Zero: dataOffset == 0}
+		if current.Length == 0 {
+			current = status
+		} else if sameStatus(current, status) {
+			current.Length += n
+		} else {
+			break
+		}
+		start += n
+		length -= n
+	}
+	return current, nil
+}
 
-func (a *Asif) Size() int64 {
-	return int64(a.sectorCount) * int64(a.blockSize)
+// Return true if extents have the same status.
+func sameStatus(a, b image.Extent) bool {
+	return a.Allocated == b.Allocated && a.Zero == b.Zero && a.Compressed == b.Compressed
 }
@@ -1,6 +1,7 @@
 package asif
 
 import (
+	"bytes"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -68,9 +69,22 @@ func TestOpenASIF(t *testing.T) {
 	// Open ASIF image and verify properties
 	if img, err := Open(f); err != nil {
 		t.Fatalf("failed to open ASIF image: %v", err)
-	} else if img.sectorCount != sectorCount {
-		t.Fatalf("unexpected sector count: got %d, want %d", img.sectorCount, sectorCount)
+	} else if img.Header.SectorCount != sectorCount {
+		t.Fatalf("unexpected sector count: got %d, want %d", img.Header.SectorCount, sectorCount)
 	} else if img.Size() != totalBytes {
 		t.Fatalf("unexpected size: got %d, want %d", img.Size(), totalBytes)
+	} else if err := img.Readable(); err != nil {
+		t.Fatalf("ASIF image is not readable: %v", err)
+	} else {
+		// A blank image reads as zeros.
+		buf := make([]byte, 1<<20)
+		for _, off := range []int64{0, img.Size() / 2, img.Size() - int64(len(buf))} {
+			if _, err := img.ReadAt(buf, off); err != nil {
+				t.Fatalf("failed to read at offset %d: %v", off, err)
+			}
+			if !bytes.Equal(buf, make([]byte, len(buf))) {
+				t.Fatalf("unexpected data at offset %d", off)
+			}
+		}
 	}
 }
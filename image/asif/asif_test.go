@@ -0,0 +1,137 @@
+package asif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/lima-vm/go-qcow2reader/image"
+	"github.com/lima-vm/go-qcow2reader/test/imagetest"
+)
+
+const (
+	testChunkSize = 64 << 10
+	// With 64 KiB chunks and 512 bytes blocks, a table has 3 groups of 2048
+	// data entries and a bitmap entry.
+	testTableSize = 3 * 2048 * testChunkSize
+)
+
+// createTestImage creates an image of 3 tables, with chunks allocated at the
+// specified indexes of tables 0 and 2, and an older directory copy without
+// tables. The file is laid out in chunks: header, directories, tables, data.
+// Returns the image and the data of the allocated chunks.
+func createTestImage(t *testing.T, size int64, chunks []int64) ([]byte, map[int64][]byte) {
+	r := rand.New(rand.NewSource(1))
+	h := Header{
+		Version:          1,
+		HeaderSize:       headerSize,
+		DirectoryOffsets: [2]uint64{1 * testChunkSize, 2 * testChunkSize},
+		SectorCount:      uint64(size / 512),
+		MaxSectorCount:   3 * testTableSize / 512,
+		ChunkSize:        testChunkSize,
+		BlockSize:        512,
+	}
+	copy(h.Signature[:], Magic)
+	img := make([]byte, 5*testChunkSize)
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, h); err != nil {
+		t.Fatal(err)
+	}
+	copy(img, buf.Bytes())
+	// The old directory has version 1, the current directory version 2. The
+	// flag in the upper bits of entries is ignored.
+	binary.BigEndian.PutUint64(img[1*testChunkSize:], 1)
+	binary.BigEndian.PutUint64(img[2*testChunkSize:], 2)
+	binary.BigEndian.PutUint64(img[2*testChunkSize+8:], 3|1<<63)
+	binary.BigEndian.PutUint64(img[2*testChunkSize+8+2*8:], 4)
+
+	want := make(map[int64][]byte)
+	for _, c := range chunks {
+		table := c * testChunkSize / testTableSize
+		if table != 0 && table != 2 {
+			t.Fatalf("chunk %d is not in table 0 or 2", c)
+		}
+		i := c % (testTableSize / testChunkSize)
+		entry := i + i/2048
+		chunk := uint64(len(img) / testChunkSize)
+		binary.BigEndian.PutUint64(img[(3+table/2)*testChunkSize+entry*8:], chunk)
+		data := make([]byte, testChunkSize)
+		want[c] = data
+		if _, err := r.Read(data); err != nil {
+			t.Fatal(err)
+		}
+		img = append(img, data...)
+	}
+	return img, want
+}
+
+func TestAsif(t *testing.T) {
+	const size = 3*testTableSize - 4096
+	chunks := []int64{0, 1, 2047, 2048, 3*2048 - 1, 2*3*2048 + 5, 3*3*2048 - 1}
+	data, want := createTestImage(t, size, chunks)
+	img, err := Open(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Readable(); err != nil {
+		t.Fatal(err)
+	}
+	if img.Size() != size {
+		t.Fatalf("expected size %d, got %d", size, img.Size())
+	}
+	// Read the allocated chunks and their neighbors; the image is 1 GiB.
+	buf := make([]byte, testChunkSize)
+	for _, c := range chunks {
+		for _, i := range []int64{c - 1, c, c + 1} {
+			if i < 0 || i*testChunkSize >= size {
+				continue
+			}
+			n, err := img.ReadAt(buf, i*testChunkSize)
+			if err != nil && !(errors.Is(err, io.EOF) && i*testChunkSize+int64(n) == size) {
+				t.Fatal(err)
+			}
+			expected := want[i]
+			if expected == nil {
+				expected = make([]byte, testChunkSize)
+			}
+			if !bytes.Equal(buf[:n], expected[:n]) {
+				t.Fatalf("unexpected data in chunk %d", i)
+			}
+		}
+	}
+
+	wantExtents := []image.Extent{
+		{Start: 0, Length: 2 * testChunkSize, Allocated: true},
+		{Start: 2 * testChunkSize, Length: 2045 * testChunkSize, Zero: true},
+		{Start: 2047 * testChunkSize, Length: 2 * testChunkSize, Allocated: true},
+		{Start: 2049 * testChunkSize, Length: (3*2048 - 1 - 2049) * testChunkSize, Zero: true},
+		{Start: (3*2048 - 1) * testChunkSize, Length: testChunkSize, Allocated: true},
+		{Start: 3 * 2048 * testChunkSize, Length: (3*2048 + 5) * testChunkSize, Zero: true},
+		{Start: (2*3*2048 + 5) * testChunkSize, Length: testChunkSize, Allocated: true},
+		{Start: (2*3*2048 + 6) * testChunkSize, Length: (3*2048 - 7) * testChunkSize, Zero: true},
+		{Start: (3*3*2048 - 1) * testChunkSize, Length: testChunkSize - 4096, Allocated: true},
+	}
+	if extents := imagetest.ReadExtents(t, img); !reflect.DeepEqual(extents, wantExtents) {
+		t.Fatalf("expected extents\n%+v\ngot\n%+v", wantExtents, extents)
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	data, _ := createTestImage(t, testChunkSize, nil)
+	data[68], data[69] = 0, 100 // block size
+	img, err := Open(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Readable(); err == nil {
+		t.Fatal("expected an error for an invalid block size")
+	}
+
+	if _, err := Open(bytes.NewReader(make([]byte, 512))); !errors.Is(err, image.ErrWrongType) {
+		t.Fatalf("expected ErrWrongType, got %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package asif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+)
+
+// Magic is the signature of the header.
+const Magic = "shdw"
+
+const headerSize = 80
+
+// entryMask is the mask of the chunk number in directory and table entries.
+// The upper bits are flags.
+const entryMask = 0x007fffffffffffff
+
+// Header is the header of an ASIF image. The layout is not documented by
+// Apple; it follows dissect.hypervisor.
+//
+// ref: https://github.com/fox-it/dissect.hypervisor/blob/0c8976613a369923e69022304b2f0ed587e997e2/dissect/hypervisor/disk/c_asif.py
+type Header struct {
+	Signature  [4]byte `json:"-"`
+	Version    uint32  `json:"version"`
+	HeaderSize uint32  `json:"header_size"`
+	Flags      uint32  `json:"flags"`
+	// DirectoryOffsets are the offsets of the two copies of the directory in
+	// bytes. The copy with the highest version is used.
+	DirectoryOffsets [2]uint64 `json:"directory_offsets"`
+	GUID             [16]byte  `json:"guid"`
+	SectorCount      uint64    `json:"sector_count"`
+	MaxSectorCount   uint64    `json:"max_sector_count"`
+	ChunkSize        uint32    `json:"chunk_size"`
+	BlockSize        uint16    `json:"block_size"`
+	TotalSegments    uint16    `json:"total_segments"`
+	MetadataChunk    uint64    `json:"metadata_chunk"`
+}
+
+// readHeader reads the header. Returns [ErrNotAsif] if the magic does not
+// match.
+func readHeader(ra io.ReaderAt) (*Header, error) {
+	b := make([]byte, headerSize)
+	if _, err := ra.ReadAt(b, 0); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read the header: %w", err)
+	}
+	if !bytes.HasPrefix(b, []byte(Magic)) {
+		return nil, ErrNotAsif
+	}
+	var h Header
+	if err := binary.Read(bytes.NewReader(b), binary.BigEndian, &h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// layout is the geometry of the tables, derived from the header.
+type layout struct {
+	chunkSize int64
+	// dataEntriesPerBitmap is the number of data entries in a table followed
+	// by a bitmap entry.
+	dataEntriesPerBitmap int64
+	// tableEntries is the number of entries of a table, including bitmap
+	// entries.
+	tableEntries int64
+	// tableSize is the size of the guest data mapped by a table.
+	tableSize int64
+	tables    int64
+}
+
+func newLayout(h *Header) (*layout, error) {
+	if h.BlockSize < 512 || bits.OnesCount16(h.BlockSize) != 1 {
+		return nil, fmt.Errorf("invalid block size %d", h.BlockSize)
+	}
+	if h.ChunkSize == 0 || h.ChunkSize%uint32(h.BlockSize) != 0 {
+		return nil, fmt.Errorf("invalid chunk size %d (block size %d)", h.ChunkSize, h.BlockSize)
+	}
+	if h.SectorCount > h.MaxSectorCount {
+		return nil, fmt.Errorf("the sector count %d is larger than the maximum sector count %d", h.SectorCount, h.MaxSectorCount)
+	}
+	l := &layout{chunkSize: int64(h.ChunkSize)}
+	blocksPerChunk := l.chunkSize / int64(h.BlockSize)
+	// A bitmap chunk has 2 bits per block.
+	l.dataEntriesPerBitmap = max(1, 4*l.chunkSize/blocksPerChunk)
+	groupEntries := l.dataEntriesPerBitmap + 1
+	maxEntries := l.chunkSize / 8
+	l.tableEntries = maxEntries - maxEntries%groupEntries
+	if l.tableEntries == 0 {
+		return nil, fmt.Errorf("invalid chunk size %d (block size %d)", h.ChunkSize, h.BlockSize)
+	}
+	l.tableSize = l.tableEntries / groupEntries * l.dataEntriesPerBitmap * l.chunkSize
+	if h.MaxSectorCount > math.MaxInt64/uint64(h.BlockSize) {
+		return nil, fmt.Errorf("invalid maximum sector count %d", h.MaxSectorCount)
+	}
+	maxSize := int64(h.MaxSectorCount) * int64(h.BlockSize)
+	l.tables = (maxSize + l.tableSize - 1) / l.tableSize
+	return l, nil
+}
+
+// tableEntry returns the index of the table entry of the data chunk at index i
+// of a table, skipping bitmap entries.
+func (l *layout) tableEntry(i int64) int64 {
+	return i + i/l.dataEntriesPerBitmap
+}
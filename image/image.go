@@ -38,11 +38,31 @@ type Image interface {
 // ErrWrongType is returned from [Opener].
 var ErrWrongType = errors.New("wrong image type")
 
+// ErrBackingFileFormatRequired is returned for backing files without an
+// explicit format, when probing the format of backing files is refused.
+var ErrBackingFileFormatRequired = errors.New("backing file format required")
+
 // OpenWithType opens [Image] with the specified [Type].
 // Opener must return [ErrWrongType] when the image is not parsable with
 // the specified [Type].
 type OpenWithType func(io.ReaderAt, Type) (Image, error)
 
+// DefaultMaxBackingChainDepth is the default maximum number of backing images
+// below an image.
+const DefaultMaxBackingChainDepth = 64
+
+var (
+	ErrUnsupportedBackingFile = errors.New("unsupported backing file")
+	ErrBackingChainTooDeep    = errors.New("backing chain too deep")
+	ErrBackingChainLoop       = errors.New("backing chain loop")
+)
+
+// OpenBackingFile opens a backing file with the specified [Type], like
+// [OpenWithType]. chain is the resolved names of the images above the backing
+// file, from the top image, used to limit the depth of backing chains and to
+// detect loops across image formats. Names are empty if unknown.
+type OpenBackingFile func(ra io.ReaderAt, t Type, chain []string) (Image, error)
+
 // ImageInfo wraps [Image] for [json.Marshal].
 type ImageInfo struct {
 	Type  Type  `json:"type"`
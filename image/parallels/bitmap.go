@@ -0,0 +1,265 @@
+package parallels
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+
+	"github.com/lima-vm/go-qcow2reader/align"
+	"github.com/lima-vm/go-qcow2reader/log"
+)
+
+const (
+	FormatExtensionMagic = 0xab234cef23dcea87
+
+	// FeatureEnd is the magic of the last feature of the format extension.
+	FeatureEnd = 0
+	// FeatureDirtyBitmap is the magic of a dirty bitmap.
+	FeatureDirtyBitmap = 0x20385fae252cb34a
+
+	// FeatureFlagsNecessaryBit is set if the image cannot be used without
+	// the feature.
+	FeatureFlagsNecessaryBit = 0
+	// FeatureFlagsTransitBit is set if the feature may be kept when the
+	// image is modified by a program that does not know it.
+	FeatureFlagsTransitBit = 1
+
+	formatExtensionHeaderSize = 24
+	featureHeaderSize         = 24
+	dirtyBitmapHeaderSize     = 32
+
+	bitmapTableAllOnes = 1
+)
+
+var (
+	ErrBitmapNotFound     = errors.New("bitmap not found")
+	ErrInconsistentBitmap = errors.New("inconsistent bitmap")
+)
+
+// FeatureHeader is the header of a feature of the format extension.
+type FeatureHeader struct {
+	Magic    uint64 `json:"magic"`
+	Flags    uint64 `json:"flags"`
+	DataSize uint32 `json:"data_size"`
+	Unused   uint32 `json:"-"`
+}
+
+// FormatExtension is the format extension cluster.
+type FormatExtension struct {
+	Features []FeatureHeader `json:"features"`
+	bitmaps  []Bitmap
+}
+
+type dirtyBitmapHeader struct {
+	Size        uint64
+	ID          [16]byte
+	Granularity uint32
+	L1Size      uint32
+}
+
+// Bitmap is a dirty bitmap.
+type Bitmap struct {
+	// Name is the UUID of the bitmap, like qemu.
+	Name        string `json:"name"`
+	Granularity uint64 `json:"granularity"` // Bytes covered by each bit
+	// Size is the size of the disk covered by the bitmap in bytes.
+	Size int64 `json:"size"`
+	// table has an offset in sectors for each cluster of the bitmap, or 0
+	// (all zeros) or 1 (all ones).
+	table []uint64
+}
+
+// DirtyRange is a range of the guest disk marked dirty in a bitmap.
+type DirtyRange struct {
+	// Offset from start of the image in bytes.
+	Start int64 `json:"start"`
+	// Length of this range in bytes.
+	Length int64 `json:"length"`
+}
+
+// readFormatExtension reads the format extension cluster. Returns nil if the
+// checksum does not match; like qemu, the format extension is ignored.
+func readFormatExtension(ra io.ReaderAt, off, clusterSize int64) (*FormatExtension, error) {
+	b := make([]byte, clusterSize)
+	if _, err := ra.ReadAt(b, off); err != nil {
+		return nil, fmt.Errorf("failed to read the format extension: %w", err)
+	}
+	if binary.LittleEndian.Uint64(b) != FormatExtensionMagic {
+		return nil, errors.New("invalid format extension magic")
+	}
+	if sum := md5.Sum(b[formatExtensionHeaderSize:]); !bytes.Equal(sum[:], b[8:formatExtensionHeaderSize]) {
+		log.Warnf("parallels: invalid format extension checksum, ignoring the format extension")
+		return nil, nil
+	}
+	var ext FormatExtension
+	for pos := formatExtensionHeaderSize; ; {
+		if pos+featureHeaderSize > len(b) {
+			return nil, errors.New("the format extension has no end of features")
+		}
+		var fh FeatureHeader
+		if _, err := binary.Decode(b[pos:], binary.LittleEndian, &fh); err != nil {
+			return nil, err
+		}
+		if fh.Magic == FeatureEnd {
+			return &ext, nil
+		}
+		pos += featureHeaderSize
+		if int64(fh.DataSize) > int64(len(b)-pos) {
+			return nil, fmt.Errorf("feature %#x: data out of the cluster", fh.Magic)
+		}
+		data := b[pos : pos+int(fh.DataSize)]
+		pos = min(pos+align.Up(int(fh.DataSize), 8), len(b))
+		ext.Features = append(ext.Features, fh)
+		switch fh.Magic {
+		case FeatureDirtyBitmap:
+			bitmap, err := parseDirtyBitmap(data)
+			if err != nil {
+				return nil, err
+			}
+			ext.bitmaps = append(ext.bitmaps, *bitmap)
+		default:
+			if fh.Flags&(1<<FeatureFlagsNecessaryBit) != 0 {
+				return nil, fmt.Errorf("%w: feature %#x", ErrUnsupportedFeature, fh.Magic)
+			}
+			log.Warnf("parallels: ignoring unknown feature %#x", fh.Magic)
+		}
+	}
+}
+
+func parseDirtyBitmap(data []byte) (*Bitmap, error) {
+	var h dirtyBitmapHeader
+	if _, err := binary.Decode(data, binary.LittleEndian, &h); err != nil {
+		return nil, fmt.Errorf("failed to parse a dirty bitmap: %w", err)
+	}
+	if h.Granularity == 0 {
+		return nil, fmt.Errorf("dirty bitmap %s: invalid granularity 0", formatUUID(h.ID))
+	}
+	if int64(h.L1Size)*8 > int64(len(data)-dirtyBitmapHeaderSize) {
+		return nil, fmt.Errorf("dirty bitmap %s: the table (%d entries) is out of the feature data", formatUUID(h.ID), h.L1Size)
+	}
+	b := &Bitmap{
+		Name:        formatUUID(h.ID),
+		Granularity: uint64(h.Granularity) * 512,
+		Size:        int64(h.Size) * 512,
+		table:       make([]uint64, h.L1Size),
+	}
+	if _, err := binary.Decode(data[dirtyBitmapHeaderSize:], binary.LittleEndian, b.table); err != nil {
+		return nil, fmt.Errorf("dirty bitmap %s: %w", formatUUID(h.ID), err)
+	}
+	return b, nil
+}
+
+// formatUUID formats a UUID stored in big-endian order.
+func formatUUID(b [16]byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// Bitmaps returns the dirty bitmaps of the format extension.
+func (img *Parallels) Bitmaps() ([]Bitmap, error) {
+	if img.errUnreadable != nil {
+		return nil, img.errUnreadable
+	}
+	if img.FormatExtension == nil {
+		return nil, nil
+	}
+	return img.FormatExtension.bitmaps, nil
+}
+
+func (img *Parallels) bitmap(name string) (*Bitmap, error) {
+	bitmaps, err := img.Bitmaps()
+	if err != nil {
+		return nil, err
+	}
+	for i := range bitmaps {
+		if bitmaps[i].Name == name {
+			return &bitmaps[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %q", ErrBitmapNotFound, name)
+}
+
+// DirtyRanges returns the ranges of the guest disk marked dirty in the named
+// bitmap, in ascending order. Adjacent dirty ranges are merged.
+//
+// Iteration stops after yielding the first error.
+func (img *Parallels) DirtyRanges(name string) iter.Seq2[DirtyRange, error] {
+	return func(yield func(DirtyRange, error) bool) {
+		b, err := img.bitmap(name)
+		if err != nil {
+			yield(DirtyRange{}, err)
+			return
+		}
+		if img.Header.Dirty() {
+			// Bitmaps are not updated while the image is in use.
+			yield(DirtyRange{}, fmt.Errorf("%w: the image was not closed properly", ErrInconsistentBitmap))
+			return
+		}
+
+		e := img.expanding
+		size := min(img.Size(), b.Size)
+		granularity := int64(b.Granularity)
+		bytesPerCluster := e.clusterSize * 8 * granularity
+		need := (size + bytesPerCluster - 1) / bytesPerCluster
+		if int64(len(b.table)) < need {
+			yield(DirtyRange{}, fmt.Errorf("bitmap %q: table too small (%d entries < %d entries)", name, len(b.table), need))
+			return
+		}
+
+		var cur DirtyRange
+		// add merges [start, end) into cur, yielding cur when not adjacent.
+		add := func(start, end int64) bool {
+			end = min(end, size)
+			if cur.Length > 0 && cur.Start+cur.Length == start {
+				cur.Length += end - start
+				return true
+			}
+			if cur.Length > 0 && !yield(cur, nil) {
+				return false
+			}
+			cur = DirtyRange{Start: start, Length: end - start}
+			return true
+		}
+
+		buf := make([]byte, e.clusterSize)
+		for i, entry := range b.table[:need] {
+			clusterStart := int64(i) * bytesPerCluster
+			switch entry {
+			case 0:
+				continue
+			case bitmapTableAllOnes:
+				if !add(clusterStart, clusterStart+bytesPerCluster) {
+					return
+				}
+				continue
+			}
+			if _, err := e.ra.ReadAt(buf, int64(entry)*512); err != nil {
+				yield(DirtyRange{}, fmt.Errorf("failed to read data of bitmap %q: %w", name, err))
+				return
+			}
+			for j, x := range buf {
+				if x == 0 {
+					continue
+				}
+				for k := 0; k < 8; k++ {
+					if x&(1<<k) == 0 {
+						continue
+					}
+					start := clusterStart + (int64(j)*8+int64(k))*granularity
+					if start >= size {
+						break
+					}
+					if !add(start, start+granularity) {
+						return
+					}
+				}
+			}
+		}
+		if cur.Length > 0 {
+			yield(cur, nil)
+		}
+	}
+}
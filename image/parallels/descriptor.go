@@ -0,0 +1,126 @@
+package parallels
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+)
+
+// DescriptorFileName is the name of the descriptor file in a bundle directory
+// (e.g. "disk.hdd/DiskDescriptor.xml").
+const DescriptorFileName = "DiskDescriptor.xml"
+
+// maxDescriptorSize is the maximum size of a descriptor file.
+const maxDescriptorSize = 1 << 20
+
+// Image types in the descriptor.
+const (
+	// ImageTypeCompressed is an expanding image.
+	ImageTypeCompressed = "Compressed"
+	// ImageTypePlain is a raw image.
+	ImageTypePlain = "Plain"
+)
+
+// nullGUID is the parent GUID of the base snapshot.
+const nullGUID = "{00000000-0000-0000-0000-000000000000}"
+
+// DiskDescriptor is the DiskDescriptor.xml file of a bundle. Sizes and offsets
+// are in sectors.
+type DiskDescriptor struct {
+	XMLName        xml.Name       `xml:"Parallels_disk_image" json:"-"`
+	Version        string         `xml:"Version,attr" json:"version"`
+	DiskParameters DiskParameters `xml:"Disk_Parameters" json:"disk_parameters"`
+	Storages       []Storage      `xml:"StorageData>Storage" json:"storages"`
+	Snapshots      Snapshots      `xml:"Snapshots" json:"snapshots"`
+}
+
+type DiskParameters struct {
+	DiskSize  uint64 `xml:"Disk_size" json:"disk_size"`
+	Cylinders uint32 `xml:"Cylinders" json:"cylinders"`
+	Heads     uint32 `xml:"Heads" json:"heads"`
+	Sectors   uint32 `xml:"Sectors" json:"sectors"`
+}
+
+// Storage is a range of the disk, with an image file for each snapshot.
+type Storage struct {
+	Start     uint64         `xml:"Start" json:"start"`
+	End       uint64         `xml:"End" json:"end"`
+	Blocksize uint32         `xml:"Blocksize" json:"blocksize"`
+	Images    []StorageImage `xml:"Image" json:"images"`
+}
+
+type StorageImage struct {
+	GUID string `xml:"GUID" json:"guid"`
+	Type string `xml:"Type" json:"type"`
+	File string `xml:"File" json:"file"`
+}
+
+type Snapshots struct {
+	// TopGUID is the GUID of the current snapshot. Optional if there is a
+	// single snapshot without children.
+	TopGUID string `xml:"TopGUID" json:"top_guid,omitempty"`
+	Shots   []Shot `xml:"Shot" json:"shots"`
+}
+
+type Shot struct {
+	GUID       string `xml:"GUID" json:"guid"`
+	ParentGUID string `xml:"ParentGUID" json:"parent_guid"`
+}
+
+// ParseDiskDescriptor parses a DiskDescriptor.xml file.
+func ParseDiskDescriptor(b []byte) (*DiskDescriptor, error) {
+	var d DiskDescriptor
+	if err := xml.Unmarshal(b, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// SnapshotChain returns the GUIDs of the current snapshot and its parents, from
+// the current snapshot to the base snapshot.
+func (d *DiskDescriptor) SnapshotChain() ([]string, error) {
+	parents := make(map[string]string, len(d.Snapshots.Shots))
+	hasChildren := make(map[string]bool)
+	for _, shot := range d.Snapshots.Shots {
+		parents[shot.GUID] = shot.ParentGUID
+		hasChildren[shot.ParentGUID] = true
+	}
+	top := d.Snapshots.TopGUID
+	if top == "" {
+		for _, shot := range d.Snapshots.Shots {
+			if hasChildren[shot.GUID] {
+				continue
+			}
+			if top != "" {
+				return nil, errors.New("the descriptor has several snapshots without children, and no TopGUID")
+			}
+			top = shot.GUID
+		}
+		if top == "" {
+			return nil, errors.New("the descriptor has no snapshots")
+		}
+	}
+	var chain []string
+	for guid := top; guid != nullGUID; {
+		if len(chain) > len(d.Snapshots.Shots) {
+			return nil, errors.New("snapshot loop")
+		}
+		parent, ok := parents[guid]
+		if !ok {
+			return nil, fmt.Errorf("unknown snapshot %s", guid)
+		}
+		chain = append(chain, guid)
+		guid = parent
+	}
+	return chain, nil
+}
+
+// image returns the image of the snapshot guid.
+func (s *Storage) image(guid string) (*StorageImage, error) {
+	for i := range s.Images {
+		if s.Images[i].GUID == guid {
+			return &s.Images[i], nil
+		}
+	}
+	return nil, fmt.Errorf("the storage at sector %d has no image for snapshot %s", s.Start, guid)
+}
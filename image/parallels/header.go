@@ -0,0 +1,103 @@
+package parallels
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// Magic is the magic of images with BAT entries in sectors, and a 32-bit
+	// number of sectors.
+	Magic = "WithoutFreeSpace"
+	// MagicExt is the magic of images with BAT entries in clusters.
+	MagicExt = "WithouFreSpacExt"
+
+	Version = 2
+
+	headerSize = 64
+
+	// InUseDirty is the value of the InUse field of images not closed
+	// properly.
+	InUseDirty = 0x746f6e59
+)
+
+// Header is the header of an expanding Parallels image, followed by the BAT.
+type Header struct {
+	Magic     [16]byte `json:"-"`
+	Version   uint32   `json:"version"`
+	Heads     uint32   `json:"heads"`
+	Cylinders uint32   `json:"cylinders"`
+	// Tracks is the size of a cluster in sectors.
+	Tracks     uint32 `json:"tracks"`
+	BATEntries uint32 `json:"bat_entries"`
+	NbSectors  uint64 `json:"nb_sectors"`
+	InUse      uint32 `json:"inuse"`
+	// DataOff is the offset of the data in sectors. Zero if the data starts
+	// after the BAT.
+	DataOff uint32 `json:"data_off"`
+	Flags   uint32 `json:"flags"`
+	// ExtOff is the offset of the format extension cluster in sectors, or zero.
+	ExtOff uint64 `json:"ext_off"`
+}
+
+// HasExtMagic returns true if BAT entries are in clusters rather than sectors.
+func (h *Header) HasExtMagic() bool {
+	return string(h.Magic[:]) == MagicExt
+}
+
+// Dirty returns true if the image was not closed properly.
+func (h *Header) Dirty() bool {
+	return h.InUse == InUseDirty
+}
+
+// readHeader reads the header. Returns [ErrNotParallels] if the magic does not
+// match.
+func readHeader(ra io.ReaderAt) (*Header, error) {
+	b := make([]byte, headerSize)
+	if _, err := ra.ReadAt(b, 0); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read the header: %w", err)
+	}
+	if !bytes.HasPrefix(b, []byte(Magic)) && !bytes.HasPrefix(b, []byte(MagicExt)) {
+		return nil, ErrNotParallels
+	}
+	var h Header
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// validate returns an error if the image cannot be read.
+func (h *Header) validate() error {
+	if h.Version != Version {
+		return fmt.Errorf("%w: version %d", ErrUnsupportedFeature, h.Version)
+	}
+	if h.Tracks == 0 {
+		return errors.New("invalid cluster size 0")
+	}
+	clusterSectors := uint64(h.Tracks)
+	if (h.sectors()+clusterSectors-1)/clusterSectors > uint64(h.BATEntries) {
+		return fmt.Errorf("the BAT has %d entries of %d sectors, but the disk has %d sectors", h.BATEntries, h.Tracks, h.sectors())
+	}
+	return nil
+}
+
+// sectors returns the size of the disk in sectors.
+func (h *Header) sectors() uint64 {
+	if !h.HasExtMagic() {
+		// Only the low 32 bits are used in old images.
+		return h.NbSectors & 0xffffffff
+	}
+	return h.NbSectors
+}
+
+// batUnit returns the size of the unit of BAT entries in bytes.
+func (h *Header) batUnit() int64 {
+	if h.HasExtMagic() {
+		return int64(h.Tracks) * 512
+	}
+	return 512
+}
@@ -1,18 +1,444 @@
 package parallels
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
+	"path"
 
 	"github.com/lima-vm/go-qcow2reader/image"
-	"github.com/lima-vm/go-qcow2reader/image/stub"
+	"github.com/lima-vm/go-qcow2reader/log"
 )
 
 const Type = image.Type("parallels")
 
-// Open returns a stub.
-func Open(ra io.ReaderAt) (*stub.Stub, error) {
-	return stub.New(ra, Type,
-		stub.SimpleProber([]byte("WithoutFreeSpace")),
-		stub.SimpleProber([]byte("WithouFreSpacExt")),
-	)
+var (
+	ErrNotParallels       = fmt.Errorf("%w: image is not %s", image.ErrWrongType, Type)
+	ErrUnsupportedFeature = errors.New("unsupported feature")
+)
+
+// Parallels implements [image.Image] for expanding Parallels images and
+// Parallels Desktop bundles.
+type Parallels struct {
+	ra io.ReaderAt
+	// Header is the header of an expanding image. Nil for bundles.
+	Header          *Header          `json:"header,omitempty"`
+	FormatExtension *FormatExtension `json:"format_extension,omitempty"`
+	// Descriptor is the descriptor of a bundle.
+	Descriptor    *DiskDescriptor `json:"descriptor,omitempty"`
+	errUnreadable error
+	size          int64
+	// expanding is the expanding image. Nil for bundles.
+	expanding *expanding
+	storages  []*storage
+}
+
+// expanding is an expanding image.
+type expanding struct {
+	ra          io.ReaderAt
+	bat         []uint32
+	clusterSize int64
+	// batUnit is the size of the unit of BAT entries in bytes.
+	batUnit int64
+	size    int64
+}
+
+// storage is a range of the image.
+type storage struct {
+	// start and size in the image in bytes.
+	start, size int64
+	// layers are the image files of the snapshots, from the current snapshot
+	// to the base snapshot.
+	layers []*layer
+}
+
+type layer struct {
+	ra io.ReaderAt
+	// expanding is nil for plain images.
+	expanding *expanding
+}
+
+type Option func(*options)
+
+type options struct {
+	fileResolver image.FileResolver
+	name         string
+}
+
+// WithFileResolver sets the [image.FileResolver] used to open the files of a
+// bundle. The default is [image.OSFileResolver].
+func WithFileResolver(r image.FileResolver) Option {
+	return func(o *options) {
+		o.fileResolver = r
+	}
+}
+
+// WithName sets the name of the image, used as base to resolve the files of a
+// bundle. By default, the name of the file is used if ra implements Name() and
+// no [image.FileResolver] is set.
+func WithName(name string) Option {
+	return func(o *options) {
+		o.name = name
+	}
+}
+
+// Open opens an expanding Parallels image, or a Parallels Desktop bundle.
+//
+// A bundle is a ".hdd" directory with a DiskDescriptor.xml file, listing the
+// image files of each snapshot. ra is either the descriptor file, or the
+// bundle directory opened with [os.Open]. The image files are resolved
+// relative to the descriptor (see [WithFileResolver]), and closed with the
+// image. The current snapshot is read.
+func Open(ra io.ReaderAt, opts ...Option) (*Parallels, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.name == "" && o.fileResolver == nil {
+		if namer, ok := ra.(interface{ Name() string }); ok {
+			o.name = namer.Name()
+		}
+	}
+	if o.fileResolver == nil {
+		o.fileResolver = image.OSFileResolver
+	}
+	return open(ra, &o)
+}
+
+func open(ra io.ReaderAt, o *options) (*Parallels, error) {
+	img := &Parallels{ra: ra, size: -1}
+	if isDir(ra) {
+		img.errUnreadable = img.openBundleDir(o)
+		return img, nil
+	}
+	b := make([]byte, 512)
+	if _, err := ra.ReadAt(b, 0); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read the first %d bytes: %w", len(b), err)
+	}
+	switch {
+	case bytes.HasPrefix(b, []byte(Magic)), bytes.HasPrefix(b, []byte(MagicExt)):
+		img.errUnreadable = img.openExpanding()
+	case isDescriptor(b):
+		img.errUnreadable = img.openDescriptorFile(ra, o)
+	default:
+		return nil, ErrNotParallels
+	}
+	return img, nil
+}
+
+// isDescriptor returns true if b is the start of a descriptor file.
+func isDescriptor(b []byte) bool {
+	b = bytes.TrimLeft(b, "\ufeff \t\r\n")
+	return bytes.HasPrefix(b, []byte("<")) && bytes.Contains(b, []byte("<Parallels_disk_image"))
+}
+
+func isDir(ra io.ReaderAt) bool {
+	if f, ok := ra.(interface{ Stat() (fs.FileInfo, error) }); ok {
+		if st, err := f.Stat(); err == nil {
+			return st.IsDir()
+		}
+	}
+	return false
+}
+
+func (img *Parallels) openExpanding() error {
+	h, err := readHeader(img.ra)
+	if err != nil {
+		return err
+	}
+	img.Header = h
+	if img.expanding, err = openExpanding(img.ra, h); err != nil {
+		return err
+	}
+	img.size = img.expanding.size
+	img.storages = []*storage{{size: img.size, layers: []*layer{{ra: img.ra, expanding: img.expanding}}}}
+	if h.ExtOff != 0 {
+		if img.FormatExtension, err = readFormatExtension(img.ra, int64(h.ExtOff)*512, img.expanding.clusterSize); err != nil {
+			return fmt.Errorf("format extension: %w", err)
+		}
+	}
+	return nil
+}
+
+func openExpanding(ra io.ReaderAt, h *Header) (*expanding, error) {
+	if err := h.validate(); err != nil {
+		return nil, err
+	}
+	e := &expanding{
+		ra:          ra,
+		clusterSize: int64(h.Tracks) * 512,
+		batUnit:     h.batUnit(),
+		size:        int64(h.sectors()) * 512,
+	}
+	batSize := int64(h.BATEntries) * 4
+	if size := fileSize(ra); size >= 0 && headerSize+batSize > size {
+		return nil, fmt.Errorf("the BAT (%d entries) is beyond the end of the file", h.BATEntries)
+	}
+	e.bat = make([]uint32, h.BATEntries)
+	if err := binary.Read(io.NewSectionReader(ra, headerSize, batSize), binary.LittleEndian, e.bat); err != nil {
+		return nil, fmt.Errorf("failed to read the BAT: %w", err)
+	}
+	return e, nil
+}
+
+// openBundleDir opens the descriptor file of a bundle directory.
+func (img *Parallels) openBundleDir(o *options) error {
+	if o.name == "" {
+		return errors.New("the bundle directory name is unknown")
+	}
+	// The resolver resolves names relative to the directory of the base.
+	ra, resolved, err := o.fileResolver(path.Join(o.name, DescriptorFileName), DescriptorFileName)
+	if err != nil {
+		return fmt.Errorf("failed to open %q: %w", DescriptorFileName, err)
+	}
+	defer closeReaderAt(ra)
+	descriptorOptions := *o
+	descriptorOptions.name = resolved
+	return img.openDescriptorFile(ra, &descriptorOptions)
+}
+
+// openDescriptorFile opens the image files of the current snapshot.
+func (img *Parallels) openDescriptorFile(ra io.ReaderAt, o *options) error {
+	b, err := io.ReadAll(io.NewSectionReader(ra, 0, maxDescriptorSize+1))
+	if err != nil {
+		return fmt.Errorf("failed to read the descriptor: %w", err)
+	}
+	if len(b) > maxDescriptorSize {
+		return fmt.Errorf("descriptor too large (more than %d bytes)", maxDescriptorSize)
+	}
+	if img.Descriptor, err = ParseDiskDescriptor(b); err != nil {
+		return fmt.Errorf("failed to parse the descriptor: %w", err)
+	}
+	chain, err := img.Descriptor.SnapshotChain()
+	if err != nil {
+		return err
+	}
+	img.size = int64(img.Descriptor.DiskParameters.DiskSize) * 512
+	var start int64
+	for _, d := range img.Descriptor.Storages {
+		s := &storage{start: int64(d.Start) * 512, size: int64(d.End-d.Start) * 512}
+		if d.End < d.Start || s.start != start {
+			return fmt.Errorf("invalid storage (sectors %d-%d)", d.Start, d.End)
+		}
+		start += s.size
+		// Append first, to close the files on errors.
+		img.storages = append(img.storages, s)
+		for _, guid := range chain {
+			si, err := d.image(guid)
+			if err != nil {
+				return err
+			}
+			l, err := openLayer(si, o)
+			if err != nil {
+				return err
+			}
+			s.layers = append(s.layers, l)
+		}
+	}
+	if start < img.size {
+		return fmt.Errorf("the storages (%d bytes) are smaller than the disk (%d bytes)", start, img.size)
+	}
+	return nil
+}
+
+// openLayer opens the image file of a snapshot.
+func openLayer(si *StorageImage, o *options) (*layer, error) {
+	ra, _, err := o.fileResolver(o.name, si.File)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %q: %w", si.File, err)
+	}
+	l := &layer{ra: ra}
+	switch si.Type {
+	case ImageTypePlain:
+	case ImageTypeCompressed:
+		h, err := readHeader(ra)
+		if err == nil {
+			l.expanding, err = openExpanding(ra, h)
+		}
+		if err != nil {
+			closeReaderAt(ra)
+			return nil, fmt.Errorf("%q: %w", si.File, err)
+		}
+	default:
+		closeReaderAt(ra)
+		return nil, fmt.Errorf("%w: image type %q", ErrUnsupportedFeature, si.Type)
+	}
+	return l, nil
+}
+
+// fileSize returns the size of ra, or -1 if the size is unknown.
+func fileSize(ra io.ReaderAt) int64 {
+	// Implemented by [os.File] and files of most [fs.FS] implementations.
+	if f, ok := ra.(interface{ Stat() (fs.FileInfo, error) }); ok {
+		if st, err := f.Stat(); err == nil {
+			return st.Size()
+		}
+	}
+	if s, ok := ra.(interface{ Size() int64 }); ok {
+		return s.Size()
+	}
+	return -1
+}
+
+func closeReaderAt(ra io.ReaderAt) {
+	if closer, ok := ra.(io.Closer); ok {
+		_ = closer.Close()
+	}
+}
+
+func (img *Parallels) Close() error {
+	var err error
+	closeOne := func(ra io.ReaderAt) {
+		if closer, ok := ra.(io.Closer); ok {
+			if err2 := closer.Close(); err2 != nil {
+				if err != nil {
+					log.Warn(err)
+				}
+				err = err2
+			}
+		}
+	}
+	for _, s := range img.storages {
+		for _, l := range s.layers {
+			if l.ra != img.ra {
+				closeOne(l.ra)
+			}
+		}
+	}
+	closeOne(img.ra)
+	return err
+}
+
+func (img *Parallels) Type() image.Type {
+	return Type
+}
+
+func (img *Parallels) Size() int64 {
+	return img.size
+}
+
+// Readable returns nil if the image is readable, otherwise returns an error.
+func (img *Parallels) Readable() error {
+	return img.errUnreadable
+}
+
+// unit is a range of the image with the same status: a cluster of an expanding
+// image, or the rest of a storage with a plain base image.
+type unit struct {
+	allocated bool
+	ra        io.ReaderAt
+	// offset is the file offset of the data.
+	offset int64
+	// length of the unit from the requested offset.
+	length int64
+}
+
+// unitAt returns the unit containing off, from the first snapshot with data at
+// off.
+func (img *Parallels) unitAt(off int64) (unit, error) {
+	s, err := img.storageAt(off)
+	if err != nil {
+		return unit{}, err
+	}
+	rel := off - s.start
+	u := unit{length: min(s.size, img.size-s.start) - rel}
+	for _, l := range s.layers {
+		e := l.expanding
+		if e == nil {
+			u.allocated, u.ra, u.offset = true, l.ra, rel
+			return u, nil
+		}
+		if rel >= e.size {
+			continue
+		}
+		u.length = min(u.length, e.clusterSize-rel%e.clusterSize)
+		if entry := e.bat[rel/e.clusterSize]; entry != 0 {
+			u.allocated, u.ra, u.offset = true, l.ra, int64(entry)*e.batUnit+rel%e.clusterSize
+			return u, nil
+		}
+	}
+	return u, nil
+}
+
+func (img *Parallels) storageAt(off int64) (*storage, error) {
+	for _, s := range img.storages {
+		if off >= s.start && off < s.start+s.size {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("no storage at offset %d", off)
+}
+
+// ReadAt implements [io.ReaderAt].
+func (img *Parallels) ReadAt(p []byte, off int64) (int, error) {
+	if img.errUnreadable != nil {
+		return 0, img.errUnreadable
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= img.size {
+		return 0, io.EOF
+	}
+	var eof bool
+	if off+int64(len(p)) > img.size {
+		p = p[:img.size-off]
+		eof = true
+	}
+	var n int
+	for n < len(p) {
+		u, err := img.unitAt(off + int64(n))
+		if err != nil {
+			return n, err
+		}
+		end := n + int(min(int64(len(p)-n), u.length))
+		if !u.allocated {
+			clear(p[n:end])
+		} else if _, err := u.ra.ReadAt(p[n:end], u.offset); err != nil {
+			return n, fmt.Errorf("failed to read data at offset %d: %w", u.offset, err)
+		}
+		n = end
+	}
+	if eof {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Extent returns the next extent starting at start, with the same allocation
+// and zero status, limited to length.
+func (img *Parallels) Extent(start, length int64) (image.Extent, error) {
+	var current image.Extent
+	if img.errUnreadable != nil {
+		return current, img.errUnreadable
+	}
+	if start < 0 || start+length > img.size {
+		return current, errors.New("length out of bounds")
+	}
+	for length > 0 {
+		u, err := img.unitAt(start)
+		if err != nil {
+			return current, err
+		}
+		n := min(length, u.length)
+		status := image.Extent{Start: start, Length: n, Allocated: u.allocated, Zero: !u.allocated}
+		if current.Length == 0 {
+			current = status
+		} else if sameStatus(current, status) {
+			current.Length += n
+		} else {
+			break
+		}
+		start += n
+		length -= n
+	}
+	return current, nil
+}
+
+// Return true if extents have the same status.
+func sameStatus(a, b image.Extent) bool {
+	return a.Allocated == b.Allocated && a.Zero == b.Zero && a.Compressed == b.Compressed
 }
@@ -0,0 +1,429 @@
+package parallels
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"testing/fstest"
+
+	"github.com/lima-vm/go-qcow2reader/image"
+	"github.com/lima-vm/go-qcow2reader/test/imagetest"
+	"github.com/lima-vm/go-qcow2reader/test/qemuimg"
+)
+
+const (
+	testClusterSectors = 16
+	testClusterSize    = testClusterSectors * 512
+)
+
+type testImage struct {
+	// ext selects the MagicExt magic, with BAT entries in clusters.
+	ext bool
+	// layout has 'a' for allocated clusters and 'u' for unallocated clusters.
+	layout string
+	// size defaults to the size of the clusters in layout.
+	size  int64
+	dirty bool
+	// features are appended to the format extension, if not nil.
+	features []testFeature
+	seed     int64
+}
+
+type testFeature struct {
+	magic uint64
+	flags uint64
+	data  []byte
+}
+
+// createTestImage creates an expanding image, with the data clusters in
+// reverse order. Returns the image and the expected data of the image.
+func createTestImage(t *testing.T, ti testImage) ([]byte, []byte) {
+	r := rand.New(rand.NewSource(ti.seed))
+	size := ti.size
+	if size == 0 {
+		size = int64(len(ti.layout)) * testClusterSize
+	}
+	h := Header{
+		Version:    Version,
+		Tracks:     testClusterSectors,
+		BATEntries: uint32(len(ti.layout)),
+		NbSectors:  uint64(size / 512),
+	}
+	copy(h.Magic[:], Magic)
+	if ti.ext {
+		copy(h.Magic[:], MagicExt)
+	}
+	if ti.dirty {
+		h.InUse = InUseDirty
+	}
+	dataStart := (headerSize + int64(len(ti.layout))*4 + testClusterSize - 1) / testClusterSize * testClusterSize
+	h.DataOff = uint32(dataStart / 512)
+	bat := make([]uint32, len(ti.layout))
+	want := make([]byte, len(ti.layout)*testClusterSize)
+	var data []byte
+	for i := len(ti.layout) - 1; i >= 0; i-- {
+		if ti.layout[i] != 'a' {
+			continue
+		}
+		off := dataStart + int64(len(data))
+		bat[i] = uint32(off / 512)
+		if ti.ext {
+			bat[i] = uint32(off / testClusterSize)
+		}
+		cluster := want[i*testClusterSize:][:testClusterSize]
+		if _, err := r.Read(cluster); err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, cluster...)
+	}
+	if ti.features != nil {
+		h.ExtOff = uint64(dataStart+int64(len(data))) / 512
+		ext := make([]byte, formatExtensionHeaderSize, testClusterSize)
+		binary.LittleEndian.PutUint64(ext, FormatExtensionMagic)
+		for _, f := range ti.features {
+			ext = binary.LittleEndian.AppendUint64(ext, f.magic)
+			ext = binary.LittleEndian.AppendUint64(ext, f.flags)
+			ext = binary.LittleEndian.AppendUint32(ext, uint32(len(f.data)))
+			ext = binary.LittleEndian.AppendUint32(ext, 0)
+			ext = append(ext, f.data...)
+		}
+		ext = ext[:testClusterSize]
+		sum := md5.Sum(ext[formatExtensionHeaderSize:])
+		copy(ext[8:], sum[:])
+		data = append(data, ext...)
+	}
+	var buf bytes.Buffer
+	for _, v := range []any{h, bat} {
+		if err := binary.Write(&buf, binary.LittleEndian, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf.Write(make([]byte, dataStart-int64(buf.Len())))
+	buf.Write(data)
+	return buf.Bytes(), want[:size]
+}
+
+func TestExpanding(t *testing.T) {
+	const layout = "aauuaua"
+	wantExtents := []image.Extent{
+		{Start: 0, Length: 2 * testClusterSize, Allocated: true},
+		{Start: 2 * testClusterSize, Length: 2 * testClusterSize, Zero: true},
+		{Start: 4 * testClusterSize, Length: testClusterSize, Allocated: true},
+		{Start: 5 * testClusterSize, Length: testClusterSize, Zero: true},
+		{Start: 6 * testClusterSize, Length: testClusterSize, Allocated: true},
+	}
+	for _, ext := range []bool{false, true} {
+		t.Run(fmt.Sprintf("ext=%v", ext), func(t *testing.T) {
+			data, want := createTestImage(t, testImage{ext: ext, layout: layout})
+			img, err := Open(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := img.Readable(); err != nil {
+				t.Fatal(err)
+			}
+			if img.Header.HasExtMagic() != ext {
+				t.Fatalf("expected HasExtMagic %v", ext)
+			}
+			if img.Size() != int64(len(want)) {
+				t.Fatalf("expected size %d, got %d", len(want), img.Size())
+			}
+			if !bytes.Equal(imagetest.ReadAll(t, img), want) {
+				t.Fatal("unexpected data")
+			}
+			if extents := imagetest.ReadExtents(t, img); !reflect.DeepEqual(extents, wantExtents) {
+				t.Fatalf("expected extents\n%+v\ngot\n%+v", wantExtents, extents)
+			}
+		})
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	data, _ := createTestImage(t, testImage{layout: "a"})
+	data[16] = 3 // version
+	img, err := Open(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	imagetest.CheckUnreadable(t, img, ErrUnsupportedFeature)
+
+	data, _ = createTestImage(t, testImage{ext: true, layout: "a", features: []testFeature{{magic: 0x1234, flags: 1 << FeatureFlagsNecessaryBit}}})
+	img, err = Open(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	imagetest.CheckUnreadable(t, img, ErrUnsupportedFeature)
+
+	if _, err := Open(bytes.NewReader(make([]byte, 512))); !errors.Is(err, image.ErrWrongType) {
+		t.Fatalf("expected ErrWrongType, got %v", err)
+	}
+}
+
+// TestQemuImg reads images converted by qemu-img.
+func TestQemuImg(t *testing.T) {
+	for _, options := range []string{"cluster_size=1M", "cluster_size=64k"} {
+		t.Run(options, func(t *testing.T) {
+			path := imagetest.ConvertQemuImg(t, qemuimg.FormatParallels, 10<<20, options)
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close() //nolint:errcheck
+			img, err := Open(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			imagetest.CompareQemuImg(t, img, path)
+		})
+	}
+}
+
+func testDirtyBitmap(id byte, granularity uint32, table ...uint64) []byte {
+	var b []byte
+	b = binary.LittleEndian.AppendUint64(b, 4*testClusterSectors)
+	b = append(b, id)
+	b = append(b, make([]byte, 15)...)
+	b = binary.LittleEndian.AppendUint32(b, granularity)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(table)))
+	for _, e := range table {
+		b = binary.LittleEndian.AppendUint64(b, e)
+	}
+	return b
+}
+
+func TestDirtyRanges(t *testing.T) {
+	const layout = "auaa"
+	// The bitmap data is appended after the format extension cluster.
+	bitmapOffset := func(data []byte) uint64 { return uint64(len(data)) / 512 }
+	createImage := func(dirty bool) []byte {
+		probe, _ := createTestImage(t, testImage{ext: true, layout: layout, features: []testFeature{{}}})
+		features := []testFeature{
+			{magic: FeatureDirtyBitmap, data: testDirtyBitmap(1, 1, bitmapOffset(probe))},
+			{magic: FeatureDirtyBitmap, data: testDirtyBitmap(2, 8, bitmapTableAllOnes)},
+			{magic: 0x1234},
+		}
+		data, _ := createTestImage(t, testImage{ext: true, layout: layout, dirty: dirty, features: features})
+		if bitmapOffset(data) != bitmapOffset(probe) {
+			t.Fatal("unexpected bitmap offset")
+		}
+		bitmap := make([]byte, testClusterSize)
+		bitmap[0] = 0b11
+		bitmap[1] = 0b100
+		bitmap[3] = 0b10000000
+		bitmap[4] = 0b1
+		return append(data, bitmap...)
+	}
+
+	img, err := Open(bytes.NewReader(createImage(false)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bitmaps, err := img.Bitmaps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bitmaps) != 2 || bitmaps[0].Name != "01000000-0000-0000-0000-000000000000" || bitmaps[1].Granularity != 4096 {
+		t.Fatalf("unexpected bitmaps %+v", bitmaps)
+	}
+	cases := []struct {
+		name string
+		want []DirtyRange
+	}{
+		{
+			name: bitmaps[0].Name,
+			want: []DirtyRange{{Start: 0, Length: 1024}, {Start: 10 * 512, Length: 512}, {Start: 31 * 512, Length: 1024}},
+		},
+		{
+			name: bitmaps[1].Name,
+			want: []DirtyRange{{Start: 0, Length: img.Size()}},
+		},
+	}
+	for _, tc := range cases {
+		var got []DirtyRange
+		for r, err := range img.DirtyRanges(tc.name) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, r)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("%s: expected %+v, got %+v", tc.name, tc.want, got)
+		}
+	}
+	for _, err := range img.DirtyRanges("missing") {
+		if !errors.Is(err, ErrBitmapNotFound) {
+			t.Fatalf("expected ErrBitmapNotFound, got %v", err)
+		}
+	}
+
+	img, err = Open(bytes.NewReader(createImage(true)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range img.DirtyRanges(bitmaps[0].Name) {
+		if !errors.Is(err, ErrInconsistentBitmap) {
+			t.Fatalf("expected ErrInconsistentBitmap, got %v", err)
+		}
+	}
+}
+
+const testDescriptor = `<?xml version='1.0' encoding='UTF-8'?>
+<Parallels_disk_image Version="1.0">
+  <Disk_Parameters>
+    <Disk_size>%d</Disk_size>
+    <Cylinders>1</Cylinders>
+    <PhysicalSectorSize>512</PhysicalSectorSize>
+    <Heads>16</Heads>
+    <Sectors>32</Sectors>
+  </Disk_Parameters>
+  <StorageData>
+    <Storage>
+      <Start>0</Start>
+      <End>%d</End>
+      <Blocksize>16</Blocksize>
+      <Image>
+        <GUID>{5fbaabe3-6958-40ff-92a7-860e329aab41}</GUID>
+        <Type>Plain</Type>
+        <File>disk.hdd.0.{5fbaabe3-6958-40ff-92a7-860e329aab41}.hds</File>
+      </Image>
+      <Image>
+        <GUID>{0ec8c7b2-8d4c-44e1-b0d4-3a0b8e0d5c2f}</GUID>
+        <Type>Compressed</Type>
+        <File>disk.hdd.0.{0ec8c7b2-8d4c-44e1-b0d4-3a0b8e0d5c2f}.hds</File>
+      </Image>
+    </Storage>
+    <Storage>
+      <Start>%d</Start>
+      <End>%d</End>
+      <Blocksize>16</Blocksize>
+      <Image>
+        <GUID>{5fbaabe3-6958-40ff-92a7-860e329aab41}</GUID>
+        <Type>Compressed</Type>
+        <File>disk.hdd.1.{5fbaabe3-6958-40ff-92a7-860e329aab41}.hds</File>
+      </Image>
+      <Image>
+        <GUID>{0ec8c7b2-8d4c-44e1-b0d4-3a0b8e0d5c2f}</GUID>
+        <Type>Compressed</Type>
+        <File>disk.hdd.1.{0ec8c7b2-8d4c-44e1-b0d4-3a0b8e0d5c2f}.hds</File>
+      </Image>
+    </Storage>
+  </StorageData>
+  <Snapshots>
+    <Shot>
+      <GUID>{5fbaabe3-6958-40ff-92a7-860e329aab41}</GUID>
+      <ParentGUID>{00000000-0000-0000-0000-000000000000}</ParentGUID>
+    </Shot>
+    <Shot>
+      <GUID>{0ec8c7b2-8d4c-44e1-b0d4-3a0b8e0d5c2f}</GUID>
+      <ParentGUID>{5fbaabe3-6958-40ff-92a7-860e329aab41}</ParentGUID>
+    </Shot>
+  </Snapshots>
+</Parallels_disk_image>
+`
+
+func TestBundle(t *testing.T) {
+	// The first storage has 4 clusters with a plain base image, and the
+	// second storage has 4 clusters with an expanding base image.
+	const storageSectors = 4 * testClusterSectors
+	const size = 2*storageSectors*512 - 4096
+	r := rand.New(rand.NewSource(1))
+	plain := make([]byte, storageSectors*512)
+	if _, err := r.Read(plain); err != nil {
+		t.Fatal(err)
+	}
+	top0, wantTop0 := createTestImage(t, testImage{ext: true, layout: "uaau", seed: 2})
+	base1, wantBase1 := createTestImage(t, testImage{layout: "auua", seed: 3})
+	top1, wantTop1 := createTestImage(t, testImage{ext: true, layout: "uau", seed: 4})
+
+	want := bytes.Clone(plain)
+	copy(want[testClusterSize:], wantTop0[testClusterSize:3*testClusterSize])
+	want = append(want, wantBase1...)
+	copy(want[5*testClusterSize:], wantTop1[testClusterSize:2*testClusterSize])
+	want = want[:size]
+	wantExtents := []image.Extent{
+		{Start: 0, Length: 6 * testClusterSize, Allocated: true},
+		{Start: 6 * testClusterSize, Length: testClusterSize, Zero: true},
+		{Start: 7 * testClusterSize, Length: testClusterSize - 4096, Allocated: true},
+	}
+
+	files := map[string][]byte{
+		"disk.hdd/" + DescriptorFileName:                                 fmt.Appendf(nil, testDescriptor, size/512, storageSectors, storageSectors, 2*storageSectors),
+		"disk.hdd/disk.hdd.0.{5fbaabe3-6958-40ff-92a7-860e329aab41}.hds": plain,
+		"disk.hdd/disk.hdd.0.{0ec8c7b2-8d4c-44e1-b0d4-3a0b8e0d5c2f}.hds": top0,
+		"disk.hdd/disk.hdd.1.{5fbaabe3-6958-40ff-92a7-860e329aab41}.hds": base1,
+		"disk.hdd/disk.hdd.1.{0ec8c7b2-8d4c-44e1-b0d4-3a0b8e0d5c2f}.hds": top1,
+	}
+	check := func(t *testing.T, img *Parallels) {
+		t.Helper()
+		if err := img.Readable(); err != nil {
+			t.Fatal(err)
+		}
+		if img.Size() != size {
+			t.Fatalf("expected size %d, got %d", size, img.Size())
+		}
+		if !bytes.Equal(imagetest.ReadAll(t, img), want) {
+			t.Fatal("unexpected data")
+		}
+		if extents := imagetest.ReadExtents(t, img); !reflect.DeepEqual(extents, wantExtents) {
+			t.Fatalf("expected extents\n%+v\ngot\n%+v", wantExtents, extents)
+		}
+	}
+
+	t.Run("descriptor", func(t *testing.T) {
+		fsys := fstest.MapFS{}
+		for name, data := range files {
+			fsys[name] = &fstest.MapFile{Data: data}
+		}
+		name := "disk.hdd/" + DescriptorFileName
+		img, err := Open(bytes.NewReader(files[name]), WithFileResolver(image.FSFileResolver(fsys)), WithName(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer img.Close()
+		check(t, img)
+	})
+
+	t.Run("outside", func(t *testing.T) {
+		// Errors of the resolver are reported, e.g. for an open policy.
+		name := "disk.hdd/" + DescriptorFileName
+		descriptor := bytes.ReplaceAll(files[name], []byte("<File>disk.hdd.0."), []byte("<File>../../disk.hdd.0."))
+		fsys := fstest.MapFS{name: &fstest.MapFile{Data: descriptor}}
+		img, err := Open(bytes.NewReader(descriptor), WithFileResolver(image.FSFileResolver(fsys)), WithName(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer img.Close()
+		if err := img.Readable(); !errors.Is(err, image.ErrUnsafeFileName) {
+			t.Fatalf("expected image.ErrUnsafeFileName, got %v", err)
+		}
+	})
+
+	t.Run("directory", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.Mkdir(filepath.Join(dir, "disk.hdd"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		for name, data := range files {
+			if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		f, err := os.Open(filepath.Join(dir, "disk.hdd"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := Open(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer img.Close()
+		check(t, img)
+	})
+}
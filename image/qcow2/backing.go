@@ -0,0 +1,351 @@
+package qcow2
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/lima-vm/go-qcow2reader/image"
+)
+
+// DefaultMaxBackingChainDepth is the default maximum number of backing images
+// below an image.
+const DefaultMaxBackingChainDepth = image.DefaultMaxBackingChainDepth
+
+var (
+	ErrUnsafeBackingFile   = image.ErrUnsafeFileName
+	ErrBackingChainTooDeep = image.ErrBackingChainTooDeep
+	ErrBackingChainLoop    = image.ErrBackingChainLoop
+
+	ErrBackingFileFormatRequired = image.ErrBackingFileFormatRequired
+)
+
+// BackingFileResolver opens the backing file of an image. See
+// [image.FileResolver].
+type BackingFileResolver = image.FileResolver
+
+// WithBackingFileResolver sets the [BackingFileResolver] used to open backing
+// files and external data files. The resolver is also used for the files of
+// backing images.
+//
+// The default is [image.OSFileResolver].
+func WithBackingFileResolver(r BackingFileResolver) Option {
+	return func(o *options) {
+		o.backingFileResolver = r
+	}
+}
+
+// WithMaxBackingChainDepth sets the maximum number of backing images below the
+// image. The default is [DefaultMaxBackingChainDepth].
+func WithMaxBackingChainDepth(n int) Option {
+	return func(o *options) {
+		o.maxBackingChainDepth = n
+	}
+}
+
+// WithBackingFileFormatRequired refuses backing files without an explicit
+// format with [ErrBackingFileFormatRequired], instead of probing their format.
+// Probing is unsafe if the backing file may be written by a guest: a raw image
+// with a qcow2 header would be opened as qcow2 image, with its own backing
+// file.
+func WithBackingFileFormatRequired() Option {
+	return func(o *options) {
+		o.requireBackingFormat = true
+	}
+}
+
+// WithName sets the name of the image, used instead of [Namer] to resolve
+// backing files and to get the passphrase of encrypted images. With a custom
+// [BackingFileResolver], this is the name passed as base for the top image.
+func WithName(name string) Option {
+	return func(o *options) {
+		o.name = name
+	}
+}
+
+// WithBackingChain sets the resolved names of the images above the image, from
+// the top image, when the image is the backing file of an image of another
+// format. The names count in the depth of the backing chain and are used to
+// detect loops.
+func WithBackingChain(chain []string) Option {
+	return func(o *options) {
+		o.depth = len(chain)
+		o.chain = chain
+	}
+}
+
+// WithBackingFileOpener sets the [image.OpenBackingFile] used instead of
+// openWithType to open backing files of other formats. It is passed the names
+// of the images above the backing file, so that the depth of the backing chain
+// is limited and loops are detected across formats.
+func WithBackingFileOpener(open image.OpenBackingFile) Option {
+	return func(o *options) {
+		o.openBackingFile = open
+	}
+}
+
+// fileResolver returns the resolver of backing files and data files.
+func (o *options) fileResolver() BackingFileResolver {
+	if o.backingFileResolver == nil {
+		return image.OSFileResolver
+	}
+	return o.backingFileResolver
+}
+
+// FSBackingFileResolver returns a [BackingFileResolver] opening backing files
+// in fsys, e.g. [os.DirFS] or [testing/fstest.MapFS]. Files must implement
+// [io.ReaderAt].
+//
+// Backing file names are resolved relative to the directory of the image in
+// fsys. The top image is at the root of fsys unless its path is set with
+// [WithName]. Absolute names and names outside fsys are rejected with
+// [ErrUnsafeBackingFile].
+func FSBackingFileResolver(fsys fs.FS) BackingFileResolver {
+	return image.FSFileResolver(fsys)
+}
+
+// loadBackingFile opens the backing image. qcow2 backing images are opened
+// with the options of this image, to limit the depth of the chain and detect
+// loops. Other formats are opened with openWithType.
+func (img *Qcow2) loadBackingFile(o *options, openWithType image.OpenWithType) error {
+	resolver := o.fileResolver()
+	maxDepth := o.maxBackingChainDepth
+	if maxDepth == 0 {
+		maxDepth = DefaultMaxBackingChainDepth
+	}
+	if o.depth >= maxDepth {
+		return fmt.Errorf("%w: %w (more than %d images)", ErrUnsupportedBackingFile, ErrBackingChainTooDeep, maxDepth)
+	}
+
+	name := img.BackingFile
+	if strings.HasPrefix(name, jsonBackingFilePrefix) {
+		filename, format, err := parseJSONBackingFile(name)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrUnsupportedBackingFile, err)
+		}
+		name = filename
+		if format != "" {
+			img.BackingFileFormat = format
+		}
+	}
+	if o.requireBackingFormat && img.BackingFileFormat == "" {
+		return fmt.Errorf("%w: %w (file %q)", ErrUnsupportedBackingFile, ErrBackingFileFormatRequired, name)
+	}
+	ra, resolved, err := resolver(o.name, name)
+	if err != nil {
+		return fmt.Errorf("%w: failed to open %q: %w", ErrUnsupportedBackingFile, name, err)
+	}
+	img.BackingFileFullPath = resolved
+	// Unknown names are kept to count the depth in other formats.
+	chain := append(slices.Clip(o.chain), o.name)
+	if resolved != "" && slices.Contains(chain, resolved) {
+		closeReaderAt(ra)
+		return fmt.Errorf("%w: %w (file %q)", ErrUnsupportedBackingFile, ErrBackingChainLoop, resolved)
+	}
+
+	switch img.BackingFileFormat {
+	case Type, "":
+		backingOptions := *o
+		backingOptions.name = resolved
+		backingOptions.depth++
+		backingOptions.chain = chain
+		backing, err := open(ra, openWithType, &backingOptions)
+		if err == nil {
+			img.backingImage = backing
+			// Report errors of the backing chain on the top image.
+			if err := backing.Readable(); errors.Is(err, ErrUnsupportedBackingFile) {
+				return err
+			}
+			return nil
+		}
+		if img.BackingFileFormat == Type || !errors.Is(err, image.ErrWrongType) {
+			closeReaderAt(ra)
+			return fmt.Errorf("%w (file %q, format %q): %w", ErrUnsupportedBackingFile, resolved, img.BackingFileFormat, err)
+		}
+	}
+	switch {
+	case o.openBackingFile != nil:
+		img.backingImage, err = o.openBackingFile(ra, img.BackingFileFormat, chain)
+	case openWithType != nil:
+		img.backingImage, err = openWithType(ra, img.BackingFileFormat)
+	default:
+		closeReaderAt(ra)
+		return fmt.Errorf("%w (file %q, format %q): no opener", ErrUnsupportedBackingFile, resolved, img.BackingFileFormat)
+	}
+	if err != nil {
+		if img.backingImage != nil {
+			_ = img.backingImage.Close()
+			img.backingImage = nil
+		} else {
+			closeReaderAt(ra)
+		}
+		return fmt.Errorf("%w (file %q, format %q): %w", ErrUnsupportedBackingFile, resolved, img.BackingFileFormat, err)
+	}
+	// Errors of other formats may be about their own files, e.g. extents.
+	if err := img.backingImage.Readable(); err != nil {
+		if errors.Is(err, ErrUnsupportedBackingFile) {
+			return err
+		}
+		return fmt.Errorf("%w (file %q, format %q): %w", ErrUnsupportedBackingFile, resolved, img.BackingFileFormat, err)
+	}
+	return nil
+}
+
+func closeReaderAt(ra io.ReaderAt) {
+	if closer, ok := ra.(io.Closer); ok {
+		_ = closer.Close()
+	}
+}
+
+// jsonBackingFilePrefix is the prefix of backing file names using the json:
+// pseudo-protocol, e.g.
+// `json:{"driver":"qcow2","file":{"driver":"file","filename":"base.img"}}`.
+// Such names are written by qemu when the backing file was opened with
+// options, e.g. by libvirt block jobs.
+const jsonBackingFilePrefix = "json:"
+
+// parseJSONBackingFile returns the file name and the format of a json:
+// pseudo-protocol backing file name. The format is empty if it should be
+// probed. Only the "file" protocol is supported.
+//
+// Options other than the driver and the file name are rejected, since options
+// like "offset" and "size" of the raw driver change the data read. A "file"
+// string is rejected too: qemu resolves it as the name of a block node, not as
+// a file name.
+//
+// Like other backing file names, relative file names are resolved relative to
+// the image.
+func parseJSONBackingFile(s string) (string, image.Type, error) {
+	var spec map[string]any
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(s, jsonBackingFilePrefix)), &spec); err != nil {
+		return "", "", fmt.Errorf("failed to parse %q: %w", s, err)
+	}
+	spec, err := crumpleJSONOptions(spec)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to parse %q: %w", s, err)
+	}
+	driver, err := jsonString(spec, "driver")
+	if err != nil {
+		return "", "", err
+	}
+	if driver == "file" {
+		if err := checkJSONOptions(spec, "", "driver", "filename"); err != nil {
+			return "", "", err
+		}
+		filename, err := jsonFilename(spec)
+		return filename, "", err
+	}
+	format := image.Type(driver)
+	switch file := spec["file"].(type) {
+	case nil:
+		// e.g. {"driver": "qcow2", "filename": "base.img"}
+		if err := checkJSONOptions(spec, "", "driver", "filename"); err != nil {
+			return "", "", err
+		}
+		filename, err := jsonFilename(spec)
+		return filename, format, err
+	case string:
+		return "", "", fmt.Errorf(`unsupported block node reference "file": %q in json: backing file name`, file)
+	case map[string]any:
+		if err := checkJSONOptions(spec, "", "driver", "file"); err != nil {
+			return "", "", err
+		}
+		protocol, err := jsonString(file, "driver")
+		if err != nil {
+			return "", "", err
+		}
+		if protocol != "" && protocol != "file" {
+			return "", "", fmt.Errorf("unsupported protocol %q in json: backing file name", protocol)
+		}
+		if err := checkJSONOptions(file, "file.", "driver", "filename"); err != nil {
+			return "", "", err
+		}
+		filename, err := jsonFilename(file)
+		return filename, format, err
+	default:
+		return "", "", fmt.Errorf(`unexpected "file" in json: backing file name: %v`, file)
+	}
+}
+
+// checkJSONOptions returns an error if m has options other than allowed. prefix
+// is the prefix of the options in error messages, e.g. "file.".
+func checkJSONOptions(m map[string]any, prefix string, allowed ...string) error {
+	for _, k := range slices.Sorted(maps.Keys(m)) {
+		if !slices.Contains(allowed, k) {
+			return fmt.Errorf("unsupported option %q in json: backing file name", prefix+k)
+		}
+	}
+	return nil
+}
+
+// crumpleJSONOptions converts flattened options like {"file.filename": "a"}
+// to nested options like {"file": {"filename": "a"}}, like qemu.
+func crumpleJSONOptions(m map[string]any) (map[string]any, error) {
+	res := make(map[string]any, len(m))
+	for k, v := range m {
+		if nested, ok := v.(map[string]any); ok {
+			var err error
+			if v, err = crumpleJSONOptions(nested); err != nil {
+				return nil, err
+			}
+		}
+		keys := strings.Split(k, ".")
+		cur := res
+		for _, key := range keys[:len(keys)-1] {
+			switch next := cur[key].(type) {
+			case nil:
+				child := make(map[string]any)
+				cur[key] = child
+				cur = child
+			case map[string]any:
+				cur = next
+			default:
+				return nil, fmt.Errorf("conflicting option %q", k)
+			}
+		}
+		last := keys[len(keys)-1]
+		if prev, ok := cur[last]; ok {
+			prevMap, ok1 := prev.(map[string]any)
+			vMap, ok2 := v.(map[string]any)
+			if !ok1 || !ok2 {
+				return nil, fmt.Errorf("conflicting option %q", k)
+			}
+			for kk, vv := range vMap {
+				if _, ok := prevMap[kk]; ok {
+					return nil, fmt.Errorf("conflicting option %q", k+"."+kk)
+				}
+				prevMap[kk] = vv
+			}
+			continue
+		}
+		cur[last] = v
+	}
+	return res, nil
+}
+
+func jsonString(m map[string]any, key string) (string, error) {
+	switch v := m[key].(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	default:
+		return "", fmt.Errorf("unexpected %q in json: backing file name: %v", key, v)
+	}
+}
+
+func jsonFilename(m map[string]any) (string, error) {
+	filename, err := jsonString(m, "filename")
+	if err != nil {
+		return "", err
+	}
+	if filename == "" {
+		return "", errors.New(`missing "filename" in json: backing file name`)
+	}
+	return filename, nil
+}
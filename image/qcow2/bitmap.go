@@ -0,0 +1,276 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+
+	"github.com/lima-vm/go-qcow2reader/align"
+	"github.com/lima-vm/go-qcow2reader/log"
+)
+
+// Limits from qemu.
+const (
+	maxBitmaps             = 65535
+	maxBitmapDirectorySize = 64 << 20
+	maxBitmapNameSize      = 1023
+	minBitmapGranularity   = 9
+	maxBitmapGranularity   = 31
+	maxBitmapTableSize     = 0x8000000 // entries
+	bitmapDirectoryHeader  = 24
+	bitmapTypeDirtyTrack   = 1
+	bitmapTableOffsetMask  = 0x00fffffffffffe00
+	bitmapTableAllOnes     = 1
+)
+
+var (
+	ErrBitmapNotFound     = errors.New("bitmap not found")
+	ErrInconsistentBitmap = errors.New("inconsistent bitmap")
+)
+
+// BitmapsExtension is the data of the bitmaps header extension.
+type BitmapsExtension struct {
+	NbBitmaps             uint32 `json:"nb_bitmaps"`
+	Reserved              uint32 `json:"reserved"`
+	BitmapDirectorySize   uint64 `json:"bitmap_directory_size"`
+	BitmapDirectoryOffset uint64 `json:"bitmap_directory_offset"`
+}
+
+type BitmapFlags uint32
+
+const (
+	BitmapFlagsInUseBit               = 0
+	BitmapFlagsAutoBit                = 1
+	BitmapFlagsExtraDataCompatibleBit = 2
+)
+
+var BitmapFlagsNames = []string{
+	"in_use",                // 0
+	"auto",                  // 1
+	"extra_data_compatible", // 2
+}
+
+func (x BitmapFlags) MarshalJSON() ([]byte, error) {
+	return json.Marshal(newFeatures(uint64(x), BitmapFlagsNames))
+}
+
+type bitmapDirectoryEntry struct {
+	BitmapTableOffset uint64
+	BitmapTableSize   uint32
+	Flags             BitmapFlags
+	Type              uint8
+	GranularityBits   uint8
+	NameSize          uint16
+	ExtraDataSize     uint32
+}
+
+// Bitmap is a persistent dirty bitmap.
+type Bitmap struct {
+	Name        string      `json:"name"`
+	Granularity uint64      `json:"granularity"` // Bytes covered by each bit
+	Flags       BitmapFlags `json:"flags"`
+	TableOffset uint64      `json:"table_offset"`
+	TableSize   uint32      `json:"table_size"`
+}
+
+// InUse returns true if the bitmap was not saved properly, e.g. because
+// qemu did not exit cleanly. Such a bitmap cannot be trusted.
+func (b *Bitmap) InUse() bool {
+	return b.Flags&(1<<BitmapFlagsInUseBit) != 0
+}
+
+// Auto returns true if the bitmap tracks all writes to the image.
+func (b *Bitmap) Auto() bool {
+	return b.Flags&(1<<BitmapFlagsAutoBit) != 0
+}
+
+// DirtyRange is a range of the guest disk marked dirty in a bitmap.
+type DirtyRange struct {
+	// Offset from start of the image in bytes.
+	Start int64 `json:"start"`
+	// Length of this range in bytes.
+	Length int64 `json:"length"`
+}
+
+func (img *Qcow2) bitmapsExtension() *BitmapsExtension {
+	for _, ext := range img.HeaderExtensions {
+		if ext.Type == HeaderExtensionTypeBitmapsExtension {
+			if data, ok := ext.Data.(*BitmapsExtension); ok {
+				return data
+			}
+		}
+	}
+	return nil
+}
+
+// Bitmaps reads the bitmap directory.
+//
+// Snapshot images have no bitmaps.
+func (img *Qcow2) Bitmaps() ([]Bitmap, error) {
+	if img.snapshotOf != nil {
+		return nil, nil
+	}
+	ext := img.bitmapsExtension()
+	if ext == nil || ext.NbBitmaps == 0 {
+		return nil, nil
+	}
+	if img.HeaderFieldsV3 == nil || img.AutoclearFeatures&(1<<AutoclearFeaturesBitmapsExtensionBit) == 0 {
+		// The image was modified by a program that does not know about bitmaps.
+		return nil, fmt.Errorf("%w: the %q autoclear feature is not set", ErrInconsistentBitmap, AutoclearFeaturesNames[AutoclearFeaturesBitmapsExtensionBit])
+	}
+	if ext.NbBitmaps > maxBitmaps {
+		return nil, fmt.Errorf("too many bitmaps (%d > %d)", ext.NbBitmaps, maxBitmaps)
+	}
+	if ext.BitmapDirectorySize > maxBitmapDirectorySize {
+		return nil, fmt.Errorf("bitmap directory too large (%d bytes > %d bytes)", ext.BitmapDirectorySize, maxBitmapDirectorySize)
+	}
+	dir := make([]byte, ext.BitmapDirectorySize)
+	if _, err := img.ra.ReadAt(dir, int64(ext.BitmapDirectoryOffset)); err != nil {
+		return nil, fmt.Errorf("failed to read bitmap directory: %w", err)
+	}
+	res := make([]Bitmap, 0, ext.NbBitmaps)
+	for i := 0; i < int(ext.NbBitmaps); i++ {
+		if len(dir) < bitmapDirectoryHeader {
+			return nil, fmt.Errorf("bitmap directory is truncated at entry %d", i)
+		}
+		var e bitmapDirectoryEntry
+		if _, err := binary.Decode(dir, binary.BigEndian, &e); err != nil {
+			return nil, fmt.Errorf("failed to parse bitmap %d: %w", i, err)
+		}
+		if e.NameSize > maxBitmapNameSize {
+			return nil, fmt.Errorf("bitmap %d: name too long (%d bytes)", i, e.NameSize)
+		}
+		entryLen := bitmapDirectoryHeader + int(e.ExtraDataSize) + int(e.NameSize)
+		if len(dir) < entryLen {
+			return nil, fmt.Errorf("bitmap directory is truncated at entry %d", i)
+		}
+		nameOffset := bitmapDirectoryHeader + int(e.ExtraDataSize)
+		b := Bitmap{
+			Name:        string(dir[nameOffset : nameOffset+int(e.NameSize)]),
+			Granularity: 1 << e.GranularityBits,
+			Flags:       e.Flags,
+			TableOffset: e.BitmapTableOffset,
+			TableSize:   e.BitmapTableSize,
+		}
+		if e.Type != bitmapTypeDirtyTrack {
+			return nil, fmt.Errorf("bitmap %q: unsupported type %d", b.Name, e.Type)
+		}
+		if e.GranularityBits < minBitmapGranularity || e.GranularityBits > maxBitmapGranularity {
+			return nil, fmt.Errorf("bitmap %q: invalid granularity bits %d", b.Name, e.GranularityBits)
+		}
+		if e.ExtraDataSize > 0 && e.Flags&(1<<BitmapFlagsExtraDataCompatibleBit) == 0 {
+			log.Warnf("Bitmap %q has unknown extra data (%d bytes)", b.Name, e.ExtraDataSize)
+		}
+		res = append(res, b)
+		dir = dir[min(align.Up(entryLen, 8), len(dir)):]
+	}
+	return res, nil
+}
+
+func (img *Qcow2) bitmap(name string) (*Bitmap, error) {
+	bitmaps, err := img.Bitmaps()
+	if err != nil {
+		return nil, err
+	}
+	for i := range bitmaps {
+		if bitmaps[i].Name == name {
+			return &bitmaps[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %q", ErrBitmapNotFound, name)
+}
+
+// DirtyRanges returns the ranges of the guest disk marked dirty in the named
+// bitmap, in ascending order. Adjacent dirty ranges are merged.
+//
+// Iteration stops after yielding the first error.
+func (img *Qcow2) DirtyRanges(name string) iter.Seq2[DirtyRange, error] {
+	return func(yield func(DirtyRange, error) bool) {
+		b, err := img.bitmap(name)
+		if err != nil {
+			yield(DirtyRange{}, err)
+			return
+		}
+		if b.InUse() {
+			yield(DirtyRange{}, fmt.Errorf("%w: bitmap %q is in use", ErrInconsistentBitmap, name))
+			return
+		}
+
+		size := img.Size()
+		granularity := int64(b.Granularity)
+		bitsPerCluster := int64(img.clusterSize) * 8
+		bytesPerCluster := bitsPerCluster * granularity
+		need := (size + bytesPerCluster - 1) / bytesPerCluster
+		if int64(b.TableSize) < need {
+			yield(DirtyRange{}, fmt.Errorf("bitmap %q: table too small (%d entries < %d entries)", name, b.TableSize, need))
+			return
+		}
+		if b.TableSize > maxBitmapTableSize {
+			yield(DirtyRange{}, fmt.Errorf("bitmap %q: table too large (%d entries > %d entries)", name, b.TableSize, maxBitmapTableSize))
+			return
+		}
+		if fileSize := readerSize(img.ra); fileSize >= 0 && (b.TableOffset > uint64(fileSize) || need*8 > fileSize-int64(b.TableOffset)) {
+			yield(DirtyRange{}, fmt.Errorf("bitmap %q: table at offset %d exceeds the file size %d", name, b.TableOffset, fileSize))
+			return
+		}
+		table := make([]uint64, need)
+		if err := binary.Read(io.NewSectionReader(img.ra, int64(b.TableOffset), need*8), binary.BigEndian, table); err != nil {
+			yield(DirtyRange{}, fmt.Errorf("failed to read table of bitmap %q: %w", name, err))
+			return
+		}
+
+		var cur DirtyRange
+		// add merges [start, end) into cur, yielding cur when not adjacent.
+		add := func(start, end int64) bool {
+			end = min(end, size)
+			if cur.Length > 0 && cur.Start+cur.Length == start {
+				cur.Length += end - start
+				return true
+			}
+			if cur.Length > 0 && !yield(cur, nil) {
+				return false
+			}
+			cur = DirtyRange{Start: start, Length: end - start}
+			return true
+		}
+
+		buf := make([]byte, img.clusterSize)
+		for i, entry := range table {
+			clusterStart := int64(i) * bytesPerCluster
+			offset := entry & bitmapTableOffsetMask
+			if offset == 0 {
+				if entry&bitmapTableAllOnes != 0 && !add(clusterStart, clusterStart+bytesPerCluster) {
+					return
+				}
+				continue
+			}
+			if _, err := img.ra.ReadAt(buf, int64(offset)); err != nil {
+				yield(DirtyRange{}, fmt.Errorf("failed to read data of bitmap %q: %w", name, err))
+				return
+			}
+			for j, x := range buf {
+				if x == 0 {
+					continue
+				}
+				for k := 0; k < 8; k++ {
+					if x&(1<<k) == 0 {
+						continue
+					}
+					start := clusterStart + (int64(j)*8+int64(k))*granularity
+					if start >= size {
+						break
+					}
+					if !add(start, start+granularity) {
+						return
+					}
+				}
+			}
+		}
+		if cur.Length > 0 {
+			yield(cur, nil)
+		}
+	}
+}
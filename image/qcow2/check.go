@@ -0,0 +1,526 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+type CheckProblemType string
+
+const (
+	// CheckProblemTypeLeak is a cluster with a higher refcount than the number
+	// of references. Leaks waste space but do not harm data.
+	CheckProblemTypeLeak = CheckProblemType("leak")
+	// CheckProblemTypeCorruption is an inconsistency that may cause data loss.
+	CheckProblemTypeCorruption = CheckProblemType("corruption")
+	// CheckProblemTypeError is a part of the image that could not be checked.
+	CheckProblemTypeError = CheckProblemType("check-error")
+)
+
+// CheckProblem is a problem found by [Qcow2.Check].
+type CheckProblem struct {
+	Type CheckProblemType `json:"type"`
+	// Offset in the image file where the problem was found.
+	Offset  uint64 `json:"offset"`
+	Message string `json:"message"`
+}
+
+// CheckResult is the result of [Qcow2.Check].
+// The JSON field names are compatible with `qemu-img check --output=json`.
+type CheckResult struct {
+	ImageEndOffset     int64          `json:"image-end-offset"`
+	TotalClusters      int64          `json:"total-clusters"`
+	AllocatedClusters  int64          `json:"allocated-clusters"`
+	FragmentedClusters int64          `json:"fragmented-clusters"`
+	CompressedClusters int64          `json:"compressed-clusters"`
+	CheckErrors        int            `json:"check-errors"`
+	Leaks              int            `json:"leaks"`
+	Corruptions        int            `json:"corruptions"`
+	Dirty              bool           `json:"dirty"`   // The dirty bit is set; refcounts may be stale
+	Corrupt            bool           `json:"corrupt"` // The corrupt bit is set
+	Problems           []CheckProblem `json:"problems,omitempty"`
+}
+
+// IsClean returns true if no leaks, corruptions or check errors were found.
+func (res *CheckResult) IsClean() bool {
+	return res.CheckErrors == 0 && res.Leaks == 0 && res.Corruptions == 0
+}
+
+type clusterType uint8
+
+const (
+	clusterTypeFree = clusterType(iota)
+	clusterTypeData
+	clusterTypeHeader
+	clusterTypeRefcountTable
+	clusterTypeRefcountBlock
+	clusterTypeL1Table
+	clusterTypeL2Table
+	clusterTypeSnapshotTable
+	clusterTypeBitmapDirectory
+	clusterTypeBitmapTable
+	clusterTypeBitmapData
+	clusterTypeEncryptionHeader
+)
+
+func (x clusterType) String() string {
+	switch x {
+	case clusterTypeFree:
+		return "free cluster"
+	case clusterTypeData:
+		return "data cluster"
+	case clusterTypeHeader:
+		return "header"
+	case clusterTypeRefcountTable:
+		return "refcount table"
+	case clusterTypeRefcountBlock:
+		return "refcount block"
+	case clusterTypeL1Table:
+		return "L1 table"
+	case clusterTypeL2Table:
+		return "L2 table"
+	case clusterTypeSnapshotTable:
+		return "snapshot table"
+	case clusterTypeBitmapDirectory:
+		return "bitmap directory"
+	case clusterTypeBitmapTable:
+		return "bitmap table"
+	case clusterTypeBitmapData:
+		return "bitmap data"
+	case clusterTypeEncryptionHeader:
+		return "encryption header"
+	default:
+		return fmt.Sprintf("unknown-%d", int(x))
+	}
+}
+
+type checker struct {
+	img         *Qcow2
+	res         *CheckResult
+	clusterSize uint64
+	fileSize    int64 // -1 if unknown
+
+	// On-disk refcounts.
+	rc            *refcounts
+	refcountLimit uint64 // Number of clusters covered by the refcount table
+
+	// Computed refcounts and cluster types, indexed by cluster number.
+	refcounts []uint64
+	types     []clusterType
+
+	visitedL2 map[uint64]bool
+
+	// Number of clusters compared by compareRefcounts.
+	clusters uint64
+}
+
+// readerSize returns the size of ra, or -1 if unknown.
+func readerSize(ra io.ReaderAt) int64 {
+	switch x := ra.(type) {
+	case interface{ Stat() (os.FileInfo, error) }:
+		if st, err := x.Stat(); err == nil {
+			return st.Size()
+		}
+	case interface{ Size() int64 }:
+		return x.Size()
+	}
+	return -1
+}
+
+// Check checks the consistency of the image metadata like `qemu-img check`.
+// Only metadata in this image is checked; the backing image and the data are
+// not read.
+//
+// The returned error is non-nil only if the image cannot be checked at all.
+// Problems found in the image are reported in [CheckResult].
+func (img *Qcow2) Check() (*CheckResult, error) {
+	c, err := img.check()
+	if err != nil {
+		return nil, err
+	}
+	return c.res, nil
+}
+
+func (img *Qcow2) check() (*checker, error) {
+	if img.snapshotOf != nil {
+		return img.snapshotOf.check()
+	}
+	if err := img.Header.Readable(); err != nil {
+		return nil, err
+	}
+	c := &checker{
+		img:         img,
+		res:         &CheckResult{},
+		clusterSize: uint64(1) << img.ClusterBits,
+		fileSize:    readerSize(img.ra),
+		visitedL2:   make(map[uint64]bool),
+	}
+	if img.HeaderFieldsV3 != nil {
+		c.res.Dirty = img.IncompatibleFeatures&(1<<IncompatibleFeaturesDirtyBit) != 0
+		c.res.Corrupt = img.IncompatibleFeatures&(1<<IncompatibleFeaturesCorruptBit) != 0
+	}
+	c.res.TotalClusters = int64((img.Header.Size + c.clusterSize - 1) / c.clusterSize)
+	if err := c.readRefcounts(); err != nil {
+		return nil, err
+	}
+
+	c.inc(0, c.clusterSize, clusterTypeHeader)
+	c.inc(img.RefcountTableOffset, uint64(img.RefcountTableClusters)*c.clusterSize, clusterTypeRefcountTable)
+	for i, entry := range c.rc.table {
+		if off := entry.blockOffset(); off != 0 {
+			if off%c.clusterSize != 0 {
+				c.corruption(off, "refcount block %d is not cluster aligned", i)
+				continue
+			}
+			c.inc(off, c.clusterSize, clusterTypeRefcountBlock)
+		}
+	}
+	for _, ext := range img.HeaderExtensions {
+		if ptr, ok := ext.Data.(*OffsetLengthPair64); ok && ext.Type == HeaderExtensionTypeFullDiskEncryptionHeaderPointer {
+			c.inc(ptr.Offset, ptr.Length, clusterTypeEncryptionHeader)
+		}
+	}
+
+	c.checkL1(img.L1TableOffset, img.L1Size, true)
+	c.checkSnapshots()
+	c.checkBitmaps()
+	c.compareRefcounts()
+	return c, nil
+}
+
+func (c *checker) problem(typ CheckProblemType, off uint64, format string, args ...any) {
+	switch typ {
+	case CheckProblemTypeLeak:
+		c.res.Leaks++
+	case CheckProblemTypeCorruption:
+		c.res.Corruptions++
+	default:
+		c.res.CheckErrors++
+	}
+	c.res.Problems = append(c.res.Problems, CheckProblem{Type: typ, Offset: off, Message: fmt.Sprintf(format, args...)})
+}
+
+func (c *checker) corruption(off uint64, format string, args ...any) {
+	c.problem(CheckProblemTypeCorruption, off, format, args...)
+}
+
+func (c *checker) checkError(off uint64, format string, args ...any) {
+	c.problem(CheckProblemTypeError, off, format, args...)
+}
+
+func (c *checker) readRefcounts() error {
+	img := c.img
+	rc, err := readRefcounts(img)
+	if err != nil {
+		return err
+	}
+	tableLen := uint64(img.RefcountTableClusters) * c.clusterSize
+	if c.fileSize >= 0 && img.RefcountTableOffset+tableLen > uint64(c.fileSize) {
+		return fmt.Errorf("refcount table at offset %d (%d bytes) is beyond the end of the file", img.RefcountTableOffset, tableLen)
+	}
+	c.rc = rc
+	c.refcountLimit = uint64(len(rc.table)) * rc.perBlock()
+	for i, entry := range rc.table {
+		if off := entry.blockOffset(); off == 0 || off%c.clusterSize != 0 {
+			continue
+		}
+		if _, err := rc.block(uint64(i)); err != nil {
+			c.checkError(entry.blockOffset(), "%v", err)
+		}
+	}
+	return nil
+}
+
+// refcount returns the on-disk refcount of the cluster.
+func (c *checker) refcount(cluster uint64) uint64 {
+	if cluster/c.rc.perBlock() < uint64(len(c.rc.table)) {
+		if _, ok := c.rc.blocks[c.rc.table[cluster/c.rc.perBlock()].blockOffset()]; !ok {
+			// Unreadable blocks are already reported.
+			return 0
+		}
+	}
+	refcount, _ := c.rc.get(cluster)
+	return refcount
+}
+
+// inc increments the computed refcount of the clusters in the range.
+// Reports ranges outside the file, and metadata overlapping other clusters.
+// Returns false if the range is invalid.
+func (c *checker) inc(off, length uint64, typ clusterType) bool {
+	if length == 0 {
+		return true
+	}
+	end := off + length
+	if end < off || (c.fileSize >= 0 && end > uint64(c.fileSize)) {
+		c.corruption(off, "%s at offset %d (%d bytes) is beyond the end of the file", typ, off, length)
+		return false
+	}
+	first, last := off/c.clusterSize, (end-1)/c.clusterSize
+	if c.fileSize < 0 && last >= c.refcountLimit {
+		c.corruption(off, "%s at offset %d (%d bytes) is not covered by the refcount table", typ, off, length)
+		return false
+	}
+	if n := last + 1; n > uint64(len(c.refcounts)) {
+		c.refcounts = append(c.refcounts, make([]uint64, n-uint64(len(c.refcounts)))...)
+		c.types = append(c.types, make([]clusterType, n-uint64(len(c.types)))...)
+	}
+	for i := first; i <= last; i++ {
+		c.refcounts[i]++
+		switch prev := c.types[i]; {
+		case prev == clusterTypeFree:
+			c.types[i] = typ
+		case prev == clusterTypeData && typ == clusterTypeData:
+			// Shared by snapshots, or compressed clusters sharing a host cluster.
+		default:
+			c.corruption(i*c.clusterSize, "%s at offset %d overlaps with %s", typ, off, prev)
+		}
+	}
+	return true
+}
+
+// checkL1 walks an L1 table and the L2 tables it references.
+// Allocation statistics and the copied flags are only checked for the active
+// L1 table.
+func (c *checker) checkL1(l1Offset uint64, l1Size uint32, active bool) {
+	img := c.img
+	if l1Size == 0 {
+		return
+	}
+	if l1Offset%c.clusterSize != 0 {
+		c.corruption(l1Offset, "L1 table is not cluster aligned")
+		return
+	}
+	if !c.inc(l1Offset, uint64(l1Size)*8, clusterTypeL1Table) {
+		return
+	}
+	l1Table, err := readL1Table(img.ra, l1Offset, l1Size)
+	if err != nil {
+		c.checkError(l1Offset, "failed to read L1 table: %v", err)
+		return
+	}
+	l2Entries := c.clusterSize / 8
+	if img.extendedL2() {
+		l2Entries = c.clusterSize / 16
+	}
+	if active {
+		if need := (img.Header.Size + c.clusterSize*l2Entries - 1) / (c.clusterSize * l2Entries); uint64(l1Size) < need {
+			c.corruption(l1Offset, "L1 table is too small (%d entries < %d entries)", l1Size, need)
+		}
+	}
+	var nextContiguous uint64
+	for l1Index, l1Entry := range l1Table {
+		l2Offset := l1Entry.l2Offset()
+		if l2Offset == 0 {
+			continue
+		}
+		if l2Offset%c.clusterSize != 0 {
+			c.corruption(l2Offset, "L2 table of L1 entry %d is not cluster aligned", l1Index)
+			continue
+		}
+		if c.visitedL2[l2Offset] {
+			// Shared with a snapshot; only the refcount is incremented.
+			c.refcounts[l2Offset/c.clusterSize]++
+		} else {
+			if !c.inc(l2Offset, c.clusterSize, clusterTypeL2Table) {
+				continue
+			}
+			c.visitedL2[l2Offset] = true
+		}
+		if active {
+			c.checkCopied(l2Offset, uint64(l1Entry)>>63 == 1, "L2 table")
+		}
+		raw := make([]byte, c.clusterSize)
+		if _, err := img.ra.ReadAt(raw, int64(l2Offset)); err != nil {
+			c.checkError(l2Offset, "failed to read L2 table: %v", err)
+			continue
+		}
+		for l2Index := uint64(0); l2Index < l2Entries; l2Index++ {
+			var ent extendedL2TableEntry
+			if img.extendedL2() {
+				ent.L2TableEntry = l2TableEntry(binary.BigEndian.Uint64(raw[l2Index*16:]))
+				ent.ZeroStatusBitmap = binary.BigEndian.Uint32(raw[l2Index*16+8:])
+				ent.AllocStatusBitmap = binary.BigEndian.Uint32(raw[l2Index*16+12:])
+			} else {
+				ent.L2TableEntry = l2TableEntry(binary.BigEndian.Uint64(raw[l2Index*8:]))
+			}
+			guestOffset := (uint64(l1Index)*l2Entries + l2Index) * c.clusterSize
+			inImage := active && guestOffset < img.Header.Size
+			entryOffset := l2Offset + l2Index*8
+			if img.extendedL2() {
+				entryOffset = l2Offset + l2Index*16
+			}
+			c.checkL2Entry(entryOffset, ent, active, inImage, &nextContiguous)
+		}
+	}
+}
+
+func (c *checker) checkL2Entry(entryOffset uint64, ent extendedL2TableEntry, active, inImage bool, nextContiguous *uint64) {
+	img := c.img
+	l2Entry := ent.L2TableEntry
+	desc := l2Entry.clusterDescriptor()
+	if l2Entry.compressed() {
+		if img.externalDataFile() {
+			c.corruption(entryOffset, "compressed cluster in an image with an external data file")
+			return
+		}
+		if l2Entry.copied() {
+			c.corruption(entryOffset, "compressed cluster has the copied flag set")
+		}
+		if img.extendedL2() && (ent.ZeroStatusBitmap != 0 || ent.AllocStatusBitmap != 0) {
+			c.corruption(entryOffset, "compressed cluster has non-zero subcluster bitmaps")
+		}
+		cd := compressedClusterDescriptor(desc)
+		hostOffset := cd.hostClusterOffset(int(img.ClusterBits))
+		if hostOffset == 0 {
+			c.corruption(entryOffset, "compressed cluster has host offset 0")
+			return
+		}
+		start := hostOffset &^ 511
+		c.inc(start, uint64(cd.additionalSectors(int(img.ClusterBits))+1)*512, clusterTypeData)
+		if inImage {
+			c.res.AllocatedClusters++
+			c.res.CompressedClusters++
+			// Compressed clusters are fragmented by nature.
+			c.res.FragmentedClusters++
+		}
+		return
+	}
+
+	sd := standardClusterDescriptor(desc)
+	hostOffset := sd.hostClusterOffset()
+	allocated := hostOffset != 0
+	if img.extendedL2() {
+		if ent.ZeroStatusBitmap&ent.AllocStatusBitmap != 0 {
+			c.corruption(entryOffset, "subclusters are marked both allocated and zero (bitmaps %#x, %#x)", ent.AllocStatusBitmap, ent.ZeroStatusBitmap)
+		}
+		if !allocated && ent.AllocStatusBitmap != 0 && !img.externalDataFile() {
+			c.corruption(entryOffset, "subclusters are allocated without a host cluster")
+		}
+	} else if img.externalDataFile() && l2Entry.copied() {
+		// Offset 0 is valid in external data files.
+		allocated = true
+	}
+	if !allocated {
+		return
+	}
+	if hostOffset%c.clusterSize != 0 {
+		c.corruption(entryOffset, "data cluster at offset %d is not cluster aligned", hostOffset)
+		return
+	}
+	if inImage {
+		c.res.AllocatedClusters++
+		if *nextContiguous != hostOffset {
+			c.res.FragmentedClusters++
+		}
+		*nextContiguous = hostOffset + c.clusterSize
+	}
+	if img.externalDataFile() {
+		// Data clusters are not refcounted in this file.
+		return
+	}
+	c.inc(hostOffset, c.clusterSize, clusterTypeData)
+	if active {
+		c.checkCopied(hostOffset, l2Entry.copied(), "data cluster")
+	}
+}
+
+// checkCopied checks that the copied flag is set if and only if the refcount
+// is 1.
+func (c *checker) checkCopied(off uint64, copied bool, what string) {
+	refcount := c.refcount(off / c.clusterSize)
+	if copied != (refcount == 1) {
+		c.corruption(off, "copied flag of %s at offset %d is %v, but refcount=%d", what, off, copied, refcount)
+	}
+}
+
+func (c *checker) checkSnapshots() {
+	img := c.img
+	snapshots, tableLen, err := img.readSnapshotTable()
+	if err != nil {
+		c.checkError(img.SnapshotsOffset, "failed to read snapshot table: %v", err)
+		return
+	}
+	if tableLen == 0 {
+		return
+	}
+	if img.SnapshotsOffset%c.clusterSize != 0 {
+		c.corruption(img.SnapshotsOffset, "snapshot table is not cluster aligned")
+	}
+	if !c.inc(img.SnapshotsOffset, uint64(tableLen), clusterTypeSnapshotTable) {
+		return
+	}
+	for _, s := range snapshots {
+		c.checkL1(s.L1TableOffset, s.L1Size, false)
+	}
+}
+
+func (c *checker) checkBitmaps() {
+	img := c.img
+	ext := img.bitmapsExtension()
+	if ext == nil {
+		return
+	}
+	bitmaps, err := img.Bitmaps()
+	if err != nil {
+		if errors.Is(err, ErrInconsistentBitmap) {
+			// Stale bitmaps are ignored, like qemu.
+			return
+		}
+		c.checkError(ext.BitmapDirectoryOffset, "failed to read bitmap directory: %v", err)
+		return
+	}
+	c.inc(ext.BitmapDirectoryOffset, ext.BitmapDirectorySize, clusterTypeBitmapDirectory)
+	for _, b := range bitmaps {
+		if b.TableOffset%c.clusterSize != 0 {
+			c.corruption(b.TableOffset, "table of bitmap %q is not cluster aligned", b.Name)
+			continue
+		}
+		if !c.inc(b.TableOffset, uint64(b.TableSize)*8, clusterTypeBitmapTable) {
+			continue
+		}
+		table := make([]uint64, b.TableSize)
+		r := io.NewSectionReader(img.ra, int64(b.TableOffset), int64(b.TableSize)*8)
+		if err := binary.Read(r, binary.BigEndian, table); err != nil {
+			c.checkError(b.TableOffset, "failed to read table of bitmap %q: %v", b.Name, err)
+			continue
+		}
+		for _, entry := range table {
+			if off := entry & bitmapTableOffsetMask; off != 0 {
+				c.inc(off, c.clusterSize, clusterTypeBitmapData)
+			}
+		}
+	}
+}
+
+// compareRefcounts compares the computed refcounts with the on-disk refcounts.
+func (c *checker) compareRefcounts() {
+	n := uint64(len(c.refcounts))
+	for i := len(c.rc.table) - 1; i >= 0; i-- {
+		if _, ok := c.rc.blocks[c.rc.table[i].blockOffset()]; ok {
+			n = max(n, uint64(i+1)*c.rc.perBlock())
+			break
+		}
+	}
+	c.clusters = n
+	var highest int64 = -1
+	for i := uint64(0); i < n; i++ {
+		var computed uint64
+		if i < uint64(len(c.refcounts)) {
+			computed = c.refcounts[i]
+		}
+		actual := c.refcount(i)
+		if actual > 0 || computed > 0 {
+			highest = int64(i)
+		}
+		switch {
+		case actual < computed:
+			c.corruption(i*c.clusterSize, "cluster %d has refcount=%d but %d references", i, actual, computed)
+		case actual > computed:
+			c.problem(CheckProblemTypeLeak, i*c.clusterSize, "cluster %d is leaked (refcount=%d, references=%d)", i, actual, computed)
+		}
+	}
+	c.res.ImageEndOffset = (highest + 1) * int64(c.clusterSize)
+}
@@ -0,0 +1,200 @@
+package qcow2
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+type Compressor func(w io.Writer) (io.WriteCloser, error)
+
+var compressors = map[CompressionType]Compressor{
+	CompressionTypeZlib: newZlibCompressor,
+}
+
+// SetCompressor sets a custom compressor.
+// By default, a raw deflate compressor compatible with qemu is registered for
+// [CompressionTypeZlib].
+// No compressor is registered by default for [CompressionTypeZstd].
+func SetCompressor(t CompressionType, c Compressor) {
+	compressors[t] = c
+}
+
+// zlibWindowSize is the deflate window size used by qemu (window bits 12).
+// qemu fails to decompress data referring further back.
+const zlibWindowSize = 4096
+
+// zlibCompressor writes raw deflate data that can be decompressed with a
+// window of [zlibWindowSize] bytes.
+//
+// [compress/flate.Writer] always uses a 32 KiB window, so the data is buffered and
+// compressed on Close as a single stream by [deflater].
+type zlibCompressor struct {
+	w   io.Writer
+	buf []byte
+}
+
+func newZlibCompressor(w io.Writer) (io.WriteCloser, error) {
+	return &zlibCompressor{w: w}, nil
+}
+
+func (z *zlibCompressor) Write(p []byte) (int, error) {
+	z.buf = append(z.buf, p...)
+	return len(p), nil
+}
+
+// Close compresses and writes the buffered data.
+func (z *zlibCompressor) Close() error {
+	d := deflaterPool.Get().(*deflater)
+	defer deflaterPool.Put(d)
+	_, err := z.w.Write(d.compress(z.buf))
+	z.buf = nil
+	return err
+}
+
+// ClusterSize returns the size of a cluster in bytes.
+func (img *Qcow2) ClusterSize() int {
+	return img.clusterSize
+}
+
+// WriteCompressedAt compresses p and writes it at the guest offset off.
+// off must be cluster aligned and p must be a whole cluster, except in the last
+// cluster of the image, where p may end before the end of the image (e.g. when
+// the size of the image was rounded up to 512 bytes). The rest of the cluster
+// is written as zeros.
+//
+// If the cluster does not compress, it is written uncompressed like
+// [WritableQcow2.WriteAt].
+//
+// Compression happens without holding the lock, so concurrent calls compress
+// in parallel. Compressed clusters are packed into host clusters in the order
+// they are written.
+func (w *WritableQcow2) WriteCompressedAt(p []byte, off int64) (int, error) {
+	clusterSize := int64(w.clusterSize)
+	if off < 0 || off%clusterSize != 0 {
+		return 0, fmt.Errorf("compressed write at offset %d is not cluster aligned", off)
+	}
+	end := uint64(off) + uint64(len(p))
+	last := uint64(off)+uint64(clusterSize) >= w.Header.Size
+	if int64(len(p)) > clusterSize || end > w.Header.Size || int64(len(p)) < clusterSize && !last {
+		return 0, fmt.Errorf("compressed write of %d bytes at offset %d is not a whole cluster", len(p), off)
+	}
+	if w.cipher != nil {
+		return 0, fmt.Errorf("%w: compressed clusters in encrypted images", ErrUnsupportedEncryption)
+	}
+	compress := compressors[w.compressionType()]
+	if compress == nil {
+		return 0, fmt.Errorf("%w: no compressor for compression type %q", ErrUnsupportedCompression, w.compressionType())
+	}
+
+	var buf bytes.Buffer
+	zw, err := compress(&buf)
+	if err != nil {
+		return 0, fmt.Errorf("could not open the compressor: %w", err)
+	}
+	if _, err := zw.Write(p); err != nil {
+		return 0, err
+	}
+	// The decompressor reads a whole cluster.
+	if pad := clusterSize - int64(len(p)); pad > 0 {
+		if _, err := zw.Write(make([]byte, pad)); err != nil {
+			return 0, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+	if int64(buf.Len()) >= clusterSize {
+		return w.WriteAt(p, off)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.markModified(); err != nil {
+		return 0, err
+	}
+	if err := w.writeCompressedCluster(buf.Bytes(), off); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *WritableQcow2) compressionType() CompressionType {
+	if w.HeaderFieldsAdditional != nil {
+		return w.HeaderFieldsAdditional.CompressionType
+	}
+	return CompressionTypeZlib
+}
+
+// writeCompressedCluster writes compressed data for the cluster at the guest
+// offset off.
+func (w *WritableQcow2) writeCompressedCluster(data []byte, off int64) error {
+	clusterNo := off / int64(w.clusterSize)
+	l1Index := int(clusterNo / int64(w.l2Entries))
+	l2Index := int(clusterNo % int64(w.l2Entries))
+	l2Offset, err := w.l2TableForWrite(l1Index)
+	if err != nil {
+		return err
+	}
+	entryOffset, ent, err := w.readL2Entry(l2Offset, l2Index)
+	if err != nil {
+		return err
+	}
+
+	hostOffset, err := w.allocateCompressedBytes(uint64(len(data)))
+	if err != nil {
+		return err
+	}
+	// Like qemu, make the last sector complete, so the data is within the file.
+	// More compressed data may be written over the padding.
+	end := hostOffset + uint64(len(data))
+	if pad := (512 - end%512) % 512; pad > 0 {
+		data = append(data, make([]byte, pad)...)
+	}
+	if _, err := w.rw.WriteAt(data, int64(hostOffset)); err != nil {
+		return fmt.Errorf("failed to write compressed cluster at offset %d: %w", hostOffset, err)
+	}
+
+	clusterBits := int(w.ClusterBits)
+	x := compressedClusterDescriptor(0).x(clusterBits)
+	additionalSectors := (end-1)/512 - hostOffset/512
+	newEntry := l2TableEntry(1<<62 | additionalSectors<<x | hostOffset)
+	if err := w.writeL2Entry(entryOffset, newEntry, 0); err != nil {
+		return err
+	}
+	if !w.extendedL2() {
+		if l2Table, ok := w.l2TableCache.Get(w.l1Table[l1Index]); ok {
+			l2Table[l2Index] = newEntry
+		}
+	}
+	return w.releaseCluster(ent.L2TableEntry)
+}
+
+// allocateCompressedBytes allocates n bytes for compressed data, after the
+// previous compressed data if it fits in the same host cluster. Each host
+// cluster holding compressed data has a reference for each compressed cluster
+// stored in it.
+func (w *WritableQcow2) allocateCompressedBytes(n uint64) (uint64, error) {
+	clusterSize := uint64(w.clusterSize)
+	if off := w.compressedOffset; off != 0 && off%clusterSize != 0 && off%clusterSize+n <= clusterSize {
+		refcount, err := w.refcounts.get(off / clusterSize)
+		if err != nil {
+			return 0, err
+		}
+		// With small refcounts, a host cluster may not be shared.
+		if refcount < w.refcounts.max() {
+			if err := w.setRefcount(off/clusterSize, refcount+1); err != nil {
+				return 0, err
+			}
+			w.compressedOffset += n
+			return off, nil
+		}
+	}
+	off, err := w.allocateClusters((n + clusterSize - 1) / clusterSize)
+	if err != nil {
+		return 0, err
+	}
+	// Data ending in a partially used cluster may be followed by more data.
+	w.compressedOffset = off + n
+	return off, nil
+}
@@ -0,0 +1,310 @@
+package qcow2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+
+	"github.com/lima-vm/go-qcow2reader/image"
+)
+
+// Defaults for [CreateOptions], same as qemu-img.
+const (
+	DefaultClusterSize  = 65536
+	DefaultVersion      = 3
+	DefaultRefcountBits = 16
+)
+
+// Limits from qemu.
+const (
+	minClusterBits            = 9
+	maxClusterBits            = 21
+	minClusterBitsExtendedL2  = 14
+	maxL1TableSize            = 32 << 20
+	maxBackingFileNameSize    = 1023
+	headerLengthV3WithPadding = 112
+)
+
+var ErrInvalidCreateOptions = errors.New("invalid create options")
+
+// Preallocation is the preallocation mode for [Create].
+type Preallocation string
+
+const (
+	// PreallocationOff allocates only the header, the refcount structures and
+	// the L1 table.
+	PreallocationOff = Preallocation("off")
+	// PreallocationMetadata also allocates L2 tables and data clusters.
+	// Data clusters are not written, so the file is sparse on most file
+	// systems.
+	PreallocationMetadata = Preallocation("metadata")
+)
+
+// CreateOptions are options for [Create].
+type CreateOptions struct {
+	// Size is the virtual size in bytes, a multiple of 512.
+	Size uint64
+	// ClusterSize is a power of two between 512 bytes and 2 MiB.
+	// Defaults to [DefaultClusterSize].
+	ClusterSize int
+	// Version is 2 or 3. Defaults to [DefaultVersion].
+	Version uint32
+	// RefcountBits is the width of a refcount (1 << refcount order), a power
+	// of two up to 64. Defaults to [DefaultRefcountBits], which is the only
+	// width supported by version 2.
+	RefcountBits int
+	// ExtendedL2 enables subclusters. Requires version 3 and a cluster size
+	// of at least 16 KiB.
+	ExtendedL2 bool
+	// CompressionType is the compression type of compressed clusters.
+	// Types other than zlib require version 3.
+	CompressionType CompressionType
+	// BackingFile is the name of the backing file, relative to the image.
+	BackingFile string
+	// BackingFileFormat is the format of the backing file (e.g. "qcow2").
+	BackingFileFormat image.Type
+	// Preallocation defaults to [PreallocationOff].
+	Preallocation Preallocation
+}
+
+func (o *CreateOptions) setDefaults() error {
+	if o.ClusterSize == 0 {
+		o.ClusterSize = DefaultClusterSize
+	}
+	if o.Version == 0 {
+		o.Version = DefaultVersion
+	}
+	if o.RefcountBits == 0 {
+		o.RefcountBits = DefaultRefcountBits
+	}
+	if o.Preallocation == "" {
+		o.Preallocation = PreallocationOff
+	}
+	if o.ClusterSize < 1<<minClusterBits || o.ClusterSize > 1<<maxClusterBits || o.ClusterSize&(o.ClusterSize-1) != 0 {
+		return fmt.Errorf("%w: cluster size must be a power of two between %d and %d, got %d", ErrInvalidCreateOptions, 1<<minClusterBits, 1<<maxClusterBits, o.ClusterSize)
+	}
+	switch o.Version {
+	case 2:
+		if o.RefcountBits != 16 {
+			return fmt.Errorf("%w: version 2 images require 16-bit refcounts", ErrInvalidCreateOptions)
+		}
+		if o.ExtendedL2 {
+			return fmt.Errorf("%w: version 2 images do not support %q", ErrInvalidCreateOptions, IncompatibleFeaturesNames[IncompatibleFeaturesExtendedL2EntriesBit])
+		}
+		if o.CompressionType != CompressionTypeZlib {
+			return fmt.Errorf("%w: version 2 images do not support compression type %q", ErrInvalidCreateOptions, o.CompressionType)
+		}
+	case 3:
+	default:
+		return fmt.Errorf("%w: unsupported version %d", ErrInvalidCreateOptions, o.Version)
+	}
+	if o.Size%512 != 0 {
+		return fmt.Errorf("%w: size must be a multiple of 512 bytes, got %d", ErrInvalidCreateOptions, o.Size)
+	}
+	if o.RefcountBits < 0 || o.RefcountBits > 64 || o.RefcountBits&(o.RefcountBits-1) != 0 {
+		return fmt.Errorf("%w: refcount bits must be a power of two up to 64, got %d", ErrInvalidCreateOptions, o.RefcountBits)
+	}
+	if o.ExtendedL2 && o.ClusterSize < 1<<minClusterBitsExtendedL2 {
+		return fmt.Errorf("%w: %q require a cluster size of at least %d", ErrInvalidCreateOptions, IncompatibleFeaturesNames[IncompatibleFeaturesExtendedL2EntriesBit], 1<<minClusterBitsExtendedL2)
+	}
+	switch o.CompressionType {
+	case CompressionTypeZlib, CompressionTypeZstd:
+	default:
+		return fmt.Errorf("%w (%q)", ErrUnsupportedCompression, o.CompressionType)
+	}
+	if len(o.BackingFile) > maxBackingFileNameSize {
+		return fmt.Errorf("%w: backing file name too long (%d bytes)", ErrInvalidCreateOptions, len(o.BackingFile))
+	}
+	if o.BackingFile == "" && o.BackingFileFormat != "" {
+		return fmt.Errorf("%w: backing file format requires a backing file", ErrInvalidCreateOptions)
+	}
+	switch o.Preallocation {
+	case PreallocationOff, PreallocationMetadata:
+	default:
+		return fmt.Errorf("%w: unsupported preallocation mode %q", ErrInvalidCreateOptions, o.Preallocation)
+	}
+	return nil
+}
+
+// Create writes a new qcow2 image to w, which should be empty.
+//
+// The image starts with the header cluster, followed by the refcount table,
+// the refcount blocks, the L1 table and, with [PreallocationMetadata], the L2
+// tables and the data clusters.
+func Create(w io.WriterAt, opts CreateOptions) error {
+	if err := opts.setDefaults(); err != nil {
+		return err
+	}
+	clusterSize := uint64(opts.ClusterSize)
+	clusterBits := uint32(bits.TrailingZeros64(clusterSize))
+	l2EntrySize := uint64(8)
+	if opts.ExtendedL2 {
+		l2EntrySize = 16
+	}
+	l2Entries := clusterSize / l2EntrySize
+	dataClusters := (opts.Size + clusterSize - 1) / clusterSize
+	// Readers reject an empty L1 table, even for an empty image.
+	l1Size := max(1, (dataClusters+l2Entries-1)/l2Entries)
+	if l1Size*8 > maxL1TableSize {
+		return fmt.Errorf("%w: image too large (%d bytes)", ErrInvalidCreateOptions, opts.Size)
+	}
+	l1Clusters := max(1, (l1Size*8+clusterSize-1)/clusterSize)
+	var l2Clusters uint64
+	if opts.Preallocation == PreallocationMetadata {
+		l2Clusters = l1Size
+	} else {
+		dataClusters = 0
+	}
+
+	// The refcount structures must also cover themselves.
+	perBlock := clusterSize * 8 / uint64(opts.RefcountBits)
+	others := 1 + l1Clusters + l2Clusters + dataClusters
+	var blocks, tableClusters uint64 = 1, 1
+	for {
+		total := others + tableClusters + blocks
+		newBlocks := (total + perBlock - 1) / perBlock
+		newTableClusters := (newBlocks*8 + clusterSize - 1) / clusterSize
+		if newBlocks == blocks && newTableClusters == tableClusters {
+			break
+		}
+		blocks, tableClusters = newBlocks, newTableClusters
+	}
+	if tableClusters*clusterSize > maxRefcountTableSize {
+		return fmt.Errorf("%w: refcount table too large (%d bytes)", ErrInvalidCreateOptions, tableClusters*clusterSize)
+	}
+	tableOffset := clusterSize
+	blocksOffset := tableOffset + tableClusters*clusterSize
+	l1Offset := blocksOffset + blocks*clusterSize
+	l2Offset := l1Offset + l1Clusters*clusterSize
+	dataOffset := l2Offset + l2Clusters*clusterSize
+	totalClusters := dataOffset/clusterSize + dataClusters
+
+	// Header
+	header, err := marshalHeader(&opts, clusterBits, l1Size, l1Offset, tableOffset, tableClusters)
+	if err != nil {
+		return err
+	}
+	if uint64(len(header)) > clusterSize {
+		return fmt.Errorf("%w: header too large (%d bytes)", ErrInvalidCreateOptions, len(header))
+	}
+
+	// Refcount table
+	table := make([]byte, tableClusters*clusterSize)
+	for i := uint64(0); i < blocks; i++ {
+		binary.BigEndian.PutUint64(table[i*8:], blocksOffset+i*clusterSize)
+	}
+	if _, err := w.WriteAt(table, int64(tableOffset)); err != nil {
+		return err
+	}
+
+	// Refcount blocks
+	block := make([]byte, clusterSize)
+	for i := uint64(0); i < blocks; i++ {
+		clear(block)
+		for j := uint64(0); j < perBlock && i*perBlock+j < totalClusters; j++ {
+			setRefcount(block, j, uint64(opts.RefcountBits), 1)
+		}
+		if _, err := w.WriteAt(block, int64(blocksOffset+i*clusterSize)); err != nil {
+			return err
+		}
+	}
+
+	// L1 and L2 tables
+	l1Table := make([]byte, l1Clusters*clusterSize)
+	if opts.Preallocation == PreallocationMetadata {
+		l2Table := make([]byte, clusterSize)
+		for i := uint64(0); i < l1Size; i++ {
+			binary.BigEndian.PutUint64(l1Table[i*8:], (l2Offset+i*clusterSize)|1<<63)
+			clear(l2Table)
+			for j := uint64(0); j < l2Entries && i*l2Entries+j < dataClusters; j++ {
+				hostOffset := dataOffset + (i*l2Entries+j)*clusterSize
+				binary.BigEndian.PutUint64(l2Table[j*l2EntrySize:], hostOffset|1<<63)
+				if opts.ExtendedL2 {
+					binary.BigEndian.PutUint32(l2Table[j*l2EntrySize+12:], 0xffffffff)
+				}
+			}
+			if _, err := w.WriteAt(l2Table, int64(l2Offset+i*clusterSize)); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := w.WriteAt(l1Table, int64(l1Offset)); err != nil {
+		return err
+	}
+
+	// Data clusters are not written, but must be readable.
+	if dataClusters > 0 {
+		end := int64(totalClusters * clusterSize)
+		if t, ok := w.(interface{ Truncate(int64) error }); ok {
+			if err := t.Truncate(end); err != nil {
+				return err
+			}
+		} else if _, err := w.WriteAt([]byte{0}, end-1); err != nil {
+			return err
+		}
+	}
+
+	// Write the header last, so a partially created image is not valid.
+	_, err = w.WriteAt(header, 0)
+	return err
+}
+
+func marshalHeader(opts *CreateOptions, clusterBits uint32, l1Size, l1Offset, tableOffset, tableClusters uint64) ([]byte, error) {
+	v2 := HeaderFieldsV2{
+		Version:               opts.Version,
+		ClusterBits:           clusterBits,
+		Size:                  opts.Size,
+		L1Size:                uint32(l1Size),
+		L1TableOffset:         l1Offset,
+		RefcountTableOffset:   tableOffset,
+		RefcountTableClusters: uint32(tableClusters),
+	}
+	copy(v2.Magic[:], Magic)
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, &v2); err != nil {
+		return nil, err
+	}
+	if opts.Version >= 3 {
+		v3 := HeaderFieldsV3{
+			RefcountOrder: uint32(bits.TrailingZeros(uint(opts.RefcountBits))),
+			HeaderLength:  headerLengthV3WithPadding,
+		}
+		if opts.ExtendedL2 {
+			v3.IncompatibleFeatures |= 1 << IncompatibleFeaturesExtendedL2EntriesBit
+		}
+		if opts.CompressionType != CompressionTypeZlib {
+			v3.IncompatibleFeatures |= 1 << IncompatibleFeaturesCompressionTypeBit
+		}
+		additional := HeaderFieldsAdditional{CompressionType: opts.CompressionType}
+		if err := binary.Write(&buf, binary.BigEndian, &v3); err != nil {
+			return nil, err
+		}
+		if err := binary.Write(&buf, binary.BigEndian, &additional); err != nil {
+			return nil, err
+		}
+	}
+
+	// Header extensions
+	writeExtension := func(typ HeaderExtensionType, data []byte) {
+		_ = binary.Write(&buf, binary.BigEndian, typ)
+		_ = binary.Write(&buf, binary.BigEndian, uint32(len(data)))
+		buf.Write(data)
+		buf.Write(make([]byte, (8-len(data)%8)%8))
+	}
+	if opts.BackingFileFormat != "" {
+		writeExtension(HeaderExtensionTypeBackingFileFormatNameString, []byte(opts.BackingFileFormat))
+	}
+	writeExtension(HeaderExtensionTypeEnd, nil)
+
+	// The backing file name follows the header extensions.
+	if opts.BackingFile != "" {
+		b := buf.Bytes()
+		binary.BigEndian.PutUint64(b[8:], uint64(buf.Len()))
+		binary.BigEndian.PutUint32(b[16:], uint32(len(opts.BackingFile)))
+		buf.WriteString(opts.BackingFile)
+	}
+	return buf.Bytes(), nil
+}
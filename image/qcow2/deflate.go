@@ -0,0 +1,460 @@
+package qcow2
+
+import (
+	"slices"
+	"sync"
+)
+
+// A raw deflate (RFC 1951) encoder with a small window, as needed by qemu.
+// [compress/flate] always refers up to 32 KiB back.
+
+const (
+	deflateMinMatch = 3
+	deflateMaxMatch = 258
+	// deflateMaxDistance is the largest distance of a match. Like zlib, the
+	// window size minus the lookahead.
+	deflateMaxDistance = zlibWindowSize - (deflateMaxMatch + deflateMinMatch + 1)
+	// Parameters of zlib level 6, the default of qemu.
+	deflateMaxChain  = 128
+	deflateNiceMatch = 128
+
+	deflateHashBits    = 15
+	deflateBlockTokens = 1 << 14
+	deflateEndOfBlock  = 256
+)
+
+var (
+	deflateLengthBase  = [29]uint16{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+	deflateLengthExtra = [29]uint8{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	deflateDistBase    = [30]uint16{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+	deflateDistExtra   = [30]uint8{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+	// Order of the code length code lengths in a dynamic block header.
+	deflateCodeLengthOrder = [19]uint8{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+
+	deflateLengthCode [deflateMaxMatch + 1]uint8    // length to index in deflateLengthBase
+	deflateDistCode   [deflateMaxDistance + 1]uint8 // distance to index in deflateDistBase
+
+	deflateFixedLitLengths  [288]uint8
+	deflateFixedDistLengths [30]uint8
+	deflateFixedLitCodes    []uint16
+	deflateFixedDistCodes   []uint16
+)
+
+func init() {
+	for i, base := range deflateLengthBase {
+		for l := int(base); l < int(base)+1<<deflateLengthExtra[i] && l <= deflateMaxMatch; l++ {
+			deflateLengthCode[l] = uint8(i)
+		}
+	}
+	for i, base := range deflateDistBase {
+		for d := int(base); d < int(base)+1<<deflateDistExtra[i] && d <= deflateMaxDistance; d++ {
+			deflateDistCode[d] = uint8(i)
+		}
+	}
+	for i := range deflateFixedLitLengths {
+		switch {
+		case i < 144:
+			deflateFixedLitLengths[i] = 8
+		case i < 256:
+			deflateFixedLitLengths[i] = 9
+		case i < 280:
+			deflateFixedLitLengths[i] = 7
+		default:
+			deflateFixedLitLengths[i] = 8
+		}
+	}
+	for i := range deflateFixedDistLengths {
+		deflateFixedDistLengths[i] = 5
+	}
+	deflateFixedLitCodes = huffmanCodes(deflateFixedLitLengths[:])
+	deflateFixedDistCodes = huffmanCodes(deflateFixedDistLengths[:])
+}
+
+// deflateToken is a literal byte, or a match of a length and a distance.
+type deflateToken struct {
+	length uint16 // 0 for a literal
+	value  uint16 // the literal, or the distance of the match
+}
+
+// deflater compresses data into a single raw deflate stream whose matches
+// refer at most [deflateMaxDistance] bytes back.
+type deflater struct {
+	// Position+1 of the last occurrence of each hash, or 0.
+	head [1 << deflateHashBits]int32
+	// Position+1 of the previous occurrence of the hash of a position, or 0,
+	// indexed by the position modulo the window size.
+	prev   [zlibWindowSize]int32
+	tokens []deflateToken
+	out    bitWriter
+}
+
+var deflaterPool = sync.Pool{
+	New: func() any { return new(deflater) },
+}
+
+func deflateHash(p []byte) uint32 {
+	return (uint32(p[0])<<16 | uint32(p[1])<<8 | uint32(p[2])) * 2654435761 >> (32 - deflateHashBits)
+}
+
+func (d *deflater) insert(data []byte, i int) {
+	h := deflateHash(data[i:])
+	d.prev[i%zlibWindowSize] = d.head[h]
+	d.head[h] = int32(i + 1)
+}
+
+// findMatch returns the longest match for the data at i, following the hash
+// chain. The length is 0 if there is no match.
+func (d *deflater) findMatch(data []byte, i int) (length, dist int) {
+	maxLen := min(deflateMaxMatch, len(data)-i)
+	if maxLen < deflateMinMatch {
+		return 0, 0
+	}
+	cand := d.head[deflateHash(data[i:])]
+	for chain := deflateMaxChain; cand > 0 && chain > 0; chain-- {
+		j := int(cand) - 1
+		if i-j > deflateMaxDistance {
+			break
+		}
+		if data[j+length] == data[i+length] {
+			n := 0
+			for n < maxLen && data[j+n] == data[i+n] {
+				n++
+			}
+			if n > length {
+				length, dist = n, i-j
+				if n >= min(maxLen, deflateNiceMatch) {
+					break
+				}
+			}
+		}
+		cand = d.prev[j%zlibWindowSize]
+	}
+	if length < deflateMinMatch {
+		return 0, 0
+	}
+	return length, dist
+}
+
+// compress returns data compressed as a single final block sequence.
+func (d *deflater) compress(data []byte) []byte {
+	clear(d.head[:])
+	d.tokens = d.tokens[:0]
+	d.out.reset()
+	for i := 0; i < len(data); {
+		length, dist := d.findMatch(data, i)
+		// Lazy matching: emit a literal if the next position has a longer
+		// match.
+		if length > 0 && length < deflateNiceMatch && i+1 < len(data) {
+			if i+deflateMinMatch <= len(data) {
+				d.insert(data, i)
+			}
+			if next, _ := d.findMatch(data, i+1); next > length {
+				d.emit(deflateToken{value: uint16(data[i])}, false)
+				i++
+				continue
+			}
+		} else if i+deflateMinMatch <= len(data) {
+			d.insert(data, i)
+		}
+		if length == 0 {
+			d.emit(deflateToken{value: uint16(data[i])}, false)
+			i++
+			continue
+		}
+		d.emit(deflateToken{length: uint16(length), value: uint16(dist)}, false)
+		for k := i + 1; k < i+length && k+deflateMinMatch <= len(data); k++ {
+			d.insert(data, k)
+		}
+		i += length
+	}
+	d.writeBlock(true)
+	d.out.flush()
+	return d.out.buf
+}
+
+func (d *deflater) emit(t deflateToken, final bool) {
+	d.tokens = append(d.tokens, t)
+	if len(d.tokens) == deflateBlockTokens {
+		d.writeBlock(final)
+	}
+}
+
+// writeBlock writes the tokens as a block with fixed or dynamic Huffman codes,
+// whichever is smaller.
+func (d *deflater) writeBlock(final bool) {
+	var litFreq [286]int
+	var distFreq [30]int
+	extraBits := 0
+	for _, t := range d.tokens {
+		if t.length == 0 {
+			litFreq[t.value]++
+			continue
+		}
+		lc, dc := deflateLengthCode[t.length], deflateDistCode[t.value]
+		litFreq[257+int(lc)]++
+		distFreq[dc]++
+		extraBits += int(deflateLengthExtra[lc]) + int(deflateDistExtra[dc])
+	}
+	litFreq[deflateEndOfBlock]++
+
+	litLengths := huffmanLengths(litFreq[:], 15)
+	distLengths := huffmanLengths(distFreq[:], 15)
+	nlit := 257
+	for i := len(litLengths) - 1; i >= 257; i-- {
+		if litLengths[i] != 0 {
+			nlit = i + 1
+			break
+		}
+	}
+	ndist := 1
+	for i := len(distLengths) - 1; i >= 1; i-- {
+		if distLengths[i] != 0 {
+			ndist = i + 1
+			break
+		}
+	}
+	codeLengths := rleCodeLengths(append(slices.Clone(litLengths[:nlit]), distLengths[:ndist]...))
+	var clFreq [19]int
+	for _, c := range codeLengths {
+		clFreq[c.symbol]++
+	}
+	clLengths := huffmanLengths(clFreq[:], 7)
+	nclen := 19
+	for nclen > 4 && clLengths[deflateCodeLengthOrder[nclen-1]] == 0 {
+		nclen--
+	}
+
+	dynamicBits := 5 + 5 + 4 + 3*nclen
+	for _, c := range codeLengths {
+		dynamicBits += int(clLengths[c.symbol]) + int(c.extraBits)
+	}
+	fixedBits := 0
+	for i, f := range litFreq {
+		dynamicBits += f * int(litLengths[i])
+		fixedBits += f * int(deflateFixedLitLengths[i])
+	}
+	for i, f := range distFreq {
+		dynamicBits += f * int(distLengths[i])
+		fixedBits += f * int(deflateFixedDistLengths[i])
+	}
+
+	w := &d.out
+	var finalBit uint32
+	if final {
+		finalBit = 1
+	}
+	w.write(finalBit, 1)
+	if fixedBits+extraBits <= dynamicBits+extraBits {
+		w.write(1, 2)
+		d.writeTokens(deflateFixedLitCodes, deflateFixedLitLengths[:], deflateFixedDistCodes, deflateFixedDistLengths[:])
+	} else {
+		w.write(2, 2)
+		w.write(uint32(nlit-257), 5)
+		w.write(uint32(ndist-1), 5)
+		w.write(uint32(nclen-4), 4)
+		for _, s := range deflateCodeLengthOrder[:nclen] {
+			w.write(uint32(clLengths[s]), 3)
+		}
+		clCodes := huffmanCodes(clLengths)
+		for _, c := range codeLengths {
+			w.write(uint32(clCodes[c.symbol]), uint(clLengths[c.symbol]))
+			w.write(uint32(c.extra), uint(c.extraBits))
+		}
+		d.writeTokens(huffmanCodes(litLengths), litLengths, huffmanCodes(distLengths), distLengths)
+	}
+	d.tokens = d.tokens[:0]
+}
+
+func (d *deflater) writeTokens(litCodes []uint16, litLengths []uint8, distCodes []uint16, distLengths []uint8) {
+	w := &d.out
+	for _, t := range d.tokens {
+		if t.length == 0 {
+			w.write(uint32(litCodes[t.value]), uint(litLengths[t.value]))
+			continue
+		}
+		lc, dc := deflateLengthCode[t.length], deflateDistCode[t.value]
+		w.write(uint32(litCodes[257+int(lc)]), uint(litLengths[257+int(lc)]))
+		w.write(uint32(t.length-deflateLengthBase[lc]), uint(deflateLengthExtra[lc]))
+		w.write(uint32(distCodes[dc]), uint(distLengths[dc]))
+		w.write(uint32(t.value-deflateDistBase[dc]), uint(deflateDistExtra[dc]))
+	}
+	w.write(uint32(litCodes[deflateEndOfBlock]), uint(litLengths[deflateEndOfBlock]))
+}
+
+// codeLength is a symbol of the code length alphabet, with its extra bits.
+type codeLength struct {
+	symbol    uint8
+	extra     uint8
+	extraBits uint8
+}
+
+// rleCodeLengths encodes code lengths with the repeat codes 16, 17 and 18.
+func rleCodeLengths(lengths []uint8) []codeLength {
+	var res []codeLength
+	for i := 0; i < len(lengths); {
+		l := lengths[i]
+		run := 1
+		for i+run < len(lengths) && lengths[i+run] == l {
+			run++
+		}
+		i += run
+		if l == 0 {
+			for run >= 11 {
+				n := min(run, 138)
+				res = append(res, codeLength{symbol: 18, extra: uint8(n - 11), extraBits: 7})
+				run -= n
+			}
+			if run >= 3 {
+				res = append(res, codeLength{symbol: 17, extra: uint8(run - 3), extraBits: 3})
+				run = 0
+			}
+		} else {
+			res = append(res, codeLength{symbol: l})
+			run--
+			for run >= 3 {
+				n := min(run, 6)
+				res = append(res, codeLength{symbol: 16, extra: uint8(n - 3), extraBits: 2})
+				run -= n
+			}
+		}
+		for ; run > 0; run-- {
+			res = append(res, codeLength{symbol: l})
+		}
+	}
+	return res
+}
+
+// huffmanLengths returns code lengths of at most maxBits bits for the symbol
+// frequencies. At least two symbols get a code, so that the code is complete.
+func huffmanLengths(freq []int, maxBits int) []uint8 {
+	f := slices.Clone(freq)
+	for i := 0; i < len(f) && countNonZero(f) < 2; i++ {
+		f[i] = max(f[i], 1)
+	}
+	lengths := make([]uint8, len(f))
+	for {
+		buildHuffman(f, lengths)
+		if int(slices.Max(lengths)) <= maxBits {
+			return lengths
+		}
+		// Flatten the distribution until the code fits.
+		for i := range f {
+			if f[i] > 0 {
+				f[i] = (f[i] + 1) / 2
+			}
+		}
+	}
+}
+
+func countNonZero(f []int) int {
+	n := 0
+	for _, x := range f {
+		if x > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// buildHuffman sets the lengths of a Huffman code for the frequencies, using
+// the two-queue method.
+func buildHuffman(freq []int, lengths []uint8) {
+	var leaves []int
+	for i, f := range freq {
+		lengths[i] = 0
+		if f > 0 {
+			leaves = append(leaves, i)
+		}
+	}
+	slices.SortStableFunc(leaves, func(a, b int) int { return freq[a] - freq[b] })
+	type node struct {
+		freq   int
+		parent int
+	}
+	nodes := make([]node, len(leaves), 2*len(leaves)-1)
+	for i, sym := range leaves {
+		nodes[i].freq = freq[sym]
+	}
+	nextLeaf, nextInternal := 0, len(leaves)
+	pop := func() int {
+		if nextLeaf < len(leaves) && (nextInternal == len(nodes) || nodes[nextLeaf].freq <= nodes[nextInternal].freq) {
+			nextLeaf++
+			return nextLeaf - 1
+		}
+		nextInternal++
+		return nextInternal - 1
+	}
+	for len(nodes) < cap(nodes) {
+		a, b := pop(), pop()
+		nodes = append(nodes, node{freq: nodes[a].freq + nodes[b].freq})
+		nodes[a].parent, nodes[b].parent = len(nodes)-1, len(nodes)-1
+	}
+	// Parents follow their children, so depths are computed from the root.
+	depth := make([]uint8, len(nodes))
+	for i := len(nodes) - 2; i >= 0; i-- {
+		depth[i] = depth[nodes[i].parent] + 1
+	}
+	for i, sym := range leaves {
+		lengths[sym] = depth[i]
+	}
+}
+
+// huffmanCodes returns the canonical codes for the code lengths, bit reversed
+// to be written least significant bit first.
+func huffmanCodes(lengths []uint8) []uint16 {
+	var count [16]int
+	for _, l := range lengths {
+		if l > 0 {
+			count[l]++
+		}
+	}
+	var next [16]int
+	code := 0
+	for bits := 1; bits < len(next); bits++ {
+		code = (code + count[bits-1]) << 1
+		next[bits] = code
+	}
+	codes := make([]uint16, len(lengths))
+	for i, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		c := next[l]
+		next[l]++
+		var rev uint16
+		for j := uint8(0); j < l; j++ {
+			rev = rev<<1 | uint16(c>>j&1)
+		}
+		codes[i] = rev
+	}
+	return codes
+}
+
+// bitWriter writes bits least significant bit first.
+type bitWriter struct {
+	buf   []byte
+	bits  uint64
+	nbits uint
+}
+
+func (w *bitWriter) reset() {
+	w.buf = w.buf[:0]
+	w.bits, w.nbits = 0, 0
+}
+
+func (w *bitWriter) write(v uint32, n uint) {
+	w.bits |= uint64(v) << w.nbits
+	w.nbits += n
+	for w.nbits >= 8 {
+		w.buf = append(w.buf, byte(w.bits))
+		w.bits >>= 8
+		w.nbits -= 8
+	}
+}
+
+func (w *bitWriter) flush() {
+	if w.nbits > 0 {
+		w.buf = append(w.buf, byte(w.bits))
+		w.bits, w.nbits = 0, 0
+	}
+}
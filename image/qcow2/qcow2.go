@@ -8,13 +8,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"os"
-	"path/filepath"
 
 	"github.com/lima-vm/go-qcow2reader/align"
 	"github.com/lima-vm/go-qcow2reader/image"
 	"github.com/lima-vm/go-qcow2reader/log"
 	"github.com/lima-vm/go-qcow2reader/lru"
+	"github.com/lima-vm/go-qcow2reader/luks"
 )
 
 const Type = "qcow2"
@@ -300,8 +299,10 @@ type OffsetLengthPair64 struct {
 
 var (
 	ErrNotQcow2               = fmt.Errorf("%w: image is not qcow2", image.ErrWrongType)
-	ErrUnsupportedBackingFile = errors.New("unsupported backing file")
+	ErrUnsupportedBackingFile = image.ErrUnsupportedBackingFile
+	ErrUnsupportedDataFile    = errors.New("unsupported external data file")
 	ErrUnsupportedEncryption  = errors.New("unsupported encryption method")
+	ErrKeyRequired            = errors.New("encrypted image requires a key")
 	ErrUnsupportedCompression = errors.New("unsupported compression type")
 	ErrUnsupportedFeature     = errors.New("unsupported feature")
 )
@@ -317,7 +318,10 @@ func (header *Header) Readable() error {
 	if header.ClusterBits < 9 {
 		return fmt.Errorf("expected cluster bits >= 9, got %d", header.ClusterBits)
 	}
-	if header.CryptMethod != CryptMethodNone {
+	switch header.CryptMethod {
+	case CryptMethodNone, CryptMethodAES, CryptMethodLUKS:
+		// NOP
+	default:
 		return fmt.Errorf("%w: %q", ErrUnsupportedEncryption, header.CryptMethod)
 	}
 	if v3 := header.HeaderFieldsV3; v3 != nil {
@@ -328,10 +332,8 @@ func (header *Header) Readable() error {
 					log.Warnf("unexpected incompatible feature bit: %q", IncompatibleFeaturesNames[i])
 				case IncompatibleFeaturesExtendedL2EntriesBit:
 					log.Warnf("Support for %q is experimental", IncompatibleFeaturesNames[i])
-				case IncompatibleFeaturesCompressionTypeBit:
+				case IncompatibleFeaturesCompressionTypeBit, IncompatibleFeaturesExternalDataFileBit:
 					// NOP
-				case IncompatibleFeaturesExternalDataFileBit:
-					return fmt.Errorf("%w: incompatible feature: %q", ErrUnsupportedFeature, IncompatibleFeaturesNames[i])
 				default:
 					return fmt.Errorf("%w: incompatible feature bit %d", ErrUnsupportedFeature, i)
 				}
@@ -423,7 +425,11 @@ loop:
 				}
 				ext.Data = &ptr
 			case HeaderExtensionTypeBitmapsExtension:
-				// NOP
+				var bitmaps BitmapsExtension
+				if err := binary.Read(bytes.NewReader(data), binary.BigEndian, &bitmaps); err != nil {
+					return res, err
+				}
+				ext.Data = &bitmaps
 			default:
 				ext.Data = data
 			}
@@ -450,7 +456,10 @@ func readL1Table(ra io.ReaderAt, offset uint64, entries uint32) ([]l1TableEntry,
 	if entries == 0 {
 		return nil, errors.New("invalid L1 table size: 0")
 	}
-	r := io.NewSectionReader(ra, int64(offset), int64(entries*8))
+	if entries > maxL1TableSize/8 {
+		return nil, fmt.Errorf("invalid L1 table size: %d (more than %d)", entries, maxL1TableSize/8)
+	}
+	r := io.NewSectionReader(ra, int64(offset), int64(entries)*8)
 	l1Table := make([]l1TableEntry, entries)
 	if err := binary.Read(r, binary.BigEndian, &l1Table); err != nil {
 		return nil, err
@@ -464,6 +473,11 @@ func (x l2TableEntry) clusterDescriptor() uint64 {
 	return uint64(x) & 0x3fffffffffffffff
 }
 
+// copied returns true if the refcount of the cluster is exactly one.
+func (x l2TableEntry) copied() bool {
+	return (x>>63)&0b1 == 0b1
+}
+
 func (x l2TableEntry) compressed() bool {
 	return (x>>62)&0b1 == 0b1
 }
@@ -540,23 +554,90 @@ type Qcow2 struct {
 	l1Table             []l1TableEntry
 	l2TableCache        *lru.Cache[l1TableEntry, []l2TableEntry]
 	decompressor        Decompressor
+	Encryption          *luks.Header `json:"encryption,omitempty"`
+	cipher              *luks.Cipher
+	cipherGuestOffset   bool       // derive IVs from guest offsets instead of host offsets
 	BackingFile         string     `json:"backing_file"`
 	BackingFileFullPath string     `json:"backing_file_full_path"`
 	BackingFileFormat   image.Type `json:"backing_file_format"`
 	backingImage        image.Image
+	DataFile            string `json:"data_file,omitempty"`
+	DataFileFullPath    string `json:"data_file_full_path,omitempty"`
+	// dataFile holds the guest clusters. It is ra unless the image has an
+	// external data file.
+	dataFile io.ReaderAt
+	// snapshotOf is set for images opened with [Qcow2.OpenSnapshot]. Such
+	// images do not own ra, dataFile and backingImage.
+	snapshotOf *Qcow2
 }
 
 // With the default cluster size (64 Kib) this uses 1 MiB and cover 8 GiB image.
 const maxL2Tables = 16
 
+// KeyProvider returns the passphrase for an encrypted image. name is the name
+// set with [WithName], the resolved name of a backing image, or the name of the
+// image file if it implements [Namer], otherwise an empty string.
+type KeyProvider func(name string) ([]byte, error)
+
+// Passphrase returns a [KeyProvider] that always returns passphrase.
+func Passphrase(passphrase []byte) KeyProvider {
+	return func(string) ([]byte, error) {
+		return passphrase, nil
+	}
+}
+
+type options struct {
+	keyProvider          KeyProvider
+	backingFileResolver  BackingFileResolver
+	maxBackingChainDepth int
+	requireBackingFormat bool
+	name                 string
+	openBackingFile      image.OpenBackingFile
+
+	// Set when opening backing images.
+	depth int      // number of images above this image
+	chain []string // resolved names of the images above this image
+}
+
+// Option is an option for [Open].
+type Option func(*options)
+
+// WithKeyProvider sets the [KeyProvider] used to unlock encrypted images.
+func WithKeyProvider(kp KeyProvider) Option {
+	return func(o *options) {
+		o.keyProvider = kp
+	}
+}
+
 // Open opens an qcow2 image.
 //
-// To open an image with backing files, ra must implement [Namer],
-// and openWithType must be non-nil.
-func Open(ra io.ReaderAt, openWithType image.OpenWithType) (*Qcow2, error) {
+// To open an image with backing files, ra must implement [Namer] or the name
+// must be set with [WithName], and openWithType or [WithBackingFileOpener]
+// must be set. Backing files
+// and external data files are opened with [os.Open] unless a resolver is set
+// with [WithBackingFileResolver], which ignores [Namer].
+//
+// To read an encrypted image, use [WithKeyProvider].
+func Open(ra io.ReaderAt, openWithType image.OpenWithType, opts ...Option) (*Qcow2, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	// Names from Namer are host paths, which may not be understood by a custom
+	// resolver.
+	if o.name == "" && o.backingFileResolver == nil {
+		if namer, ok := ra.(Namer); ok {
+			o.name = namer.Name()
+		}
+	}
+	return open(ra, openWithType, &o)
+}
+
+func open(ra io.ReaderAt, openWithType image.OpenWithType, o *options) (*Qcow2, error) {
 	img := &Qcow2{
 		ra:           ra,
 		l2TableCache: lru.New[l1TableEntry, []l2TableEntry](maxL2Tables),
+		dataFile:     ra,
 	}
 	r := io.NewSectionReader(ra, 0, -1)
 	var err error
@@ -574,6 +655,7 @@ func Open(ra io.ReaderAt, openWithType image.OpenWithType) (*Qcow2, error) {
 		if err != nil {
 			log.Warnf("Failed to read header extensions: %v", err)
 		}
+		var encryptionHeaderPtr *OffsetLengthPair64
 		for _, ext := range img.HeaderExtensions {
 			switch ext.Type {
 			case HeaderExtensionTypeBackingFileFormatNameString:
@@ -583,6 +665,42 @@ func Open(ra io.ReaderAt, openWithType image.OpenWithType) (*Qcow2, error) {
 					break
 				}
 				img.BackingFileFormat = image.Type(backingFileFormat)
+			case HeaderExtensionTypeFullDiskEncryptionHeaderPointer:
+				ptr, ok := ext.Data.(*OffsetLengthPair64)
+				if !ok {
+					log.Warnf("Unexpected header extension %v", ext)
+					break
+				}
+				encryptionHeaderPtr = ptr
+			case HeaderExtensionTypeExternalDataFileNameString:
+				dataFile, ok := ext.Data.(string)
+				if !ok {
+					log.Warnf("Unexpected header extension %v", ext)
+					break
+				}
+				img.DataFile = dataFile
+			}
+		}
+
+		// Load external data file
+		if img.externalDataFile() {
+			if err := img.loadDataFile(o); err != nil {
+				img.errUnreadable = err
+				return img, nil
+			}
+		}
+
+		// Load encryption
+		switch img.CryptMethod {
+		case CryptMethodAES:
+			if err := img.loadAES(ra, o.name, o.keyProvider); err != nil {
+				img.errUnreadable = err
+				return img, nil
+			}
+		case CryptMethodLUKS:
+			if err := img.loadLUKS(ra, o.name, encryptionHeaderPtr, o.keyProvider); err != nil {
+				img.errUnreadable = err
+				return img, nil
 			}
 		}
 
@@ -622,20 +740,8 @@ func Open(ra io.ReaderAt, openWithType image.OpenWithType) (*Qcow2, error) {
 				return img, nil
 			}
 			img.BackingFile = string(backingFileNameB)
-			img.BackingFileFullPath, err = resolveBackingFilePath(ra, img.BackingFile)
-			if err != nil {
-				img.errUnreadable = fmt.Errorf("%w: failed to resolve the path of %q: %v", ErrUnsupportedBackingFile, img.BackingFile, err)
-				return img, nil
-			}
-			backingFile, err := os.Open(img.BackingFileFullPath)
-			if err != nil {
-				img.errUnreadable = fmt.Errorf("%w (file %q): %v", ErrUnsupportedBackingFile, img.BackingFileFullPath, err)
-				return img, nil
-			}
-			img.backingImage, err = openWithType(backingFile, img.BackingFileFormat)
-			if err != nil {
-				img.errUnreadable = fmt.Errorf("%w (file %q, format %q): %v", ErrUnsupportedBackingFile, img.BackingFileFullPath, img.BackingFileFormat, err)
-				_ = img.backingImage.Close()
+			if err := img.loadBackingFile(o, openWithType); err != nil {
+				img.errUnreadable = err
 				return img, nil
 			}
 		}
@@ -648,25 +754,94 @@ type Namer interface {
 	Name() string
 }
 
-func resolveBackingFilePath(ra io.ReaderAt, s string) (string, error) {
-	if filepath.IsAbs(s) {
-		return s, nil
+// loadDataFile opens the external data file with the resolver of the backing
+// files, so that the data file is subject to the same policy.
+func (img *Qcow2) loadDataFile(o *options) error {
+	if img.DataFile == "" {
+		return fmt.Errorf("%w: missing %q header extension", ErrUnsupportedDataFile, HeaderExtensionTypeExternalDataFileNameString)
 	}
-	raAsNamer, ok := ra.(Namer)
-	if !ok {
-		return "", fmt.Errorf("file %T does not have Name() string", ra)
+	ra, resolved, err := o.fileResolver()(o.name, img.DataFile)
+	if err != nil {
+		return fmt.Errorf("%w: failed to open %q: %w", ErrUnsupportedDataFile, img.DataFile, err)
+	}
+	img.DataFileFullPath = resolved
+	img.dataFile = ra
+	return nil
+}
+
+func passphrase(ra io.ReaderAt, name string, method CryptMethod, keyProvider KeyProvider) ([]byte, error) {
+	if keyProvider == nil {
+		return nil, fmt.Errorf("%w: %q (%w)", ErrUnsupportedEncryption, method, ErrKeyRequired)
 	}
-	dir := filepath.Dir(raAsNamer.Name())
-	// s can be "../../..." (allowed by qemu)
-	joined := filepath.Join(dir, s)
-	return filepath.Abs(joined)
+	if namer, ok := ra.(Namer); ok && name == "" {
+		name = namer.Name()
+	}
+	p, err := keyProvider(name)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q (%w: %v)", ErrUnsupportedEncryption, method, ErrKeyRequired, err)
+	}
+	return p, nil
+}
+
+// loadAES loads the legacy AES encryption (AES-128-CBC with plain64 IVs
+// derived from the guest offset). The key is the passphrase truncated or
+// zero-padded to 16 bytes, as in qemu.
+func (img *Qcow2) loadAES(ra io.ReaderAt, name string, keyProvider KeyProvider) error {
+	p, err := passphrase(ra, name, img.CryptMethod, keyProvider)
+	if err != nil {
+		return err
+	}
+	key := make([]byte, 16)
+	copy(key, p)
+	img.cipher, err = luks.NewCipher("aes", "cbc-plain64", key, luks.SectorSize)
+	if err != nil {
+		return err
+	}
+	img.cipherGuestOffset = true
+	return nil
+}
+
+func (img *Qcow2) loadLUKS(ra io.ReaderAt, name string, ptr *OffsetLengthPair64, keyProvider KeyProvider) error {
+	if ptr == nil || ptr.Offset == 0 || ptr.Length == 0 {
+		return fmt.Errorf("%w: missing %q header extension", ErrUnsupportedEncryption, HeaderExtensionTypeFullDiskEncryptionHeaderPointer)
+	}
+	var err error
+	img.Encryption, err = luks.ReadHeader(io.NewSectionReader(ra, int64(ptr.Offset), int64(ptr.Length)))
+	if err != nil {
+		return fmt.Errorf("%w: failed to read LUKS header: %v", ErrUnsupportedEncryption, err)
+	}
+	p, err := passphrase(ra, name, img.CryptMethod, keyProvider)
+	if err != nil {
+		return err
+	}
+	img.cipher, err = img.Encryption.Unlock(p)
+	if err != nil {
+		return fmt.Errorf("failed to unlock LUKS header: %w", err)
+	}
+	if img.clusterSize < img.cipher.SectorSize() {
+		return fmt.Errorf("%w: encryption sector size %d exceeds cluster size %d", ErrUnsupportedEncryption, img.cipher.SectorSize(), img.clusterSize)
+	}
+	return nil
 }
 
 func (img *Qcow2) Close() error {
+	if img.snapshotOf != nil {
+		return nil
+	}
 	var err error
 	if img.backingImage != nil {
 		err = img.backingImage.Close()
 	}
+	if img.dataFile != img.ra {
+		if closer, ok := img.dataFile.(io.Closer); ok {
+			if err2 := closer.Close(); err2 != nil {
+				if err != nil {
+					log.Warn(err)
+				}
+				err = err2
+			}
+		}
+	}
 	if closer, ok := img.ra.(io.Closer); ok {
 		if err2 := closer.Close(); err2 != nil {
 			if err != nil {
@@ -690,6 +865,19 @@ func (img *Qcow2) Readable() error {
 	return img.errUnreadable
 }
 
+// externalDataFile returns true if guest clusters are stored in an external
+// data file.
+func (img *Qcow2) externalDataFile() bool {
+	return img.HeaderFieldsV3 != nil && img.IncompatibleFeatures&(1<<IncompatibleFeaturesExternalDataFileBit) != 0
+}
+
+// rawExternalDataFile returns true if the external data file is a valid raw
+// image, so guest offsets are equal to offsets in the data file regardless of
+// the L2 tables.
+func (img *Qcow2) rawExternalDataFile() bool {
+	return img.externalDataFile() && img.AutoclearFeatures&(1<<AutoclearFeaturesRawExternalBit) != 0
+}
+
 func (img *Qcow2) extendedL2() bool {
 	return img.HeaderFieldsV3 != nil && img.IncompatibleFeatures&(1<<IncompatibleFeaturesExtendedL2EntriesBit) != 0
 }
@@ -769,7 +957,11 @@ func (img *Qcow2) getClusterMeta(off int64, cm *clusterMeta) error {
 
 	desc := cm.L2Entry.clusterDescriptor()
 	if desc == 0 && !img.extendedL2() {
-		return nil
+		// Offset 0 is valid in external data files, where all clusters have the
+		// copied flag.
+		if !img.externalDataFile() || !cm.L2Entry.copied() {
+			return nil
+		}
 	}
 
 	cm.Allocated = true
@@ -787,6 +979,9 @@ func (img *Qcow2) getClusterMeta(off int64, cm *clusterMeta) error {
 
 // readAtAligned requires that off and off+len(p)-1 belong to the same cluster.
 func (img *Qcow2) readAtAligned(p []byte, off int64) (int, error) {
+	if img.rawExternalDataFile() {
+		return img.readAtAlignedRawExternal(p, off)
+	}
 	var cm clusterMeta
 	if err := img.getClusterMeta(off, &cm); err != nil {
 		return 0, err
@@ -822,6 +1017,21 @@ func (img *Qcow2) readAtAligned(p []byte, off int64) (int, error) {
 	return n, err
 }
 
+// readAtAlignedRawExternal reads from the raw external data file, ignoring the
+// L2 tables which may be stale.
+func (img *Qcow2) readAtAlignedRawExternal(p []byte, off int64) (int, error) {
+	n, err := img.readAtHost(p, off, off)
+	if errors.Is(err, io.EOF) {
+		// The data file may be shorter than the image.
+		readZeroN, readZeroErr := img.readZero(p[n:], off+int64(n))
+		return n + readZeroN, readZeroErr
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to read %d bytes from the raw external data file at offset %d: %w", len(p), off, err)
+	}
+	return n, err
+}
+
 func (img *Qcow2) readAtAlignedUnallocated(p []byte, off int64) (int, error) {
 	if img.backingImage == nil {
 		return img.readZero(p, off)
@@ -852,16 +1062,44 @@ func (img *Qcow2) readAtAlignedStandard(p []byte, off int64, desc standardCluste
 	}
 	hostClusterOffset := desc.hostClusterOffset()
 	rawOffset := int64(desc.hostClusterOffset()) + (off % int64(img.clusterSize))
-	if rawOffset == 0 {
+	if rawOffset == 0 && !img.externalDataFile() {
 		return 0, fmt.Errorf("invalid raw offset 0 for virtual offset %d (host cluster offset=%d)", off, hostClusterOffset)
 	}
-	n, err := img.ra.ReadAt(p, rawOffset)
+	n, err := img.readAtHost(p, rawOffset, off)
 	if err != nil {
 		err = fmt.Errorf("failed to read %d bytes from the raw offset %d: %w", len(p), rawOffset, err)
 	}
 	return n, err
 }
 
+// readAtHost reads data of a standard cluster at the host offset off in the
+// data file, decrypting it if the image is encrypted. guestOff is the virtual
+// offset of the data.
+func (img *Qcow2) readAtHost(p []byte, off, guestOff int64) (int, error) {
+	if img.cipher == nil {
+		return img.dataFile.ReadAt(p, off)
+	}
+	// The IV is derived from the host offset (LUKS) or the guest offset (AES),
+	// in units of encryption sectors. Both are aligned the same way within a
+	// cluster.
+	sectorSize := int64(img.cipher.SectorSize())
+	head := off % sectorSize
+	begin := off - head
+	end := (off + int64(len(p)) + sectorSize - 1) / sectorSize * sectorSize
+	buf := make([]byte, end-begin)
+	if _, err := img.dataFile.ReadAt(buf, begin); err != nil {
+		return 0, err
+	}
+	ivOff := begin
+	if img.cipherGuestOffset {
+		ivOff = guestOff - head
+	}
+	if err := img.cipher.Decrypt(buf, uint64(ivOff/sectorSize)); err != nil {
+		return 0, err
+	}
+	return copy(p, buf[head:]), nil
+}
+
 // readAtAlignedStandardExtendedL2 is experimental
 //
 // TODO: read multiple subclusters at once
@@ -895,7 +1133,7 @@ func (img *Qcow2) readAtAlignedStandardExtendedL2(p []byte, off int64, desc stan
 		)
 		if ((extL2Entry.AllocStatusBitmap >> i) & 0b1) == 0b1 {
 			currentRawOff := int64(hostClusterOffset) + (off % int64(img.clusterSize)) + int64(n)
-			currentN, err = img.ra.ReadAt(p[pIdxBegin:pIdxEnd], currentRawOff)
+			currentN, err = img.readAtHost(p[pIdxBegin:pIdxEnd], currentRawOff, currentOff)
 			if err != nil {
 				return n, fmt.Errorf("failed to read from the raw offset %d: %w", currentRawOff, err)
 			}
@@ -920,6 +1158,12 @@ func (img *Qcow2) readAtAlignedStandardExtendedL2(p []byte, off int64, desc stan
 }
 
 func (img *Qcow2) readAtAlignedCompressed(p []byte, off int64, desc compressedClusterDescriptor) (int, error) {
+	if img.cipher != nil {
+		return 0, fmt.Errorf("%w: compressed clusters in encrypted images", ErrUnsupportedEncryption)
+	}
+	if img.externalDataFile() {
+		return 0, fmt.Errorf("%w: compressed clusters in images with an external data file", ErrUnsupportedDataFile)
+	}
 	hostClusterOffset := desc.hostClusterOffset(int(img.ClusterBits))
 	if hostClusterOffset == 0 {
 		return 0, fmt.Errorf("invalid host cluster offset 0 for virtual offset %d", off)
@@ -937,7 +1181,8 @@ func (img *Qcow2) readAtAlignedCompressed(p []byte, off int64, desc compressedCl
 			return 0, err
 		}
 	}
-	return zr.Read(p)
+	// A single Read may return the data of a block only.
+	return io.ReadFull(zr, p)
 }
 
 func (img *Qcow2) readZero(p []byte, off int64) (int, error) {
@@ -972,6 +1217,10 @@ func readZero(p []byte, off int64, sz uint64) (int, error) {
 // clusterStatus returns an extent describing a single cluster. off must be aligned to
 // cluster size.
 func (img *Qcow2) clusterStatus(off int64) (image.Extent, error) {
+	if img.rawExternalDataFile() {
+		// The L2 tables may be stale; all clusters are read from the data file.
+		return image.Extent{Start: off, Length: int64(img.clusterSize), Allocated: true}, nil
+	}
 	var cm clusterMeta
 	if err := img.getClusterMeta(off, &cm); err != nil {
 		return image.Extent{}, err
@@ -995,6 +1244,11 @@ func (img *Qcow2) clusterStatus(off int64) (image.Extent, error) {
 		if err != nil {
 			return parent, err
 		}
+		// The backing image may report a smaller extent, e.g. a sparse raw
+		// image with a hole in the cluster. Such a cluster must be read.
+		if parent.Length < length {
+			parent.Allocated, parent.Zero = true, false
+		}
 		// The backing image may be a raw image not aligned to cluster size.
 		parent.Length = int64(img.clusterSize)
 		return parent, nil
@@ -0,0 +1,1777 @@
+package qcow2
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/lima-vm/go-qcow2reader/image"
+	"github.com/lima-vm/go-qcow2reader/image/raw"
+	"github.com/lima-vm/go-qcow2reader/luks"
+	"github.com/lima-vm/go-qcow2reader/test/imagetest"
+	"github.com/lima-vm/go-qcow2reader/test/qemuimg"
+	"github.com/lima-vm/go-qcow2reader/test/qemuio"
+)
+
+const testClusterBits = 12
+
+type testHeaderExtension struct {
+	Type HeaderExtensionType
+	Data []byte
+}
+
+// marshalTestHeader encodes a header with extensions. v3 is nil for version 2
+// images.
+func marshalTestHeader(t *testing.T, v2 HeaderFieldsV2, v3 *HeaderFieldsV3, exts ...testHeaderExtension) []byte {
+	var buf bytes.Buffer
+	copy(v2.Magic[:], Magic)
+	if err := binary.Write(&buf, binary.BigEndian, &v2); err != nil {
+		t.Fatal(err)
+	}
+	if v3 == nil {
+		return buf.Bytes()
+	}
+	v3.HeaderLength = 104
+	if err := binary.Write(&buf, binary.BigEndian, v3); err != nil {
+		t.Fatal(err)
+	}
+	for _, ext := range append(exts, testHeaderExtension{Type: HeaderExtensionTypeEnd}) {
+		if err := binary.Write(&buf, binary.BigEndian, ext.Type); err != nil {
+			t.Fatal(err)
+		}
+		if err := binary.Write(&buf, binary.BigEndian, uint32(len(ext.Data))); err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(ext.Data)
+		buf.Write(make([]byte, (8-len(ext.Data)%8)%8))
+	}
+	return buf.Bytes()
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// createTestImageAES creates a qcow2 v2 image encrypted with the legacy AES
+// method. Clusters for which allocated is false are left unallocated. Returns
+// the image and the expected guest data.
+func createTestImageAES(t *testing.T, passphrase string, allocated []bool) ([]byte, []byte) {
+	const clusterSize = 1 << testClusterBits
+	size := len(allocated) * clusterSize
+	header := HeaderFieldsV2{
+		Version:       2,
+		ClusterBits:   testClusterBits,
+		Size:          uint64(size),
+		CryptMethod:   CryptMethodAES,
+		L1Size:        1,
+		L1TableOffset: 1 * clusterSize,
+	}
+
+	const l2Offset = 2 * clusterSize
+	img := make([]byte, (3+len(allocated))*clusterSize)
+	copy(img, marshalTestHeader(t, header, nil))
+	binary.BigEndian.PutUint64(img[header.L1TableOffset:], l2Offset|1<<63)
+
+	key := make([]byte, 16)
+	copy(key, passphrase)
+	c, err := luks.NewCipher("aes", "cbc-plain64", key, luks.SectorSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, size)
+	for i, ok := range allocated {
+		if !ok {
+			continue
+		}
+		guest := data[i*clusterSize : (i+1)*clusterSize]
+		copy(guest, randomBytes(t, clusterSize))
+		// Allocate host clusters in reverse order, so host and guest offsets
+		// differ.
+		hostOffset := (3 + len(allocated) - 1 - i) * clusterSize
+		binary.BigEndian.PutUint64(img[l2Offset+8*i:], uint64(hostOffset)|1<<63)
+		host := img[hostOffset : hostOffset+clusterSize]
+		copy(host, guest)
+		if err := c.Encrypt(host, uint64(i*clusterSize/luks.SectorSize)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return img, data
+}
+
+func TestEncryptedAES(t *testing.T) {
+	const passphrase = "secret"
+	allocated := []bool{true, false, true, true}
+	raw, expected := createTestImageAES(t, passphrase, allocated)
+
+	t.Run("no key", func(t *testing.T) {
+		img, err := Open(bytes.NewReader(raw), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = img.Readable()
+		if !errors.Is(err, ErrUnsupportedEncryption) || !errors.Is(err, ErrKeyRequired) {
+			t.Fatalf("expected %v and %v, got %v", ErrUnsupportedEncryption, ErrKeyRequired, err)
+		}
+	})
+	t.Run("read", func(t *testing.T) {
+		img, err := Open(bytes.NewReader(raw), nil, WithKeyProvider(Passphrase([]byte(passphrase))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := img.Readable(); err != nil {
+			t.Fatal(err)
+		}
+		actual := make([]byte, img.Size())
+		if _, err := img.ReadAt(actual, 0); err != nil && !errors.Is(err, io.EOF) {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(expected, actual) {
+			t.Fatal("decrypted data does not match")
+		}
+		// Unaligned read crossing sector and cluster boundaries.
+		off := int64(3<<testClusterBits - 1000)
+		unaligned := make([]byte, 2000)
+		if _, err := img.ReadAt(unaligned, off); err != nil && !errors.Is(err, io.EOF) {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(expected[off:off+2000], unaligned) {
+			t.Fatal("decrypted unaligned data does not match")
+		}
+	})
+	t.Run("extent", func(t *testing.T) {
+		img, err := Open(bytes.NewReader(raw), nil, WithKeyProvider(Passphrase([]byte(passphrase))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := img.Extent(2<<testClusterBits, 2<<testClusterBits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := image.Extent{Start: 2 << testClusterBits, Length: 2 << testClusterBits, Allocated: true}
+		if actual != expected {
+			t.Fatalf("expected %+v, got %+v", expected, actual)
+		}
+	})
+}
+
+// TestEncryptedAESQemuImg reads legacy AES images created by qemu-img.
+func TestEncryptedAESQemuImg(t *testing.T) {
+	const (
+		size       = 4 << 20
+		passphrase = "secret"
+	)
+	dir := t.TempDir()
+	openEncrypted := func(t *testing.T, path string) *Qcow2 {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Close() })
+		img, err := Open(f, nil, WithKeyProvider(Passphrase([]byte(passphrase))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := img.Readable(); err != nil {
+			t.Fatal(err)
+		}
+		return img
+	}
+
+	t.Run("create", func(t *testing.T) {
+		path := filepath.Join(dir, "empty.qcow2")
+		if err := qemuimg.CreateEncrypted(path, size, "aes", passphrase); err != nil {
+			t.Fatal(err)
+		}
+		img := openEncrypted(t, path)
+		if img.Size() != size {
+			t.Fatalf("expected size %d, got %d", size, img.Size())
+		}
+		if !bytes.Equal(imagetest.ReadAll(t, img), make([]byte, size)) {
+			t.Fatal("expected zeros")
+		}
+	})
+	t.Run("convert", func(t *testing.T) {
+		expected := make([]byte, size)
+		copy(expected[1<<20:], randomBytes(t, 1<<20))
+		copy(expected[3<<20+1000:], randomBytes(t, 5000))
+		base := createTestFile(t, "base.raw", expected)
+		path := filepath.Join(dir, "data.qcow2")
+		if err := qemuimg.ConvertEncrypted(base.Name(), path, "aes", passphrase); err != nil {
+			t.Fatal(err)
+		}
+		img := openEncrypted(t, path)
+		if !bytes.Equal(imagetest.ReadAll(t, img), expected) {
+			t.Fatal("decrypted data does not match")
+		}
+	})
+}
+
+func TestExternalDataFile(t *testing.T) {
+	const (
+		clusterSize = 1 << testClusterBits
+		clusters    = 4
+		size        = clusters * clusterSize
+	)
+	for _, raw := range []bool{false, true} {
+		name := "mapped"
+		if raw {
+			name = "raw"
+		}
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			v3 := &HeaderFieldsV3{
+				IncompatibleFeatures: 1 << IncompatibleFeaturesExternalDataFileBit,
+				RefcountOrder:        4,
+			}
+			if raw {
+				v3.AutoclearFeatures = 1 << AutoclearFeaturesRawExternalBit
+			}
+			header := marshalTestHeader(t, HeaderFieldsV2{
+				Version:       3,
+				ClusterBits:   testClusterBits,
+				Size:          size,
+				L1Size:        1,
+				L1TableOffset: 1 * clusterSize,
+			}, v3, testHeaderExtension{
+				Type: HeaderExtensionTypeExternalDataFileNameString,
+				Data: []byte("data.raw"),
+			})
+			const l2Offset = 2 * clusterSize
+			meta := make([]byte, 3*clusterSize)
+			copy(meta, header)
+			binary.BigEndian.PutUint64(meta[1*clusterSize:], l2Offset|1<<63)
+
+			// The data file is a valid raw image. Only clusters 0 and 2 are mapped;
+			// in raw mode the L2 table is stale and cluster 3 must be read too.
+			data := randomBytes(t, size)
+			for _, i := range []int{0, 2} {
+				binary.BigEndian.PutUint64(meta[l2Offset+8*i:], uint64(i*clusterSize)|1<<63)
+			}
+			expected := bytes.Clone(data)
+			if !raw {
+				clear(expected[1*clusterSize : 2*clusterSize])
+				clear(expected[3*clusterSize : 4*clusterSize])
+			}
+			if err := os.WriteFile(filepath.Join(dir, "data.raw"), data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "image.qcow2"), meta, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.Open(filepath.Join(dir, "image.qcow2"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			img, err := Open(f, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer img.Close() //nolint:errcheck
+			if err := img.Readable(); err != nil {
+				t.Fatal(err)
+			}
+			if img.DataFileFullPath != filepath.Join(dir, "data.raw") {
+				t.Fatalf("unexpected data file path %q", img.DataFileFullPath)
+			}
+			actual := make([]byte, size)
+			if _, err := img.ReadAt(actual, 0); err != nil && !errors.Is(err, io.EOF) {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(expected, actual) {
+				t.Fatal("data does not match")
+			}
+			extent, err := img.Extent(0, size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectedLength := int64(clusterSize)
+			if raw {
+				expectedLength = size
+			}
+			if extent != (image.Extent{Start: 0, Length: expectedLength, Allocated: true}) {
+				t.Fatalf("unexpected extent %+v", extent)
+			}
+		})
+	}
+}
+
+func marshalTestSnapshot(t *testing.T, h snapshotHeader, extra []byte, id, name string) []byte {
+	var buf bytes.Buffer
+	h.ExtraDataSize = uint32(len(extra))
+	h.IDStrSize = uint16(len(id))
+	h.NameSize = uint16(len(name))
+	if err := binary.Write(&buf, binary.BigEndian, &h); err != nil {
+		t.Fatal(err)
+	}
+	buf.Write(extra)
+	buf.WriteString(id)
+	buf.WriteString(name)
+	buf.Write(make([]byte, (8-buf.Len()%8)%8))
+	return buf.Bytes()
+}
+
+func TestSnapshots(t *testing.T) {
+	const (
+		clusterSize  = 1 << testClusterBits
+		size         = 4 * clusterSize
+		snapshotSize = 2 * clusterSize
+		l1Offset     = 1 * clusterSize
+		l2Offset     = 2 * clusterSize
+		snapL1Offset = 3 * clusterSize
+		snapL2Offset = 4 * clusterSize
+		tableOffset  = 5 * clusterSize
+		dataOffset   = 6 * clusterSize
+		snapOffset   = 7 * clusterSize
+	)
+	raw := make([]byte, 8*clusterSize)
+	copy(raw, marshalTestHeader(t, HeaderFieldsV2{
+		Version:         3,
+		ClusterBits:     testClusterBits,
+		Size:            size,
+		L1Size:          1,
+		L1TableOffset:   l1Offset,
+		NbSnapshots:     2,
+		SnapshotsOffset: tableOffset,
+	}, &HeaderFieldsV3{RefcountOrder: 4}))
+
+	// The active image has data in cluster 1, the snapshot in cluster 0.
+	binary.BigEndian.PutUint64(raw[l1Offset:], l2Offset|1<<63)
+	binary.BigEndian.PutUint64(raw[l2Offset+8:], dataOffset|1<<63)
+	binary.BigEndian.PutUint64(raw[snapL1Offset:], snapL2Offset)
+	binary.BigEndian.PutUint64(raw[snapL2Offset:], snapOffset)
+	current := randomBytes(t, clusterSize)
+	copy(raw[dataOffset:], current)
+	snapshotted := randomBytes(t, clusterSize)
+	copy(raw[snapOffset:], snapshotted)
+
+	extra := make([]byte, 24)
+	binary.BigEndian.PutUint64(extra[0:], 1<<33) // vm_state_size_large
+	binary.BigEndian.PutUint64(extra[8:], snapshotSize)
+	table := marshalTestSnapshot(t, snapshotHeader{
+		L1TableOffset: snapL1Offset,
+		L1Size:        1,
+		DateSec:       1700000000,
+		DateNsec:      42,
+		VMClockNsec:   uint64(3 * time.Second),
+	}, extra, "1", "before-upgrade")
+	// Old snapshot without extra data and without L1 table.
+	table = append(table, marshalTestSnapshot(t, snapshotHeader{
+		DateSec:     1600000000,
+		VMStateSize: 1000,
+	}, nil, "2", "1")...)
+	copy(raw[tableOffset:], table)
+
+	img, err := Open(bytes.NewReader(raw), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshots, err := img.Snapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Snapshot{
+		{
+			ID:            "1",
+			Name:          "before-upgrade",
+			Date:          time.Unix(1700000000, 42),
+			VMClock:       3 * time.Second,
+			VMStateSize:   1 << 33,
+			DiskSize:      snapshotSize,
+			L1TableOffset: snapL1Offset,
+			L1Size:        1,
+		},
+		{
+			ID:          "2",
+			Name:        "1",
+			Date:        time.Unix(1600000000, 0),
+			VMStateSize: 1000,
+			DiskSize:    size,
+		},
+	}
+	if !reflect.DeepEqual(expected, snapshots) {
+		t.Fatalf("expected %+v, got %+v", expected, snapshots)
+	}
+
+	t.Run("by name", func(t *testing.T) {
+		snap, err := img.OpenSnapshot("before-upgrade")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if snap.Size() != snapshotSize {
+			t.Fatalf("expected size %d, got %d", snapshotSize, snap.Size())
+		}
+		actual := make([]byte, snapshotSize)
+		if _, err := snap.ReadAt(actual, 0); err != nil && !errors.Is(err, io.EOF) {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(snapshotted, actual[:clusterSize]) || !bytes.Equal(make([]byte, clusterSize), actual[clusterSize:]) {
+			t.Fatal("snapshot data does not match")
+		}
+		if err := snap.Close(); err != nil {
+			t.Fatal(err)
+		}
+		// The active image is not affected.
+		if _, err := img.ReadAt(actual, 0); err != nil && !errors.Is(err, io.EOF) {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(make([]byte, clusterSize), actual[:clusterSize]) || !bytes.Equal(current, actual[clusterSize:]) {
+			t.Fatal("image data does not match")
+		}
+	})
+	t.Run("id before name", func(t *testing.T) {
+		snap, err := img.OpenSnapshot("1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if snap.Size() != snapshotSize {
+			t.Fatalf("expected snapshot with ID 1, got size %d", snap.Size())
+		}
+	})
+	t.Run("empty", func(t *testing.T) {
+		snap, err := img.OpenSnapshot("2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		extent, err := snap.Extent(0, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if extent != (image.Extent{Start: 0, Length: size, Zero: true}) {
+			t.Fatalf("unexpected extent %+v", extent)
+		}
+	})
+	t.Run("not found", func(t *testing.T) {
+		if _, err := img.OpenSnapshot("3"); !errors.Is(err, ErrSnapshotNotFound) {
+			t.Fatalf("expected %v, got %v", ErrSnapshotNotFound, err)
+		}
+	})
+	t.Run("huge disk size", func(t *testing.T) {
+		// The disk size of the snapshot needs more than 32 MiB of L1 table.
+		huge := bytes.Clone(raw)
+		binary.BigEndian.PutUint64(huge[tableOffset+snapshotHeaderLength+8:], 1<<62)
+		img, err := Open(bytes.NewReader(huge), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := img.OpenSnapshot("before-upgrade"); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+}
+
+// TestSnapshotsQemuImg reads internal snapshots created by qemu-img.
+func TestSnapshotsQemuImg(t *testing.T) {
+	const size = 4 << 20
+	path := filepath.Join(t.TempDir(), "image.qcow2")
+	if err := qemuimg.Create(path, qemuimg.FormatQcow2, size, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := qemuio.Write(path, qemuimg.FormatQcow2, 0, 2<<20, 0x11); err != nil {
+		t.Fatal(err)
+	}
+	if err := qemuimg.Snapshot(path, "before"); err != nil {
+		t.Fatal(err)
+	}
+	if err := qemuio.Write(path, qemuimg.FormatQcow2, 1<<20, 2<<20, 0x22); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close() //nolint:errcheck
+	img, err := Open(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Readable(); err != nil {
+		t.Fatal(err)
+	}
+	snapshots, err := img.Snapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 1 || snapshots[0].Name != "before" || snapshots[0].DiskSize != size {
+		t.Fatalf("unexpected snapshots %+v", snapshots)
+	}
+	snap, err := img.OpenSnapshot("before")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make([]byte, size)
+	copy(expected, bytes.Repeat([]byte{0x11}, 2<<20))
+	if !bytes.Equal(imagetest.ReadAll(t, snap), expected) {
+		t.Fatal("snapshot data does not match")
+	}
+	copy(expected[1<<20:], bytes.Repeat([]byte{0x22}, 2<<20))
+	if !bytes.Equal(imagetest.ReadAll(t, img), expected) {
+		t.Fatal("image data does not match")
+	}
+}
+
+func marshalTestBitmap(t *testing.T, e bitmapDirectoryEntry, name string) []byte {
+	var buf bytes.Buffer
+	e.Type = bitmapTypeDirtyTrack
+	e.NameSize = uint16(len(name))
+	if err := binary.Write(&buf, binary.BigEndian, &e); err != nil {
+		t.Fatal(err)
+	}
+	buf.WriteString(name)
+	buf.Write(make([]byte, (8-buf.Len()%8)%8))
+	return buf.Bytes()
+}
+
+func TestBitmaps(t *testing.T) {
+	const (
+		clusterSize     = 1 << testClusterBits
+		granularityBits = 16
+		size            = 16<<granularityBits - 4096
+		l1Offset        = 1 * clusterSize
+		dirOffset       = 2 * clusterSize
+		tableOffset     = 3 * clusterSize
+		dataOffset      = 4 * clusterSize
+	)
+	dir := marshalTestBitmap(t, bitmapDirectoryEntry{
+		BitmapTableOffset: tableOffset,
+		BitmapTableSize:   1,
+		Flags:             1 << BitmapFlagsAutoBit,
+		GranularityBits:   granularityBits,
+	}, "daily")
+	dir = append(dir, marshalTestBitmap(t, bitmapDirectoryEntry{
+		BitmapTableOffset: tableOffset + 8,
+		BitmapTableSize:   1,
+		GranularityBits:   granularityBits,
+	}, "full")...)
+	dir = append(dir, marshalTestBitmap(t, bitmapDirectoryEntry{
+		BitmapTableOffset: tableOffset + 16,
+		BitmapTableSize:   1,
+		Flags:             1<<BitmapFlagsInUseBit | 1<<BitmapFlagsAutoBit,
+		GranularityBits:   granularityBits,
+	}, "stale")...)
+	ext := make([]byte, 24)
+	binary.BigEndian.PutUint32(ext[0:], 3)
+	binary.BigEndian.PutUint64(ext[8:], uint64(len(dir)))
+	binary.BigEndian.PutUint64(ext[16:], dirOffset)
+
+	createImage := func(autoclear AutoclearFeatures) []byte {
+		raw := make([]byte, 5*clusterSize)
+		copy(raw, marshalTestHeader(t, HeaderFieldsV2{
+			Version:       3,
+			ClusterBits:   testClusterBits,
+			Size:          size,
+			L1Size:        1,
+			L1TableOffset: l1Offset,
+		}, &HeaderFieldsV3{RefcountOrder: 4, AutoclearFeatures: autoclear},
+			testHeaderExtension{Type: HeaderExtensionTypeBitmapsExtension, Data: ext}))
+		copy(raw[dirOffset:], dir)
+		binary.BigEndian.PutUint64(raw[tableOffset:], dataOffset)
+		binary.BigEndian.PutUint64(raw[tableOffset+8:], bitmapTableAllOnes)
+		// Bits 0, 1, 5 and 15 are set. The last chunk is partial.
+		raw[dataOffset] = 0b00100011
+		raw[dataOffset+1] = 0b10000000
+		return raw
+	}
+
+	img, err := Open(bytes.NewReader(createImage(1<<AutoclearFeaturesBitmapsExtensionBit)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bitmaps, err := img.Bitmaps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bitmaps) != 3 {
+		t.Fatalf("expected 3 bitmaps, got %+v", bitmaps)
+	}
+	if b := bitmaps[0]; b.Name != "daily" || b.Granularity != 1<<granularityBits || !b.Auto() || b.InUse() {
+		t.Fatalf("unexpected bitmap %+v", b)
+	}
+	if b := bitmaps[2]; b.Name != "stale" || !b.InUse() {
+		t.Fatalf("unexpected bitmap %+v", b)
+	}
+
+	dirtyRanges := func(name string) ([]DirtyRange, error) {
+		var res []DirtyRange
+		for r, err := range img.DirtyRanges(name) {
+			if err != nil {
+				return res, err
+			}
+			res = append(res, r)
+		}
+		return res, nil
+	}
+	for _, tc := range []struct {
+		name     string
+		expected []DirtyRange
+		err      error
+	}{
+		{
+			name: "daily",
+			expected: []DirtyRange{
+				{Start: 0, Length: 2 << granularityBits},
+				{Start: 5 << granularityBits, Length: 1 << granularityBits},
+				{Start: 15 << granularityBits, Length: size - 15<<granularityBits},
+			},
+		},
+		{name: "full", expected: []DirtyRange{{Start: 0, Length: size}}},
+		{name: "stale", err: ErrInconsistentBitmap},
+		{name: "missing", err: ErrBitmapNotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := dirtyRanges(tc.name)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected error %v, got %v", tc.err, err)
+			}
+			if !reflect.DeepEqual(tc.expected, actual) {
+				t.Fatalf("expected %+v, got %+v", tc.expected, actual)
+			}
+		})
+	}
+
+	t.Run("invalid table", func(t *testing.T) {
+		// The directory entry of "full" follows the entry of "daily".
+		const fullEntry = dirOffset + 32
+		for name, modify := range map[string]func(raw []byte){
+			"too large":   func(raw []byte) { binary.BigEndian.PutUint32(raw[fullEntry+8:], maxBitmapTableSize+1) },
+			"beyond file": func(raw []byte) { binary.BigEndian.PutUint64(raw[fullEntry:], 1<<40) },
+		} {
+			t.Run(name, func(t *testing.T) {
+				raw := createImage(1 << AutoclearFeaturesBitmapsExtensionBit)
+				modify(raw)
+				img, err := Open(bytes.NewReader(raw), nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, err := range img.DirtyRanges("full") {
+					if err == nil {
+						t.Fatal("expected an error")
+					}
+				}
+			})
+		}
+	})
+
+	t.Run("autoclear not set", func(t *testing.T) {
+		img, err := Open(bytes.NewReader(createImage(0)), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := img.Bitmaps(); !errors.Is(err, ErrInconsistentBitmap) {
+			t.Fatalf("expected %v, got %v", ErrInconsistentBitmap, err)
+		}
+	})
+}
+
+// TestBitmapsQemuImg reads a dirty bitmap added by qemu-img and updated by
+// qemu-io.
+func TestBitmapsQemuImg(t *testing.T) {
+	const (
+		size        = 4 << 20
+		granularity = 64 << 10 // default of qemu
+	)
+	path := filepath.Join(t.TempDir(), "image.qcow2")
+	if err := qemuimg.Create(path, qemuimg.FormatQcow2, size, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	// Not tracked by the bitmap.
+	if err := qemuio.Write(path, qemuimg.FormatQcow2, 0, 1<<20, 0x11); err != nil {
+		t.Fatal(err)
+	}
+	if err := qemuimg.AddBitmap(path, "backup"); err != nil {
+		t.Fatal(err)
+	}
+	if err := qemuio.Write(path, qemuimg.FormatQcow2, 2<<20+1000, 5000, 0x22); err != nil {
+		t.Fatal(err)
+	}
+	if err := qemuio.Write(path, qemuimg.FormatQcow2, 3<<20, 2*granularity, 0x33); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close() //nolint:errcheck
+	img, err := Open(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bitmaps, err := img.Bitmaps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bitmaps) != 1 || bitmaps[0].Name != "backup" || bitmaps[0].Granularity != granularity || bitmaps[0].InUse() {
+		t.Fatalf("unexpected bitmaps %+v", bitmaps)
+	}
+	var actual []DirtyRange
+	for r, err := range img.DirtyRanges("backup") {
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual = append(actual, r)
+	}
+	expected := []DirtyRange{
+		{Start: 2 << 20, Length: granularity},
+		{Start: 3 << 20, Length: 2 * granularity},
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected %+v, got %+v", expected, actual)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	const (
+		clusterSize    = 1 << testClusterBits
+		size           = 4 * clusterSize
+		refTableOffset = 1 * clusterSize
+		refBlockOffset = 2 * clusterSize
+		l1Offset       = 3 * clusterSize
+		l2Offset       = 4 * clusterSize
+		dataOffset     = 5 * clusterSize
+		compOffset     = 6 * clusterSize
+		fileClusters   = 8
+	)
+	// createImage creates a consistent image with one standard and one
+	// compressed cluster, and calls modify before returning it.
+	createImage := func(modify func(raw []byte)) []byte {
+		raw := make([]byte, fileClusters*clusterSize)
+		copy(raw, marshalTestHeader(t, HeaderFieldsV2{
+			Version:               3,
+			ClusterBits:           testClusterBits,
+			Size:                  size,
+			L1Size:                1,
+			L1TableOffset:         l1Offset,
+			RefcountTableOffset:   refTableOffset,
+			RefcountTableClusters: 1,
+		}, &HeaderFieldsV3{RefcountOrder: 4}))
+		binary.BigEndian.PutUint64(raw[refTableOffset:], refBlockOffset)
+		for i := 0; i < 7; i++ {
+			binary.BigEndian.PutUint16(raw[refBlockOffset+i*2:], 1)
+		}
+		binary.BigEndian.PutUint64(raw[l1Offset:], l2Offset|1<<63)
+		binary.BigEndian.PutUint64(raw[l2Offset:], dataOffset|1<<63)
+		// Compressed cluster at 100 bytes into compOffset, spanning 2 sectors.
+		x := 62 - (testClusterBits - 8)
+		binary.BigEndian.PutUint64(raw[l2Offset+8:], 1<<62|1<<x|(compOffset+100))
+		if modify != nil {
+			modify(raw)
+		}
+		return raw
+	}
+	check := func(t *testing.T, raw []byte) *CheckResult {
+		img, err := Open(bytes.NewReader(raw), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := img.Check()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	hasProblem := func(res *CheckResult, typ CheckProblemType, substr string) bool {
+		for _, p := range res.Problems {
+			if p.Type == typ && strings.Contains(p.Message, substr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	t.Run("clean", func(t *testing.T) {
+		res := check(t, createImage(nil))
+		expected := &CheckResult{
+			ImageEndOffset:     7 * clusterSize,
+			TotalClusters:      4,
+			AllocatedClusters:  2,
+			FragmentedClusters: 2,
+			CompressedClusters: 1,
+		}
+		if !reflect.DeepEqual(expected, res) {
+			t.Fatalf("expected %+v, got %+v", expected, res)
+		}
+		if !res.IsClean() {
+			t.Fatal("expected a clean image")
+		}
+	})
+	t.Run("leak", func(t *testing.T) {
+		res := check(t, createImage(func(raw []byte) {
+			binary.BigEndian.PutUint16(raw[refBlockOffset+7*2:], 1)
+		}))
+		if res.Leaks != 1 || res.Corruptions != 0 || !hasProblem(res, CheckProblemTypeLeak, "cluster 7") {
+			t.Fatalf("unexpected result %+v", res)
+		}
+		if res.ImageEndOffset != 8*clusterSize {
+			t.Fatalf("expected image end offset %d, got %d", 8*clusterSize, res.ImageEndOffset)
+		}
+	})
+	t.Run("refcount mismatch", func(t *testing.T) {
+		res := check(t, createImage(func(raw []byte) {
+			binary.BigEndian.PutUint16(raw[refBlockOffset+5*2:], 0)
+		}))
+		if res.Corruptions != 2 || !hasProblem(res, CheckProblemTypeCorruption, "refcount=0 but 1 references") ||
+			!hasProblem(res, CheckProblemTypeCorruption, "copied flag") {
+			t.Fatalf("unexpected result %+v", res)
+		}
+	})
+	t.Run("overlap", func(t *testing.T) {
+		res := check(t, createImage(func(raw []byte) {
+			binary.BigEndian.PutUint64(raw[l2Offset:], l1Offset|1<<63)
+		}))
+		if !hasProblem(res, CheckProblemTypeCorruption, "data cluster at offset 12288 overlaps with L1 table") {
+			t.Fatalf("unexpected result %+v", res)
+		}
+	})
+	t.Run("out of bounds", func(t *testing.T) {
+		res := check(t, createImage(func(raw []byte) {
+			binary.BigEndian.PutUint64(raw[l2Offset+16:], 100*clusterSize|1<<63)
+		}))
+		if !hasProblem(res, CheckProblemTypeCorruption, "beyond the end of the file") {
+			t.Fatalf("unexpected result %+v", res)
+		}
+	})
+	t.Run("compressed with copied flag", func(t *testing.T) {
+		res := check(t, createImage(func(raw []byte) {
+			raw[l2Offset+8] |= 0x80
+		}))
+		if res.Corruptions != 1 || !hasProblem(res, CheckProblemTypeCorruption, "compressed cluster has the copied flag set") {
+			t.Fatalf("unexpected result %+v", res)
+		}
+	})
+	t.Run("dirty", func(t *testing.T) {
+		res := check(t, createImage(func(raw []byte) {
+			raw[79] |= 1 << IncompatibleFeaturesDirtyBit
+		}))
+		if !res.Dirty || res.Corrupt || !res.IsClean() {
+			t.Fatalf("unexpected result %+v", res)
+		}
+	})
+}
+
+// createTestImage creates an empty image with a refcount table in cluster 1,
+// a refcount block in cluster 2 and the L1 table from cluster 3. v3 is nil
+// for version 2 images.
+func createTestImage(t *testing.T, clusterBits uint32, size uint64, v3 *HeaderFieldsV3, backingFile string) []byte {
+	clusterSize := uint64(1) << clusterBits
+	l2Entries := clusterSize / 8
+	l1Size := (size + clusterSize*l2Entries - 1) / (clusterSize * l2Entries)
+	l1Clusters := (l1Size*8 + clusterSize - 1) / clusterSize
+	v2 := HeaderFieldsV2{
+		Version:               2,
+		ClusterBits:           clusterBits,
+		Size:                  size,
+		L1Size:                uint32(l1Size),
+		L1TableOffset:         3 * clusterSize,
+		RefcountTableOffset:   1 * clusterSize,
+		RefcountTableClusters: 1,
+	}
+	refcountBits := uint64(16)
+	if v3 != nil {
+		v2.Version = 3
+		refcountBits = 1 << v3.RefcountOrder
+	}
+	if backingFile != "" {
+		v2.BackingFileOffset = 256
+		v2.BackingFileSize = uint32(len(backingFile))
+	}
+	raw := make([]byte, (3+l1Clusters)*clusterSize)
+	copy(raw, marshalTestHeader(t, v2, v3))
+	copy(raw[256:], backingFile)
+	binary.BigEndian.PutUint64(raw[clusterSize:], 2*clusterSize)
+	block := raw[2*clusterSize : 3*clusterSize]
+	for i := uint64(0); i < 3+l1Clusters; i++ {
+		setRefcount(block, i, refcountBits, 1)
+	}
+	return raw
+}
+
+func createTestFile(t *testing.T, name string, data []byte) *os.File {
+	f, err := os.Create(filepath.Join(t.TempDir(), name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// reopenTestFile opens the file again after closing an image.
+func reopenTestFile(t *testing.T, f *os.File) *os.File {
+	f, err := os.OpenFile(f.Name(), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func checkClean(t *testing.T, ra io.ReaderAt) {
+	img, err := Open(ra, openRaw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := img.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.IsClean() || res.Dirty {
+		t.Fatalf("expected a clean image, got %+v", res)
+	}
+}
+
+func openRaw(ra io.ReaderAt, _ image.Type) (image.Image, error) {
+	return &raw.Raw{ReaderAt: ra}, nil
+}
+
+func TestWritable(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		clusterBits uint32
+		size        uint64
+		v3          *HeaderFieldsV3
+	}{
+		{name: "v2", clusterBits: 12, size: 1 << 20},
+		{name: "v3", clusterBits: 12, size: 1<<20 + 1000, v3: &HeaderFieldsV3{RefcountOrder: 4}},
+		{name: "refcount order 1", clusterBits: 12, size: 1 << 20, v3: &HeaderFieldsV3{RefcountOrder: 1}},
+		{name: "lazy refcounts", clusterBits: 12, size: 1 << 20, v3: &HeaderFieldsV3{
+			RefcountOrder:      4,
+			CompatibleFeatures: 1 << CompatibleFeaturesLazyRefcountsBit,
+		}},
+		// Each refcount block covers 64 clusters and the refcount table
+		// covers 2 MiB, so writing 4 MiB grows the refcount table.
+		{name: "grow refcount table", clusterBits: 9, size: 4 << 20, v3: &HeaderFieldsV3{RefcountOrder: 6}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := createTestFile(t, "disk.qcow2", createTestImage(t, tc.clusterBits, tc.size, tc.v3, ""))
+			w, err := OpenWritable(f, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := make([]byte, tc.size)
+			write := func(off int64, n int) {
+				p := randomBytes(t, n)
+				if _, err := w.WriteAt(p, off); err != nil {
+					t.Fatal(err)
+				}
+				copy(expected[off:], p)
+			}
+			write(0, 100)
+			write(5000, 10000)
+			write(int64(tc.size)-3000, 3000)
+			write(5100, 10)
+			if tc.clusterBits == 9 {
+				write(0, int(tc.size))
+			}
+			if _, err := w.WriteAt(make([]byte, 2), int64(tc.size)-1); err == nil {
+				t.Fatal("expected an error writing beyond the end of the image")
+			}
+			if !bytes.Equal(expected, imagetest.ReadAll(t, w)) {
+				t.Fatal("data does not match before closing")
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			// Closing again does nothing.
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			f = reopenTestFile(t, f)
+			img, err := Open(f, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(expected, imagetest.ReadAll(t, img)) {
+				t.Fatal("data does not match after closing")
+			}
+			checkClean(t, f)
+		})
+	}
+}
+
+func TestWritableBacking(t *testing.T) {
+	const size = 64 << 10
+	backing := randomBytes(t, size)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "backing.raw"), backing, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(dir, "overlay.qcow2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(createTestImage(t, testClusterBits, size, &HeaderFieldsV3{RefcountOrder: 4}, "backing.raw")); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := OpenWritable(f, openRaw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := randomBytes(t, 100)
+	if _, err := w.WriteAt(p, 2*4096+1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := bytes.Clone(backing)
+	copy(expected[2*4096+1000:], p)
+	f = reopenTestFile(t, f)
+	img, err := Open(f, openRaw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(expected, imagetest.ReadAll(t, img)) {
+		t.Fatal("data does not match")
+	}
+	// Only the L2 table and one data cluster are allocated.
+	if st, err := f.Stat(); err != nil {
+		t.Fatal(err)
+	} else if st.Size() != 6*4096 {
+		t.Fatalf("expected 6 clusters, got %d bytes", st.Size())
+	}
+	checkClean(t, f)
+}
+
+// takeTestSnapshot creates an internal snapshot like `qemu-img snapshot -c`.
+func takeTestSnapshot(t *testing.T, w *WritableQcow2, name string) {
+	clusterSize := uint64(w.clusterSize)
+	l1Offset, err := w.allocateClusters((uint64(w.L1Size)*8 + clusterSize - 1) / clusterSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, l1Entry := range w.l1Table {
+		l2Offset := l1Entry.l2Offset()
+		if err := w.writeUint64(uint64(l2Offset), int64(l1Offset)+int64(i)*8); err != nil {
+			t.Fatal(err)
+		}
+		if l2Offset == 0 {
+			continue
+		}
+		if err := w.updateRefcount(l2Offset/clusterSize, 1); err != nil {
+			t.Fatal(err)
+		}
+		w.l1Table[i] = l1TableEntry(l2Offset)
+		if err := w.writeUint64(l2Offset, int64(w.L1TableOffset)+int64(i)*8); err != nil {
+			t.Fatal(err)
+		}
+		l2Table, err := readL2Table(w.ra, l2Offset, w.clusterSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j, l2Entry := range l2Table {
+			hostOffset := standardClusterDescriptor(l2Entry.clusterDescriptor()).hostClusterOffset()
+			if hostOffset == 0 {
+				continue
+			}
+			if err := w.updateRefcount(hostOffset/clusterSize, 1); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.writeUint64(uint64(l2Entry)&^(1<<63), int64(l2Offset)+int64(j)*8); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	table := marshalTestSnapshot(t, snapshotHeader{L1TableOffset: l1Offset, L1Size: w.L1Size}, nil, "1", name)
+	tableOffset, err := w.allocateClusters(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.rw.WriteAt(table, int64(tableOffset)); err != nil {
+		t.Fatal(err)
+	}
+	var hdr [12]byte
+	binary.BigEndian.PutUint32(hdr[0:], 1)
+	binary.BigEndian.PutUint64(hdr[4:], tableOffset)
+	if _, err := w.rw.WriteAt(hdr[:], 60); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWritableSnapshot(t *testing.T) {
+	const size = 64 << 10
+	f := createTestFile(t, "disk.qcow2", createTestImage(t, testClusterBits, size, &HeaderFieldsV3{RefcountOrder: 4}, ""))
+	w, err := OpenWritable(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := randomBytes(t, size)
+	if _, err := w.WriteAt(before, 0); err != nil {
+		t.Fatal(err)
+	}
+	takeTestSnapshot(t, w, "before")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f = reopenTestFile(t, f)
+	checkClean(t, f)
+
+	// Writes copy the shared L2 table and data clusters.
+	w, err = OpenWritable(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := bytes.Clone(before)
+	p := randomBytes(t, 10)
+	copy(after[5000:], p)
+	if _, err := w.WriteAt(p, 5000); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f = reopenTestFile(t, f)
+	img, err := Open(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(after, imagetest.ReadAll(t, img)) {
+		t.Fatal("image data does not match")
+	}
+	snap, err := img.OpenSnapshot("before")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, imagetest.ReadAll(t, snap)) {
+		t.Fatal("snapshot data does not match")
+	}
+	checkClean(t, f)
+}
+
+func TestWritableLazyRefcountsRepair(t *testing.T) {
+	const size = 64 << 10
+	f := createTestFile(t, "disk.qcow2", createTestImage(t, testClusterBits, size, &HeaderFieldsV3{
+		RefcountOrder:      4,
+		CompatibleFeatures: 1 << CompatibleFeaturesLazyRefcountsBit,
+	}, ""))
+	w, err := OpenWritable(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := randomBytes(t, size)
+	if _, err := w.WriteAt(expected, 0); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a crash by not closing w.
+
+	img, err := Open(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := img.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Dirty || res.Corruptions == 0 {
+		t.Fatalf("expected a dirty image with stale refcounts, got %+v", res)
+	}
+
+	w, err = OpenWritable(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f = reopenTestFile(t, f)
+	checkClean(t, f)
+	img, err = Open(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(expected, imagetest.ReadAll(t, img)) {
+		t.Fatal("data does not match")
+	}
+}
+
+func TestCreate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts CreateOptions
+	}{
+		{name: "default", opts: CreateOptions{Size: 10 << 20}},
+		{name: "v2", opts: CreateOptions{Size: 10<<20 + 512, Version: 2, ClusterSize: 4096}},
+		{name: "refcount bits 1", opts: CreateOptions{Size: 10 << 20, RefcountBits: 1, ClusterSize: 512}},
+		{name: "refcount bits 64", opts: CreateOptions{Size: 10 << 20, RefcountBits: 64, ClusterSize: 512}},
+		{name: "extended L2", opts: CreateOptions{Size: 10 << 20, ExtendedL2: true, ClusterSize: 16384}},
+		{name: "metadata", opts: CreateOptions{Size: 10<<20 + 512, Preallocation: PreallocationMetadata}},
+		// Needs several refcount blocks and refcount table clusters.
+		{name: "metadata large", opts: CreateOptions{Size: 64 << 20, ClusterSize: 512, RefcountBits: 64, Preallocation: PreallocationMetadata}},
+		{name: "metadata extended L2", opts: CreateOptions{Size: 10 << 20, ExtendedL2: true, Preallocation: PreallocationMetadata}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := createTestFile(t, "disk.qcow2", nil)
+			if err := Create(f, tc.opts); err != nil {
+				t.Fatal(err)
+			}
+			img, err := Open(f, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := img.Readable(); err != nil {
+				t.Fatal(err)
+			}
+			if img.Size() != int64(tc.opts.Size) {
+				t.Fatalf("expected size %d, got %d", tc.opts.Size, img.Size())
+			}
+			if tc.opts.Version != 0 && img.Version != tc.opts.Version {
+				t.Fatalf("expected version %d, got %d", tc.opts.Version, img.Version)
+			}
+			if tc.opts.ClusterSize != 0 && img.clusterSize != tc.opts.ClusterSize {
+				t.Fatalf("expected cluster size %d, got %d", tc.opts.ClusterSize, img.clusterSize)
+			}
+			if tc.opts.RefcountBits != 0 && 1<<img.RefcountOrder != tc.opts.RefcountBits {
+				t.Fatalf("expected refcount order %d, got %d", tc.opts.RefcountBits, 1<<img.RefcountOrder)
+			}
+			if img.extendedL2() != tc.opts.ExtendedL2 {
+				t.Fatalf("expected extended L2 %v", tc.opts.ExtendedL2)
+			}
+			if !bytes.Equal(make([]byte, tc.opts.Size), imagetest.ReadAll(t, img)) {
+				t.Fatal("expected zeros")
+			}
+			extent, err := img.Extent(0, img.Size())
+			if err != nil {
+				t.Fatal(err)
+			}
+			allocated := tc.opts.Preallocation == PreallocationMetadata
+			if extent.Allocated != allocated || extent.Length != img.Size() {
+				t.Fatalf("unexpected extent %+v", extent)
+			}
+			checkClean(t, f)
+
+			w, err := OpenWritable(f, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := randomBytes(t, 100000)
+			if _, err := w.WriteAt(p, 12345); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			f = reopenTestFile(t, f)
+			checkClean(t, f)
+		})
+	}
+
+	t.Run("empty", func(t *testing.T) {
+		for _, prealloc := range []Preallocation{PreallocationOff, PreallocationMetadata} {
+			f := createTestFile(t, "disk.qcow2", nil)
+			if err := Create(f, CreateOptions{Preallocation: prealloc}); err != nil {
+				t.Fatal(err)
+			}
+			img, err := Open(f, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := img.Readable(); err != nil {
+				t.Fatalf("%s: %v", prealloc, err)
+			}
+			if img.Size() != 0 {
+				t.Fatalf("%s: expected size 0, got %d", prealloc, img.Size())
+			}
+			checkClean(t, f)
+			w, err := OpenWritable(f, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+
+	t.Run("backing file", func(t *testing.T) {
+		f := createTestFile(t, "disk.qcow2", nil)
+		if err := Create(f, CreateOptions{
+			Size:              1 << 20,
+			BackingFile:       "base.qcow2",
+			BackingFileFormat: "qcow2",
+			CompressionType:   CompressionTypeZstd,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		header, err := readHeader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.CompressionType != CompressionTypeZstd || header.IncompatibleFeatures != 1<<IncompatibleFeaturesCompressionTypeBit {
+			t.Fatalf("unexpected header %+v", header.HeaderFieldsV3)
+		}
+		exts, err := readHeaderExtensions(f, header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(exts) != 1 || exts[0].Data != "qcow2" {
+			t.Fatalf("unexpected header extensions %+v", exts)
+		}
+		name := make([]byte, header.BackingFileSize)
+		if _, err := f.ReadAt(name, int64(header.BackingFileOffset)); err != nil {
+			t.Fatal(err)
+		}
+		if string(name) != "base.qcow2" {
+			t.Fatalf("unexpected backing file %q", name)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, opts := range []CreateOptions{
+			{ClusterSize: 1000},
+			{ClusterSize: 256},
+			{Version: 4},
+			{Version: 2, RefcountBits: 64},
+			{Version: 2, ExtendedL2: true},
+			{ExtendedL2: true, ClusterSize: 4096},
+			{RefcountBits: 3},
+			{BackingFileFormat: "raw"},
+			{Preallocation: "full"},
+			{Size: 1000},
+		} {
+			if err := Create(createTestFile(t, "disk.qcow2", nil), opts); !errors.Is(err, ErrInvalidCreateOptions) {
+				t.Errorf("expected %v for %+v, got %v", ErrInvalidCreateOptions, opts, err)
+			}
+		}
+	})
+}
+
+// compressibleBytes returns n bytes of data which compresses well.
+func compressibleBytes(t *testing.T, n int) []byte {
+	data := randomBytes(t, n)
+	for i := range data {
+		if i%8 != 0 {
+			data[i] = byte(i % 7)
+		}
+	}
+	return data
+}
+
+func TestWriteCompressed(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts CreateOptions
+	}{
+		{name: "v2", opts: CreateOptions{Size: 1<<20 + 1024, Version: 2, ClusterSize: 4096}},
+		{name: "v3", opts: CreateOptions{Size: 1<<20 + 1024, ClusterSize: 4096}},
+		// Host clusters cannot be shared by compressed clusters.
+		{name: "refcount bits 1", opts: CreateOptions{Size: 1<<20 + 1024, ClusterSize: 4096, RefcountBits: 1}},
+		{name: "extended L2", opts: CreateOptions{Size: 1<<20 + 1024, ClusterSize: 16384, ExtendedL2: true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := createTestFile(t, "disk.qcow2", nil)
+			if err := Create(f, tc.opts); err != nil {
+				t.Fatal(err)
+			}
+			w, err := OpenWritable(f, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clusterSize := int64(w.ClusterSize())
+			expected := make([]byte, tc.opts.Size)
+			copy(expected, compressibleBytes(t, len(expected)))
+			// Leave a hole, and store an incompressible cluster.
+			clear(expected[2*clusterSize : 3*clusterSize])
+			copy(expected[4*clusterSize:5*clusterSize], randomBytes(t, int(clusterSize)))
+
+			var wg sync.WaitGroup
+			errs := make(chan error, len(expected)/int(clusterSize)+1)
+			for off := int64(0); off < int64(len(expected)); off += clusterSize {
+				if off == 2*clusterSize {
+					continue
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					end := min(off+clusterSize, int64(len(expected)))
+					if _, err := w.WriteCompressedAt(expected[off:end], off); err != nil {
+						errs <- err
+					}
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(expected, imagetest.ReadAll(t, w)) {
+				t.Fatal("unexpected data after compressed writes")
+			}
+			for _, tc := range []struct {
+				off        int64
+				allocated  bool
+				compressed bool
+			}{
+				{off: 0, allocated: true, compressed: true},
+				{off: 4 * clusterSize, allocated: true},
+				{off: int64(tc.opts.Size) - 1, allocated: true, compressed: true},
+			} {
+				extent, err := w.Extent(tc.off, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if extent.Allocated != tc.allocated || extent.Compressed != tc.compressed {
+					t.Errorf("unexpected extent at offset %d: %+v", tc.off, extent)
+				}
+			}
+			// Extents of extended L2 images do not report unallocated clusters yet.
+			if !tc.opts.ExtendedL2 {
+				if extent, err := w.Extent(2*clusterSize, clusterSize); err != nil || extent.Allocated {
+					t.Errorf("expected an unallocated extent, got %+v (%v)", extent, err)
+				}
+			}
+
+			// Overwrite compressed clusters in place and compressed.
+			p := randomBytes(t, 100)
+			if _, err := w.WriteAt(p, clusterSize+10); err != nil {
+				t.Fatal(err)
+			}
+			copy(expected[clusterSize+10:], p)
+			p = compressibleBytes(t, int(clusterSize))
+			if _, err := w.WriteCompressedAt(p, 3*clusterSize); err != nil {
+				t.Fatal(err)
+			}
+			copy(expected[3*clusterSize:], p)
+			if _, err := w.WriteCompressedAt(p[:100], 3*clusterSize); err == nil {
+				t.Fatal("expected an error for a partial cluster")
+			}
+			// The last write may end before the end of the image, e.g. when
+			// its size was rounded up to 512 bytes.
+			last := int64(tc.opts.Size) / clusterSize * clusterSize
+			if _, err := w.WriteCompressedAt(p[:int64(tc.opts.Size)-last+1], last); err == nil {
+				t.Fatal("expected an error for a write beyond the end of the image")
+			}
+			if _, err := w.WriteCompressedAt(p[:1000], last); err != nil {
+				t.Fatal(err)
+			}
+			copy(expected[last:], p[:1000])
+			clear(expected[last+1000:])
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			f = reopenTestFile(t, f)
+			checkClean(t, f)
+			img, err := Open(f, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(expected, imagetest.ReadAll(t, img)) {
+				t.Fatal("unexpected data after reopening")
+			}
+			st, err := f.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.opts.RefcountBits != 1 && st.Size() > int64(tc.opts.Size)/2 {
+				t.Fatalf("expected compressed clusters to be packed, image file size is %d", st.Size())
+			}
+		})
+	}
+}
+
+func TestZlibCompressor(t *testing.T) {
+	text := bytes.Repeat([]byte("The quick brown fox jumps over the lazy dog. "), 2000)
+	// Random data repeating beyond the window cannot be compressed.
+	farRepeat := bytes.Repeat(randomBytes(t, zlibWindowSize-100), 16)
+	nearRepeat := bytes.Repeat(randomBytes(t, deflateMaxDistance), 16)
+	for _, tc := range []struct {
+		name     string
+		data     []byte
+		maxRatio float64
+	}{
+		{name: "empty", maxRatio: 2},
+		{name: "one byte", data: []byte{42}, maxRatio: 4},
+		{name: "short", data: []byte("abcabcabcab"), maxRatio: 1.5},
+		{name: "zeros", data: make([]byte, 2<<20), maxRatio: 0.01},
+		{name: "text", data: text, maxRatio: 0.05},
+		{name: "compressible", data: compressibleBytes(t, 1<<20), maxRatio: 0.5},
+		{name: "random", data: randomBytes(t, 1<<16), maxRatio: 1.01},
+		{name: "near repeat", data: nearRepeat, maxRatio: 0.1},
+		{name: "far repeat", data: farRepeat, maxRatio: 1.01},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			zw, err := newZlibCompressor(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for p := tc.data; len(p) > 0; p = p[min(len(p), 1000):] {
+				if _, err := zw.Write(p[:min(len(p), 1000)]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := zw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if ratio := float64(buf.Len()) / float64(max(len(tc.data), 1)); ratio > tc.maxRatio {
+				t.Errorf("compressed %d bytes to %d bytes, expected a ratio of at most %v", len(tc.data), buf.Len(), tc.maxRatio)
+			}
+			data, err := io.ReadAll(flate.NewReader(&buf))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, tc.data) {
+				t.Fatal("unexpected data after decompression")
+			}
+		})
+	}
+}
+
+func TestBackingFileResolver(t *testing.T) {
+	base := randomBytes(t, 1<<20)
+	newImage := func(backingFile string) []byte {
+		return createTestImage(t, testClusterBits, 1<<20, nil, backingFile)
+	}
+	fsys := fstest.MapFS{
+		"images/base.raw":        {Data: base},
+		"images/mid.qcow2":       {Data: newImage("base.raw")},
+		"images/top.qcow2":       {Data: newImage("mid.qcow2")},
+		"images/sub/top.qcow2":   {Data: newImage("../mid.qcow2")},
+		"images/escape.qcow2":    {Data: newImage("../../base.raw")},
+		"images/absolute.qcow2":  {Data: newImage("/images/base.raw")},
+		"images/self.qcow2":      {Data: newImage("self.qcow2")},
+		"images/loop1.qcow2":     {Data: newImage("loop2.qcow2")},
+		"images/loop2.qcow2":     {Data: newImage("./loop1.qcow2")},
+		"images/missing.qcow2":   {Data: newImage("missing.raw")},
+		"images/top-wrong.qcow2": {Data: newImage("sub/../mid.qcow2")},
+	}
+	open := func(t *testing.T, name string, opts ...Option) *Qcow2 {
+		t.Helper()
+		opts = append([]Option{WithBackingFileResolver(FSBackingFileResolver(fsys)), WithName(name)}, opts...)
+		img, err := Open(bytes.NewReader(fsys[name].Data), openRaw, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { img.Close() })
+		return img
+	}
+
+	for _, name := range []string{"images/top.qcow2", "images/sub/top.qcow2", "images/top-wrong.qcow2"} {
+		t.Run(name, func(t *testing.T) {
+			img := open(t, name)
+			if err := img.Readable(); err != nil {
+				t.Fatal(err)
+			}
+			if img.BackingFileFullPath != "images/mid.qcow2" {
+				t.Fatalf("unexpected backing file path %q", img.BackingFileFullPath)
+			}
+			if !bytes.Equal(base, imagetest.ReadAll(t, img)) {
+				t.Fatal("unexpected data")
+			}
+		})
+	}
+
+	t.Run("fs.Sub", func(t *testing.T) {
+		sub, err := fs.Sub(fsys, "images")
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := Open(bytes.NewReader(fsys["images/top.qcow2"].Data), openRaw, WithBackingFileResolver(FSBackingFileResolver(sub)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer img.Close()
+		if !bytes.Equal(base, imagetest.ReadAll(t, img)) {
+			t.Fatal("unexpected data")
+		}
+	})
+
+	t.Run("in-memory", func(t *testing.T) {
+		var opened []string
+		resolver := func(_, name string) (io.ReaderAt, string, error) {
+			opened = append(opened, name)
+			f, ok := fsys["images/"+name]
+			if !ok {
+				return nil, "", os.ErrNotExist
+			}
+			return &raw.Raw{ReaderAt: bytes.NewReader(f.Data)}, name, nil
+		}
+		img, err := Open(bytes.NewReader(fsys["images/top.qcow2"].Data), openRaw, WithBackingFileResolver(resolver))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer img.Close()
+		if !bytes.Equal(base, imagetest.ReadAll(t, img)) {
+			t.Fatal("unexpected data")
+		}
+		if !reflect.DeepEqual(opened, []string{"mid.qcow2", "base.raw"}) {
+			t.Fatalf("unexpected resolved files %q", opened)
+		}
+	})
+
+	for _, tc := range []struct {
+		name string
+		opts []Option
+		err  error
+	}{
+		{name: "images/escape.qcow2", err: ErrUnsafeBackingFile},
+		{name: "images/absolute.qcow2", err: ErrUnsafeBackingFile},
+		{name: "images/self.qcow2", err: ErrBackingChainLoop},
+		{name: "images/loop1.qcow2", err: ErrBackingChainLoop},
+		{name: "images/missing.qcow2", err: fs.ErrNotExist},
+		{name: "images/top.qcow2", opts: []Option{WithMaxBackingChainDepth(1)}, err: ErrBackingChainTooDeep},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			img := open(t, tc.name, tc.opts...)
+			err := img.Readable()
+			if !errors.Is(err, tc.err) || !errors.Is(err, ErrUnsupportedBackingFile) {
+				t.Fatalf("expected %v, got %v", tc.err, err)
+			}
+		})
+	}
+
+	t.Run("loop without names", func(t *testing.T) {
+		resolver := func(_, name string) (io.ReaderAt, string, error) {
+			return bytes.NewReader(fsys["images/self.qcow2"].Data), "", nil
+		}
+		img, err := Open(bytes.NewReader(fsys["images/self.qcow2"].Data), openRaw, WithBackingFileResolver(resolver))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer img.Close()
+		if err := img.Readable(); !errors.Is(err, ErrBackingChainTooDeep) {
+			t.Fatalf("expected %v, got %v", ErrBackingChainTooDeep, err)
+		}
+	})
+
+	t.Run("os", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "base.raw"), base, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "loop.qcow2"), newImage("loop.qcow2"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		f := createTestFile(t, "top.qcow2", newImage(filepath.Join(dir, "base.raw")))
+		img, err := Open(f, openRaw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer img.Close()
+		if !bytes.Equal(base, imagetest.ReadAll(t, img)) {
+			t.Fatal("unexpected data")
+		}
+		if err := os.WriteFile(filepath.Join(dir, "top.qcow2"), newImage("base.raw"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		f, err = os.Open(filepath.Join(dir, "top.qcow2"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err = Open(f, openRaw, WithBackingFileResolver(FSBackingFileResolver(os.DirFS(dir))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer img.Close()
+		if !bytes.Equal(base, imagetest.ReadAll(t, img)) {
+			t.Fatal("unexpected data")
+		}
+
+		f, err = os.Open(filepath.Join(dir, "loop.qcow2"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err = Open(f, openRaw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer img.Close()
+		if err := img.Readable(); !errors.Is(err, ErrBackingChainLoop) {
+			t.Fatalf("expected %v, got %v", ErrBackingChainLoop, err)
+		}
+	})
+}
+
+func TestJSONBackingFile(t *testing.T) {
+	for _, tc := range []struct {
+		s        string
+		filename string
+		format   image.Type
+	}{
+		{`json:{"driver":"qcow2","file":{"driver":"file","filename":"base.img"}}`, "base.img", "qcow2"},
+		{`json:{"driver":"raw","file.driver":"file","file.filename":"/images/base.img"}`, "/images/base.img", "raw"},
+		{`json:{"driver":"file","filename":"base.img"}`, "base.img", ""},
+		{`json:{"file":{"driver":"file","filename":"base.img"}}`, "base.img", ""},
+		{`json:{"driver":"vmdk","filename":"base.vmdk"}`, "base.vmdk", "vmdk"},
+	} {
+		filename, format, err := parseJSONBackingFile(tc.s)
+		if err != nil {
+			t.Errorf("%s: %v", tc.s, err)
+			continue
+		}
+		if filename != tc.filename || format != tc.format {
+			t.Errorf("%s: expected %q, %q, got %q, %q", tc.s, tc.filename, tc.format, filename, format)
+		}
+	}
+	for _, s := range []string{
+		`json:{"driver":"qcow2"`,
+		`json:{"driver":"qcow2","file":{"driver":"nbd","server":{"host":"localhost"}}}`,
+		`json:{"driver":"qcow2","file":{"driver":"file"}}`,
+		`json:{"driver":"qcow2","file":"base.img","file.filename":"base.img"}`,
+		`json:{"driver":"qcow2","file":{"filename":"a"},"file.filename":"b"}`,
+		`json:{"driver":1,"file":"base.img"}`,
+		// A block node name, not a file name.
+		`json:{"driver":"qcow2","file":"base.img"}`,
+		// Options changing the data read, or not supported.
+		`json:{"driver":"raw","offset":1024,"size":4096,"file":{"driver":"file","filename":"disk.img"}}`,
+		`json:{"driver":"raw","file":{"driver":"file","filename":"disk.img"},"size":4096}`,
+		`json:{"driver":"qcow2","file":{"filename":"base.img"},"file.aio":"native"}`,
+		`json:{"driver":"qcow2","backing":null,"file":{"filename":"base.img"}}`,
+		`json:{"driver":"file","filename":"base.img","locking":"off"}`,
+		`json:{"driver":"vmdk","filename":"base.vmdk","file":{"filename":"base.vmdk"}}`,
+	} {
+		if _, _, err := parseJSONBackingFile(s); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+
+	base := randomBytes(t, 1<<20)
+	fsys := fstest.MapFS{
+		"images/base.raw": {Data: base},
+		"images/top.qcow2": {Data: createTestImage(t, testClusterBits, 1<<20, nil,
+			`json:{"driver":"raw","file":{"driver":"file","filename":"base.raw"}}`)},
+		"images/nbd.qcow2": {Data: createTestImage(t, testClusterBits, 1<<20, nil,
+			`json:{"driver":"raw","file":{"driver":"nbd","host":"localhost"}}`)},
+	}
+	open := func(name string) *Qcow2 {
+		img, err := Open(bytes.NewReader(fsys[name].Data), openRaw, WithBackingFileResolver(FSBackingFileResolver(fsys)), WithName(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { img.Close() })
+		return img
+	}
+	img := open("images/top.qcow2")
+	if err := img.Readable(); err != nil {
+		t.Fatal(err)
+	}
+	if img.BackingFileFormat != "raw" || img.BackingFileFullPath != "images/base.raw" {
+		t.Fatalf("unexpected backing file %q (%q)", img.BackingFileFullPath, img.BackingFileFormat)
+	}
+	if !bytes.Equal(base, imagetest.ReadAll(t, img)) {
+		t.Fatal("unexpected data")
+	}
+	if err := open("images/nbd.qcow2").Readable(); !errors.Is(err, ErrUnsupportedBackingFile) {
+		t.Fatalf("expected %v, got %v", ErrUnsupportedBackingFile, err)
+	}
+}
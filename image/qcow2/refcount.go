@@ -0,0 +1,144 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// maxRefcountTableSize is the limit from qemu.
+const maxRefcountTableSize = 8 << 20
+
+// refcountTableEntry is an entry of the refcount table.
+type refcountTableEntry uint64
+
+// blockOffset returns the offset into the image file at which the refcount
+// block starts.
+func (x refcountTableEntry) blockOffset() uint64 {
+	return uint64(x) &^ 0x1ff
+}
+
+// refcounts holds the refcount table and caches refcount blocks.
+// Not safe for concurrent use.
+type refcounts struct {
+	ra          io.ReaderAt
+	clusterSize uint64
+	bits        uint64
+	table       []refcountTableEntry
+	blocks      map[uint64][]byte // refcount block offset -> refcount block
+}
+
+func readRefcounts(img *Qcow2) (*refcounts, error) {
+	r := &refcounts{
+		ra:          img.ra,
+		clusterSize: uint64(img.clusterSize),
+		bits:        16,
+		blocks:      make(map[uint64][]byte),
+	}
+	if img.HeaderFieldsV3 != nil {
+		if img.RefcountOrder > 6 {
+			return nil, fmt.Errorf("%w: refcount order %d", ErrUnsupportedFeature, img.RefcountOrder)
+		}
+		r.bits = 1 << img.RefcountOrder
+	}
+	if img.RefcountTableOffset == 0 || img.RefcountTableOffset%r.clusterSize != 0 {
+		return nil, fmt.Errorf("invalid refcount table offset: %d", img.RefcountTableOffset)
+	}
+	tableLen := uint64(img.RefcountTableClusters) * r.clusterSize
+	if tableLen > maxRefcountTableSize {
+		return nil, fmt.Errorf("refcount table too large (%d bytes > %d bytes)", tableLen, maxRefcountTableSize)
+	}
+	r.table = make([]refcountTableEntry, tableLen/8)
+	sr := io.NewSectionReader(img.ra, int64(img.RefcountTableOffset), int64(tableLen))
+	if err := binary.Read(sr, binary.BigEndian, r.table); err != nil {
+		return nil, fmt.Errorf("failed to read refcount table: %w", err)
+	}
+	return r, nil
+}
+
+// perBlock returns the number of refcounts in a refcount block.
+func (r *refcounts) perBlock() uint64 {
+	return r.clusterSize * 8 / r.bits
+}
+
+// max returns the largest representable refcount.
+func (r *refcounts) max() uint64 {
+	if r.bits == 64 {
+		return ^uint64(0)
+	}
+	return 1<<r.bits - 1
+}
+
+// block returns the refcount block for the refcount table index, or nil if
+// the block is not allocated.
+func (r *refcounts) block(idx uint64) ([]byte, error) {
+	if idx >= uint64(len(r.table)) {
+		return nil, nil
+	}
+	off := r.table[idx].blockOffset()
+	if off == 0 {
+		return nil, nil
+	}
+	if block, ok := r.blocks[off]; ok {
+		return block, nil
+	}
+	if off%r.clusterSize != 0 {
+		return nil, fmt.Errorf("refcount block %d at offset %d is not cluster aligned", idx, off)
+	}
+	block := make([]byte, r.clusterSize)
+	if _, err := r.ra.ReadAt(block, int64(off)); err != nil {
+		return nil, fmt.Errorf("failed to read refcount block %d: %w", idx, err)
+	}
+	r.blocks[off] = block
+	return block, nil
+}
+
+// get returns the refcount of the cluster.
+func (r *refcounts) get(cluster uint64) (uint64, error) {
+	block, err := r.block(cluster / r.perBlock())
+	if err != nil || block == nil {
+		return 0, err
+	}
+	return getRefcount(block, cluster%r.perBlock(), r.bits), nil
+}
+
+// refcountRange returns the range of bytes of a refcount block holding the
+// refcount at index i.
+func refcountRange(i, bits uint64) (begin, end uint64) {
+	begin = i * bits / 8
+	end = max(begin+1, (i+1)*bits/8)
+	return begin, end
+}
+
+func getRefcount(block []byte, i, bits uint64) uint64 {
+	switch bits {
+	case 1, 2, 4:
+		shift := (i * bits) % 8
+		return uint64(block[i*bits/8]>>shift) & (1<<bits - 1)
+	case 8:
+		return uint64(block[i])
+	case 16:
+		return uint64(binary.BigEndian.Uint16(block[i*2:]))
+	case 32:
+		return uint64(binary.BigEndian.Uint32(block[i*4:]))
+	default:
+		return binary.BigEndian.Uint64(block[i*8:])
+	}
+}
+
+func setRefcount(block []byte, i, bits, v uint64) {
+	switch bits {
+	case 1, 2, 4:
+		shift := (i * bits) % 8
+		mask := byte(1<<bits-1) << shift
+		block[i*bits/8] = block[i*bits/8]&^mask | byte(v<<shift)&mask
+	case 8:
+		block[i] = byte(v)
+	case 16:
+		binary.BigEndian.PutUint16(block[i*2:], uint16(v))
+	case 32:
+		binary.BigEndian.PutUint32(block[i*4:], uint32(v))
+	default:
+		binary.BigEndian.PutUint64(block[i*8:], v)
+	}
+}
@@ -0,0 +1,185 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/lima-vm/go-qcow2reader/lru"
+)
+
+// Limits from qemu.
+const (
+	maxSnapshots           = 65536
+	maxSnapshotExtraData   = 1024
+	snapshotHeaderLength   = 40
+	snapshotTableAlignment = 8
+)
+
+var ErrSnapshotNotFound = errors.New("snapshot not found")
+
+type snapshotHeader struct {
+	L1TableOffset uint64
+	L1Size        uint32
+	IDStrSize     uint16
+	NameSize      uint16
+	DateSec       uint32
+	DateNsec      uint32
+	VMClockNsec   uint64
+	VMStateSize   uint32
+	ExtraDataSize uint32
+}
+
+// Snapshot is an internal snapshot.
+type Snapshot struct {
+	ID            string        `json:"id"`
+	Name          string        `json:"name"`
+	Date          time.Time     `json:"date"`
+	VMClock       time.Duration `json:"vm_clock"`
+	VMStateSize   uint64        `json:"vm_state_size"`
+	DiskSize      uint64        `json:"disk_size"` // Virtual disk size when the snapshot was taken
+	L1TableOffset uint64        `json:"l1_table_offset"`
+	L1Size        uint32        `json:"l1_size"`
+}
+
+// Snapshots reads the snapshot table.
+func (img *Qcow2) Snapshots() ([]Snapshot, error) {
+	snapshots, _, err := img.readSnapshotTable()
+	return snapshots, err
+}
+
+// readSnapshotTable returns the snapshots and the length of the snapshot table
+// in bytes.
+func (img *Qcow2) readSnapshotTable() ([]Snapshot, int64, error) {
+	if img.NbSnapshots == 0 {
+		return nil, 0, nil
+	}
+	if img.NbSnapshots > maxSnapshots {
+		return nil, 0, fmt.Errorf("too many snapshots (%d > %d)", img.NbSnapshots, maxSnapshots)
+	}
+	r := io.NewSectionReader(img.ra, int64(img.SnapshotsOffset), 1<<62)
+	res := make([]Snapshot, 0, img.NbSnapshots)
+	for i := 0; i < int(img.NbSnapshots); i++ {
+		var h snapshotHeader
+		if err := binary.Read(r, binary.BigEndian, &h); err != nil {
+			return nil, 0, fmt.Errorf("failed to read snapshot %d: %w", i, err)
+		}
+		if h.ExtraDataSize > maxSnapshotExtraData {
+			return nil, 0, fmt.Errorf("snapshot %d: too much extra data (%d bytes)", i, h.ExtraDataSize)
+		}
+		buf := make([]byte, int(h.ExtraDataSize)+int(h.IDStrSize)+int(h.NameSize))
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, 0, fmt.Errorf("failed to read snapshot %d: %w", i, err)
+		}
+		extra := buf[:h.ExtraDataSize]
+		s := Snapshot{
+			ID:            string(buf[h.ExtraDataSize : int(h.ExtraDataSize)+int(h.IDStrSize)]),
+			Name:          string(buf[int(h.ExtraDataSize)+int(h.IDStrSize):]),
+			Date:          time.Unix(int64(h.DateSec), int64(h.DateNsec)),
+			VMClock:       time.Duration(h.VMClockNsec),
+			VMStateSize:   uint64(h.VMStateSize),
+			DiskSize:      img.Header.Size,
+			L1TableOffset: h.L1TableOffset,
+			L1Size:        h.L1Size,
+		}
+		if len(extra) >= 8 {
+			s.VMStateSize = binary.BigEndian.Uint64(extra[0:8])
+		}
+		if len(extra) >= 16 {
+			s.DiskSize = binary.BigEndian.Uint64(extra[8:16])
+		}
+		res = append(res, s)
+
+		// Each entry is aligned to 8 bytes.
+		entryLen := snapshotHeaderLength + len(buf)
+		if pad := (snapshotTableAlignment - entryLen%snapshotTableAlignment) % snapshotTableAlignment; pad > 0 {
+			if _, err := r.Seek(int64(pad), io.SeekCurrent); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+	tableLen, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, 0, err
+	}
+	return res, tableLen, nil
+}
+
+// OpenSnapshot opens the snapshot with the specified ID or name as an
+// image. Like qemu, the ID is tried first.
+//
+// The snapshot image shares the underlying file and backing image with img.
+// Closing the snapshot image does not close them, and the snapshot image must
+// not be used after img is closed.
+func (img *Qcow2) OpenSnapshot(idOrName string) (*Qcow2, error) {
+	if img.errUnreadable != nil {
+		return nil, img.errUnreadable
+	}
+	snapshots, err := img.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+	var found *Snapshot
+	for i := range snapshots {
+		if snapshots[i].ID == idOrName {
+			found = &snapshots[i]
+			break
+		}
+	}
+	if found == nil {
+		for i := range snapshots {
+			if snapshots[i].Name == idOrName {
+				found = &snapshots[i]
+				break
+			}
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%w: %q", ErrSnapshotNotFound, idOrName)
+	}
+
+	header := *img.Header
+	header.Size = found.DiskSize
+	header.L1Size = found.L1Size
+	header.L1TableOffset = found.L1TableOffset
+	header.NbSnapshots = 0
+	header.SnapshotsOffset = 0
+	snap := &Qcow2{
+		ra:                  img.ra,
+		Header:              &header,
+		HeaderExtensions:    img.HeaderExtensions,
+		clusterSize:         img.clusterSize,
+		l2Entries:           img.l2Entries,
+		l2TableCache:        lru.New[l1TableEntry, []l2TableEntry](maxL2Tables),
+		decompressor:        img.decompressor,
+		Encryption:          img.Encryption,
+		cipher:              img.cipher,
+		cipherGuestOffset:   img.cipherGuestOffset,
+		BackingFile:         img.BackingFile,
+		BackingFileFullPath: img.BackingFileFullPath,
+		BackingFileFormat:   img.BackingFileFormat,
+		backingImage:        img.backingImage,
+		DataFile:            img.DataFile,
+		DataFileFullPath:    img.DataFileFullPath,
+		dataFile:            img.dataFile,
+		snapshotOf:          img,
+	}
+	if found.L1Size > 0 {
+		snap.l1Table, err = readL1Table(img.ra, found.L1TableOffset, found.L1Size)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read L1 table of snapshot %q: %w", idOrName, err)
+		}
+	}
+	l2Coverage := uint64(img.clusterSize) * uint64(img.l2Entries)
+	need := found.DiskSize/l2Coverage + min(found.DiskSize%l2Coverage, 1)
+	if need > maxL1TableSize/8 {
+		return nil, fmt.Errorf("snapshot %q: disk size %d needs %d L1 entries (more than %d)", idOrName, found.DiskSize, need, maxL1TableSize/8)
+	}
+	if uint64(len(snap.l1Table)) < need {
+		// The L1 table may be shorter than the disk; the rest is unallocated.
+		snap.l1Table = append(snap.l1Table, make([]l1TableEntry, need-uint64(len(snap.l1Table)))...)
+	}
+	return snap, nil
+}
@@ -0,0 +1,626 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/lima-vm/go-qcow2reader/image"
+	"github.com/lima-vm/go-qcow2reader/log"
+)
+
+// Offsets of header fields updated by [WritableQcow2].
+const (
+	headerOffsetRefcountTableOffset  = 48
+	headerOffsetIncompatibleFeatures = 72
+	headerOffsetAutoclearFeatures    = 88
+)
+
+var ErrNotWritable = errors.New("image is not writable")
+
+// ReadWriterAt is implemented by files opened for reading and writing, such
+// as [os.File].
+type ReadWriterAt interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// WritableQcow2 is a qcow2 image opened with [OpenWritable].
+// It implements [image.Image] and [io.WriterAt].
+//
+// Writes allocate clusters at the first free host cluster, and copy clusters
+// that are shared with snapshots, compressed, or not allocated in this image
+// (copy-on-write from the backing image).
+//
+// If the image has the lazy refcounts feature, refcount updates are kept in
+// memory and the dirty bit is set until [WritableQcow2.Flush] or
+// [WritableQcow2.Close]. Otherwise refcounts are written before the metadata
+// referencing the clusters, so a crash can only leak clusters.
+//
+// Autoclear features (e.g. bitmaps) are cleared on the first write, as the
+// writer does not maintain them.
+type WritableQcow2 struct {
+	*Qcow2
+	rw ReadWriterAt
+
+	mu            sync.RWMutex
+	refcounts     *refcounts
+	lazyRefcounts bool
+	dirtyBlocks   map[uint64]bool // refcount blocks not written yet (lazy refcounts)
+	modified      bool
+	freeHint      uint64 // no free clusters before this cluster
+	// End of the last compressed data, or 0. More compressed data may be
+	// packed into the same host cluster.
+	compressedOffset uint64
+	closed           bool
+}
+
+// OpenWritable opens a qcow2 image for reading and writing.
+// The backing image, if any, is opened with openWithType and is never written.
+//
+// If the dirty bit is set, e.g. after a crash while using lazy refcounts, the
+// refcounts are repaired like `qemu-img check -r all`.
+func OpenWritable(rw ReadWriterAt, openWithType image.OpenWithType, opts ...Option) (*WritableQcow2, error) {
+	img, err := Open(rw, openWithType, opts...)
+	if err != nil {
+		return nil, err
+	}
+	w := &WritableQcow2{
+		Qcow2:       img,
+		rw:          rw,
+		dirtyBlocks: make(map[uint64]bool),
+	}
+	if err := w.writable(); err != nil {
+		_ = img.Close()
+		return nil, err
+	}
+	if img.HeaderFieldsV3 != nil {
+		w.lazyRefcounts = img.CompatibleFeatures&(1<<CompatibleFeaturesLazyRefcountsBit) != 0
+	}
+	w.refcounts, err = readRefcounts(img)
+	if err != nil {
+		_ = img.Close()
+		return nil, err
+	}
+	if img.HeaderFieldsV3 != nil && img.IncompatibleFeatures&(1<<IncompatibleFeaturesDirtyBit) != 0 {
+		log.Warnf("Image was not closed cleanly, repairing refcounts")
+		if err := w.repairRefcounts(); err != nil {
+			_ = img.Close()
+			return nil, fmt.Errorf("failed to repair refcounts: %w", err)
+		}
+	}
+	return w, nil
+}
+
+func (w *WritableQcow2) writable() error {
+	img := w.Qcow2
+	if img.errUnreadable != nil {
+		return img.errUnreadable
+	}
+	if img.HeaderFieldsV3 != nil {
+		if img.IncompatibleFeatures&(1<<IncompatibleFeaturesCorruptBit) != 0 {
+			return fmt.Errorf("%w: the %q is set", ErrNotWritable, IncompatibleFeaturesNames[IncompatibleFeaturesCorruptBit])
+		}
+		if img.HeaderLength < 104 {
+			return fmt.Errorf("%w: invalid header length %d", ErrNotWritable, img.HeaderLength)
+		}
+	}
+	if img.externalDataFile() {
+		return fmt.Errorf("%w: %w", ErrNotWritable, ErrUnsupportedDataFile)
+	}
+	if uint64(len(img.l1Table)) < img.l1EntriesNeeded() {
+		return fmt.Errorf("%w: L1 table too small (%d entries)", ErrNotWritable, len(img.l1Table))
+	}
+	return nil
+}
+
+func (img *Qcow2) l1EntriesNeeded() uint64 {
+	bytesPerL1Entry := uint64(img.clusterSize) * uint64(img.l2Entries)
+	return (img.Header.Size + bytesPerL1Entry - 1) / bytesPerL1Entry
+}
+
+// ReadAt implements [io.ReaderAt].
+func (w *WritableQcow2) ReadAt(p []byte, off int64) (int, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.Qcow2.ReadAt(p, off)
+}
+
+// Extent implements [image.Image].
+func (w *WritableQcow2) Extent(start, length int64) (image.Extent, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.Qcow2.Extent(start, length)
+}
+
+// WriteAt implements [io.WriterAt].
+func (w *WritableQcow2) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || uint64(off)+uint64(len(p)) > w.Header.Size {
+		return 0, fmt.Errorf("write of %d bytes at offset %d is beyond the end of the image (%d bytes)", len(p), off, w.Header.Size)
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.markModified(); err != nil {
+		return 0, err
+	}
+	var n int
+	for n < len(p) {
+		currentOff := off + int64(n)
+		inCluster := int(currentOff % int64(w.clusterSize))
+		end := min(len(p), n+w.clusterSize-inCluster)
+		if err := w.writeCluster(p[n:end], currentOff); err != nil {
+			return n, err
+		}
+		n = end
+	}
+	return n, nil
+}
+
+// Flush writes pending refcount updates and clears the dirty bit.
+func (w *WritableQcow2) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.flush()
+}
+
+func (w *WritableQcow2) flush() error {
+	for off := range w.dirtyBlocks {
+		if _, err := w.rw.WriteAt(w.refcounts.blocks[off], int64(off)); err != nil {
+			return fmt.Errorf("failed to write refcount block at offset %d: %w", off, err)
+		}
+		delete(w.dirtyBlocks, off)
+	}
+	if s, ok := w.rw.(interface{ Sync() error }); ok && w.modified {
+		if err := s.Sync(); err != nil {
+			return err
+		}
+	}
+	if w.HeaderFieldsV3 != nil && w.IncompatibleFeatures&(1<<IncompatibleFeaturesDirtyBit) != 0 {
+		if err := w.writeIncompatibleFeatures(w.IncompatibleFeatures &^ (1 << IncompatibleFeaturesDirtyBit)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close flushes the image and closes it. Calling Close again does nothing and
+// returns nil.
+func (w *WritableQcow2) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	err := w.flush()
+	return errors.Join(err, w.Qcow2.Close())
+}
+
+func (w *WritableQcow2) writeUint64(v uint64, off int64) error {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	_, err := w.rw.WriteAt(buf[:], off)
+	return err
+}
+
+func (w *WritableQcow2) writeIncompatibleFeatures(x IncompatibleFeatures) error {
+	if err := w.writeUint64(uint64(x), headerOffsetIncompatibleFeatures); err != nil {
+		return fmt.Errorf("failed to update incompatible features: %w", err)
+	}
+	w.IncompatibleFeatures = x
+	return nil
+}
+
+// markModified updates the header before writing.
+func (w *WritableQcow2) markModified() error {
+	if w.HeaderFieldsV3 == nil {
+		w.modified = true
+		return nil
+	}
+	if !w.modified && w.AutoclearFeatures != 0 {
+		if err := w.writeUint64(0, headerOffsetAutoclearFeatures); err != nil {
+			return fmt.Errorf("failed to clear autoclear features: %w", err)
+		}
+		w.AutoclearFeatures = 0
+	}
+	w.modified = true
+	if w.lazyRefcounts && w.IncompatibleFeatures&(1<<IncompatibleFeaturesDirtyBit) == 0 {
+		return w.writeIncompatibleFeatures(w.IncompatibleFeatures | 1<<IncompatibleFeaturesDirtyBit)
+	}
+	return nil
+}
+
+// writeCluster writes p at the guest offset off. p must not cross a cluster
+// boundary.
+func (w *WritableQcow2) writeCluster(p []byte, off int64) error {
+	clusterSize := int64(w.clusterSize)
+	clusterNo := off / clusterSize
+	clusterBegin := clusterNo * clusterSize
+	l1Index := int(clusterNo / int64(w.l2Entries))
+	l2Index := int(clusterNo % int64(w.l2Entries))
+	l2Offset, err := w.l2TableForWrite(l1Index)
+	if err != nil {
+		return err
+	}
+
+	entryOffset, ent, err := w.readL2Entry(l2Offset, l2Index)
+	if err != nil {
+		return err
+	}
+
+	var hostOffset uint64
+	desc := ent.L2TableEntry.clusterDescriptor()
+	if !ent.L2TableEntry.compressed() {
+		hostOffset = standardClusterDescriptor(desc).hostClusterOffset()
+	}
+	inPlace := hostOffset != 0 && ent.L2TableEntry.copied()
+
+	// Write directly into a cluster owned by this image.
+	if inPlace && w.cipher == nil {
+		complete := !standardClusterDescriptor(desc).allZero()
+		if w.extendedL2() {
+			complete = ent.AllocStatusBitmap == 0xffffffff
+		}
+		if complete {
+			if _, err := w.rw.WriteAt(p, int64(hostOffset)+off-clusterBegin); err != nil {
+				return fmt.Errorf("failed to write data cluster at offset %d: %w", hostOffset, err)
+			}
+			return nil
+		}
+	}
+
+	// Read the current content of the cluster, which may come from the
+	// backing image, and write the whole cluster.
+	buf := make([]byte, clusterSize)
+	if int64(len(p)) < clusterSize {
+		if _, err := w.Qcow2.ReadAt(buf, clusterBegin); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("failed to read cluster at guest offset %d: %w", clusterBegin, err)
+		}
+	}
+	copy(buf[off-clusterBegin:], p)
+	target := hostOffset
+	if !inPlace {
+		if target, err = w.allocateClusters(1); err != nil {
+			return err
+		}
+	}
+	if w.cipher != nil {
+		ivOff := int64(target)
+		if w.cipherGuestOffset {
+			ivOff = clusterBegin
+		}
+		if err := w.cipher.Encrypt(buf, uint64(ivOff/int64(w.cipher.SectorSize()))); err != nil {
+			return err
+		}
+	}
+	if _, err := w.rw.WriteAt(buf, int64(target)); err != nil {
+		return fmt.Errorf("failed to write data cluster at offset %d: %w", target, err)
+	}
+
+	// Update the L2 entry.
+	newEntry := l2TableEntry(target | 1<<63)
+	if err := w.writeL2Entry(entryOffset, newEntry, 0xffffffff); err != nil {
+		return err
+	}
+	if !w.extendedL2() {
+		if l2Table, ok := w.l2TableCache.Get(w.l1Table[l1Index]); ok {
+			l2Table[l2Index] = newEntry
+		}
+	}
+
+	// Release the previous cluster.
+	if inPlace {
+		return nil
+	}
+	return w.releaseCluster(ent.L2TableEntry)
+}
+
+// readL2Entry reads the entry at l2Index of the L2 table at l2Offset.
+func (w *WritableQcow2) readL2Entry(l2Offset uint64, l2Index int) (int64, extendedL2TableEntry, error) {
+	entrySize := 8
+	if w.extendedL2() {
+		entrySize = 16
+	}
+	entryOffset := int64(l2Offset) + int64(l2Index*entrySize)
+	raw := make([]byte, entrySize)
+	var ent extendedL2TableEntry
+	if _, err := w.rw.ReadAt(raw, entryOffset); err != nil {
+		return 0, ent, fmt.Errorf("failed to read L2 entry at offset %d: %w", entryOffset, err)
+	}
+	ent.L2TableEntry = l2TableEntry(binary.BigEndian.Uint64(raw))
+	if w.extendedL2() {
+		ent.ZeroStatusBitmap = binary.BigEndian.Uint32(raw[8:])
+		ent.AllocStatusBitmap = binary.BigEndian.Uint32(raw[12:])
+	}
+	return entryOffset, ent, nil
+}
+
+// writeL2Entry writes an L2 entry. For extended L2 entries, the zero status
+// bitmap is cleared and the allocation status bitmap is set to alloc.
+func (w *WritableQcow2) writeL2Entry(entryOffset int64, entry l2TableEntry, alloc uint32) error {
+	raw := make([]byte, 8, 16)
+	binary.BigEndian.PutUint64(raw, uint64(entry))
+	if w.extendedL2() {
+		raw = binary.BigEndian.AppendUint32(raw, 0)
+		raw = binary.BigEndian.AppendUint32(raw, alloc)
+	}
+	if _, err := w.rw.WriteAt(raw, entryOffset); err != nil {
+		return fmt.Errorf("failed to write L2 entry at offset %d: %w", entryOffset, err)
+	}
+	return nil
+}
+
+// releaseCluster drops the references of an L2 entry that was replaced.
+func (w *WritableQcow2) releaseCluster(entry l2TableEntry) error {
+	clusterSize := uint64(w.clusterSize)
+	desc := entry.clusterDescriptor()
+	if entry.compressed() {
+		cd := compressedClusterDescriptor(desc)
+		begin := cd.hostClusterOffset(int(w.ClusterBits)) &^ 511
+		end := begin + uint64(cd.additionalSectors(int(w.ClusterBits))+1)*512
+		for c := begin / clusterSize; c <= (end-1)/clusterSize; c++ {
+			if err := w.updateRefcount(c, -1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if hostOffset := standardClusterDescriptor(desc).hostClusterOffset(); hostOffset != 0 {
+		return w.updateRefcount(hostOffset/clusterSize, -1)
+	}
+	return nil
+}
+
+// l2TableForWrite returns the offset of the L2 table for the L1 index,
+// allocating the table or copying a table shared with snapshots.
+func (w *WritableQcow2) l2TableForWrite(l1Index int) (uint64, error) {
+	l1Entry := w.l1Table[l1Index]
+	oldOffset := l1Entry.l2Offset()
+	if oldOffset != 0 && uint64(l1Entry)>>63 == 1 {
+		return oldOffset, nil
+	}
+	newOffset, err := w.allocateClusters(1)
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, w.clusterSize)
+	if oldOffset != 0 {
+		if _, err := w.rw.ReadAt(buf, int64(oldOffset)); err != nil {
+			return 0, fmt.Errorf("failed to read L2 table at offset %d: %w", oldOffset, err)
+		}
+	}
+	if _, err := w.rw.WriteAt(buf, int64(newOffset)); err != nil {
+		return 0, fmt.Errorf("failed to write L2 table at offset %d: %w", newOffset, err)
+	}
+	newEntry := l1TableEntry(newOffset | 1<<63)
+	if err := w.writeUint64(uint64(newEntry), int64(w.L1TableOffset)+int64(l1Index)*8); err != nil {
+		return 0, fmt.Errorf("failed to write L1 entry %d: %w", l1Index, err)
+	}
+	w.l1Table[l1Index] = newEntry
+	if !w.extendedL2() {
+		l2Table := make([]l2TableEntry, w.clusterSize/8)
+		for i := range l2Table {
+			l2Table[i] = l2TableEntry(binary.BigEndian.Uint64(buf[i*8:]))
+		}
+		w.l2TableCache.Add(newEntry, l2Table)
+	}
+	if oldOffset != 0 {
+		if err := w.updateRefcount(oldOffset/uint64(w.clusterSize), -1); err != nil {
+			return 0, err
+		}
+	}
+	return newOffset, nil
+}
+
+// findFreeClusters returns the first cluster of n contiguous free clusters,
+// without allocating them.
+func (w *WritableQcow2) findFreeClusters(n uint64) (uint64, error) {
+	start := w.freeHint
+	for c := start; ; c++ {
+		refcount, err := w.refcounts.get(c)
+		if err != nil {
+			return 0, err
+		}
+		if refcount != 0 {
+			start = c + 1
+		} else if c+1-start == n {
+			return start, nil
+		}
+	}
+}
+
+// allocateClusters allocates n contiguous clusters and returns the offset of
+// the first one.
+func (w *WritableQcow2) allocateClusters(n uint64) (uint64, error) {
+	first, err := w.findFreeClusters(n)
+	if err != nil {
+		return 0, err
+	}
+	// Refcount blocks allocated while updating the refcounts must not
+	// reuse these clusters.
+	hint := w.freeHint
+	w.freeHint = first + n
+	for c := first; c < first+n; c++ {
+		if err := w.updateRefcount(c, 1); err != nil {
+			return 0, err
+		}
+	}
+	if n > 1 {
+		// There may be free clusters before first.
+		w.freeHint = min(w.freeHint, hint)
+	}
+	return first * uint64(w.clusterSize), nil
+}
+
+// updateRefcount adds delta to the refcount of the cluster.
+func (w *WritableQcow2) updateRefcount(cluster uint64, delta int64) error {
+	refcount, err := w.refcounts.get(cluster)
+	if err != nil {
+		return err
+	}
+	switch {
+	case delta < 0 && refcount < uint64(-delta):
+		return fmt.Errorf("refcount of cluster %d would become negative", cluster)
+	case delta > 0 && w.refcounts.max()-refcount < uint64(delta):
+		return fmt.Errorf("refcount of cluster %d would exceed %d", cluster, w.refcounts.max())
+	}
+	return w.setRefcount(cluster, uint64(int64(refcount)+delta))
+}
+
+// setRefcount sets the refcount of the cluster, allocating refcount blocks
+// and growing the refcount table as needed.
+func (w *WritableQcow2) setRefcount(cluster, refcount uint64) error {
+	rc := w.refcounts
+	idx := cluster / rc.perBlock()
+	if idx >= uint64(len(rc.table)) {
+		if err := w.growRefcountTable(idx + 1); err != nil {
+			return err
+		}
+	}
+	block, err := rc.block(idx)
+	if err != nil {
+		return err
+	}
+	if block == nil {
+		if block, err = w.allocateRefcountBlock(idx); err != nil {
+			return err
+		}
+	}
+	i := cluster % rc.perBlock()
+	setRefcount(block, i, rc.bits, refcount)
+	if refcount == 0 && cluster < w.freeHint {
+		w.freeHint = cluster
+	}
+	if refcount == 0 && w.compressedOffset != 0 && cluster == (w.compressedOffset-1)/uint64(w.clusterSize) {
+		w.compressedOffset = 0
+	}
+	blockOffset := rc.table[idx].blockOffset()
+	if w.lazyRefcounts {
+		w.dirtyBlocks[blockOffset] = true
+		return nil
+	}
+	begin, end := refcountRange(i, rc.bits)
+	if _, err := w.rw.WriteAt(block[begin:end], int64(blockOffset+begin)); err != nil {
+		return fmt.Errorf("failed to write refcount block at offset %d: %w", blockOffset, err)
+	}
+	return nil
+}
+
+// allocateRefcountBlock allocates the refcount block for the refcount table
+// index.
+func (w *WritableQcow2) allocateRefcountBlock(idx uint64) ([]byte, error) {
+	rc := w.refcounts
+	first, err := w.findFreeClusters(1)
+	if err != nil {
+		return nil, err
+	}
+	w.freeHint = max(w.freeHint, first+1)
+	off := first * uint64(w.clusterSize)
+	block := make([]byte, w.clusterSize)
+	if _, err := w.rw.WriteAt(block, int64(off)); err != nil {
+		return nil, fmt.Errorf("failed to write refcount block at offset %d: %w", off, err)
+	}
+	rc.blocks[off] = block
+	rc.table[idx] = refcountTableEntry(off)
+	if err := w.writeUint64(off, int64(w.RefcountTableOffset+idx*8)); err != nil {
+		return nil, fmt.Errorf("failed to write refcount table entry %d: %w", idx, err)
+	}
+	// The block may describe itself.
+	if err := w.updateRefcount(first, 1); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// growRefcountTable moves the refcount table to new clusters with at least
+// entries entries.
+func (w *WritableQcow2) growRefcountTable(entries uint64) error {
+	rc := w.refcounts
+	clusterSize := uint64(w.clusterSize)
+	oldOffset, oldClusters := w.RefcountTableOffset, uint64(w.RefcountTableClusters)
+	newClusters := max((entries*8+clusterSize-1)/clusterSize, oldClusters*2)
+	if newClusters*clusterSize > maxRefcountTableSize {
+		return fmt.Errorf("refcount table too large (%d bytes > %d bytes)", newClusters*clusterSize, maxRefcountTableSize)
+	}
+	first, err := w.findFreeClusters(newClusters)
+	if err != nil {
+		return err
+	}
+	hint := w.freeHint
+	w.freeHint = max(w.freeHint, first+newClusters)
+	newOffset := first * clusterSize
+
+	table := make([]refcountTableEntry, newClusters*clusterSize/8)
+	copy(table, rc.table)
+	buf := make([]byte, len(table)*8)
+	for i, entry := range table {
+		binary.BigEndian.PutUint64(buf[i*8:], uint64(entry))
+	}
+	if _, err := w.rw.WriteAt(buf, int64(newOffset)); err != nil {
+		return fmt.Errorf("failed to write refcount table at offset %d: %w", newOffset, err)
+	}
+	var hdr [12]byte
+	binary.BigEndian.PutUint64(hdr[:], newOffset)
+	binary.BigEndian.PutUint32(hdr[8:], uint32(newClusters))
+	if _, err := w.rw.WriteAt(hdr[:], headerOffsetRefcountTableOffset); err != nil {
+		return fmt.Errorf("failed to update refcount table in header: %w", err)
+	}
+	rc.table = table
+	w.RefcountTableOffset = newOffset
+	w.RefcountTableClusters = uint32(newClusters)
+
+	for c := first; c < first+newClusters; c++ {
+		if err := w.updateRefcount(c, 1); err != nil {
+			return err
+		}
+	}
+	for c := oldOffset / clusterSize; c < oldOffset/clusterSize+oldClusters; c++ {
+		if err := w.updateRefcount(c, -1); err != nil {
+			return err
+		}
+	}
+	w.freeHint = min(w.freeHint, hint)
+	return nil
+}
+
+// repairRefcounts sets the refcounts to the number of references.
+func (w *WritableQcow2) repairRefcounts() error {
+	c, err := w.Qcow2.check()
+	if err != nil {
+		return err
+	}
+	if c.res.CheckErrors > 0 {
+		return fmt.Errorf("%d errors occurred while checking the image", c.res.CheckErrors)
+	}
+	// Clusters allocated during repair must be beyond the checked clusters,
+	// so refcounts are increased before leaks are freed.
+	w.freeHint = c.clusters
+	for _, increase := range []bool{true, false} {
+		for i := uint64(0); i < c.clusters; i++ {
+			var computed uint64
+			if i < uint64(len(c.refcounts)) {
+				computed = c.refcounts[i]
+			}
+			actual, err := w.refcounts.get(i)
+			if err != nil {
+				return err
+			}
+			if computed == actual || (computed > actual) != increase {
+				continue
+			}
+			if computed > w.refcounts.max() {
+				return fmt.Errorf("cluster %d has too many references (%d)", i, computed)
+			}
+			if err := w.setRefcount(i, computed); err != nil {
+				return err
+			}
+		}
+	}
+	w.freeHint = 0
+	return w.flush()
+}
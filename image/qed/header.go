@@ -0,0 +1,131 @@
+package qed
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+)
+
+// Magic is the magic of QED images, "QED\0".
+const Magic = "QED\x00"
+
+// headerSize is the size of the header fields, including the backing file
+// fields.
+const headerSize = 64
+
+// Limits from qemu.
+const (
+	minClusterSize = 4 << 10
+	maxClusterSize = 64 << 20
+	minTableSize   = 1
+	maxTableSize   = 16
+)
+
+// Features.
+const (
+	// FeaturesBackingFile is set if the image has a backing file.
+	FeaturesBackingFile = 1 << 0
+	// FeaturesNeedCheck is set if the image was not closed properly, and may
+	// have inconsistent tables.
+	FeaturesNeedCheck = 1 << 1
+	// FeaturesBackingFormatNoProbe is set if the backing file is a raw image.
+	FeaturesBackingFormatNoProbe = 1 << 2
+
+	knownFeatures = FeaturesBackingFile | FeaturesNeedCheck | FeaturesBackingFormatNoProbe
+)
+
+// Header is the header of a QED image.
+type Header struct {
+	Magic [4]byte `json:"-"`
+	// ClusterSize is the size of a cluster in bytes.
+	ClusterSize uint32 `json:"cluster_size"`
+	// TableSize is the size of L1 and L2 tables in clusters.
+	TableSize uint32 `json:"table_size"`
+	// HeaderSize is the size of the header in clusters.
+	HeaderSize        uint32 `json:"header_size"`
+	Features          uint64 `json:"features"`
+	CompatFeatures    uint64 `json:"compat_features"`
+	AutoclearFeatures uint64 `json:"autoclear_features"`
+	L1TableOffset     uint64 `json:"l1_table_offset"`
+	ImageSize         uint64 `json:"image_size"`
+	// BackingFilenameOffset is the offset of the backing file name from the
+	// start of the header, if FeaturesBackingFile is set.
+	BackingFilenameOffset uint32 `json:"backing_filename_offset"`
+	BackingFilenameSize   uint32 `json:"backing_filename_size"`
+}
+
+// NeedCheck returns true if the image was not closed properly. Like qemu, such
+// images can be read, but the data may be inconsistent.
+func (h *Header) NeedCheck() bool {
+	return h.Features&FeaturesNeedCheck != 0
+}
+
+// readHeader reads the header. Returns [ErrNotQed] if the magic does not match.
+func readHeader(ra io.ReaderAt) (*Header, error) {
+	b := make([]byte, headerSize)
+	if _, err := ra.ReadAt(b, 0); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read the header: %w", err)
+	}
+	if !bytes.HasPrefix(b, []byte(Magic)) {
+		return nil, ErrNotQed
+	}
+	var h Header
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// validate returns an error if the image cannot be read, like qemu.
+func (h *Header) validate() error {
+	if unknown := h.Features &^ knownFeatures; unknown != 0 {
+		return fmt.Errorf("%w: features %#x", ErrUnsupportedFeature, unknown)
+	}
+	if h.ClusterSize < minClusterSize || h.ClusterSize > maxClusterSize || bits.OnesCount32(h.ClusterSize) != 1 {
+		return fmt.Errorf("invalid cluster size %d", h.ClusterSize)
+	}
+	if h.TableSize < minTableSize || h.TableSize > maxTableSize || bits.OnesCount32(h.TableSize) != 1 {
+		return fmt.Errorf("invalid table size %d", h.TableSize)
+	}
+	if h.HeaderSize == 0 {
+		return errors.New("invalid header size 0")
+	}
+	if h.ImageSize%512 != 0 {
+		return fmt.Errorf("invalid image size %d (not a multiple of 512)", h.ImageSize)
+	}
+	if h.ImageSize > h.maxImageSize() {
+		return fmt.Errorf("invalid image size %d (more than %d)", h.ImageSize, h.maxImageSize())
+	}
+	if h.L1TableOffset == 0 || h.L1TableOffset%uint64(h.ClusterSize) != 0 {
+		return fmt.Errorf("invalid L1 table offset %d", h.L1TableOffset)
+	}
+	if h.Features&FeaturesBackingFile != 0 {
+		end := uint64(h.BackingFilenameOffset) + uint64(h.BackingFilenameSize)
+		if end > uint64(h.HeaderSize)*uint64(h.ClusterSize) {
+			return fmt.Errorf("the backing file name (%d bytes at offset %d) is beyond the header", h.BackingFilenameSize, h.BackingFilenameOffset)
+		}
+	}
+	return nil
+}
+
+// tableEntries returns the number of entries of L1 and L2 tables.
+func (h *Header) tableEntries() uint64 {
+	return uint64(h.TableSize) * uint64(h.ClusterSize) / 8
+}
+
+// maxImageSize returns the size mapped by a full L1 table, limited to
+// [math.MaxInt64].
+func (h *Header) maxImageSize() uint64 {
+	n := h.tableEntries()
+	hi, l2Size := bits.Mul64(n, uint64(h.ClusterSize))
+	if hi == 0 {
+		if hi, size := bits.Mul64(l2Size, n); hi == 0 && size <= math.MaxInt64 {
+			return size
+		}
+	}
+	return math.MaxInt64
+}
@@ -0,0 +1,471 @@
+package qed
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+
+	"github.com/lima-vm/go-qcow2reader/image"
+	"github.com/lima-vm/go-qcow2reader/image/raw"
+	"github.com/lima-vm/go-qcow2reader/log"
+	"github.com/lima-vm/go-qcow2reader/lru"
+)
+
+const Type = image.Type("qed")
+
+// DefaultMaxBackingChainDepth is the default maximum number of backing images
+// below an image.
+const DefaultMaxBackingChainDepth = image.DefaultMaxBackingChainDepth
+
+// With the default cluster size (64 KiB) and table size (4 clusters), a L2
+// table uses 256 KiB.
+const maxL2Tables = 32
+
+// zeroCluster is the L2 table entry of clusters read as zeros.
+const zeroCluster = 1
+
+var (
+	ErrNotQed                 = fmt.Errorf("%w: image is not %s", image.ErrWrongType, Type)
+	ErrUnsupportedFeature     = errors.New("unsupported feature")
+	ErrUnsupportedBackingFile = image.ErrUnsupportedBackingFile
+	ErrBackingChainTooDeep    = image.ErrBackingChainTooDeep
+	ErrBackingChainLoop       = image.ErrBackingChainLoop
+
+	ErrBackingFileFormatRequired = image.ErrBackingFileFormatRequired
+)
+
+// Qed implements [image.Image] for QED images.
+type Qed struct {
+	ra     io.ReaderAt
+	Header *Header `json:"header"`
+	// BackingFileFormat is "raw" if the backing file must not be probed, or
+	// empty.
+	BackingFile         string     `json:"backing_file,omitempty"`
+	BackingFileFormat   image.Type `json:"backing_file_format,omitempty"`
+	BackingFileFullPath string     `json:"backing_file_full_path,omitempty"`
+	backingImage        image.Image
+	errUnreadable       error
+	clusterSize         int64
+	tableEntries        int64
+	l1Table             []uint64
+	l2TableCache        *lru.Cache[uint64, []uint64]
+	fileSize            int64
+}
+
+type Option func(*options)
+
+type options struct {
+	backingFileResolver  image.FileResolver
+	maxBackingChainDepth int
+	requireBackingFormat bool
+	name                 string
+	openBackingFile      image.OpenBackingFile
+	depth                int
+	chain                []string
+}
+
+// WithBackingFileResolver sets the [image.FileResolver] used to open backing
+// files. The default is [image.OSFileResolver].
+func WithBackingFileResolver(r image.FileResolver) Option {
+	return func(o *options) {
+		o.backingFileResolver = r
+	}
+}
+
+// WithMaxBackingChainDepth sets the maximum number of backing images below the
+// image. The default is [DefaultMaxBackingChainDepth].
+func WithMaxBackingChainDepth(n int) Option {
+	return func(o *options) {
+		o.maxBackingChainDepth = n
+	}
+}
+
+// WithBackingFileFormatRequired refuses backing files without the raw format
+// flag ([FeaturesBackingFormatNoProbe]) with [ErrBackingFileFormatRequired],
+// instead of probing their format.
+func WithBackingFileFormatRequired() Option {
+	return func(o *options) {
+		o.requireBackingFormat = true
+	}
+}
+
+// WithBackingChain sets the resolved names of the images above the image, from
+// the top image, when the image is the backing file of an image of another
+// format. The names count in the depth of the backing chain and are used to
+// detect loops.
+func WithBackingChain(chain []string) Option {
+	return func(o *options) {
+		o.depth = len(chain)
+		o.chain = chain
+	}
+}
+
+// WithBackingFileOpener sets the [image.OpenBackingFile] used instead of
+// openWithType to open backing files of other formats. It is passed the names
+// of the images above the backing file, so that the depth of the backing chain
+// is limited and loops are detected across formats.
+func WithBackingFileOpener(open image.OpenBackingFile) Option {
+	return func(o *options) {
+		o.openBackingFile = open
+	}
+}
+
+// WithName sets the name of the image, used as base to resolve backing files.
+// By default, the name of the file is used if ra implements Name() and no
+// [image.FileResolver] is set.
+func WithName(name string) Option {
+	return func(o *options) {
+		o.name = name
+	}
+}
+
+// Open opens a QED image.
+//
+// Backing files are resolved relative to the image (see
+// [WithBackingFileResolver]), and closed with the image. QED and raw backing
+// images are opened by this package; other formats are probed with
+// openWithType or the opener set with [WithBackingFileOpener], which may be
+// unset if backing files of other formats are not needed.
+//
+// Like qemu, images with the need check flag set can be read (see
+// [Header.NeedCheck]).
+func Open(ra io.ReaderAt, openWithType image.OpenWithType, opts ...Option) (*Qed, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.name == "" && o.backingFileResolver == nil {
+		if namer, ok := ra.(interface{ Name() string }); ok {
+			o.name = namer.Name()
+		}
+	}
+	if o.backingFileResolver == nil {
+		o.backingFileResolver = image.OSFileResolver
+	}
+	if o.maxBackingChainDepth == 0 {
+		o.maxBackingChainDepth = DefaultMaxBackingChainDepth
+	}
+	return open(ra, openWithType, &o)
+}
+
+func open(ra io.ReaderAt, openWithType image.OpenWithType, o *options) (*Qed, error) {
+	h, err := readHeader(ra)
+	if err != nil {
+		return nil, err
+	}
+	img := &Qed{ra: ra, Header: h, fileSize: fileSize(ra)}
+	img.errUnreadable = img.load(openWithType, o)
+	return img, nil
+}
+
+func (img *Qed) load(openWithType image.OpenWithType, o *options) error {
+	h := img.Header
+	if err := h.validate(); err != nil {
+		return err
+	}
+	if h.NeedCheck() {
+		log.Warnf("qed: the image was not closed properly, the data may be inconsistent")
+	}
+	img.clusterSize = int64(h.ClusterSize)
+	img.tableEntries = int64(h.tableEntries())
+	l2Size := img.tableEntries * img.clusterSize
+	// Read only the L1 entries mapping the image.
+	img.l1Table = make([]uint64, (int64(h.ImageSize)+l2Size-1)/l2Size)
+	if err := img.readTable(img.l1Table, h.L1TableOffset); err != nil {
+		return fmt.Errorf("failed to read the L1 table: %w", err)
+	}
+	img.l2TableCache = lru.New[uint64, []uint64](maxL2Tables)
+	if h.Features&FeaturesBackingFile != 0 {
+		return img.loadBackingFile(openWithType, o)
+	}
+	return nil
+}
+
+func (img *Qed) readTable(table []uint64, off uint64) error {
+	if img.fileSize >= 0 && int64(off)+int64(len(table))*8 > img.fileSize {
+		return fmt.Errorf("the table at offset %d is beyond the end of the file", off)
+	}
+	return binary.Read(io.NewSectionReader(img.ra, int64(off), int64(len(table))*8), binary.LittleEndian, table)
+}
+
+// loadBackingFile opens the backing image. QED backing images are opened with
+// the options of this image, to limit the depth of the chain and detect loops.
+// Raw backing images are opened with [raw.Open], other formats with
+// openWithType.
+func (img *Qed) loadBackingFile(openWithType image.OpenWithType, o *options) error {
+	if o.depth >= o.maxBackingChainDepth {
+		return fmt.Errorf("%w: %w (more than %d images)", ErrUnsupportedBackingFile, ErrBackingChainTooDeep, o.maxBackingChainDepth)
+	}
+	h := img.Header
+	b := make([]byte, h.BackingFilenameSize)
+	if _, err := img.ra.ReadAt(b, int64(h.BackingFilenameOffset)); err != nil {
+		return fmt.Errorf("failed to read the backing file name: %w", err)
+	}
+	img.BackingFile = string(b)
+	if h.Features&FeaturesBackingFormatNoProbe != 0 {
+		img.BackingFileFormat = raw.Type
+	}
+	if o.requireBackingFormat && img.BackingFileFormat == "" {
+		return fmt.Errorf("%w: %w (file %q)", ErrUnsupportedBackingFile, ErrBackingFileFormatRequired, img.BackingFile)
+	}
+	ra, resolved, err := o.backingFileResolver(o.name, img.BackingFile)
+	if err != nil {
+		return fmt.Errorf("%w: failed to open %q: %w", ErrUnsupportedBackingFile, img.BackingFile, err)
+	}
+	img.BackingFileFullPath = resolved
+	// Unknown names are kept to count the depth in other formats.
+	chain := append(slices.Clip(o.chain), o.name)
+	if resolved != "" && slices.Contains(chain, resolved) {
+		closeReaderAt(ra)
+		return fmt.Errorf("%w: %w (file %q)", ErrUnsupportedBackingFile, ErrBackingChainLoop, resolved)
+	}
+
+	if img.BackingFileFormat == raw.Type {
+		img.backingImage, _ = raw.Open(ra)
+		if img.backingImage.Size() < 0 {
+			return fmt.Errorf("%w (file %q): unknown size", ErrUnsupportedBackingFile, resolved)
+		}
+		return nil
+	}
+	backingOptions := *o
+	backingOptions.name = resolved
+	backingOptions.depth++
+	backingOptions.chain = chain
+	backing, err := open(ra, openWithType, &backingOptions)
+	switch {
+	case err == nil:
+		img.backingImage = backing
+		// Report errors of the backing chain on the top image.
+		if err := backing.Readable(); errors.Is(err, ErrUnsupportedBackingFile) {
+			return err
+		}
+		return nil
+	case !errors.Is(err, image.ErrWrongType):
+		closeReaderAt(ra)
+		return fmt.Errorf("%w (file %q): %w", ErrUnsupportedBackingFile, resolved, err)
+	case o.openBackingFile != nil:
+		img.backingImage, err = o.openBackingFile(ra, "", chain)
+	case openWithType != nil:
+		img.backingImage, err = openWithType(ra, "")
+	default:
+		closeReaderAt(ra)
+		return fmt.Errorf("%w (file %q): no opener", ErrUnsupportedBackingFile, resolved)
+	}
+	if err != nil {
+		if img.backingImage != nil {
+			_ = img.backingImage.Close()
+			img.backingImage = nil
+		} else {
+			closeReaderAt(ra)
+		}
+		return fmt.Errorf("%w (file %q): %w", ErrUnsupportedBackingFile, resolved, err)
+	}
+	// Errors of other formats may be about their own files, e.g. extents.
+	if err := img.backingImage.Readable(); err != nil {
+		if errors.Is(err, ErrUnsupportedBackingFile) {
+			return err
+		}
+		return fmt.Errorf("%w (file %q): %w", ErrUnsupportedBackingFile, resolved, err)
+	}
+	return nil
+}
+
+// fileSize returns the size of ra, or -1 if the size is unknown.
+func fileSize(ra io.ReaderAt) int64 {
+	// Implemented by [os.File] and files of most [fs.FS] implementations.
+	if f, ok := ra.(interface{ Stat() (fs.FileInfo, error) }); ok {
+		if st, err := f.Stat(); err == nil {
+			return st.Size()
+		}
+	}
+	if s, ok := ra.(interface{ Size() int64 }); ok {
+		return s.Size()
+	}
+	return -1
+}
+
+func closeReaderAt(ra io.ReaderAt) {
+	if closer, ok := ra.(io.Closer); ok {
+		_ = closer.Close()
+	}
+}
+
+func (img *Qed) Close() error {
+	var err error
+	if img.backingImage != nil {
+		err = img.backingImage.Close()
+	}
+	if closer, ok := img.ra.(io.Closer); ok {
+		if err2 := closer.Close(); err2 != nil {
+			if err != nil {
+				log.Warn(err)
+			}
+			err = err2
+		}
+	}
+	return err
+}
+
+func (img *Qed) Type() image.Type {
+	return Type
+}
+
+func (img *Qed) Size() int64 {
+	return int64(img.Header.ImageSize)
+}
+
+// Readable returns nil if the image is readable, otherwise returns an error.
+func (img *Qed) Readable() error {
+	return img.errUnreadable
+}
+
+// checkOffset returns an error if off is not a valid offset of a cluster or a
+// table in the file.
+func (img *Qed) checkOffset(off uint64) error {
+	if off%uint64(img.clusterSize) != 0 || img.fileSize >= 0 && off >= uint64(img.fileSize) {
+		return fmt.Errorf("invalid offset %d", off)
+	}
+	return nil
+}
+
+// clusterEntry returns the L2 table entry of the cluster containing off: the
+// offset of the data, 0 for unallocated clusters, or zeroCluster.
+func (img *Qed) clusterEntry(off int64) (uint64, error) {
+	l2Size := img.tableEntries * img.clusterSize
+	l2Offset := img.l1Table[off/l2Size]
+	if l2Offset == 0 {
+		return 0, nil
+	}
+	l2Table, ok := img.l2TableCache.Get(l2Offset)
+	if !ok {
+		if err := img.checkOffset(l2Offset); err != nil {
+			return 0, fmt.Errorf("L2 table: %w", err)
+		}
+		l2Table = make([]uint64, img.tableEntries)
+		if err := img.readTable(l2Table, l2Offset); err != nil {
+			return 0, fmt.Errorf("failed to read the L2 table at offset %d: %w", l2Offset, err)
+		}
+		img.l2TableCache.Add(l2Offset, l2Table)
+	}
+	entry := l2Table[off%l2Size/img.clusterSize]
+	if entry > zeroCluster {
+		if err := img.checkOffset(entry); err != nil {
+			return 0, fmt.Errorf("cluster at offset %d: %w", off, err)
+		}
+	}
+	return entry, nil
+}
+
+// ReadAt implements [io.ReaderAt].
+func (img *Qed) ReadAt(p []byte, off int64) (int, error) {
+	if img.errUnreadable != nil {
+		return 0, img.errUnreadable
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	size := img.Size()
+	if off >= size {
+		return 0, io.EOF
+	}
+	var eof bool
+	if off+int64(len(p)) > size {
+		p = p[:size-off]
+		eof = true
+	}
+	var n int
+	for n < len(p) {
+		currentOff := off + int64(n)
+		entry, err := img.clusterEntry(currentOff)
+		if err != nil {
+			return n, err
+		}
+		inCluster := currentOff % img.clusterSize
+		end := n + int(min(int64(len(p)-n), img.clusterSize-inCluster))
+		switch entry {
+		case 0:
+			if err := img.readBacking(p[n:end], currentOff); err != nil {
+				return n, err
+			}
+		case zeroCluster:
+			clear(p[n:end])
+		default:
+			dataOffset := int64(entry) + inCluster
+			if _, err := img.ra.ReadAt(p[n:end], dataOffset); err != nil {
+				return n, fmt.Errorf("failed to read data at offset %d: %w", dataOffset, err)
+			}
+		}
+		n = end
+	}
+	if eof {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readBacking reads unallocated data at off from the backing image.
+func (img *Qed) readBacking(p []byte, off int64) error {
+	var n int
+	if img.backingImage != nil && off < img.backingImage.Size() {
+		var err error
+		n, err = img.backingImage.ReadAt(p, off)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+	}
+	// Data beyond the end of the backing image is read as zeros.
+	clear(p[n:])
+	return nil
+}
+
+// Extent returns the next extent starting at start, with the same allocation
+// and zero status, limited to length. Zero clusters are allocated and read as
+// zeros.
+func (img *Qed) Extent(start, length int64) (image.Extent, error) {
+	var current image.Extent
+	if img.errUnreadable != nil {
+		return current, img.errUnreadable
+	}
+	if start < 0 || start+length > img.Size() {
+		return current, errors.New("length out of bounds")
+	}
+	for length > 0 {
+		entry, err := img.clusterEntry(start)
+		if err != nil {
+			return current, err
+		}
+		n := min(length, img.clusterSize-start%img.clusterSize)
+		status := image.Extent{Start: start, Length: n, Allocated: entry != 0, Zero: entry == zeroCluster}
+		if entry == 0 {
+			if img.backingImage == nil || start >= img.backingImage.Size() {
+				status.Zero = true
+			} else {
+				backing, err := img.backingImage.Extent(start, min(n, img.backingImage.Size()-start))
+				if err != nil {
+					return current, err
+				}
+				status.Allocated, status.Zero = backing.Allocated, backing.Zero
+				n = min(n, backing.Length)
+				status.Length = n
+			}
+		}
+		if current.Length == 0 {
+			current = status
+		} else if sameStatus(current, status) {
+			current.Length += n
+		} else {
+			break
+		}
+		start += n
+		length -= n
+	}
+	return current, nil
+}
+
+// Return true if extents have the same status.
+func sameStatus(a, b image.Extent) bool {
+	return a.Allocated == b.Allocated && a.Zero == b.Zero && a.Compressed == b.Compressed
+}
@@ -0,0 +1,303 @@
+package qed
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/lima-vm/go-qcow2reader/image"
+	"github.com/lima-vm/go-qcow2reader/test/imagetest"
+	"github.com/lima-vm/go-qcow2reader/test/qemuimg"
+	"github.com/lima-vm/go-qcow2reader/test/qemuio"
+)
+
+const (
+	testClusterSize = 4096
+	// With table size 1, a L2 table maps 512 clusters (2 MiB).
+	testL2Size = testClusterSize / 8 * testClusterSize
+)
+
+type testImage struct {
+	size int64
+	// layout has a character for each cluster: "a" for allocated, "z" for a
+	// zero cluster, and "u" for unallocated. Clusters after the layout are
+	// unallocated.
+	layout   string
+	features uint64
+	backing  string
+	seed     int64
+}
+
+// createTestImage creates an image with the header and the backing file name in
+// cluster 0, the L1 table in cluster 1, and the L2 tables and the data after.
+// Returns the image and the data of the allocated clusters.
+func createTestImage(t *testing.T, ti testImage) ([]byte, []byte) {
+	r := rand.New(rand.NewSource(ti.seed))
+	h := Header{
+		ClusterSize:   testClusterSize,
+		TableSize:     1,
+		HeaderSize:    1,
+		Features:      ti.features,
+		L1TableOffset: testClusterSize,
+		ImageSize:     uint64(ti.size),
+	}
+	copy(h.Magic[:], Magic)
+	if ti.backing != "" {
+		h.Features |= FeaturesBackingFile
+		h.BackingFilenameOffset = headerSize
+		h.BackingFilenameSize = uint32(len(ti.backing))
+	}
+	img := make([]byte, 2*testClusterSize)
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, h); err != nil {
+		t.Fatal(err)
+	}
+	copy(img, buf.Bytes())
+	copy(img[headerSize:], ti.backing)
+
+	want := make([]byte, ti.size)
+	for i, c := range ti.layout {
+		if c == 'u' {
+			continue
+		}
+		l1Entry := img[testClusterSize+int64(i)*testClusterSize/testL2Size*8:][:8]
+		l2Offset := binary.LittleEndian.Uint64(l1Entry)
+		if l2Offset == 0 {
+			l2Offset = uint64(len(img))
+			binary.LittleEndian.PutUint64(l1Entry, l2Offset)
+			img = append(img, make([]byte, testClusterSize)...)
+		}
+		l2Entry := img[l2Offset+uint64(i%(testL2Size/testClusterSize))*8:][:8]
+		switch c {
+		case 'a':
+			binary.LittleEndian.PutUint64(l2Entry, uint64(len(img)))
+			data := make([]byte, testClusterSize)
+			if _, err := r.Read(data); err != nil {
+				t.Fatal(err)
+			}
+			copy(want[i*testClusterSize:], data)
+			img = append(img, data...)
+		case 'z':
+			binary.LittleEndian.PutUint64(l2Entry, zeroCluster)
+		default:
+			t.Fatalf("invalid layout %q", ti.layout)
+		}
+	}
+	return img, want
+}
+
+func TestQed(t *testing.T) {
+	const size = 2*testL2Size + 3*512
+	data, want := createTestImage(t, testImage{
+		size:   size,
+		layout: "aazu" + strings.Repeat("u", 508) + "aa" + strings.Repeat("u", 510) + "a",
+		seed:   1,
+	})
+	img, err := Open(bytes.NewReader(data), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Readable(); err != nil {
+		t.Fatal(err)
+	}
+	if img.Size() != size {
+		t.Fatalf("expected size %d, got %d", size, img.Size())
+	}
+	if !bytes.Equal(imagetest.ReadAll(t, img), want) {
+		t.Fatal("unexpected data")
+	}
+	wantExtents := []image.Extent{
+		{Start: 0, Length: 2 * testClusterSize, Allocated: true},
+		{Start: 2 * testClusterSize, Length: testClusterSize, Allocated: true, Zero: true},
+		{Start: 3 * testClusterSize, Length: 509 * testClusterSize, Zero: true},
+		{Start: 512 * testClusterSize, Length: 2 * testClusterSize, Allocated: true},
+		{Start: 514 * testClusterSize, Length: 510 * testClusterSize, Zero: true},
+		{Start: 1024 * testClusterSize, Length: 3 * 512, Allocated: true},
+	}
+	if extents := imagetest.ReadExtents(t, img); !reflect.DeepEqual(extents, wantExtents) {
+		t.Fatalf("expected extents\n%+v\ngot\n%+v", wantExtents, extents)
+	}
+}
+
+func TestBackingFile(t *testing.T) {
+	const size = 4 * testClusterSize
+	rawBase := make([]byte, 3*testClusterSize-512)
+	if _, err := rand.New(rand.NewSource(1)).Read(rawBase); err != nil {
+		t.Fatal(err)
+	}
+	qedBase, wantQedBase := createTestImage(t, testImage{size: size, layout: "aaua", seed: 2})
+	overRaw, wantOverRaw := createTestImage(t, testImage{
+		size:     size,
+		layout:   "uzau",
+		backing:  "base.raw",
+		features: FeaturesBackingFormatNoProbe,
+		seed:     3,
+	})
+	overQed, wantOverQed := createTestImage(t, testImage{size: size, layout: "uzau", backing: "../base/base.qed", seed: 3})
+	loop, _ := createTestImage(t, testImage{size: size, backing: "loop.qed"})
+	missing, _ := createTestImage(t, testImage{size: size, backing: "missing.qed"})
+	probeRaw, _ := createTestImage(t, testImage{size: size, backing: "base.raw"})
+	fsys := fstest.MapFS{
+		"vm/base.raw":      &fstest.MapFile{Data: rawBase},
+		"base/base.qed":    &fstest.MapFile{Data: qedBase},
+		"vm/over-raw.qed":  &fstest.MapFile{Data: overRaw},
+		"vm/over-qed.qed":  &fstest.MapFile{Data: overQed},
+		"vm/loop.qed":      &fstest.MapFile{Data: loop},
+		"vm/missing.qed":   &fstest.MapFile{Data: missing},
+		"vm/probe-raw.qed": &fstest.MapFile{Data: probeRaw},
+	}
+	openFS := func(name string) *Qed {
+		t.Helper()
+		img, err := Open(bytes.NewReader(fsys[name].Data), nil, WithBackingFileResolver(image.FSFileResolver(fsys)), WithName(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = img.Close() })
+		return img
+	}
+
+	t.Run("raw", func(t *testing.T) {
+		img := openFS("vm/over-raw.qed")
+		if err := img.Readable(); err != nil {
+			t.Fatal(err)
+		}
+		if img.BackingFileFormat != "raw" || img.BackingFileFullPath != "vm/base.raw" {
+			t.Fatalf("unexpected backing file %q (%q)", img.BackingFileFullPath, img.BackingFileFormat)
+		}
+		// Data beyond the end of the backing file is read as zeros.
+		want := make([]byte, size)
+		copy(want, rawBase)
+		clear(want[testClusterSize:][:testClusterSize])
+		copy(want[2*testClusterSize:], wantOverRaw[2*testClusterSize:][:testClusterSize])
+		if !bytes.Equal(imagetest.ReadAll(t, img), want) {
+			t.Fatal("unexpected data")
+		}
+		wantExtents := []image.Extent{
+			{Start: 0, Length: testClusterSize, Allocated: true},
+			{Start: testClusterSize, Length: testClusterSize, Allocated: true, Zero: true},
+			{Start: 2 * testClusterSize, Length: testClusterSize, Allocated: true},
+			{Start: 3 * testClusterSize, Length: testClusterSize, Zero: true},
+		}
+		if extents := imagetest.ReadExtents(t, img); !reflect.DeepEqual(extents, wantExtents) {
+			t.Fatalf("expected extents\n%+v\ngot\n%+v", wantExtents, extents)
+		}
+	})
+
+	t.Run("qed", func(t *testing.T) {
+		img := openFS("vm/over-qed.qed")
+		if err := img.Readable(); err != nil {
+			t.Fatal(err)
+		}
+		if img.BackingFileFormat != "" || img.BackingFileFullPath != "base/base.qed" {
+			t.Fatalf("unexpected backing file %q (%q)", img.BackingFileFullPath, img.BackingFileFormat)
+		}
+		want := bytes.Clone(wantQedBase)
+		clear(want[testClusterSize:][:testClusterSize])
+		copy(want[2*testClusterSize:], wantOverQed[2*testClusterSize:][:testClusterSize])
+		if !bytes.Equal(imagetest.ReadAll(t, img), want) {
+			t.Fatal("unexpected data")
+		}
+		wantExtents := []image.Extent{
+			{Start: 0, Length: testClusterSize, Allocated: true},
+			{Start: testClusterSize, Length: testClusterSize, Allocated: true, Zero: true},
+			{Start: 2 * testClusterSize, Length: 2 * testClusterSize, Allocated: true},
+		}
+		if extents := imagetest.ReadExtents(t, img); !reflect.DeepEqual(extents, wantExtents) {
+			t.Fatalf("expected extents\n%+v\ngot\n%+v", wantExtents, extents)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		if err := openFS("vm/loop.qed").Readable(); !errors.Is(err, ErrBackingChainLoop) {
+			t.Fatalf("expected ErrBackingChainLoop, got %v", err)
+		}
+		if err := openFS("vm/missing.qed").Readable(); !errors.Is(err, ErrUnsupportedBackingFile) {
+			t.Fatalf("expected ErrUnsupportedBackingFile, got %v", err)
+		}
+		// Probing backing files of other formats needs an opener.
+		if err := openFS("vm/probe-raw.qed").Readable(); !errors.Is(err, ErrUnsupportedBackingFile) {
+			t.Fatalf("expected ErrUnsupportedBackingFile, got %v", err)
+		}
+	})
+}
+
+func TestNeedCheck(t *testing.T) {
+	data, want := createTestImage(t, testImage{size: 2 * testClusterSize, layout: "a", features: FeaturesNeedCheck, seed: 1})
+	img, err := Open(bytes.NewReader(data), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !img.Header.NeedCheck() {
+		t.Fatal("expected the need check flag")
+	}
+	if err := img.Readable(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(imagetest.ReadAll(t, img), want) {
+		t.Fatal("unexpected data")
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	data, _ := createTestImage(t, testImage{size: testClusterSize, features: 1 << 3})
+	img, err := Open(bytes.NewReader(data), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imagetest.CheckUnreadable(t, img, ErrUnsupportedFeature)
+
+	if _, err := Open(bytes.NewReader(make([]byte, 512)), nil); !errors.Is(err, image.ErrWrongType) {
+		t.Fatalf("expected ErrWrongType, got %v", err)
+	}
+}
+
+// TestQemuImg reads images converted by qemu-img, and images created by
+// qemu-img over qed and raw backing files.
+func TestQemuImg(t *testing.T) {
+	const size = 10 << 20
+	openQemuImg := func(t *testing.T, path string) *Qed {
+		t.Helper()
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = f.Close() })
+		img, err := Open(f, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img
+	}
+	base := imagetest.ConvertQemuImg(t, qemuimg.FormatQed, size, "")
+	imagetest.CompareQemuImg(t, openQemuImg(t, base), base)
+
+	for _, backing := range []struct {
+		path   string
+		format qemuimg.Format
+	}{
+		{path: base, format: qemuimg.FormatQed},
+		{path: imagetest.ConvertQemuImg(t, qemuimg.FormatRaw, size, ""), format: qemuimg.FormatRaw},
+	} {
+		t.Run(string(backing.format), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "over.qed")
+			if err := qemuimg.Create(path, qemuimg.FormatQed, size, backing.path, backing.format); err != nil {
+				t.Fatal(err)
+			}
+			if err := qemuio.Write(path, qemuimg.FormatQed, 1<<20, 3<<20, 0x55); err != nil {
+				t.Fatal(err)
+			}
+			img := openQemuImg(t, path)
+			if img.BackingFileFullPath != backing.path {
+				t.Fatalf("expected backing file %q, got %q", backing.path, img.BackingFileFullPath)
+			}
+			imagetest.CompareQemuImg(t, img, path)
+		})
+	}
+}
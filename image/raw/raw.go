@@ -2,8 +2,11 @@ package raw
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"sync"
 
 	"github.com/lima-vm/go-qcow2reader/image"
 )
@@ -13,21 +16,57 @@ const Type = image.Type("raw")
 // Raw implements [image.Image].
 type Raw struct {
 	io.ReaderAt `json:"-"`
+	size        int64
+	hasSize     bool
+	sizeOnce    sync.Once
+
+	extentOnce sync.Once
+	// extentFile is a new file description of the [os.File], used to seek
+	// with SEEK_DATA and SEEK_HOLE without changing the offset of the file,
+	// which may be used with Read and Seek.
+	extentFile *os.File
+}
+
+type Option func(*options)
+
+type options struct {
+	size    int64
+	hasSize bool
 }
 
-// Extent returns an allocated extent starting at the specified offset with
-// specified length. It is used when the speicfic image type does not implement
-// Extent(). The implementation is correct but inefficient. Fails if image size
-// is unknown.
+// WithSize sets the size of the image, e.g. for a ReaderAt not reporting its
+// size. Reads are not limited to the size.
+func WithSize(size int64) Option {
+	return func(o *options) {
+		o.size, o.hasSize = size, true
+	}
+}
+
+// Extent returns the next extent starting at the specified offset, limited to
+// the specified length. On Linux, holes of an [os.File] are detected with
+// SEEK_DATA and SEEK_HOLE, and reported as unallocated zero extents. Otherwise
+// the whole range is reported as allocated. Fails if image size is unknown.
 func (img *Raw) Extent(start, length int64) (image.Extent, error) {
-	if start+length > img.Size() {
+	if start < 0 || start+length > img.Size() {
 		return image.Extent{}, errors.New("length out of bounds")
 	}
-	// TODO: Implement using SEEK_HOLE/SEEK_DATA when supported by the file system.
+	if f, ok := img.ReaderAt.(*os.File); ok && length > 0 {
+		img.extentOnce.Do(func() {
+			img.extentFile = reopenFile(f)
+		})
+		if img.extentFile != nil {
+			if extent, ok := fileExtent(img.extentFile, start, length); ok {
+				return extent, nil
+			}
+		}
+	}
 	return image.Extent{Start: start, Length: length, Allocated: true}, nil
 }
 
 func (img *Raw) Close() error {
+	if img.extentFile != nil {
+		_ = img.extentFile.Close()
+	}
 	if closer, ok := img.ReaderAt.(io.Closer); ok {
 		return closer.Close()
 	}
@@ -38,20 +77,81 @@ func (img *Raw) Type() image.Type {
 	return Type
 }
 
+// Size returns the size of the image, or -1 if the size is unknown.
+//
+// The size is the size set with [WithSize], or the size reported by the
+// ReaderAt: with a Size() method (e.g. [bytes.Reader], [io.SectionReader]),
+// with Stat() (e.g. [os.File], files of most [fs.FS] implementations), with the
+// BLKGETSIZE64 ioctl for block devices on Linux, or by seeking to the end with
+// [io.Seeker]. Seeking restores the current offset, but must not be used
+// concurrently with Read.
+//
+// The size is computed once, by [Open], or by the first call for a Raw not
+// created with [Open].
 func (img *Raw) Size() int64 {
-	if f, ok := img.ReaderAt.(*os.File); ok {
+	img.sizeOnce.Do(func() {
+		if !img.hasSize {
+			img.size, img.hasSize = readerSize(img.ReaderAt), true
+		}
+	})
+	return img.size
+}
+
+// readerSize returns the size reported by ra, or -1 if the size is unknown.
+func readerSize(ra io.ReaderAt) int64 {
+	if s, ok := ra.(interface{ Size() int64 }); ok {
+		return s.Size()
+	}
+	if f, ok := ra.(interface{ Stat() (fs.FileInfo, error) }); ok {
 		if st, err := f.Stat(); err == nil {
-			return st.Size()
+			switch {
+			case st.Mode().IsRegular():
+				return st.Size()
+			case st.Mode()&fs.ModeDevice != 0:
+				if f, ok := ra.(*os.File); ok {
+					if size, ok := blockDeviceSize(f); ok {
+						return size
+					}
+				}
+			}
 		}
 	}
+	if s, ok := ra.(io.Seeker); ok {
+		return seekSize(s)
+	}
 	return -1
 }
 
+// seekSize returns the size of s by seeking to the end, or -1 on error.
+func seekSize(s io.Seeker) int64 {
+	cur, err := s.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return -1
+	}
+	end, err := s.Seek(0, io.SeekEnd)
+	if err != nil {
+		return -1
+	}
+	if _, err := s.Seek(cur, io.SeekStart); err != nil {
+		return -1
+	}
+	return end
+}
+
 func (img *Raw) Readable() error {
 	return nil
 }
 
 // Open opens a raw image.
-func Open(ra io.ReaderAt) (*Raw, error) {
-	return &Raw{ReaderAt: ra}, nil
+func Open(ra io.ReaderAt, opts ...Option) (*Raw, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.hasSize && o.size < 0 {
+		return nil, fmt.Errorf("invalid size %d", o.size)
+	}
+	img := &Raw{ReaderAt: ra, size: o.size, hasSize: o.hasSize}
+	img.Size()
+	return img, nil
 }
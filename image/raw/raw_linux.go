@@ -0,0 +1,90 @@
+package raw
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/lima-vm/go-qcow2reader/image"
+)
+
+// fileExtent returns the next extent of f starting at start, limited to length,
+// using SEEK_DATA and SEEK_HOLE. Holes are unallocated and read as zeros.
+// Returns false if the extent cannot be detected.
+//
+// Seeking changes the offset of f, which must not be shared with users of Read
+// or Seek, see [reopenFile].
+//
+// File systems not supporting holes report the whole file as data.
+func fileExtent(f *os.File, start, length int64) (image.Extent, bool) {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return image.Extent{}, false
+	}
+	var data, hole int64
+	var seekErr error
+	err = conn.Control(func(fd uintptr) {
+		data, seekErr = syscall.Seek(int(fd), start, unix.SEEK_DATA)
+		if seekErr == nil && data == start {
+			hole, seekErr = syscall.Seek(int(fd), start, unix.SEEK_HOLE)
+		}
+	})
+	if err != nil {
+		return image.Extent{}, false
+	}
+	end := start + length
+	switch {
+	case errors.Is(seekErr, syscall.ENXIO):
+		// No data after start.
+		return image.Extent{Start: start, Length: length, Zero: true}, true
+	case seekErr != nil:
+		return image.Extent{}, false
+	case data > start:
+		return image.Extent{Start: start, Length: min(data, end) - start, Zero: true}, true
+	default:
+		return image.Extent{Start: start, Length: min(hole, end) - start, Allocated: true}, true
+	}
+}
+
+// reopenFile opens f again as a new file description, with its own offset, or
+// returns nil on errors.
+func reopenFile(f *os.File) *os.File {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var res *os.File
+	// The descriptor is valid while Control runs.
+	err = conn.Control(func(fd uintptr) {
+		res, _ = os.Open(fmt.Sprintf("/proc/self/fd/%d", fd))
+	})
+	if err != nil {
+		if res != nil {
+			_ = res.Close()
+		}
+		return nil
+	}
+	return res
+}
+
+// blockDeviceSize returns the size of the block device f, using the
+// BLKGETSIZE64 ioctl.
+func blockDeviceSize(f *os.File) (int64, bool) {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+	var size uint64
+	var errno syscall.Errno
+	err = conn.Control(func(fd uintptr) {
+		_, _, errno = unix.Syscall(unix.SYS_IOCTL, fd, unix.BLKGETSIZE64, uintptr(unsafe.Pointer(&size)))
+	})
+	if err != nil || errno != 0 {
+		return 0, false
+	}
+	return int64(size), true
+}
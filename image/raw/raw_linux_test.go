@@ -0,0 +1,72 @@
+package raw
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/lima-vm/go-qcow2reader/image"
+)
+
+func TestExtentHoles(t *testing.T) {
+	const size = 3 << 20
+	f, err := os.Create(filepath.Join(t.TempDir(), "disk.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 64<<10)
+	for i := range data {
+		data[i] = 'x'
+	}
+	if _, err := f.WriteAt(data, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	// Extent does not change the offset of the file.
+	const offset = 100
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	img, err := Open(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+
+	var extents []image.Extent
+	for start := int64(0); start < size; {
+		e, err := img.Extent(start, size-start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		extents = append(extents, e)
+		start += e.Length
+	}
+	if len(extents) == 1 && extents[0].Allocated {
+		t.Skip("the file system does not support holes")
+	}
+	want := []image.Extent{
+		{Start: 0, Length: 1 << 20, Zero: true},
+		{Start: 1 << 20, Length: int64(len(data)), Allocated: true},
+		{Start: 1<<20 + int64(len(data)), Length: size - 1<<20 - int64(len(data)), Zero: true},
+	}
+	if !reflect.DeepEqual(extents, want) {
+		t.Fatalf("expected extents\n%+v\ngot\n%+v", want, extents)
+	}
+	if off, err := f.Seek(0, io.SeekCurrent); err != nil || off != offset {
+		t.Fatalf("expected offset %d, got %d (%v)", offset, off, err)
+	}
+
+	// Extents are limited to length.
+	e, err := img.Extent(1<<20+4096, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (image.Extent{Start: 1<<20 + 4096, Length: 4096, Allocated: true}); e != want {
+		t.Fatalf("expected %+v, got %+v", want, e)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package raw
+
+import (
+	"os"
+
+	"github.com/lima-vm/go-qcow2reader/image"
+)
+
+// fileExtent, reopenFile and blockDeviceSize are implemented only on Linux.
+func fileExtent(f *os.File, start, length int64) (image.Extent, bool) {
+	return image.Extent{}, false
+}
+
+func reopenFile(f *os.File) *os.File {
+	return nil
+}
+
+func blockDeviceSize(f *os.File) (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,93 @@
+package raw
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// seekerReaderAt implements only io.ReaderAt and io.Seeker.
+type seekerReaderAt struct {
+	r     *bytes.Reader
+	seeks int
+}
+
+func (s *seekerReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	return s.r.ReadAt(p, off)
+}
+
+func (s *seekerReaderAt) Seek(offset int64, whence int) (int64, error) {
+	s.seeks++
+	return s.r.Seek(offset, whence)
+}
+
+// readerAt implements only io.ReaderAt.
+type readerAt struct {
+	io.ReaderAt
+}
+
+func TestSize(t *testing.T) {
+	data := make([]byte, 3000)
+	seeker := &seekerReaderAt{r: bytes.NewReader(data)}
+	if _, err := seeker.Seek(100, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name string
+		ra   io.ReaderAt
+		opts []Option
+		size int64
+	}{
+		{name: "Size", ra: bytes.NewReader(data), size: 3000},
+		{name: "Seeker", ra: seeker, size: 3000},
+		{name: "unknown", ra: readerAt{bytes.NewReader(data)}, size: -1},
+		{name: "WithSize", ra: readerAt{bytes.NewReader(data)}, opts: []Option{WithSize(2048)}, size: 2048},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			img, err := Open(tc.ra, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if img.Size() != tc.size {
+				t.Fatalf("expected size %d, got %d", tc.size, img.Size())
+			}
+			_, err = img.Extent(0, 1024)
+			if tc.size < 0 && err == nil {
+				t.Fatal("expected an error for an unknown size")
+			} else if tc.size >= 0 && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+	// The current offset is restored after seeking to the end.
+	if off, _ := seeker.Seek(0, io.SeekCurrent); off != 100 {
+		t.Fatalf("expected offset 100, got %d", off)
+	}
+
+	// The size is computed once, when opening the image.
+	seeker.seeks = 0
+	img, err := Open(seeker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeks := seeker.seeks
+	if seeks == 0 {
+		t.Fatal("expected Open to compute the size")
+	}
+	for range 3 {
+		if img.Size() != 3000 {
+			t.Fatalf("expected size 3000, got %d", img.Size())
+		}
+	}
+	if seeker.seeks != seeks {
+		t.Fatalf("expected %d seeks, got %d", seeks, seeker.seeks)
+	}
+	if size := (&Raw{ReaderAt: bytes.NewReader(data)}).Size(); size != 3000 {
+		t.Fatalf("expected size 3000 without Open, got %d", size)
+	}
+
+	if _, err := Open(bytes.NewReader(data), WithSize(-1)); err == nil {
+		t.Fatal("expected an error for a negative size")
+	}
+}
@@ -0,0 +1,84 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// ErrUnsafeFileName is returned from [FileResolver] for names that must not be
+// opened.
+var ErrUnsafeFileName = errors.New("unsafe file name")
+
+// FileResolver opens a file referenced by an image, e.g. a backing file or an
+// extent file.
+//
+// base is the resolved name of the image referencing the file, or an empty
+// string if the name is unknown. name is the file name stored in the image.
+// The resolver returns the file and its resolved name, which is the base for
+// the files referenced by the file itself and is used to detect loops.
+//
+// If the returned file implements [io.Closer], it is closed when the image is
+// closed.
+type FileResolver func(base, name string) (ra io.ReaderAt, resolved string, err error)
+
+// OSFileResolver is a [FileResolver] opening files with [os.Open]. Relative
+// names are resolved relative to the directory of base.
+func OSFileResolver(base, name string) (io.ReaderAt, string, error) {
+	resolved := name
+	if !filepath.IsAbs(name) {
+		if base == "" {
+			return nil, "", errors.New("the image name is unknown")
+		}
+		// name can be "../../..." (allowed by qemu)
+		var err error
+		resolved, err = filepath.Abs(filepath.Join(filepath.Dir(base), name))
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	f, err := os.Open(resolved)
+	if err != nil {
+		return nil, "", err
+	}
+	return f, resolved, nil
+}
+
+// FSFileResolver returns a [FileResolver] opening files in fsys, e.g.
+// [os.DirFS] or [testing/fstest.MapFS]. Files must implement [io.ReaderAt].
+//
+// Names are resolved relative to the directory of base in fsys. An empty base
+// is the root of fsys. Absolute names and names outside fsys are rejected with
+// [ErrUnsafeFileName].
+func FSFileResolver(fsys fs.FS) FileResolver {
+	return func(base, name string) (io.ReaderAt, string, error) {
+		if path.IsAbs(name) {
+			return nil, "", fmt.Errorf("%w: %q is absolute", ErrUnsafeFileName, name)
+		}
+		dir := "."
+		if base != "" {
+			if !fs.ValidPath(base) {
+				return nil, "", fmt.Errorf("%w: the image name %q is not a valid path", ErrUnsafeFileName, base)
+			}
+			dir = path.Dir(base)
+		}
+		resolved := path.Join(dir, name)
+		if !fs.ValidPath(resolved) {
+			return nil, "", fmt.Errorf("%w: %q is outside of the file system", ErrUnsafeFileName, name)
+		}
+		f, err := fsys.Open(resolved)
+		if err != nil {
+			return nil, "", err
+		}
+		ra, ok := f.(io.ReaderAt)
+		if !ok {
+			_ = f.Close()
+			return nil, "", fmt.Errorf("file %q does not implement io.ReaderAt", resolved)
+		}
+		return ra, resolved, nil
+	}
+}
@@ -0,0 +1,112 @@
+package vdi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	Signature = 0xbeda107f
+	// Version11 is the version of the header, 1.1.
+	Version11 = 0x00010001
+
+	// headerSize11 is the minimum size of the header 1.1, from the HeaderSize
+	// field. The legacy geometry was added later.
+	headerSize11 = 0x180
+)
+
+// Image types.
+const (
+	// ImageTypeNormal is a dynamic image.
+	ImageTypeNormal = 1
+	// ImageTypeFixed is a static image; all blocks are allocated on creation.
+	ImageTypeFixed = 2
+	ImageTypeUndo  = 3
+	ImageTypeDiff  = 4
+)
+
+// Block map entries of blocks without data.
+const (
+	// blockFree is the entry of unallocated blocks.
+	blockFree = 0xffffffff
+	// blockZero is the entry of discarded blocks, read as zeros.
+	blockZero = 0xfffffffe
+)
+
+// Header is the header of a VDI image, version 1.1.
+type Header struct {
+	Text            [64]byte  `json:"-"`
+	Signature       uint32    `json:"signature"`
+	Version         uint32    `json:"version"`
+	HeaderSize      uint32    `json:"header_size"`
+	ImageType       uint32    `json:"image_type"`
+	ImageFlags      uint32    `json:"image_flags"`
+	Description     [256]byte `json:"-"`
+	BlockMapOffset  uint32    `json:"block_map_offset"`
+	DataOffset      uint32    `json:"data_offset"`
+	Cylinders       uint32    `json:"cylinders"`
+	Heads           uint32    `json:"heads"`
+	Sectors         uint32    `json:"sectors"`
+	SectorSize      uint32    `json:"sector_size"`
+	Unused1         uint32    `json:"-"`
+	DiskSize        uint64    `json:"disk_size"`
+	BlockSize       uint32    `json:"block_size"`
+	BlockExtra      uint32    `json:"block_extra"`
+	BlocksInImage   uint32    `json:"blocks_in_image"`
+	BlocksAllocated uint32    `json:"blocks_allocated"`
+	UUIDImage       [16]byte  `json:"uuid_image"`
+	UUIDLastSnap    [16]byte  `json:"uuid_last_snap"`
+	UUIDLink        [16]byte  `json:"uuid_link"`
+	UUIDParent      [16]byte  `json:"uuid_parent"`
+}
+
+// readHeader reads the header. Returns [ErrNotVdi] if the signature does not
+// match.
+func readHeader(ra io.ReaderAt) (*Header, error) {
+	b := make([]byte, 512)
+	if _, err := ra.ReadAt(b, 0); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read the header: %w", err)
+	}
+	if binary.LittleEndian.Uint32(b[0x40:]) != Signature {
+		return nil, ErrNotVdi
+	}
+	var h Header
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// validate returns an error if the image cannot be read.
+func (h *Header) validate() error {
+	if h.Version != Version11 {
+		return fmt.Errorf("%w: version %d.%d", ErrUnsupportedFeature, h.Version>>16, h.Version&0xffff)
+	}
+	if h.HeaderSize < headerSize11 {
+		return fmt.Errorf("invalid header size %d", h.HeaderSize)
+	}
+	switch h.ImageType {
+	case ImageTypeNormal, ImageTypeFixed:
+	case ImageTypeUndo, ImageTypeDiff:
+		// The parent is only known by its UUID, in the VirtualBox media registry.
+		return fmt.Errorf("%w: differencing image (type %d)", ErrUnsupportedFeature, h.ImageType)
+	default:
+		return fmt.Errorf("%w: image type %d", ErrUnsupportedFeature, h.ImageType)
+	}
+	if h.SectorSize != 512 {
+		return fmt.Errorf("%w: sector size %d", ErrUnsupportedFeature, h.SectorSize)
+	}
+	if h.BlockSize == 0 || h.BlockSize%512 != 0 {
+		return fmt.Errorf("invalid block size %d", h.BlockSize)
+	}
+	if uint64(h.BlocksInImage)*uint64(h.BlockSize) < h.DiskSize {
+		return fmt.Errorf("the image has %d blocks of %d bytes, but the disk size is %d", h.BlocksInImage, h.BlockSize, h.DiskSize)
+	}
+	if h.BlocksAllocated > h.BlocksInImage {
+		return fmt.Errorf("invalid number of allocated blocks %d (more than %d)", h.BlocksAllocated, h.BlocksInImage)
+	}
+	return nil
+}
@@ -1,25 +1,183 @@
 package vdi
 
 import (
-	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 
 	"github.com/lima-vm/go-qcow2reader/image"
-	"github.com/lima-vm/go-qcow2reader/image/stub"
 )
 
 const Type = image.Type("vdi")
 
-// Open returns a stub.
-func Open(ra io.ReaderAt) (*stub.Stub, error) {
-	prober := func(b []byte) bool {
-		sr := io.NewSectionReader(bytes.NewReader(b), 0x40, 4)
-		var magic uint32
-		if err := binary.Read(sr, binary.LittleEndian, &magic); err != nil {
-			return false
+var (
+	ErrNotVdi             = fmt.Errorf("%w: image is not %s", image.ErrWrongType, Type)
+	ErrUnsupportedFeature = errors.New("unsupported feature")
+)
+
+// Vdi implements [image.Image] for VirtualBox images.
+type Vdi struct {
+	ra            io.ReaderAt
+	Header        *Header `json:"header"`
+	errUnreadable error
+	size          int64
+	blockSize     int64
+	// blockMap has the index of the data of each block, or blockFree or
+	// blockZero.
+	blockMap []uint32
+}
+
+// Open opens a VDI image (dynamic or static). Differencing images are not
+// supported.
+func Open(ra io.ReaderAt) (*Vdi, error) {
+	h, err := readHeader(ra)
+	if err != nil {
+		return nil, err
+	}
+	img := &Vdi{ra: ra, Header: h, size: int64(h.DiskSize)}
+	img.errUnreadable = img.load()
+	return img, nil
+}
+
+func (img *Vdi) load() error {
+	h := img.Header
+	if err := h.validate(); err != nil {
+		return err
+	}
+	img.blockSize = int64(h.BlockSize)
+	mapSize := int64(h.BlocksInImage) * 4
+	if size := fileSize(img.ra); size >= 0 && int64(h.BlockMapOffset)+mapSize > size {
+		return fmt.Errorf("the block map (%d bytes at offset %d) is beyond the end of the file", mapSize, h.BlockMapOffset)
+	}
+	img.blockMap = make([]uint32, h.BlocksInImage)
+	if err := binary.Read(io.NewSectionReader(img.ra, int64(h.BlockMapOffset), mapSize), binary.LittleEndian, img.blockMap); err != nil {
+		return fmt.Errorf("failed to read the block map: %w", err)
+	}
+	return nil
+}
+
+// fileSize returns the size of ra, or -1 if the size is unknown.
+func fileSize(ra io.ReaderAt) int64 {
+	// Implemented by [os.File] and files of most [fs.FS] implementations.
+	if f, ok := ra.(interface{ Stat() (fs.FileInfo, error) }); ok {
+		if st, err := f.Stat(); err == nil {
+			return st.Size()
 		}
-		return magic == 0xbeda107f
 	}
-	return stub.New(ra, Type, prober)
+	if s, ok := ra.(interface{ Size() int64 }); ok {
+		return s.Size()
+	}
+	return -1
+}
+
+func (img *Vdi) Close() error {
+	if closer, ok := img.ra.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (img *Vdi) Type() image.Type {
+	return Type
+}
+
+func (img *Vdi) Size() int64 {
+	return img.size
+}
+
+// Readable returns nil if the image is readable, otherwise returns an error.
+func (img *Vdi) Readable() error {
+	return img.errUnreadable
+}
+
+// block returns the block map entry of the block containing off, and the file
+// offset of the data at off if the block is allocated.
+func (img *Vdi) block(off int64) (entry uint32, dataOffset int64, err error) {
+	block := off / img.blockSize
+	entry = img.blockMap[block]
+	if entry == blockFree || entry == blockZero {
+		return entry, 0, nil
+	}
+	if entry >= img.Header.BlocksAllocated {
+		return entry, 0, fmt.Errorf("invalid block map entry %d for block %d (%d blocks allocated)", entry, block, img.Header.BlocksAllocated)
+	}
+	// Each block is preceded by BlockExtra bytes of unused data.
+	blockStride := img.blockSize + int64(img.Header.BlockExtra)
+	dataOffset = int64(img.Header.DataOffset) + int64(entry)*blockStride + int64(img.Header.BlockExtra) + off%img.blockSize
+	return entry, dataOffset, nil
+}
+
+// ReadAt implements [io.ReaderAt].
+func (img *Vdi) ReadAt(p []byte, off int64) (int, error) {
+	if img.errUnreadable != nil {
+		return 0, img.errUnreadable
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= img.size {
+		return 0, io.EOF
+	}
+	var eof bool
+	if off+int64(len(p)) > img.size {
+		p = p[:img.size-off]
+		eof = true
+	}
+	var n int
+	for n < len(p) {
+		currentOff := off + int64(n)
+		entry, dataOffset, err := img.block(currentOff)
+		if err != nil {
+			return n, err
+		}
+		end := n + int(min(int64(len(p)-n), img.blockSize-currentOff%img.blockSize))
+		if entry == blockFree || entry == blockZero {
+			clear(p[n:end])
+		} else if _, err := img.ra.ReadAt(p[n:end], dataOffset); err != nil {
+			return n, fmt.Errorf("failed to read data at offset %d: %w", dataOffset, err)
+		}
+		n = end
+	}
+	if eof {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Extent returns the next extent starting at start, with the same allocation
+// and zero status, limited to length. Free blocks are unallocated, and
+// discarded blocks are allocated and read as zeros.
+func (img *Vdi) Extent(start, length int64) (image.Extent, error) {
+	var current image.Extent
+	if img.errUnreadable != nil {
+		return current, img.errUnreadable
+	}
+	if start < 0 || start+length > img.size {
+		return current, errors.New("length out of bounds")
+	}
+	for length > 0 {
+		entry, _, err := img.block(start)
+		if err != nil {
+			return current, err
+		}
+		n := min(length, img.blockSize-start%img.blockSize)
+		status := image.Extent{Start: start, Length: n, Allocated: entry != blockFree, Zero: entry == blockFree || entry == blockZero}
+		if current.Length == 0 {
+			current = status
+		} else if sameStatus(current, status) {
+			current.Length += n
+		} else {
+			break
+		}
+		start += n
+		length -= n
+	}
+	return current, nil
+}
+
+// Return true if extents have the same status.
+func sameStatus(a, b image.Extent) bool {
+	return a.Allocated == b.Allocated && a.Zero == b.Zero && a.Compressed == b.Compressed
 }
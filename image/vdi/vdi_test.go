@@ -0,0 +1,205 @@
+package vdi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/lima-vm/go-qcow2reader/image"
+	"github.com/lima-vm/go-qcow2reader/test/imagetest"
+	"github.com/lima-vm/go-qcow2reader/test/qemuimg"
+)
+
+const testBlockSize = 64 << 10
+
+// Block states in test layouts.
+const (
+	blockAllocated = 'a'
+	blockFreeState = 'f'
+	blockZeroState = 'z'
+)
+
+type testImage struct {
+	imageType uint32
+	// layout has a block state for each block.
+	layout string
+	// size is the disk size. Defaults to the size of the blocks in layout.
+	size int64
+	// blockExtra is the size of the extra data preceding each block.
+	blockExtra uint32
+	modify     func(*Header)
+}
+
+// createTestImage creates a VDI image. Blocks are stored in reverse order.
+// Returns the image and the expected data of the image.
+func createTestImage(t *testing.T, ti testImage) ([]byte, []byte) {
+	r := rand.New(rand.NewSource(1))
+	size := ti.size
+	if size == 0 {
+		size = int64(len(ti.layout)) * testBlockSize
+	}
+	const blockMapOffset = 512
+	dataOffset := (blockMapOffset + uint32(len(ti.layout))*4 + 511) / 512 * 512
+	h := Header{
+		Signature:      Signature,
+		Version:        Version11,
+		HeaderSize:     headerSize11,
+		ImageType:      ti.imageType,
+		BlockMapOffset: blockMapOffset,
+		DataOffset:     dataOffset,
+		SectorSize:     512,
+		DiskSize:       uint64(size),
+		BlockSize:      testBlockSize,
+		BlockExtra:     ti.blockExtra,
+		BlocksInImage:  uint32(len(ti.layout)),
+	}
+	copy(h.Text[:], "<<< Oracle VM VirtualBox Disk Image >>>\n")
+	want := make([]byte, len(ti.layout)*testBlockSize)
+	blockMap := make([]uint32, len(ti.layout))
+	var blocks [][]byte
+	for i := len(ti.layout) - 1; i >= 0; i-- {
+		switch ti.layout[i] {
+		case blockFreeState:
+			blockMap[i] = blockFree
+		case blockZeroState:
+			blockMap[i] = blockZero
+		case blockAllocated:
+			blockMap[i] = uint32(len(blocks))
+			data := want[i*testBlockSize:][:testBlockSize]
+			if _, err := r.Read(data); err != nil {
+				t.Fatal(err)
+			}
+			extra := bytes.Repeat([]byte{0xee}, int(ti.blockExtra))
+			blocks = append(blocks, append(extra, data...))
+		}
+	}
+	h.BlocksAllocated = uint32(len(blocks))
+	if ti.modify != nil {
+		ti.modify(&h)
+	}
+	var buf bytes.Buffer
+	for _, v := range []any{h, blockMap} {
+		if err := binary.Write(&buf, binary.LittleEndian, v); err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(make([]byte, (512-buf.Len()%512)%512))
+	}
+	for _, b := range blocks {
+		buf.Write(b)
+	}
+	return buf.Bytes(), want[:size]
+}
+
+func TestVdi(t *testing.T) {
+	cases := []struct {
+		name    string
+		ti      testImage
+		extents []image.Extent
+	}{
+		{
+			name: "dynamic",
+			ti:   testImage{imageType: ImageTypeNormal, layout: "affaazz"},
+			extents: []image.Extent{
+				{Start: 0, Length: testBlockSize, Allocated: true},
+				{Start: testBlockSize, Length: 2 * testBlockSize, Zero: true},
+				{Start: 3 * testBlockSize, Length: 2 * testBlockSize, Allocated: true},
+				{Start: 5 * testBlockSize, Length: 2 * testBlockSize, Allocated: true, Zero: true},
+			},
+		},
+		{
+			name: "dynamic with extra block data",
+			ti:   testImage{imageType: ImageTypeNormal, layout: "faz", blockExtra: 512},
+			extents: []image.Extent{
+				{Start: 0, Length: testBlockSize, Zero: true},
+				{Start: testBlockSize, Length: testBlockSize, Allocated: true},
+				{Start: 2 * testBlockSize, Length: testBlockSize, Allocated: true, Zero: true},
+			},
+		},
+		{
+			name: "static",
+			ti:   testImage{imageType: ImageTypeFixed, layout: "aaa", size: 2*testBlockSize + 4096},
+			extents: []image.Extent{
+				{Start: 0, Length: 2*testBlockSize + 4096, Allocated: true},
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			data, want := createTestImage(t, tc.ti)
+			img, err := Open(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := img.Readable(); err != nil {
+				t.Fatal(err)
+			}
+			if img.Size() != int64(len(want)) {
+				t.Fatalf("expected size %d, got %d", len(want), img.Size())
+			}
+			got := imagetest.ReadAll(t, img)
+			if !bytes.Equal(got, want) {
+				t.Fatal("unexpected data")
+			}
+			if extents := imagetest.ReadExtents(t, img); !reflect.DeepEqual(extents, tc.extents) {
+				t.Fatalf("expected extents\n%+v\ngot\n%+v", tc.extents, extents)
+			}
+		})
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	cases := []struct {
+		name   string
+		modify func(*Header)
+		err    error
+	}{
+		{name: "version 1.0", modify: func(h *Header) { h.Version = 0x00010000 }, err: ErrUnsupportedFeature},
+		{name: "differencing", modify: func(h *Header) { h.ImageType = ImageTypeDiff }, err: ErrUnsupportedFeature},
+		{name: "sector size", modify: func(h *Header) { h.SectorSize = 4096 }, err: ErrUnsupportedFeature},
+		{name: "disk size", modify: func(h *Header) { h.DiskSize = 3*testBlockSize + 1 }},
+		{name: "block map", modify: func(h *Header) { h.BlocksAllocated = 0 }},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			data, _ := createTestImage(t, testImage{imageType: ImageTypeNormal, layout: "aaa", modify: tc.modify})
+			img, err := Open(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = img.Readable()
+			if err == nil {
+				_, err = img.ReadAt(make([]byte, 512), 0)
+			}
+			if err == nil || tc.err != nil && !errors.Is(err, tc.err) {
+				t.Fatalf("expected error %v, got %v", tc.err, err)
+			}
+		})
+	}
+
+	if _, err := Open(bytes.NewReader(make([]byte, 512))); !errors.Is(err, image.ErrWrongType) {
+		t.Fatalf("expected ErrWrongType, got %v", err)
+	}
+}
+
+// TestQemuImg reads images converted by qemu-img.
+func TestQemuImg(t *testing.T) {
+	for _, options := range []string{"static=off", "static=on"} {
+		t.Run(options, func(t *testing.T) {
+			path := imagetest.ConvertQemuImg(t, qemuimg.FormatVdi, 10<<20, options)
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close() //nolint:errcheck
+			img, err := Open(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			imagetest.CompareQemuImg(t, img, path)
+		})
+	}
+}
@@ -0,0 +1,409 @@
+package vhdx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+// Offsets of the structures of the header section.
+const (
+	fileIdentifierOffset = 0
+	header1Offset        = 64 << 10
+	header2Offset        = 128 << 10
+	regionTable1Offset   = 192 << 10
+	regionTable2Offset   = 256 << 10
+
+	headerSize      = 4 << 10
+	regionTableSize = 64 << 10
+)
+
+const (
+	FileIdentifierSignature = "vhdxfile"
+	HeaderSignature         = "head"
+	RegionTableSignature    = "regi"
+	MetadataSignature       = "metadata"
+)
+
+// Limits from the specification.
+const (
+	maxRegionTableEntries = 2047
+	maxMetadataEntries    = 2047
+	minBlockSize          = 1 << 20
+	maxBlockSize          = 256 << 20
+	maxVirtualDiskSize    = 64 << 40
+	// metadataItemsOffset is the minimum offset of metadata items in the
+	// metadata region.
+	metadataItemsOffset = 64 << 10
+	// maxMetadataRegionSize is the default size of the metadata region, used by
+	// Hyper-V and qemu. Larger regions are refused to bound the size of
+	// metadata items read while probing.
+	maxMetadataRegionSize = 1 << 20
+)
+
+// metadataItemSizes are the sizes of the known metadata items. Zero is a
+// variable size.
+var metadataItemSizes = map[GUID]uint32{
+	MetadataFileParameters:     8,
+	MetadataVirtualDiskSize:    8,
+	MetadataVirtualDiskID:      16,
+	MetadataLogicalSectorSize:  4,
+	MetadataPhysicalSectorSize: 4,
+	MetadataParentLocator:      0,
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// GUID is a GUID in the mixed-endian format used by Microsoft.
+type GUID [16]byte
+
+// mustParseGUID parses a GUID like "2DC27766-F623-4200-9D64-115E9BFD4A08".
+func mustParseGUID(s string) GUID {
+	g, err := ParseGUID(s)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+// ParseGUID parses a GUID like "2DC27766-F623-4200-9D64-115E9BFD4A08", with
+// optional braces.
+func ParseGUID(s string) (GUID, error) {
+	var g GUID
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "{"), "}")
+	parts := strings.Split(s, "-")
+	if len(parts) != 5 || len(parts[0]) != 8 || len(parts[1]) != 4 || len(parts[2]) != 4 || len(parts[3]) != 4 || len(parts[4]) != 12 {
+		return g, fmt.Errorf("invalid GUID %q", s)
+	}
+	b, err := hex.DecodeString(strings.Join(parts, ""))
+	if err != nil {
+		return g, fmt.Errorf("invalid GUID %q: %w", s, err)
+	}
+	binary.LittleEndian.PutUint32(g[0:], binary.BigEndian.Uint32(b[0:]))
+	binary.LittleEndian.PutUint16(g[4:], binary.BigEndian.Uint16(b[4:]))
+	binary.LittleEndian.PutUint16(g[6:], binary.BigEndian.Uint16(b[6:]))
+	copy(g[8:], b[8:])
+	return g, nil
+}
+
+func (g GUID) String() string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X",
+		binary.LittleEndian.Uint32(g[0:]), binary.LittleEndian.Uint16(g[4:]), binary.LittleEndian.Uint16(g[6:]), g[8:10], g[10:])
+}
+
+func (g GUID) MarshalText() ([]byte, error) {
+	return []byte(g.String()), nil
+}
+
+// IsZero returns true if g is all zeros.
+func (g GUID) IsZero() bool {
+	return g == GUID{}
+}
+
+// Region GUIDs.
+var (
+	RegionBAT      = mustParseGUID("2DC27766-F623-4200-9D64-115E9BFD4A08")
+	RegionMetadata = mustParseGUID("8B7CA206-4790-4B9A-B8FE-575F050F886E")
+)
+
+// Metadata item GUIDs.
+var (
+	MetadataFileParameters     = mustParseGUID("CAA16737-FA36-4D43-B3B6-33F0AA44E76B")
+	MetadataVirtualDiskSize    = mustParseGUID("2FA54224-CD1B-4876-B211-5DBED83BF4B8")
+	MetadataVirtualDiskID      = mustParseGUID("BECA12AB-B2E6-4523-93EF-C309E000C746")
+	MetadataLogicalSectorSize  = mustParseGUID("8141BF1D-A96F-4709-BA47-F233A8FAAB5F")
+	MetadataPhysicalSectorSize = mustParseGUID("CDA348C7-445D-4471-9CC9-E9885251C556")
+	MetadataParentLocator      = mustParseGUID("A8D35F2D-B30B-454D-ABF7-D3D84834AB0C")
+)
+
+// ParentLocatorTypeVHDX is the locator type of VHDX parent locators.
+var ParentLocatorTypeVHDX = mustParseGUID("B04AEFB7-D19E-4A81-B789-25B8E9445913")
+
+// Header is a VHDX header. There are two copies of the header; the valid one
+// with the highest sequence number is current.
+type Header struct {
+	Signature      [4]byte `json:"signature"`
+	Checksum       uint32  `json:"checksum"`
+	SequenceNumber uint64  `json:"sequence_number"`
+	FileWriteGUID  GUID    `json:"file_write_guid"`
+	DataWriteGUID  GUID    `json:"data_write_guid"`
+	LogGUID        GUID    `json:"log_guid"`
+	LogVersion     uint16  `json:"log_version"`
+	Version        uint16  `json:"version"`
+	LogLength      uint32  `json:"log_length"`
+	LogOffset      uint64  `json:"log_offset"`
+}
+
+// RegionTableHeader is the header of a region table.
+type RegionTableHeader struct {
+	Signature  [4]byte
+	Checksum   uint32
+	EntryCount uint32
+	Reserved   uint32
+}
+
+// RegionTableEntry describes a region of the file.
+type RegionTableEntry struct {
+	GUID       GUID   `json:"guid"`
+	FileOffset uint64 `json:"file_offset"`
+	Length     uint32 `json:"length"`
+	Required   uint32 `json:"required"`
+}
+
+// MetadataTableHeader is the header of the metadata table.
+type MetadataTableHeader struct {
+	Signature  [8]byte
+	Reserved   uint16
+	EntryCount uint16
+	Reserved2  [5]uint32
+}
+
+// MetadataTableEntry describes a metadata item.
+type MetadataTableEntry struct {
+	ItemID   GUID
+	Offset   uint32
+	Length   uint32
+	Flags    uint32
+	Reserved uint32
+}
+
+// Metadata table entry flags.
+const (
+	MetadataFlagsIsUserBit        = 0
+	MetadataFlagsIsVirtualDiskBit = 1
+	MetadataFlagsIsRequiredBit    = 2
+)
+
+// File parameters flags.
+const (
+	FileParametersLeaveBlocksAllocatedBit = 0
+	FileParametersHasParentBit            = 1
+)
+
+// Metadata holds the known metadata items.
+type Metadata struct {
+	BlockSize            uint32 `json:"block_size"`
+	LeaveBlocksAllocated bool   `json:"leave_blocks_allocated"`
+	HasParent            bool   `json:"has_parent"`
+	VirtualDiskSize      uint64 `json:"virtual_disk_size"`
+	VirtualDiskID        GUID   `json:"virtual_disk_id"`
+	LogicalSectorSize    uint32 `json:"logical_sector_size"`
+	PhysicalSectorSize   uint32 `json:"physical_sector_size"`
+	// ParentLocator holds the entries of the VHDX parent locator of
+	// differencing disks, e.g. "parent_linkage" and "relative_path".
+	ParentLocator map[string]string `json:"parent_locator,omitempty"`
+}
+
+// checksumValid returns true if the CRC-32C of b, with the checksum field at
+// offset 4 set to zero, matches the checksum field.
+func checksumValid(b []byte) bool {
+	want := binary.LittleEndian.Uint32(b[4:])
+	var zero [4]byte
+	h := crc32.New(castagnoli)
+	h.Write(b[:4])
+	h.Write(zero[:])
+	h.Write(b[8:])
+	return h.Sum32() == want
+}
+
+func readHeader(ra io.ReaderAt, off int64) (*Header, error) {
+	b := make([]byte, headerSize)
+	if _, err := ra.ReadAt(b, off); err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(b, []byte(HeaderSignature)) {
+		return nil, errors.New("invalid signature")
+	}
+	if !checksumValid(b) {
+		return nil, errors.New("invalid checksum")
+	}
+	var h Header
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// readCurrentHeader returns the valid header with the highest sequence number.
+func readCurrentHeader(ra io.ReaderAt) (*Header, error) {
+	h1, err1 := readHeader(ra, header1Offset)
+	h2, err2 := readHeader(ra, header2Offset)
+	switch {
+	case err1 != nil && err2 != nil:
+		return nil, fmt.Errorf("no valid header (header 1: %w, header 2: %w)", err1, err2)
+	case err1 != nil:
+		return h2, nil
+	case err2 != nil:
+		return h1, nil
+	case h2.SequenceNumber > h1.SequenceNumber:
+		return h2, nil
+	default:
+		return h1, nil
+	}
+}
+
+func readRegionTable(ra io.ReaderAt, off int64) ([]RegionTableEntry, error) {
+	b := make([]byte, regionTableSize)
+	if _, err := ra.ReadAt(b, off); err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(b, []byte(RegionTableSignature)) {
+		return nil, errors.New("invalid signature")
+	}
+	if !checksumValid(b) {
+		return nil, errors.New("invalid checksum")
+	}
+	r := bytes.NewReader(b)
+	var h RegionTableHeader
+	if err := binary.Read(r, binary.LittleEndian, &h); err != nil {
+		return nil, err
+	}
+	if h.EntryCount > maxRegionTableEntries {
+		return nil, fmt.Errorf("too many entries (%d)", h.EntryCount)
+	}
+	entries := make([]RegionTableEntry, h.EntryCount)
+	if err := binary.Read(r, binary.LittleEndian, entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// readRegions reads the first valid region table.
+func readRegions(ra io.ReaderAt) ([]RegionTableEntry, error) {
+	entries, err1 := readRegionTable(ra, regionTable1Offset)
+	if err1 == nil {
+		return entries, nil
+	}
+	entries, err2 := readRegionTable(ra, regionTable2Offset)
+	if err2 != nil {
+		return nil, fmt.Errorf("no valid region table (region table 1: %w, region table 2: %w)", err1, err2)
+	}
+	return entries, nil
+}
+
+// readMetadata reads the metadata region at off.
+func readMetadata(ra io.ReaderAt, off int64, length uint32) (*Metadata, error) {
+	if length > maxMetadataRegionSize {
+		return nil, fmt.Errorf("%w: metadata region of %d bytes", ErrUnsupportedFeature, length)
+	}
+	r := io.NewSectionReader(ra, off, int64(length))
+	var h MetadataTableHeader
+	if err := binary.Read(r, binary.LittleEndian, &h); err != nil {
+		return nil, err
+	}
+	if string(h.Signature[:]) != MetadataSignature {
+		return nil, errors.New("invalid metadata table signature")
+	}
+	if h.EntryCount > maxMetadataEntries {
+		return nil, fmt.Errorf("too many metadata entries (%d)", h.EntryCount)
+	}
+	entries := make([]MetadataTableEntry, h.EntryCount)
+	if err := binary.Read(r, binary.LittleEndian, entries); err != nil {
+		return nil, err
+	}
+
+	var m Metadata
+	found := make(map[GUID]bool)
+	for _, e := range entries {
+		if e.Offset < metadataItemsOffset || uint64(e.Offset)+uint64(e.Length) > uint64(length) {
+			return nil, fmt.Errorf("metadata item %s out of bounds", e.ItemID)
+		}
+		size, ok := metadataItemSizes[e.ItemID]
+		if !ok {
+			// Unknown optional items are not read.
+			if e.Flags&(1<<MetadataFlagsIsRequiredBit) != 0 {
+				return nil, fmt.Errorf("%w: required metadata item %s", ErrUnsupportedFeature, e.ItemID)
+			}
+			continue
+		}
+		if e.Length < size {
+			return nil, fmt.Errorf("invalid metadata item %s: expected at least %d bytes, got %d", e.ItemID, size, e.Length)
+		}
+		if size == 0 {
+			size = e.Length
+		}
+		item := make([]byte, size)
+		if _, err := r.ReadAt(item, int64(e.Offset)); err != nil {
+			return nil, fmt.Errorf("failed to read metadata item %s: %w", e.ItemID, err)
+		}
+		var err error
+		switch e.ItemID {
+		case MetadataFileParameters:
+			m.BlockSize = binary.LittleEndian.Uint32(item)
+			flags := binary.LittleEndian.Uint32(item[4:])
+			m.LeaveBlocksAllocated = flags&(1<<FileParametersLeaveBlocksAllocatedBit) != 0
+			m.HasParent = flags&(1<<FileParametersHasParentBit) != 0
+		case MetadataVirtualDiskSize:
+			m.VirtualDiskSize = binary.LittleEndian.Uint64(item)
+		case MetadataVirtualDiskID:
+			copy(m.VirtualDiskID[:], item)
+		case MetadataLogicalSectorSize:
+			m.LogicalSectorSize = binary.LittleEndian.Uint32(item)
+		case MetadataPhysicalSectorSize:
+			m.PhysicalSectorSize = binary.LittleEndian.Uint32(item)
+		case MetadataParentLocator:
+			m.ParentLocator, err = parseParentLocator(item)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid metadata item %s: %w", e.ItemID, err)
+		}
+		found[e.ItemID] = true
+	}
+	for _, id := range []GUID{MetadataFileParameters, MetadataVirtualDiskSize, MetadataLogicalSectorSize} {
+		if !found[id] {
+			return nil, fmt.Errorf("missing metadata item %s", id)
+		}
+	}
+	if m.HasParent && !found[MetadataParentLocator] {
+		return nil, errors.New("missing parent locator")
+	}
+	return &m, nil
+}
+
+// parseParentLocator parses a VHDX parent locator. Keys and values are UTF-16
+// strings at offsets relative to the start of the locator.
+func parseParentLocator(b []byte) (map[string]string, error) {
+	if len(b) < 20 {
+		return nil, errors.New("parent locator too short")
+	}
+	var locatorType GUID
+	copy(locatorType[:], b)
+	if locatorType != ParentLocatorTypeVHDX {
+		return nil, fmt.Errorf("%w: parent locator type %s", ErrUnsupportedFeature, locatorType)
+	}
+	count := int(binary.LittleEndian.Uint16(b[18:]))
+	if 20+count*12 > len(b) {
+		return nil, errors.New("parent locator entries out of bounds")
+	}
+	res := make(map[string]string, count)
+	for i := range count {
+		e := b[20+i*12:]
+		key, err := utf16String(b, binary.LittleEndian.Uint32(e[0:]), binary.LittleEndian.Uint16(e[8:]))
+		if err != nil {
+			return nil, err
+		}
+		value, err := utf16String(b, binary.LittleEndian.Uint32(e[4:]), binary.LittleEndian.Uint16(e[10:]))
+		if err != nil {
+			return nil, err
+		}
+		res[key] = value
+	}
+	return res, nil
+}
+
+func utf16String(b []byte, off uint32, length uint16) (string, error) {
+	if uint64(off)+uint64(length) > uint64(len(b)) || length%2 != 0 {
+		return "", errors.New("parent locator string out of bounds")
+	}
+	s := make([]uint16, length/2)
+	for i := range s {
+		s[i] = binary.LittleEndian.Uint16(b[int(off)+i*2:])
+	}
+	return string(utf16.Decode(s)), nil
+}
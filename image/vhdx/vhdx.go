@@ -1,15 +1,514 @@
 package vhdx
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"math/bits"
+	"slices"
+	"strings"
 
 	"github.com/lima-vm/go-qcow2reader/image"
-	"github.com/lima-vm/go-qcow2reader/image/stub"
+	"github.com/lima-vm/go-qcow2reader/log"
+	"github.com/lima-vm/go-qcow2reader/lru"
 )
 
 const Type = image.Type("vhdx")
 
-// Open returns a stub.
-func Open(ra io.ReaderAt) (*stub.Stub, error) {
-	return stub.New(ra, Type, stub.SimpleProber([]byte("vhdxfile")))
+// maxParentChainDepth is the maximum number of parent images below an image.
+const maxParentChainDepth = 64
+
+var (
+	ErrNotVhdx            = fmt.Errorf("%w: image is not %s", image.ErrWrongType, Type)
+	ErrUnsupportedFeature = errors.New("unsupported feature")
+	ErrUnsupportedParent  = errors.New("unsupported parent image")
+	// ErrLogReplayRequired is returned for images with a non-empty log, e.g.
+	// images that were not closed cleanly. Such images must be opened by
+	// Hyper-V or qemu-img to replay the log.
+	ErrLogReplayRequired = errors.New("the log must be replayed")
+)
+
+// Payload block states.
+const (
+	PayloadBlockNotPresent       = 0
+	PayloadBlockUndefined        = 1
+	PayloadBlockZero             = 2
+	PayloadBlockUnmapped         = 3
+	PayloadBlockUnmappedV095     = 5 // written by old versions of Hyper-V
+	PayloadBlockFullyPresent     = 6
+	PayloadBlockPartiallyPresent = 7
+)
+
+// Sector bitmap block states.
+const (
+	SectorBitmapBlockNotPresent = 0
+	SectorBitmapBlockPresent    = 6
+)
+
+// sectorsPerChunk is the number of sectors described by a sector bitmap block.
+const sectorsPerChunk = 1 << 23
+
+type batEntry uint64
+
+func (e batEntry) state() int {
+	return int(e & 7)
+}
+
+// fileOffset returns the offset of the block in the file.
+func (e batEntry) fileOffset() int64 {
+	return int64(e>>20) << 20
+}
+
+// Vhdx implements [image.Image].
+type Vhdx struct {
+	ra             io.ReaderAt
+	Header         *Header            `json:"header"`
+	Regions        []RegionTableEntry `json:"regions"`
+	Metadata       *Metadata          `json:"metadata"`
+	ParentFullPath string             `json:"parent_full_path,omitempty"`
+	parent         *Vhdx
+	errUnreadable  error
+	bat            []batEntry
+	chunkRatio     int64
+	blockSize      int64
+	sectorSize     int64
+	// bitmapCache caches the sector bitmaps of partially present blocks.
+	bitmapCache *lru.Cache[int64, []byte]
+}
+
+// With the default block size (32 MiB) and 512 bytes sectors, a block bitmap
+// uses 8 KiB.
+const maxBitmaps = 64
+
+type Option func(*options)
+
+type options struct {
+	fileResolver image.FileResolver
+	name         string
+	depth        int
+	chain        []string
+}
+
+// WithFileResolver sets the [image.FileResolver] used to open parent images.
+// The default is [image.OSFileResolver].
+func WithFileResolver(r image.FileResolver) Option {
+	return func(o *options) {
+		o.fileResolver = r
+	}
+}
+
+// WithName sets the name of the image, used as base to resolve parent images.
+// By default, the name of the file is used if ra implements Name() and no
+// [image.FileResolver] is set.
+func WithName(name string) Option {
+	return func(o *options) {
+		o.name = name
+	}
+}
+
+// Open opens a vhdx image.
+//
+// The parent image of a differencing disk is resolved from the relative path in
+// the parent locator (see [WithFileResolver]), and closed with the image.
+//
+// Returns an image that is not readable (see [Vhdx.Readable]) for unsupported
+// images, e.g. images with a non-empty log ([ErrLogReplayRequired]).
+func Open(ra io.ReaderAt, opts ...Option) (*Vhdx, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.name == "" && o.fileResolver == nil {
+		if namer, ok := ra.(interface{ Name() string }); ok {
+			o.name = namer.Name()
+		}
+	}
+	if o.fileResolver == nil {
+		o.fileResolver = image.OSFileResolver
+	}
+	return open(ra, &o)
+}
+
+func open(ra io.ReaderAt, o *options) (*Vhdx, error) {
+	signature := make([]byte, len(FileIdentifierSignature))
+	if _, err := ra.ReadAt(signature, fileIdentifierOffset); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read the first %d bytes: %w", len(signature), err)
+	}
+	if string(signature) != FileIdentifierSignature {
+		return nil, ErrNotVhdx
+	}
+	img := &Vhdx{ra: ra}
+	img.errUnreadable = img.load()
+	if img.errUnreadable == nil && img.Metadata.HasParent {
+		img.errUnreadable = img.loadParent(o)
+	}
+	return img, nil
+}
+
+func (img *Vhdx) load() error {
+	var err error
+	if img.Header, err = readCurrentHeader(img.ra); err != nil {
+		return err
+	}
+	if img.Header.Version != 1 {
+		return fmt.Errorf("%w: version %d", ErrUnsupportedFeature, img.Header.Version)
+	}
+	if !img.Header.LogGUID.IsZero() {
+		return fmt.Errorf("%w (log GUID %s)", ErrLogReplayRequired, img.Header.LogGUID)
+	}
+	if img.Regions, err = readRegions(img.ra); err != nil {
+		return err
+	}
+	var batRegion, metadataRegion *RegionTableEntry
+	for i, r := range img.Regions {
+		switch r.GUID {
+		case RegionBAT:
+			batRegion = &img.Regions[i]
+		case RegionMetadata:
+			metadataRegion = &img.Regions[i]
+		default:
+			if r.Required&1 != 0 {
+				return fmt.Errorf("%w: required region %s", ErrUnsupportedFeature, r.GUID)
+			}
+		}
+	}
+	if batRegion == nil || metadataRegion == nil {
+		return errors.New("missing BAT or metadata region")
+	}
+	if img.Metadata, err = readMetadata(img.ra, int64(metadataRegion.FileOffset), metadataRegion.Length); err != nil {
+		return fmt.Errorf("failed to read metadata: %w", err)
+	}
+
+	m := img.Metadata
+	if m.BlockSize < minBlockSize || m.BlockSize > maxBlockSize || bits.OnesCount32(m.BlockSize) != 1 {
+		return fmt.Errorf("invalid block size %d", m.BlockSize)
+	}
+	if m.LogicalSectorSize != 512 && m.LogicalSectorSize != 4096 {
+		return fmt.Errorf("invalid logical sector size %d", m.LogicalSectorSize)
+	}
+	if m.VirtualDiskSize > maxVirtualDiskSize || m.VirtualDiskSize%uint64(m.LogicalSectorSize) != 0 {
+		return fmt.Errorf("invalid virtual disk size %d", m.VirtualDiskSize)
+	}
+	img.blockSize = int64(m.BlockSize)
+	img.sectorSize = int64(m.LogicalSectorSize)
+	img.chunkRatio = sectorsPerChunk * img.sectorSize / img.blockSize
+
+	payloadBlocks := (int64(m.VirtualDiskSize) + img.blockSize - 1) / img.blockSize
+	var batEntries int64
+	if m.HasParent {
+		batEntries = (payloadBlocks + img.chunkRatio - 1) / img.chunkRatio * (img.chunkRatio + 1)
+	} else if payloadBlocks > 0 {
+		batEntries = payloadBlocks + (payloadBlocks-1)/img.chunkRatio
+	}
+	if batEntries*8 > int64(batRegion.Length) {
+		return fmt.Errorf("BAT region too small (%d bytes) for %d entries", batRegion.Length, batEntries)
+	}
+	img.bat = make([]batEntry, batEntries)
+	if err := binary.Read(io.NewSectionReader(img.ra, int64(batRegion.FileOffset), batEntries*8), binary.LittleEndian, img.bat); err != nil {
+		return fmt.Errorf("failed to read the BAT: %w", err)
+	}
+	img.bitmapCache = lru.New[int64, []byte](maxBitmaps)
+	return nil
+}
+
+// loadParent opens the parent image of a differencing disk.
+func (img *Vhdx) loadParent(o *options) error {
+	if o.depth >= maxParentChainDepth {
+		return fmt.Errorf("%w: parent chain too deep (more than %d images)", ErrUnsupportedParent, maxParentChainDepth)
+	}
+	locator := img.Metadata.ParentLocator
+	linkage, err := ParseGUID(locator["parent_linkage"])
+	if err != nil {
+		return fmt.Errorf("%w: invalid parent_linkage: %w", ErrUnsupportedParent, err)
+	}
+
+	// Try the relative path first, like Hyper-V.
+	var (
+		ra       io.ReaderAt
+		resolved string
+		errs     []error
+	)
+	for _, key := range []string{"relative_path", "absolute_win32_path"} {
+		name, ok := locator[key]
+		if !ok {
+			continue
+		}
+		name = strings.ReplaceAll(name, `\`, "/")
+		ra, resolved, err = o.fileResolver(o.name, name)
+		if err == nil {
+			break
+		}
+		errs = append(errs, fmt.Errorf("failed to open %q: %w", name, err))
+	}
+	if ra == nil {
+		if len(errs) == 0 {
+			return fmt.Errorf("%w: the parent locator has no path", ErrUnsupportedParent)
+		}
+		return fmt.Errorf("%w: %w", ErrUnsupportedParent, errors.Join(errs...))
+	}
+	img.ParentFullPath = resolved
+	chain := o.chain
+	if o.name != "" {
+		chain = append(slices.Clip(chain), o.name)
+	}
+	if resolved != "" && slices.Contains(chain, resolved) {
+		closeReaderAt(ra)
+		return fmt.Errorf("%w: parent chain loop (file %q)", ErrUnsupportedParent, resolved)
+	}
+	parentOptions := *o
+	parentOptions.name = resolved
+	parentOptions.depth++
+	parentOptions.chain = chain
+	parent, err := open(ra, &parentOptions)
+	if err != nil {
+		closeReaderAt(ra)
+		return fmt.Errorf("%w (file %q): %w", ErrUnsupportedParent, resolved, err)
+	}
+	img.parent = parent
+	if err := parent.Readable(); err != nil {
+		return fmt.Errorf("%w (file %q): %w", ErrUnsupportedParent, resolved, err)
+	}
+	// The parent must not be modified after the differencing disk was created.
+	if parent.Header.DataWriteGUID != linkage {
+		linkage2, err := ParseGUID(locator["parent_linkage2"])
+		if err != nil || parent.Header.DataWriteGUID != linkage2 {
+			return fmt.Errorf("%w (file %q): the parent data write GUID %s does not match the parent_linkage %s", ErrUnsupportedParent, resolved, parent.Header.DataWriteGUID, linkage)
+		}
+	}
+	return nil
+}
+
+func closeReaderAt(ra io.ReaderAt) {
+	if closer, ok := ra.(io.Closer); ok {
+		_ = closer.Close()
+	}
+}
+
+func (img *Vhdx) Close() error {
+	var err error
+	if img.parent != nil {
+		err = img.parent.Close()
+	}
+	if closer, ok := img.ra.(io.Closer); ok {
+		if err2 := closer.Close(); err2 != nil {
+			if err != nil {
+				log.Warn(err)
+			}
+			err = err2
+		}
+	}
+	return err
+}
+
+func (img *Vhdx) Type() image.Type {
+	return Type
+}
+
+func (img *Vhdx) Size() int64 {
+	if img.Metadata == nil {
+		return -1
+	}
+	return int64(img.Metadata.VirtualDiskSize)
+}
+
+// Readable returns nil if the image is readable, otherwise returns an error.
+func (img *Vhdx) Readable() error {
+	return img.errUnreadable
+}
+
+// unitKind describes how a range of the image is read.
+type unitKind int
+
+const (
+	unitUnallocated unitKind = iota // read from the parent, or zeros
+	unitZero
+	unitData
+)
+
+// unit is a range of the image with the same status: a block, or a run of
+// sectors with the same bit in the sector bitmap of a partially present block.
+type unit struct {
+	kind unitKind
+	// offset is the file offset of the data.
+	offset int64
+	// length of the unit from the requested offset.
+	length int64
+}
+
+// unitAt returns the unit containing off.
+func (img *Vhdx) unitAt(off int64) (unit, error) {
+	block := off / img.blockSize
+	inBlock := off % img.blockSize
+	u := unit{length: min(img.blockSize-inBlock, img.Size()-off)}
+	entry := img.bat[block+block/img.chunkRatio]
+	switch entry.state() {
+	case PayloadBlockNotPresent, PayloadBlockUndefined, PayloadBlockUnmapped, PayloadBlockUnmappedV095:
+		u.kind = unitUnallocated
+	case PayloadBlockZero:
+		u.kind = unitZero
+	case PayloadBlockFullyPresent:
+		u.kind = unitData
+		u.offset = entry.fileOffset() + inBlock
+	case PayloadBlockPartiallyPresent:
+		if !img.Metadata.HasParent {
+			return u, fmt.Errorf("partially present block %d in an image without parent", block)
+		}
+		bitmap, err := img.sectorBitmap(block)
+		if err != nil {
+			return u, err
+		}
+		sector := inBlock / img.sectorSize
+		present := bitSet(bitmap, sector)
+		end := sector + 1
+		for end < int64(len(bitmap))*8 && bitSet(bitmap, end) == present {
+			end++
+		}
+		u.length = min(u.length, end*img.sectorSize-inBlock)
+		if present {
+			u.kind = unitData
+			u.offset = entry.fileOffset() + inBlock
+		}
+	default:
+		return u, fmt.Errorf("invalid state %d of block %d", entry.state(), block)
+	}
+	return u, nil
+}
+
+func bitSet(bitmap []byte, i int64) bool {
+	return bitmap[i/8]&(1<<(i%8)) != 0
+}
+
+// sectorBitmap returns the part of the sector bitmap describing block.
+func (img *Vhdx) sectorBitmap(block int64) ([]byte, error) {
+	if bitmap, ok := img.bitmapCache.Get(block); ok {
+		return bitmap, nil
+	}
+	chunk := block / img.chunkRatio
+	entry := img.bat[chunk*(img.chunkRatio+1)+img.chunkRatio]
+	if entry.state() != SectorBitmapBlockPresent {
+		return nil, fmt.Errorf("missing sector bitmap block for block %d", block)
+	}
+	sectorsPerBlock := img.blockSize / img.sectorSize
+	bitmap := make([]byte, sectorsPerBlock/8)
+	off := entry.fileOffset() + block%img.chunkRatio*sectorsPerBlock/8
+	if _, err := img.ra.ReadAt(bitmap, off); err != nil {
+		return nil, fmt.Errorf("failed to read the sector bitmap of block %d: %w", block, err)
+	}
+	img.bitmapCache.Add(block, bitmap)
+	return bitmap, nil
+}
+
+// ReadAt implements [io.ReaderAt].
+func (img *Vhdx) ReadAt(p []byte, off int64) (int, error) {
+	if img.errUnreadable != nil {
+		return 0, img.errUnreadable
+	}
+	size := img.Size()
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= size {
+		return 0, io.EOF
+	}
+	var eof bool
+	if off+int64(len(p)) > size {
+		p = p[:size-off]
+		eof = true
+	}
+	var n int
+	for n < len(p) {
+		currentOff := off + int64(n)
+		u, err := img.unitAt(currentOff)
+		if err != nil {
+			return n, err
+		}
+		end := n + int(min(int64(len(p)-n), u.length))
+		switch u.kind {
+		case unitData:
+			if _, err := img.ra.ReadAt(p[n:end], u.offset); err != nil {
+				return n, fmt.Errorf("failed to read block data at offset %d: %w", u.offset, err)
+			}
+		case unitZero:
+			clear(p[n:end])
+		default:
+			if err := img.readUnallocated(p[n:end], currentOff); err != nil {
+				return n, err
+			}
+		}
+		n = end
+	}
+	if eof {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readUnallocated reads unallocated data at off from the parent image.
+func (img *Vhdx) readUnallocated(p []byte, off int64) error {
+	var n int
+	if img.parent != nil {
+		var err error
+		n, err = img.parent.ReadAt(p, off)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+	}
+	// Data beyond the end of the parent image is read as zeros.
+	clear(p[n:])
+	return nil
+}
+
+// Extent returns the next extent starting at start, with the same allocation
+// and zero status, limited to length.
+func (img *Vhdx) Extent(start, length int64) (image.Extent, error) {
+	var current image.Extent
+	if img.errUnreadable != nil {
+		return current, img.errUnreadable
+	}
+	if start < 0 || start+length > img.Size() {
+		return current, errors.New("length out of bounds")
+	}
+	for length > 0 {
+		u, err := img.unitAt(start)
+		if err != nil {
+			return current, err
+		}
+		n := min(length, u.length)
+		status := image.Extent{Start: start, Length: n}
+		switch u.kind {
+		case unitData:
+			status.Allocated = true
+		case unitZero:
+			status.Allocated = true
+			status.Zero = true
+		default:
+			if img.parent == nil || start >= img.parent.Size() {
+				status.Zero = true
+				break
+			}
+			parent, err := img.parent.Extent(start, min(n, img.parent.Size()-start))
+			if err != nil {
+				return current, err
+			}
+			status.Allocated, status.Zero = parent.Allocated, parent.Zero
+			n = min(n, parent.Length)
+			status.Length = n
+		}
+		if current.Length == 0 {
+			current = status
+		} else if sameStatus(current, status) {
+			current.Length += n
+		} else {
+			break
+		}
+		start += n
+		length -= n
+	}
+	return current, nil
+}
+
+// Return true if extents have the same status.
+func sameStatus(a, b image.Extent) bool {
+	return a.Allocated == b.Allocated && a.Zero == b.Zero && a.Compressed == b.Compressed
 }
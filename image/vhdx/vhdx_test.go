@@ -0,0 +1,462 @@
+package vhdx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"testing/fstest"
+	"unicode/utf16"
+
+	"github.com/lima-vm/go-qcow2reader/image"
+	"github.com/lima-vm/go-qcow2reader/test/imagetest"
+	"github.com/lima-vm/go-qcow2reader/test/qemuimg"
+)
+
+const (
+	testBlockSize  = 1 << 20
+	testSectorSize = 512
+
+	testMetadataOffset = 1 << 20
+	testBATOffset      = 2 << 20
+	testBitmapOffset   = 3 << 20
+	testPayloadOffset  = 4 << 20
+)
+
+// Block states in test layouts.
+const (
+	blockFull       = 'f'
+	blockPartial    = 'p'
+	blockNotPresent = 'n'
+	blockZero       = 'z'
+	blockUnmapped   = 'u'
+	blockUndefined  = 'x'
+)
+
+type testImage struct {
+	// layout has a block state for each block.
+	layout string
+	// size defaults to the size of the blocks in layout.
+	size           int64
+	headerSequence [2]uint64 // 0 for an invalid header
+	dataWriteGUID  GUID
+	logGUID        GUID
+	parentLocator  map[string]string
+	seed           int64
+}
+
+// testBitmapByte returns the byte i of the sector bitmap of partially present
+// blocks: runs of 8 sectors alternate between present and not present.
+func testBitmapByte(i int) byte {
+	if i%2 == 0 {
+		return 0xff
+	}
+	return 0
+}
+
+func checksum(b []byte) {
+	binary.LittleEndian.PutUint32(b[4:], 0)
+	binary.LittleEndian.PutUint32(b[4:], crc32.Checksum(b, castagnoli))
+}
+
+func marshalTestStruct(t *testing.T, v any) []byte {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, v); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func marshalParentLocator(t *testing.T, locator map[string]string) []byte {
+	keys := make([]string, 0, len(locator))
+	for k := range locator {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	encode := func(s string) []byte {
+		return marshalTestStruct(t, utf16.Encode([]rune(s)))
+	}
+	header := marshalTestStruct(t, struct {
+		Type     GUID
+		Reserved uint16
+		Count    uint16
+	}{ParentLocatorTypeVHDX, 0, uint16(len(keys))})
+	stringsOffset := len(header) + 12*len(keys)
+	var entries, stringsData []byte
+	for _, k := range keys {
+		key, value := encode(k), encode(locator[k])
+		entries = append(entries, marshalTestStruct(t, struct {
+			KeyOffset, ValueOffset uint32
+			KeyLength, ValueLength uint16
+		}{
+			uint32(stringsOffset + len(stringsData)),
+			uint32(stringsOffset + len(stringsData) + len(key)),
+			uint16(len(key)), uint16(len(value)),
+		})...)
+		stringsData = append(stringsData, key...)
+		stringsData = append(stringsData, value...)
+	}
+	return append(append(header, entries...), stringsData...)
+}
+
+// createTestImage creates a vhdx image. Returns the image and the expected data
+// of blocks in this image; data of partially present blocks is set only for
+// present sectors.
+func createTestImage(t *testing.T, ti testImage) ([]byte, []byte) {
+	r := rand.New(rand.NewSource(ti.seed))
+	size := ti.size
+	if size == 0 {
+		size = int64(len(ti.layout)) * testBlockSize
+	}
+	hasParent := ti.parentLocator != nil
+	img := make([]byte, testPayloadOffset+len(ti.layout)*testBlockSize)
+	copy(img, FileIdentifierSignature)
+
+	for i, seq := range ti.headerSequence {
+		if seq == 0 {
+			continue
+		}
+		h := Header{
+			SequenceNumber: seq,
+			DataWriteGUID:  ti.dataWriteGUID,
+			LogGUID:        ti.logGUID,
+			Version:        1,
+			LogLength:      1 << 20,
+			LogOffset:      testPayloadOffset + uint64(len(ti.layout))*testBlockSize,
+		}
+		copy(h.Signature[:], HeaderSignature)
+		b := img[header1Offset+i*(header2Offset-header1Offset):][:headerSize]
+		copy(b, marshalTestStruct(t, h))
+		checksum(b)
+	}
+
+	regions := []RegionTableEntry{
+		{GUID: RegionBAT, FileOffset: testBATOffset, Length: 1 << 20, Required: 1},
+		{GUID: RegionMetadata, FileOffset: testMetadataOffset, Length: 1 << 20, Required: 1},
+	}
+	for _, off := range []int{regionTable1Offset, regionTable2Offset} {
+		b := img[off:][:regionTableSize]
+		h := RegionTableHeader{EntryCount: uint32(len(regions))}
+		copy(h.Signature[:], RegionTableSignature)
+		copy(b, append(marshalTestStruct(t, h), marshalTestStruct(t, regions)...))
+		checksum(b)
+	}
+
+	var fileParameters uint32
+	if hasParent {
+		fileParameters |= 1 << FileParametersHasParentBit
+	}
+	items := []struct {
+		id    GUID
+		data  []byte
+		flags uint32
+	}{
+		{MetadataFileParameters, marshalTestStruct(t, []uint32{testBlockSize, fileParameters}), 1 << MetadataFlagsIsRequiredBit},
+		{MetadataVirtualDiskSize, marshalTestStruct(t, uint64(size)), 1<<MetadataFlagsIsRequiredBit | 1<<MetadataFlagsIsVirtualDiskBit},
+		{MetadataVirtualDiskID, make([]byte, 16), 1<<MetadataFlagsIsRequiredBit | 1<<MetadataFlagsIsVirtualDiskBit},
+		{MetadataLogicalSectorSize, marshalTestStruct(t, uint32(testSectorSize)), 1<<MetadataFlagsIsRequiredBit | 1<<MetadataFlagsIsVirtualDiskBit},
+		{MetadataPhysicalSectorSize, marshalTestStruct(t, uint32(4096)), 1<<MetadataFlagsIsRequiredBit | 1<<MetadataFlagsIsVirtualDiskBit},
+		// Unknown items that are not required are ignored.
+		{mustParseGUID("01234567-89AB-CDEF-0123-456789ABCDEF"), []byte("user"), 1 << MetadataFlagsIsUserBit},
+	}
+	if hasParent {
+		items = append(items, struct {
+			id    GUID
+			data  []byte
+			flags uint32
+		}{MetadataParentLocator, marshalParentLocator(t, ti.parentLocator), 1<<MetadataFlagsIsRequiredBit | 1<<MetadataFlagsIsVirtualDiskBit})
+	}
+	metadata := img[testMetadataOffset:]
+	mh := MetadataTableHeader{EntryCount: uint16(len(items))}
+	copy(mh.Signature[:], MetadataSignature)
+	copy(metadata, marshalTestStruct(t, mh))
+	itemOffset := metadataItemsOffset
+	for i, item := range items {
+		e := MetadataTableEntry{ItemID: item.id, Offset: uint32(itemOffset), Length: uint32(len(item.data)), Flags: item.flags}
+		copy(metadata[32+i*32:], marshalTestStruct(t, e))
+		copy(metadata[itemOffset:], item.data)
+		itemOffset += len(item.data)
+	}
+
+	// With 1 MiB blocks and 512 bytes sectors, the chunk ratio is 4096, so all
+	// payload blocks are in the first chunk.
+	const chunkRatio = sectorsPerChunk * testSectorSize / testBlockSize
+	want := make([]byte, len(ti.layout)*testBlockSize)
+	bat := img[testBATOffset:]
+	if hasParent {
+		binary.LittleEndian.PutUint64(bat[chunkRatio*8:], testBitmapOffset|SectorBitmapBlockPresent)
+	}
+	for i, c := range ti.layout {
+		blockOffset := uint64(testPayloadOffset + i*testBlockSize)
+		var entry uint64
+		switch c {
+		case blockFull, blockPartial:
+			entry = blockOffset | PayloadBlockFullyPresent
+			data := want[i*testBlockSize:][:testBlockSize]
+			if _, err := r.Read(data); err != nil {
+				t.Fatal(err)
+			}
+			copy(img[blockOffset:], data)
+			if c == blockPartial {
+				entry = blockOffset | PayloadBlockPartiallyPresent
+				bitmap := img[testBitmapOffset+i*testBlockSize/testSectorSize/8:][:testBlockSize/testSectorSize/8]
+				for j := range bitmap {
+					bitmap[j] = testBitmapByte(j)
+					if bitmap[j] == 0 {
+						clear(data[j*8*testSectorSize:][:8*testSectorSize])
+					}
+				}
+			}
+		case blockNotPresent:
+			entry = PayloadBlockNotPresent
+		case blockZero:
+			entry = PayloadBlockZero
+		case blockUnmapped:
+			entry = PayloadBlockUnmapped
+		case blockUndefined:
+			entry = PayloadBlockUndefined
+		}
+		binary.LittleEndian.PutUint64(bat[i*8:], entry)
+	}
+	return img, want[:size]
+}
+
+func TestParseGUID(t *testing.T) {
+	const s = "2DC27766-F623-4200-9D64-115E9BFD4A08"
+	g, err := ParseGUID("{" + s + "}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := GUID{0x66, 0x77, 0xc2, 0x2d, 0x23, 0xf6, 0x00, 0x42, 0x9d, 0x64, 0x11, 0x5e, 0x9b, 0xfd, 0x4a, 0x08}
+	if g != want {
+		t.Fatalf("expected %x, got %x", want, g)
+	}
+	if g.String() != s {
+		t.Fatalf("expected %s, got %s", s, g)
+	}
+	for _, invalid := range []string{"", "2DC27766-F623-4200-9D64", "2DC27766-F623-4200-9D64-115E9BFD4AXX"} {
+		if _, err := ParseGUID(invalid); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestVhdx(t *testing.T) {
+	const layout = "fnuz" + "xff"
+	// The last block is not complete.
+	const size = int64(len(layout))*testBlockSize - 64<<10
+	wantExtents := []image.Extent{
+		{Start: 0, Length: testBlockSize, Allocated: true},
+		{Start: 1 * testBlockSize, Length: 2 * testBlockSize, Zero: true},
+		{Start: 3 * testBlockSize, Length: testBlockSize, Allocated: true, Zero: true},
+		{Start: 4 * testBlockSize, Length: testBlockSize, Zero: true},
+		{Start: 5 * testBlockSize, Length: size - 5*testBlockSize, Allocated: true},
+	}
+	cases := []struct {
+		name     string
+		sequence [2]uint64
+	}{
+		{name: "header 1", sequence: [2]uint64{2, 1}},
+		{name: "header 2", sequence: [2]uint64{1, 2}},
+		{name: "invalid header 1", sequence: [2]uint64{0, 1}},
+		{name: "invalid header 2", sequence: [2]uint64{1, 0}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			data, want := createTestImage(t, testImage{layout: layout, size: size, headerSequence: tc.sequence})
+			img, err := Open(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := img.Readable(); err != nil {
+				t.Fatal(err)
+			}
+			if img.Size() != size {
+				t.Fatalf("expected size %d, got %d", size, img.Size())
+			}
+			if !bytes.Equal(imagetest.ReadAll(t, img), want) {
+				t.Fatal("unexpected data")
+			}
+			if extents := imagetest.ReadExtents(t, img); !reflect.DeepEqual(extents, wantExtents) {
+				t.Fatalf("expected extents\n%+v\ngot\n%+v", wantExtents, extents)
+			}
+		})
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	data, _ := createTestImage(t, testImage{layout: "f", headerSequence: [2]uint64{1, 2}, logGUID: mustParseGUID("11111111-2222-3333-4444-555555555555")})
+	img, err := Open(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	imagetest.CheckUnreadable(t, img, ErrLogReplayRequired)
+
+	data, _ = createTestImage(t, testImage{layout: "f"})
+	img, err = Open(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Readable(); err == nil {
+		t.Fatal("expected an error without valid headers")
+	}
+
+	if _, err := Open(bytes.NewReader(make([]byte, 512))); !errors.Is(err, image.ErrWrongType) {
+		t.Fatalf("expected ErrWrongType, got %v", err)
+	}
+}
+
+// maxReadReaderAt records the size of the largest read.
+type maxReadReaderAt struct {
+	io.ReaderAt
+	max int
+}
+
+func (r *maxReadReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.max = max(r.max, len(p))
+	return r.ReaderAt.ReadAt(p, off)
+}
+
+func TestMetadataLimits(t *testing.T) {
+	data, _ := createTestImage(t, testImage{layout: "f", headerSequence: [2]uint64{1, 2}})
+	// Metadata table entries follow the 32 bytes header.
+	entryLength := func(i int) []byte {
+		return data[testMetadataOffset+32+i*32+20:][:4]
+	}
+	if _, err := readMetadata(bytes.NewReader(data), testMetadataOffset, maxMetadataRegionSize+512); !errors.Is(err, ErrUnsupportedFeature) {
+		t.Fatalf("expected ErrUnsupportedFeature, got %v", err)
+	}
+
+	// Unknown optional items are not read, whatever their size.
+	binary.LittleEndian.PutUint32(entryLength(5), maxMetadataRegionSize-2*metadataItemsOffset)
+	r := &maxReadReaderAt{ReaderAt: bytes.NewReader(data)}
+	if _, err := readMetadata(r, testMetadataOffset, maxMetadataRegionSize); err != nil {
+		t.Fatal(err)
+	}
+	if r.max > 4096 {
+		t.Fatalf("expected small reads, got a read of %d bytes", r.max)
+	}
+
+	// Known items are checked before reading.
+	binary.LittleEndian.PutUint32(entryLength(3), 2)
+	if _, err := readMetadata(bytes.NewReader(data), testMetadataOffset, maxMetadataRegionSize); err == nil {
+		t.Fatal("expected an error for a short logical sector size")
+	}
+}
+
+// TestQemuImg reads images converted by qemu-img.
+func TestQemuImg(t *testing.T) {
+	for _, subformat := range []string{"dynamic", "fixed"} {
+		t.Run(subformat, func(t *testing.T) {
+			path := imagetest.ConvertQemuImg(t, qemuimg.FormatVhdx, 10<<20, "subformat="+subformat)
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close() //nolint:errcheck
+			img, err := Open(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			imagetest.CompareQemuImg(t, img, path)
+		})
+	}
+}
+
+func TestDifferencing(t *testing.T) {
+	parentGUID := mustParseGUID("0D0C0B0A-0F0E-1110-1213-141516171819")
+	parent, wantParent := createTestImage(t, testImage{layout: "ffnf", headerSequence: [2]uint64{1, 0}, dataWriteGUID: parentGUID, seed: 1})
+	child, wantChild := createTestImage(t, testImage{
+		layout:         "pznp",
+		headerSequence: [2]uint64{1, 0},
+		parentLocator: map[string]string{
+			"parent_linkage":      "{" + parentGUID.String() + "}",
+			"relative_path":       `..\base\parent.vhdx`,
+			"absolute_win32_path": `C:\VMs\base\parent.vhdx`,
+		},
+		seed: 2,
+	})
+	modified, _ := createTestImage(t, testImage{
+		layout:         "pznp",
+		headerSequence: [2]uint64{1, 0},
+		parentLocator: map[string]string{
+			"parent_linkage": "{01234567-89AB-CDEF-0123-456789ABCDEF}",
+			"relative_path":  `..\base\parent.vhdx`,
+		},
+	})
+	outside, _ := createTestImage(t, testImage{
+		layout:         "pznp",
+		headerSequence: [2]uint64{1, 0},
+		parentLocator: map[string]string{
+			"parent_linkage": "{" + parentGUID.String() + "}",
+			"relative_path":  `..\..\secret.vhdx`,
+		},
+	})
+	fsys := fstest.MapFS{
+		"base/parent.vhdx":  &fstest.MapFile{Data: parent},
+		"vm/child.vhdx":     &fstest.MapFile{Data: child},
+		"vm/modified.vhdx":  &fstest.MapFile{Data: modified},
+		"vm/no-parent.vhdx": &fstest.MapFile{Data: child},
+		"vm/outside.vhdx":   &fstest.MapFile{Data: outside},
+	}
+	openFS := func(name string) *Vhdx {
+		t.Helper()
+		img, err := Open(bytes.NewReader(fsys[name].Data), WithFileResolver(image.FSFileResolver(fsys)), WithName(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = img.Close() })
+		return img
+	}
+
+	img := openFS("vm/child.vhdx")
+	if err := img.Readable(); err != nil {
+		t.Fatal(err)
+	}
+	if img.ParentFullPath != "base/parent.vhdx" {
+		t.Fatalf("expected parent base/parent.vhdx, got %q", img.ParentFullPath)
+	}
+	want := bytes.Clone(wantParent)
+	for _, block := range []int{0, 3} {
+		for j := 0; j < testBlockSize/testSectorSize/8; j++ {
+			if testBitmapByte(j) != 0 {
+				off := block*testBlockSize + j*8*testSectorSize
+				copy(want[off:off+8*testSectorSize], wantChild[off:])
+			}
+		}
+	}
+	clear(want[1*testBlockSize : 2*testBlockSize])
+	if !bytes.Equal(imagetest.ReadAll(t, img), want) {
+		t.Fatal("unexpected data")
+	}
+	extents := imagetest.ReadExtents(t, img)
+	wantExtents := []image.Extent{
+		// Sectors of partially present blocks are in the child or the parent.
+		{Start: 0, Length: testBlockSize, Allocated: true},
+		{Start: 1 * testBlockSize, Length: testBlockSize, Allocated: true, Zero: true},
+		// Not present in the child and the parent.
+		{Start: 2 * testBlockSize, Length: testBlockSize, Zero: true},
+		{Start: 3 * testBlockSize, Length: testBlockSize, Allocated: true},
+	}
+	if !reflect.DeepEqual(extents, wantExtents) {
+		t.Fatalf("expected extents\n%+v\ngot\n%+v", wantExtents, extents)
+	}
+
+	if err := openFS("vm/modified.vhdx").Readable(); !errors.Is(err, ErrUnsupportedParent) {
+		t.Fatalf("expected ErrUnsupportedParent, got %v", err)
+	}
+	// Errors of the resolver are reported, e.g. for an open policy.
+	if err := openFS("vm/outside.vhdx").Readable(); !errors.Is(err, ErrUnsupportedParent) || !errors.Is(err, image.ErrUnsafeFileName) {
+		t.Fatalf("expected ErrUnsupportedParent and image.ErrUnsafeFileName, got %v", err)
+	}
+	delete(fsys, "base/parent.vhdx")
+	if err := openFS("vm/no-parent.vhdx").Readable(); !errors.Is(err, ErrUnsupportedParent) {
+		t.Fatalf("expected ErrUnsupportedParent, got %v", err)
+	}
+}
@@ -0,0 +1,162 @@
+package vmdk
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxDescriptorSize is the maximum size of a descriptor file.
+const maxDescriptorSize = 1 << 20
+
+// noParentCID is the parentCID of images without a parent.
+const noParentCID = 0xffffffff
+
+// Extent types.
+const (
+	ExtentTypeFlat       = "FLAT"
+	ExtentTypeSparse     = "SPARSE"
+	ExtentTypeZero       = "ZERO"
+	ExtentTypeVMFS       = "VMFS"
+	ExtentTypeVMFSSparse = "VMFSSPARSE"
+	ExtentTypeSESparse   = "SESPARSE"
+)
+
+// Descriptor is the text descriptor of a vmdk image, either in a separate
+// descriptor file or embedded in a sparse extent.
+type Descriptor struct {
+	Version            int                `json:"version"`
+	CID                uint32             `json:"cid"`
+	ParentCID          uint32             `json:"parent_cid"`
+	CreateType         string             `json:"create_type"`
+	ParentFileNameHint string             `json:"parent_file_name_hint,omitempty"`
+	Extents            []ExtentDescriptor `json:"extents"`
+}
+
+// HasParent returns true if the image is a delta image of a parent image.
+func (d *Descriptor) HasParent() bool {
+	return d.ParentCID != noParentCID
+}
+
+// ExtentDescriptor describes an extent in a [Descriptor].
+type ExtentDescriptor struct {
+	// Access is "RW", "RDONLY", or "NOACCESS".
+	Access string `json:"access"`
+	// Size in sectors.
+	Size uint64 `json:"size"`
+	Type string `json:"type"`
+	// FileName is empty for ZERO extents.
+	FileName string `json:"file_name,omitempty"`
+	// Offset of the data in the file in sectors, for flat extents.
+	Offset uint64 `json:"offset,omitempty"`
+}
+
+// ParseDescriptor parses a descriptor. Unknown keys are ignored.
+func ParseDescriptor(b []byte) (*Descriptor, error) {
+	// Embedded descriptors are padded with zeros.
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	if !bytes.HasPrefix(b, []byte(DescriptorMagic)) {
+		return nil, fmt.Errorf("missing %q", DescriptorMagic)
+	}
+	d := &Descriptor{
+		Version:   1,
+		ParentCID: noParentCID,
+	}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		switch strings.Fields(line)[0] {
+		case "RW", "RDONLY", "NOACCESS":
+			extent, err := parseExtentDescriptor(line)
+			if err != nil {
+				return nil, err
+			}
+			d.Extents = append(d.Extents, extent)
+			continue
+		}
+		if key, value, ok := strings.Cut(line, "="); ok {
+			if err := d.set(strings.TrimSpace(key), unquote(strings.TrimSpace(value))); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *Descriptor) set(key, value string) error {
+	var err error
+	switch key {
+	case "version":
+		d.Version, err = strconv.Atoi(value)
+	case "CID":
+		d.CID, err = parseCID(value)
+	case "parentCID":
+		d.ParentCID, err = parseCID(value)
+	case "createType":
+		d.CreateType = value
+	case "parentFileNameHint":
+		d.ParentFileNameHint = value
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", key, value, err)
+	}
+	return nil
+}
+
+func parseCID(s string) (uint32, error) {
+	cid, err := strconv.ParseUint(s, 16, 32)
+	return uint32(cid), err
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// parseExtentDescriptor parses an extent line, e.g.
+// `RW 4192256 SPARSE "test-s001.vmdk"` or `RW 2048 FLAT "test-flat.vmdk" 0`.
+func parseExtentDescriptor(line string) (ExtentDescriptor, error) {
+	var e ExtentDescriptor
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return e, fmt.Errorf("invalid extent description %q", line)
+	}
+	e.Access = fields[0]
+	var err error
+	if e.Size, err = strconv.ParseUint(fields[1], 10, 64); err != nil {
+		return e, fmt.Errorf("invalid size in extent description %q: %w", line, err)
+	}
+	e.Type = fields[2]
+	if e.Type == ExtentTypeZero {
+		return e, nil
+	}
+	// The file name is quoted and may contain spaces.
+	start := strings.IndexByte(line, '"')
+	if start < 0 || len(fields) < 4 {
+		return e, fmt.Errorf("missing file name in extent description %q", line)
+	}
+	rest := line[start:]
+	end := strings.IndexByte(rest[1:], '"')
+	if end < 0 {
+		return e, fmt.Errorf("unterminated file name in extent description %q", line)
+	}
+	e.FileName = rest[1 : end+1]
+	if offset := strings.TrimSpace(rest[end+2:]); offset != "" {
+		if e.Offset, err = strconv.ParseUint(offset, 10, 64); err != nil {
+			return e, fmt.Errorf("invalid offset in extent description %q: %w", line, err)
+		}
+	}
+	return e, nil
+}
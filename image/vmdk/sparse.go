@@ -0,0 +1,307 @@
+package vmdk
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/lima-vm/go-qcow2reader/lru"
+)
+
+const (
+	SparseMagic = "KDMV"
+
+	// gdAtEnd is the grain directory offset of streamOptimized images written
+	// sequentially. The actual header is in the footer.
+	gdAtEnd = 0xffffffffffffffff
+
+	// gteZeroed is the grain table entry of a zero grain.
+	gteZeroed = 1
+)
+
+// Limits from qemu.
+const (
+	maxGrainSectors     = 0x200000
+	maxGTEsPerGT        = 512
+	maxGrainDirectories = 32 << 20
+)
+
+// Sparse extent header flags.
+const (
+	FlagsValidNewlineDetectionBit = 0
+	FlagsRedundantGrainTableBit   = 1
+	FlagsZeroedGrainGTEBit        = 2
+	FlagsCompressedGrainsBit      = 16
+	FlagsMarkersBit               = 17
+)
+
+// Compression algorithms.
+const (
+	CompressionNone    = 0
+	CompressionDeflate = 1
+)
+
+// Stream marker types.
+const (
+	markerEndOfStream = 0
+	markerGrainTable  = 1
+	markerGrainDir    = 2
+	markerFooter      = 3
+)
+
+// SparseExtentHeader is the header of a hosted sparse extent.
+// Sizes and offsets are in sectors.
+type SparseExtentHeader struct {
+	Magic              [4]byte `json:"magic"`
+	Version            uint32  `json:"version"`
+	Flags              uint32  `json:"flags"`
+	Capacity           uint64  `json:"capacity"`
+	GrainSize          uint64  `json:"grain_size"`
+	DescriptorOffset   uint64  `json:"descriptor_offset"`
+	DescriptorSize     uint64  `json:"descriptor_size"`
+	NumGTEsPerGT       uint32  `json:"num_gtes_per_gt"`
+	RGDOffset          uint64  `json:"rgd_offset"`
+	GDOffset           uint64  `json:"gd_offset"`
+	OverHead           uint64  `json:"overhead"`
+	UncleanShutdown    uint8   `json:"unclean_shutdown"`
+	SingleEndLineChar  byte    `json:"-"`
+	NonEndLineChar     byte    `json:"-"`
+	DoubleEndLineChar1 byte    `json:"-"`
+	DoubleEndLineChar2 byte    `json:"-"`
+	CompressAlgorithm  uint16  `json:"compress_algorithm"`
+}
+
+func (h *SparseExtentHeader) flag(bit int) bool {
+	return h.Flags&(1<<bit) != 0
+}
+
+// Compressed returns true if grains are compressed (streamOptimized).
+func (h *SparseExtentHeader) Compressed() bool {
+	return h.flag(FlagsCompressedGrainsBit)
+}
+
+func readSparseExtentHeader(ra io.ReaderAt, off int64) (*SparseExtentHeader, error) {
+	buf := make([]byte, 512)
+	if _, err := ra.ReadAt(buf, off); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read the sparse extent header: %w", err)
+	}
+	if !bytes.HasPrefix(buf, []byte(SparseMagic)) {
+		return nil, ErrNotVmdk
+	}
+	var h SparseExtentHeader
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// readFooter reads the header from the footer of a streamOptimized extent.
+func readFooter(ra io.ReaderAt, fileSize int64) (*SparseExtentHeader, error) {
+	if fileSize < 3*512 {
+		return nil, errors.New("the file is too small for a footer")
+	}
+	footerOffset := fileSize - 3*512
+	marker := make([]byte, 16)
+	if _, err := ra.ReadAt(marker, footerOffset); err != nil {
+		return nil, fmt.Errorf("failed to read the footer marker: %w", err)
+	}
+	if binary.LittleEndian.Uint32(marker[8:]) != 0 || binary.LittleEndian.Uint32(marker[12:]) != markerFooter {
+		return nil, errors.New("invalid footer marker")
+	}
+	h, err := readSparseExtentHeader(ra, footerOffset+512)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the footer: %w", err)
+	}
+	if _, err := ra.ReadAt(marker, footerOffset+1024); err != nil {
+		return nil, fmt.Errorf("failed to read the end-of-stream marker: %w", err)
+	}
+	if binary.LittleEndian.Uint64(marker) != 0 || binary.LittleEndian.Uint32(marker[8:]) != 0 || binary.LittleEndian.Uint32(marker[12:]) != markerEndOfStream {
+		return nil, errors.New("invalid end-of-stream marker")
+	}
+	return h, nil
+}
+
+// grainStatus describes a grain of a sparse extent.
+type grainStatus struct {
+	allocated  bool
+	zero       bool
+	compressed bool
+	offset     int64 // in bytes
+}
+
+// sparseExtent is a hosted sparse extent (monolithicSparse, streamOptimized,
+// or twoGbMaxExtentSparse).
+type sparseExtent struct {
+	ra          io.ReaderAt
+	header      *SparseExtentHeader
+	grainSize   int64 // in bytes
+	gtCoverage  int64 // bytes covered by a grain table
+	gd          []uint32
+	gtCache     *lru.Cache[uint32, []uint32]
+	zeroedGrain bool
+	markers     bool
+}
+
+// With 512 entries per grain table, a grain table uses 2 KiB.
+const maxGrainTables = 256
+
+func openSparseExtent(ra io.ReaderAt, fileSize int64) (*sparseExtent, error) {
+	h, err := readSparseExtentHeader(ra, 0)
+	if err != nil {
+		return nil, err
+	}
+	if h.Version < 1 || h.Version > 3 {
+		return nil, fmt.Errorf("%w: version %d", ErrUnsupportedFeature, h.Version)
+	}
+	if h.GDOffset == gdAtEnd {
+		if fileSize < 0 {
+			return nil, errors.New("the grain directory is at the end of the file, but the file size is unknown")
+		}
+		footer, err := readFooter(ra, fileSize)
+		if err != nil {
+			return nil, err
+		}
+		h = footer
+	}
+	if h.GrainSize == 0 || h.GrainSize > maxGrainSectors || h.GrainSize&(h.GrainSize-1) != 0 {
+		return nil, fmt.Errorf("invalid grain size %d", h.GrainSize)
+	}
+	if h.NumGTEsPerGT == 0 || h.NumGTEsPerGT > maxGTEsPerGT {
+		return nil, fmt.Errorf("invalid number of grain table entries %d", h.NumGTEsPerGT)
+	}
+	switch h.CompressAlgorithm {
+	case CompressionNone:
+	case CompressionDeflate:
+	default:
+		return nil, fmt.Errorf("%w: compression algorithm %d", ErrUnsupportedFeature, h.CompressAlgorithm)
+	}
+	if h.Compressed() && h.CompressAlgorithm != CompressionDeflate {
+		return nil, fmt.Errorf("%w: compressed grains with compression algorithm %d", ErrUnsupportedFeature, h.CompressAlgorithm)
+	}
+	e := &sparseExtent{
+		ra:          ra,
+		header:      h,
+		grainSize:   int64(h.GrainSize) * 512,
+		zeroedGrain: h.flag(FlagsZeroedGrainGTEBit),
+		markers:     h.flag(FlagsMarkersBit),
+		gtCache:     lru.New[uint32, []uint32](maxGrainTables),
+	}
+	e.gtCoverage = e.grainSize * int64(h.NumGTEsPerGT)
+	if h.Capacity > math.MaxInt64/512 {
+		return nil, fmt.Errorf("invalid capacity %d", h.Capacity)
+	}
+	numGDEs := (h.Capacity*512 + uint64(e.gtCoverage) - 1) / uint64(e.gtCoverage)
+	if numGDEs > maxGrainDirectories {
+		return nil, fmt.Errorf("grain directory too large (%d entries)", numGDEs)
+	}
+	gdOffset := h.GDOffset
+	if gdOffset == 0 && h.flag(FlagsRedundantGrainTableBit) {
+		gdOffset = h.RGDOffset
+	}
+	if gdOffset == 0 {
+		return nil, errors.New("missing grain directory")
+	}
+	if gdOffset > math.MaxInt64/512 || fileSize >= 0 && int64(gdOffset)*512+int64(numGDEs)*4 > fileSize {
+		return nil, fmt.Errorf("grain directory at sector %d beyond the end of the file", gdOffset)
+	}
+	e.gd = make([]uint32, numGDEs)
+	if err := binary.Read(io.NewSectionReader(ra, int64(gdOffset)*512, int64(numGDEs)*4), binary.LittleEndian, e.gd); err != nil {
+		return nil, fmt.Errorf("failed to read the grain directory: %w", err)
+	}
+	return e, nil
+}
+
+func (e *sparseExtent) size() int64 {
+	return int64(e.header.Capacity) * 512
+}
+
+func (e *sparseExtent) grainTable(gdIndex int) ([]uint32, error) {
+	gtOffset := e.gd[gdIndex]
+	if gt, ok := e.gtCache.Get(gtOffset); ok {
+		return gt, nil
+	}
+	gt := make([]uint32, e.header.NumGTEsPerGT)
+	if err := binary.Read(io.NewSectionReader(e.ra, int64(gtOffset)*512, int64(len(gt))*4), binary.LittleEndian, gt); err != nil {
+		return nil, fmt.Errorf("failed to read grain table at sector %d: %w", gtOffset, err)
+	}
+	e.gtCache.Add(gtOffset, gt)
+	return gt, nil
+}
+
+// grainStatus returns the status of the grain containing off.
+func (e *sparseExtent) grainStatus(off int64) (grainStatus, error) {
+	gdIndex := int(off / e.gtCoverage)
+	if gdIndex >= len(e.gd) || e.gd[gdIndex] == 0 {
+		return grainStatus{}, nil
+	}
+	gt, err := e.grainTable(gdIndex)
+	if err != nil {
+		return grainStatus{}, err
+	}
+	gte := gt[off%e.gtCoverage/e.grainSize]
+	switch {
+	case gte == 0:
+		return grainStatus{}, nil
+	case gte == gteZeroed && e.zeroedGrain:
+		return grainStatus{allocated: true, zero: true}, nil
+	}
+	return grainStatus{allocated: true, compressed: e.header.Compressed(), offset: int64(gte) * 512}, nil
+}
+
+// readGrain reads p from the grain at off. p must not cross a grain boundary.
+// Unallocated grains are read by readUnallocated.
+func (e *sparseExtent) readGrain(p []byte, off int64, readUnallocated func([]byte, int64) error) error {
+	gs, err := e.grainStatus(off)
+	if err != nil {
+		return err
+	}
+	inGrain := off % e.grainSize
+	switch {
+	case !gs.allocated:
+		return readUnallocated(p, off)
+	case gs.zero:
+		clear(p)
+		return nil
+	case gs.compressed:
+		return e.readCompressedGrain(p, gs.offset, inGrain)
+	}
+	if n, err := e.ra.ReadAt(p, gs.offset+inGrain); err != nil {
+		if !errors.Is(err, io.EOF) {
+			return fmt.Errorf("failed to read grain at offset %d: %w", gs.offset, err)
+		}
+		// Grains at the end of the file may be truncated.
+		clear(p[n:])
+	}
+	return nil
+}
+
+func (e *sparseExtent) readCompressedGrain(p []byte, grainOffset, inGrain int64) error {
+	dataOffset, dataSize := grainOffset, e.grainSize*2
+	if e.markers {
+		var marker [12]byte
+		if _, err := e.ra.ReadAt(marker[:], grainOffset); err != nil {
+			return fmt.Errorf("failed to read grain marker at offset %d: %w", grainOffset, err)
+		}
+		dataOffset += 12
+		dataSize = int64(binary.LittleEndian.Uint32(marker[8:]))
+	}
+	zr, err := zlib.NewReader(io.NewSectionReader(e.ra, dataOffset, dataSize))
+	if err != nil {
+		return fmt.Errorf("failed to decompress grain at offset %d: %w", grainOffset, err)
+	}
+	defer zr.Close() //nolint:errcheck
+	if _, err := io.CopyN(io.Discard, zr, inGrain); err != nil {
+		return fmt.Errorf("failed to decompress grain at offset %d: %w", grainOffset, err)
+	}
+	n, err := io.ReadFull(zr, p)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to decompress grain at offset %d: %w", grainOffset, err)
+	}
+	// The last grain may be shorter.
+	clear(p[n:])
+	return nil
+}
@@ -1,19 +1,491 @@
 package vmdk
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
+	"slices"
+	"sort"
 
 	"github.com/lima-vm/go-qcow2reader/image"
-	"github.com/lima-vm/go-qcow2reader/image/stub"
+	"github.com/lima-vm/go-qcow2reader/log"
 )
 
 const Type = image.Type("vmdk")
 
-// Open returns a stub.
-func Open(ra io.ReaderAt) (*stub.Stub, error) {
-	return stub.New(ra, Type,
-		stub.SimpleProber([]byte("# Disk DescriptorFile")),
-		stub.SimpleProber([]byte("KDMV")), // vmdk4
-		stub.SimpleProber([]byte("COWD")), // vmdk3
-	)
+const (
+	DescriptorMagic = "# Disk DescriptorFile"
+	// COWDMagic is the magic of VMware Workstation 3 images (vmdk3).
+	COWDMagic = "COWD"
+)
+
+// maxParentChainDepth is the maximum number of parent images below an image.
+const maxParentChainDepth = 64
+
+var (
+	ErrNotVmdk            = fmt.Errorf("%w: image is not %s", image.ErrWrongType, Type)
+	ErrUnsupportedFeature = errors.New("unsupported feature")
+	ErrUnsupportedExtent  = errors.New("unsupported extent")
+	ErrUnsupportedParent  = errors.New("unsupported parent image")
+)
+
+// Vmdk implements [image.Image].
+//
+// Supported variants are monolithicSparse, streamOptimized, monolithicFlat,
+// twoGbMaxExtentSparse, twoGbMaxExtentFlat, and delta images of VMware
+// snapshots.
+type Vmdk struct {
+	ra io.ReaderAt
+	// Header is the header of the sparse extent, for images starting with a
+	// sparse extent (e.g. monolithicSparse and streamOptimized).
+	Header *SparseExtentHeader `json:"header,omitempty"`
+	// Descriptor is the descriptor file, or the descriptor embedded in the
+	// sparse extent.
+	Descriptor     *Descriptor `json:"descriptor,omitempty"`
+	ParentFullPath string      `json:"parent_full_path,omitempty"`
+	parent         *Vmdk
+	errUnreadable  error
+	extents        []*extent
+	size           int64
+}
+
+// extent is an extent of the image.
+type extent struct {
+	// start and size in the image in bytes.
+	start, size int64
+	// ra is nil for ZERO extents.
+	ra io.ReaderAt
+	// offset of the data of flat extents in ra in bytes.
+	offset int64
+	sparse *sparseExtent
+}
+
+// blockLength returns the length of the block containing off, from off, where
+// off is relative to the start of the extent. Blocks are grains in sparse
+// extents, or the whole extent.
+func (e *extent) blockLength(off int64) int64 {
+	if e.sparse != nil {
+		return min(e.sparse.grainSize-off%e.sparse.grainSize, e.size-off)
+	}
+	return e.size - off
+}
+
+type Option func(*options)
+
+type options struct {
+	fileResolver image.FileResolver
+	name         string
+	depth        int
+	chain        []string
+}
+
+// WithFileResolver sets the [image.FileResolver] used to open extent files and
+// parent images. The default is [image.OSFileResolver].
+func WithFileResolver(r image.FileResolver) Option {
+	return func(o *options) {
+		o.fileResolver = r
+	}
+}
+
+// WithName sets the name of the image, used as base to resolve extent files and
+// parent images. By default, the name of the file is used if ra implements
+// Name() and no [image.FileResolver] is set.
+func WithName(name string) Option {
+	return func(o *options) {
+		o.name = name
+	}
+}
+
+// Open opens a vmdk image.
+//
+// Extent files and parent images are resolved relative to the image (see
+// [WithFileResolver]), and closed with the image.
+//
+// Returns an image that is not readable (see [Vmdk.Readable]) for unsupported
+// variants.
+func Open(ra io.ReaderAt, opts ...Option) (*Vmdk, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.name == "" && o.fileResolver == nil {
+		if namer, ok := ra.(interface{ Name() string }); ok {
+			o.name = namer.Name()
+		}
+	}
+	if o.fileResolver == nil {
+		o.fileResolver = image.OSFileResolver
+	}
+	return open(ra, &o)
+}
+
+func open(ra io.ReaderAt, o *options) (*Vmdk, error) {
+	magic := make([]byte, len(DescriptorMagic))
+	if _, err := ra.ReadAt(magic, 0); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read the first %d bytes: %w", len(magic), err)
+	}
+	img := &Vmdk{ra: ra, size: -1}
+	switch {
+	case bytes.HasPrefix(magic, []byte(SparseMagic)):
+		img.errUnreadable = img.openSparse()
+	case bytes.HasPrefix(magic, []byte(DescriptorMagic)):
+		img.errUnreadable = img.openDescriptorFile(o)
+	case bytes.HasPrefix(magic, []byte(COWDMagic)):
+		img.errUnreadable = fmt.Errorf("%w: vmdk3 (COWD) images", ErrUnsupportedFeature)
+	default:
+		return nil, ErrNotVmdk
+	}
+	if img.errUnreadable == nil && img.Descriptor != nil && img.Descriptor.HasParent() {
+		img.errUnreadable = img.loadParent(o)
+	}
+	return img, nil
+}
+
+// openSparse opens an image starting with a sparse extent, with an optional
+// embedded descriptor.
+func (img *Vmdk) openSparse() error {
+	sparse, err := openSparseExtent(img.ra, fileSize(img.ra))
+	if err != nil {
+		return fmt.Errorf("failed to open the sparse extent: %w", err)
+	}
+	img.Header = sparse.header
+	img.size = sparse.size()
+	img.extents = []*extent{{size: img.size, ra: img.ra, sparse: sparse}}
+	if h := sparse.header; h.DescriptorOffset != 0 && h.DescriptorSize != 0 {
+		if h.DescriptorSize*512 > maxDescriptorSize {
+			return fmt.Errorf("embedded descriptor too large (%d sectors)", h.DescriptorSize)
+		}
+		b := make([]byte, h.DescriptorSize*512)
+		if _, err := img.ra.ReadAt(b, int64(h.DescriptorOffset)*512); err != nil {
+			return fmt.Errorf("failed to read the embedded descriptor: %w", err)
+		}
+		if img.Descriptor, err = ParseDescriptor(b); err != nil {
+			return fmt.Errorf("failed to parse the embedded descriptor: %w", err)
+		}
+	}
+	return nil
+}
+
+// openDescriptorFile opens the extents of a descriptor file.
+func (img *Vmdk) openDescriptorFile(o *options) error {
+	b, err := io.ReadAll(io.NewSectionReader(img.ra, 0, maxDescriptorSize+1))
+	if err != nil {
+		return fmt.Errorf("failed to read the descriptor: %w", err)
+	}
+	if len(b) > maxDescriptorSize {
+		return fmt.Errorf("descriptor too large (more than %d bytes)", maxDescriptorSize)
+	}
+	if img.Descriptor, err = ParseDescriptor(b); err != nil {
+		return fmt.Errorf("failed to parse the descriptor: %w", err)
+	}
+	if len(img.Descriptor.Extents) == 0 {
+		return errors.New("the descriptor has no extents")
+	}
+	var size int64
+	for _, d := range img.Descriptor.Extents {
+		size += int64(d.Size) * 512
+	}
+	img.size = size
+	var start int64
+	for _, d := range img.Descriptor.Extents {
+		e := &extent{start: start, size: int64(d.Size) * 512}
+		start += e.size
+		switch d.Type {
+		case ExtentTypeZero:
+		case ExtentTypeFlat, ExtentTypeVMFS:
+			if e.ra, err = img.openExtentFile(o, d.FileName); err != nil {
+				return err
+			}
+			e.offset = int64(d.Offset) * 512
+		case ExtentTypeSparse:
+			if e.ra, err = img.openExtentFile(o, d.FileName); err != nil {
+				return err
+			}
+			if e.sparse, err = openSparseExtent(e.ra, fileSize(e.ra)); err != nil {
+				closeReaderAt(e.ra)
+				return fmt.Errorf("%w %q: %w", ErrUnsupportedExtent, d.FileName, err)
+			}
+		default:
+			return fmt.Errorf("%w: extent type %q", ErrUnsupportedExtent, d.Type)
+		}
+		img.extents = append(img.extents, e)
+	}
+	return nil
+}
+
+func (img *Vmdk) openExtentFile(o *options, name string) (io.ReaderAt, error) {
+	ra, _, err := o.fileResolver(o.name, name)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to open %q: %w", ErrUnsupportedExtent, name, err)
+	}
+	return ra, nil
+}
+
+// loadParent opens the parent image of a delta image.
+func (img *Vmdk) loadParent(o *options) error {
+	if o.depth >= maxParentChainDepth {
+		return fmt.Errorf("%w: parent chain too deep (more than %d images)", ErrUnsupportedParent, maxParentChainDepth)
+	}
+	name := img.Descriptor.ParentFileNameHint
+	if name == "" {
+		return fmt.Errorf("%w: missing parentFileNameHint", ErrUnsupportedParent)
+	}
+	ra, resolved, err := o.fileResolver(o.name, name)
+	if err != nil {
+		return fmt.Errorf("%w: failed to open %q: %w", ErrUnsupportedParent, name, err)
+	}
+	img.ParentFullPath = resolved
+	chain := o.chain
+	if o.name != "" {
+		chain = append(slices.Clip(chain), o.name)
+	}
+	if resolved != "" && slices.Contains(chain, resolved) {
+		closeReaderAt(ra)
+		return fmt.Errorf("%w: parent chain loop (file %q)", ErrUnsupportedParent, resolved)
+	}
+	parentOptions := *o
+	parentOptions.name = resolved
+	parentOptions.depth++
+	parentOptions.chain = chain
+	parent, err := open(ra, &parentOptions)
+	if err != nil {
+		closeReaderAt(ra)
+		return fmt.Errorf("%w (file %q): %w", ErrUnsupportedParent, resolved, err)
+	}
+	img.parent = parent
+	if err := parent.Readable(); err != nil {
+		return fmt.Errorf("%w (file %q): %w", ErrUnsupportedParent, resolved, err)
+	}
+	// Like VMware, refuse a parent modified after the delta image was created.
+	if parent.Descriptor != nil && parent.Descriptor.CID != img.Descriptor.ParentCID {
+		return fmt.Errorf("%w (file %q): the parent CID %08x does not match the parentCID %08x", ErrUnsupportedParent, resolved, parent.Descriptor.CID, img.Descriptor.ParentCID)
+	}
+	return nil
+}
+
+// fileSize returns the size of ra, or -1 if the size is unknown.
+func fileSize(ra io.ReaderAt) int64 {
+	// Implemented by [os.File] and files of most [fs.FS] implementations.
+	if f, ok := ra.(interface{ Stat() (fs.FileInfo, error) }); ok {
+		if st, err := f.Stat(); err == nil {
+			return st.Size()
+		}
+	}
+	if s, ok := ra.(interface{ Size() int64 }); ok {
+		return s.Size()
+	}
+	return -1
+}
+
+func closeReaderAt(ra io.ReaderAt) {
+	if closer, ok := ra.(io.Closer); ok {
+		_ = closer.Close()
+	}
+}
+
+func (img *Vmdk) Close() error {
+	var err error
+	if img.parent != nil {
+		err = img.parent.Close()
+	}
+	for _, e := range img.extents {
+		if e.ra == img.ra {
+			continue
+		}
+		if closer, ok := e.ra.(io.Closer); ok {
+			if err2 := closer.Close(); err2 != nil {
+				if err != nil {
+					log.Warn(err)
+				}
+				err = err2
+			}
+		}
+	}
+	if closer, ok := img.ra.(io.Closer); ok {
+		if err2 := closer.Close(); err2 != nil {
+			if err != nil {
+				log.Warn(err)
+			}
+			err = err2
+		}
+	}
+	return err
+}
+
+func (img *Vmdk) Type() image.Type {
+	return Type
+}
+
+func (img *Vmdk) Size() int64 {
+	return img.size
+}
+
+// Readable returns nil if the image is readable, otherwise returns an error.
+func (img *Vmdk) Readable() error {
+	return img.errUnreadable
+}
+
+// extentAt returns the extent containing off.
+func (img *Vmdk) extentAt(off int64) *extent {
+	i := sort.Search(len(img.extents), func(i int) bool {
+		e := img.extents[i]
+		return e.start+e.size > off
+	})
+	return img.extents[i]
+}
+
+// ReadAt implements [io.ReaderAt].
+func (img *Vmdk) ReadAt(p []byte, off int64) (int, error) {
+	if img.errUnreadable != nil {
+		return 0, img.errUnreadable
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= img.size {
+		return 0, io.EOF
+	}
+	var eof bool
+	if off+int64(len(p)) > img.size {
+		p = p[:img.size-off]
+		eof = true
+	}
+	var n int
+	for n < len(p) {
+		currentOff := off + int64(n)
+		e := img.extentAt(currentOff)
+		rel := currentOff - e.start
+		end := n + int(min(int64(len(p)-n), e.blockLength(rel)))
+		if err := img.readBlock(e, p[n:end], rel); err != nil {
+			return n, err
+		}
+		n = end
+	}
+	if eof {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readBlock reads p at off, relative to the extent. p must not cross a block
+// boundary.
+func (img *Vmdk) readBlock(e *extent, p []byte, off int64) error {
+	switch {
+	case e.sparse != nil:
+		return e.sparse.readGrain(p, off, func(p []byte, off int64) error {
+			return img.readUnallocated(p, e.start+off)
+		})
+	case e.ra != nil:
+		n, err := e.ra.ReadAt(p, e.offset+off)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("failed to read flat extent at offset %d: %w", e.offset+off, err)
+		}
+		// Flat extent files may be shorter than the extent.
+		clear(p[n:])
+		return nil
+	default:
+		clear(p)
+		return nil
+	}
+}
+
+// readUnallocated reads unallocated grains at off from the parent image.
+func (img *Vmdk) readUnallocated(p []byte, off int64) error {
+	var n int
+	if img.parent != nil {
+		var err error
+		n, err = img.parent.ReadAt(p, off)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+	}
+	// Data beyond the end of the parent image is read as zeros.
+	clear(p[n:])
+	return nil
+}
+
+// blockStatus returns the status of the block containing off.
+func (img *Vmdk) blockStatus(off int64) (image.Extent, error) {
+	e := img.extentAt(off)
+	rel := off - e.start
+	var blockStart int64
+	if e.sparse != nil {
+		blockStart = e.start + rel - rel%e.sparse.grainSize
+	} else {
+		blockStart = e.start
+	}
+	status := image.Extent{
+		Start:  blockStart,
+		Length: off - blockStart + e.blockLength(rel),
+	}
+	switch {
+	case e.sparse != nil:
+		gs, err := e.sparse.grainStatus(rel)
+		if err != nil {
+			return status, err
+		}
+		if !gs.allocated {
+			if img.parent == nil || blockStart >= img.parent.Size() {
+				status.Zero = true
+				return status, nil
+			}
+			parent, err := img.parent.Extent(blockStart, min(status.Length, img.parent.Size()-blockStart))
+			if err != nil {
+				return status, err
+			}
+			// A grain with holes and data in a sparse raw parent must be read.
+			if parent.Length < min(status.Length, img.parent.Size()-blockStart) {
+				parent.Allocated, parent.Zero = true, false
+			}
+			parent.Start, parent.Length = status.Start, status.Length
+			return parent, nil
+		}
+		status.Allocated = true
+		status.Zero = gs.zero
+		status.Compressed = gs.compressed
+	case e.ra != nil:
+		status.Allocated = true
+	default:
+		status.Allocated = true
+		status.Zero = true
+	}
+	return status, nil
+}
+
+// Extent returns the next extent starting at start, with the same allocation,
+// zero and compression status, limited to length.
+func (img *Vmdk) Extent(start, length int64) (image.Extent, error) {
+	var current image.Extent
+	if img.errUnreadable != nil {
+		return current, img.errUnreadable
+	}
+	if start < 0 || start+length > img.size {
+		return current, errors.New("length out of bounds")
+	}
+	for length > 0 {
+		status, err := img.blockStatus(start)
+		if err != nil {
+			return current, err
+		}
+		// Clip the block to the requested range.
+		n := min(length, status.Start+status.Length-start)
+		status.Start, status.Length = start, n
+		if current.Length == 0 {
+			current = status
+		} else if sameStatus(current, status) {
+			current.Length += n
+		} else {
+			break
+		}
+		start += n
+		length -= n
+	}
+	return current, nil
+}
+
+// Return true if extents have the same status.
+func sameStatus(a, b image.Extent) bool {
+	return a.Allocated == b.Allocated && a.Zero == b.Zero && a.Compressed == b.Compressed
 }
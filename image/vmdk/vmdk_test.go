@@ -0,0 +1,578 @@
+package vmdk
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/lima-vm/go-qcow2reader/image"
+	"github.com/lima-vm/go-qcow2reader/test/imagetest"
+	"github.com/lima-vm/go-qcow2reader/test/qemuimg"
+)
+
+const (
+	testGrainSectors = 8
+	testGrainSize    = testGrainSectors * 512
+	testGTEsPerGT    = 4
+)
+
+// Grain states in test layouts.
+const (
+	grainUnallocated = 'u'
+	grainZero        = 'z'
+	grainData        = 'd'
+)
+
+func marshalTestHeader(t *testing.T, h SparseExtentHeader) []byte {
+	var buf bytes.Buffer
+	copy(h.Magic[:], SparseMagic)
+	h.SingleEndLineChar, h.NonEndLineChar, h.DoubleEndLineChar1, h.DoubleEndLineChar2 = '\n', ' ', '\r', '\n'
+	if err := binary.Write(&buf, binary.LittleEndian, &h); err != nil {
+		t.Fatal(err)
+	}
+	buf.Write(make([]byte, 512-buf.Len()))
+	return buf.Bytes()
+}
+
+func marshalTestUint32s(t *testing.T, s []uint32) []byte {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, s); err != nil {
+		t.Fatal(err)
+	}
+	return padSector(buf.Bytes())
+}
+
+func padSector(b []byte) []byte {
+	return append(b, make([]byte, (512-len(b)%512)%512)...)
+}
+
+// testGrainData returns compressible grain data.
+func testGrainData(r *rand.Rand) []byte {
+	b := make([]byte, testGrainSize)
+	for i := 0; i < len(b); i += 8 {
+		b[i] = byte(r.Intn(256))
+	}
+	return b
+}
+
+// createTestSparse creates a monolithicSparse image, or a streamOptimized
+// image if stream is true, with a grain for each character of layout, and an
+// optional embedded descriptor. Returns the image and the expected guest data.
+func createTestSparse(t *testing.T, layout string, stream, redundant bool, descriptor string) ([]byte, []byte) {
+	seed := fnv.New64()
+	seed.Write([]byte(layout + descriptor))
+	r := rand.New(rand.NewSource(int64(seed.Sum64())))
+	numGDEs := (len(layout) + testGTEsPerGT - 1) / testGTEsPerGT
+	header := SparseExtentHeader{
+		Version:      1,
+		Flags:        1<<FlagsValidNewlineDetectionBit | 1<<FlagsZeroedGrainGTEBit,
+		Capacity:     uint64(len(layout)) * testGrainSectors,
+		GrainSize:    testGrainSectors,
+		NumGTEsPerGT: testGTEsPerGT,
+	}
+	gd := make([]uint32, numGDEs)
+	gts := make([][]uint32, numGDEs)
+	for i := range gts {
+		gts[i] = make([]uint32, testGTEsPerGT)
+	}
+	want := make([]byte, len(layout)*testGrainSize)
+	var grains []byte
+	var descriptorBytes []byte
+	if descriptor != "" {
+		descriptorBytes = padSector([]byte(descriptor))
+		header.DescriptorOffset = 1
+		header.DescriptorSize = uint64(len(descriptorBytes) / 512)
+	}
+
+	if !stream {
+		// header, descriptor, GD, GTs, grains
+		gdOffset := 1 + header.DescriptorSize
+		gdSectors := len(marshalTestUint32s(t, gd)) / 512
+		gtSectors := len(marshalTestUint32s(t, gts[0])) / 512
+		next := uint32(gdOffset) + uint32(gdSectors)
+		for i := range gd {
+			if bytes.ContainsAny([]byte(layout[i*testGTEsPerGT:min(len(layout), (i+1)*testGTEsPerGT)]), "zd") {
+				gd[i] = next
+				next += uint32(gtSectors)
+			}
+		}
+		header.OverHead = uint64(next)
+		for i, c := range layout {
+			switch c {
+			case grainZero:
+				gts[i/testGTEsPerGT][i%testGTEsPerGT] = gteZeroed
+			case grainData:
+				gts[i/testGTEsPerGT][i%testGTEsPerGT] = next
+				data := testGrainData(r)
+				copy(want[i*testGrainSize:], data)
+				grains = append(grains, data...)
+				next += testGrainSectors
+			}
+		}
+		if redundant {
+			header.Flags |= 1 << FlagsRedundantGrainTableBit
+			header.RGDOffset = gdOffset
+		} else {
+			header.GDOffset = gdOffset
+		}
+		img := marshalTestHeader(t, header)
+		img = append(img, descriptorBytes...)
+		img = append(img, marshalTestUint32s(t, gd)...)
+		for i := range gts {
+			if gd[i] != 0 {
+				img = append(img, marshalTestUint32s(t, gts[i])...)
+			}
+		}
+		return append(img, grains...), want
+	}
+
+	// header, descriptor, grains with markers, GTs and GD with markers,
+	// footer, end of stream
+	if descriptor == "" {
+		t.Fatal("streamOptimized images need a descriptor")
+	}
+	header.Flags |= 1<<FlagsCompressedGrainsBit | 1<<FlagsMarkersBit
+	header.CompressAlgorithm = CompressionDeflate
+	header.GDOffset = gdAtEnd
+	header.OverHead = 1 + header.DescriptorSize
+	img := marshalTestHeader(t, header)
+	img = append(img, descriptorBytes...)
+	for i, c := range layout {
+		switch c {
+		case grainZero:
+			gts[i/testGTEsPerGT][i%testGTEsPerGT] = gteZeroed
+		case grainData:
+			gts[i/testGTEsPerGT][i%testGTEsPerGT] = uint32(len(img) / 512)
+			data := testGrainData(r)
+			copy(want[i*testGrainSize:], data)
+			var z bytes.Buffer
+			zw := zlib.NewWriter(&z)
+			if _, err := zw.Write(data); err != nil {
+				t.Fatal(err)
+			}
+			if err := zw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			marker := binary.LittleEndian.AppendUint64(nil, uint64(i*testGrainSectors))
+			marker = binary.LittleEndian.AppendUint32(marker, uint32(z.Len()))
+			img = append(img, padSector(append(marker, z.Bytes()...))...)
+		}
+	}
+	metadataMarker := func(sectors int, typ uint32) []byte {
+		marker := binary.LittleEndian.AppendUint64(nil, uint64(sectors))
+		marker = binary.LittleEndian.AppendUint32(marker, 0)
+		marker = binary.LittleEndian.AppendUint32(marker, typ)
+		return padSector(marker)
+	}
+	for i := range gts {
+		if !bytes.ContainsAny([]byte(layout[i*testGTEsPerGT:min(len(layout), (i+1)*testGTEsPerGT)]), "zd") {
+			continue
+		}
+		gt := marshalTestUint32s(t, gts[i])
+		img = append(img, metadataMarker(len(gt)/512, markerGrainTable)...)
+		gd[i] = uint32(len(img) / 512)
+		img = append(img, gt...)
+	}
+	gdBytes := marshalTestUint32s(t, gd)
+	img = append(img, metadataMarker(len(gdBytes)/512, markerGrainDir)...)
+	header.GDOffset = uint64(len(img) / 512)
+	img = append(img, gdBytes...)
+	img = append(img, metadataMarker(1, markerFooter)...)
+	img = append(img, marshalTestHeader(t, header)...)
+	img = append(img, metadataMarker(0, markerEndOfStream)...)
+	return img, want
+}
+
+func testDescriptor(cid, parentCID uint32, createType, parent string, extents ...string) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s\nversion=1\nCID=%08x\nparentCID=%08x\ncreateType=%q\n", DescriptorMagic, cid, parentCID, createType)
+	if parent != "" {
+		fmt.Fprintf(&sb, "parentFileNameHint=%q\n", parent)
+	}
+	sb.WriteString("\n# Extent description\n")
+	for _, e := range extents {
+		sb.WriteString(e + "\n")
+	}
+	sb.WriteString("\n# The Disk Data Base\n#DDB\n\nddb.adapterType = \"ide\"\n")
+	return sb.String()
+}
+
+// expectedExtents returns the extents of layout, with compressed data grains
+// if compressed is true.
+func expectedExtents(layout string, compressed bool) []image.Extent {
+	var res []image.Extent
+	for i, c := range layout {
+		e := image.Extent{
+			Start:      int64(i) * testGrainSize,
+			Length:     testGrainSize,
+			Allocated:  c != grainUnallocated,
+			Zero:       c != grainData,
+			Compressed: c == grainData && compressed,
+		}
+		if len(res) > 0 && sameStatus(res[len(res)-1], e) {
+			res[len(res)-1].Length += e.Length
+		} else {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+func TestSparse(t *testing.T) {
+	// 4 grain tables, the third one is not allocated.
+	const layout = "dduz" + "zdud" + "uuuu" + "ddd"
+	cases := []struct {
+		name      string
+		stream    bool
+		redundant bool
+	}{
+		{name: "monolithicSparse"},
+		{name: "redundant grain directory", redundant: true},
+		{name: "streamOptimized", stream: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			descriptor := ""
+			if tc.stream {
+				descriptor = testDescriptor(0xfffffffe, noParentCID, "streamOptimized", "", `RW 120 SPARSE "test.vmdk"`)
+			}
+			data, want := createTestSparse(t, layout, tc.stream, tc.redundant, descriptor)
+			img, err := Open(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := img.Readable(); err != nil {
+				t.Fatal(err)
+			}
+			if img.Size() != int64(len(want)) {
+				t.Fatalf("expected size %d, got %d", len(want), img.Size())
+			}
+			got := imagetest.ReadAll(t, img)
+			if !bytes.Equal(got, want) {
+				t.Fatal("unexpected data")
+			}
+
+			// Unaligned read crossing grains and the end of the image.
+			buf := make([]byte, 3*testGrainSize)
+			off := img.Size() - 2*testGrainSize - 100
+			n, err := img.ReadAt(buf, off)
+			if !errors.Is(err, io.EOF) || n != 2*testGrainSize+100 {
+				t.Fatalf("expected %d bytes and EOF, got %d bytes, %v", 2*testGrainSize+100, n, err)
+			}
+			if !bytes.Equal(buf[:n], want[off:]) {
+				t.Fatal("unexpected data in unaligned read")
+			}
+			if _, err := img.ReadAt(buf, img.Size()); !errors.Is(err, io.EOF) {
+				t.Fatalf("expected EOF, got %v", err)
+			}
+
+			extents := imagetest.ReadExtents(t, img)
+			if wantExtents := expectedExtents(layout, tc.stream); !reflect.DeepEqual(extents, wantExtents) {
+				t.Fatalf("expected extents\n%+v\ngot\n%+v", wantExtents, extents)
+			}
+			e, err := img.Extent(100, testGrainSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.Start != 100 || e.Length != testGrainSize || !e.Allocated || e.Zero {
+				t.Fatalf("unexpected unaligned extent %+v", e)
+			}
+		})
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	data, _ := createTestSparse(t, "dd", false, false, "")
+	binary.LittleEndian.PutUint32(data[4:], 4)
+	img, err := Open(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	imagetest.CheckUnreadable(t, img, ErrUnsupportedFeature)
+
+	img, err = Open(bytes.NewReader([]byte(COWDMagic + "\x01\x00\x00\x00")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	imagetest.CheckUnreadable(t, img, ErrUnsupportedFeature)
+
+	if _, err := Open(bytes.NewReader(make([]byte, 512))); !errors.Is(err, image.ErrWrongType) {
+		t.Fatalf("expected ErrWrongType, got %v", err)
+	}
+}
+
+func TestInvalidSparse(t *testing.T) {
+	for name, modify := range map[string]func(h *SparseExtentHeader){
+		// The size in bytes overflows int64.
+		"capacity": func(h *SparseExtentHeader) {
+			h.Capacity = 1 << 54
+			h.GrainSize = 128
+			h.NumGTEsPerGT = 512
+		},
+		"grain directory offset": func(h *SparseExtentHeader) { h.GDOffset = 1 << 60 },
+		"grain directory size":   func(h *SparseExtentHeader) { h.Capacity = 1 << 25 },
+	} {
+		t.Run(name, func(t *testing.T) {
+			data, _ := createTestSparse(t, "dd", false, false, "")
+			var h SparseExtentHeader
+			if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &h); err != nil {
+				t.Fatal(err)
+			}
+			modify(&h)
+			copy(data, marshalTestHeader(t, h))
+			img, err := Open(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := img.Readable(); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+// TestTruncatedGrain reads a grain truncated at the end of the file as zeros.
+func TestTruncatedGrain(t *testing.T) {
+	data, want := createTestSparse(t, "dd", false, false, "")
+	data = data[:len(data)-1000]
+	clear(want[len(want)-1000:])
+	img, err := Open(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Readable(); err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.Repeat([]byte{0xff}, testGrainSize)
+	if _, err := img.ReadAt(buf, testGrainSize); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, want[testGrainSize:]) {
+		t.Fatal("unexpected data")
+	}
+}
+
+// TestQemuImg reads images converted by qemu-img.
+func TestQemuImg(t *testing.T) {
+	for _, subformat := range []string{"monolithicSparse", "streamOptimized"} {
+		t.Run(subformat, func(t *testing.T) {
+			path := imagetest.ConvertQemuImg(t, qemuimg.FormatVmdk, 10<<20+512, "subformat="+subformat)
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close() //nolint:errcheck
+			img, err := Open(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			imagetest.CompareQemuImg(t, img, path)
+		})
+	}
+}
+
+func TestParseDescriptor(t *testing.T) {
+	s := testDescriptor(0x12ab, 0x34cd, "twoGbMaxExtentSparse", "parent dir/parent.vmdk",
+		`RW 4192256 SPARSE "test-s001.vmdk"`,
+		`RDONLY 2048 FLAT "a b=c.vmdk" 128`,
+		`NOACCESS 1024 ZERO`,
+	)
+	d, err := ParseDescriptor([]byte(s + "\x00\x00garbage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Descriptor{
+		Version:            1,
+		CID:                0x12ab,
+		ParentCID:          0x34cd,
+		CreateType:         "twoGbMaxExtentSparse",
+		ParentFileNameHint: "parent dir/parent.vmdk",
+		Extents: []ExtentDescriptor{
+			{Access: "RW", Size: 4192256, Type: ExtentTypeSparse, FileName: "test-s001.vmdk"},
+			{Access: "RDONLY", Size: 2048, Type: ExtentTypeFlat, FileName: "a b=c.vmdk", Offset: 128},
+			{Access: "NOACCESS", Size: 1024, Type: ExtentTypeZero},
+		},
+	}
+	if !reflect.DeepEqual(d, want) {
+		t.Fatalf("expected %+v, got %+v", want, d)
+	}
+	if !d.HasParent() {
+		t.Fatal("expected a parent")
+	}
+
+	for _, invalid := range []string{
+		"version=1\n",
+		DescriptorMagic + "\nCID=xyz\n",
+		DescriptorMagic + "\nRW abc SPARSE \"a.vmdk\"\n",
+		DescriptorMagic + "\nRW 100 SPARSE\n",
+		DescriptorMagic + "\nRW 100 FLAT \"a.vmdk\n",
+		DescriptorMagic + "\nRW 100 FLAT \"a.vmdk\" x\n",
+	} {
+		if _, err := ParseDescriptor([]byte(invalid)); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestDescriptorFile(t *testing.T) {
+	sparse1, want1 := createTestSparse(t, "dzud", false, false, "")
+	sparse2, want2 := createTestSparse(t, "uudd", false, true, "")
+	flat := randomFlat(t, 3*testGrainSize)
+	const zeroSize = 2 * testGrainSize
+	fsys := fstest.MapFS{
+		"vm/disk.vmdk": &fstest.MapFile{Data: []byte(testDescriptor(0xfffffffe, noParentCID, "custom", "",
+			`RW 32 SPARSE "disk-s001.vmdk"`,
+			`RW 16 ZERO`,
+			`RW 16 FLAT "disk-flat.vmdk" 8`,
+			`RW 32 SPARSE "disk-s002.vmdk"`,
+		))},
+		"vm/disk-s001.vmdk": &fstest.MapFile{Data: sparse1},
+		"vm/disk-s002.vmdk": &fstest.MapFile{Data: sparse2},
+		// The flat extent starts at sector 8.
+		"vm/disk-flat.vmdk": &fstest.MapFile{Data: flat},
+	}
+	var want []byte
+	want = append(want, want1...)
+	want = append(want, make([]byte, zeroSize)...)
+	want = append(want, flat[8*512:]...)
+	want = append(want, make([]byte, 2*testGrainSize-(len(flat)-8*512))...)
+	want = append(want, want2...)
+
+	img, err := Open(bytes.NewReader(fsys["vm/disk.vmdk"].Data), WithFileResolver(image.FSFileResolver(fsys)), WithName("vm/disk.vmdk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if err := img.Readable(); err != nil {
+		t.Fatal(err)
+	}
+	if img.Size() != int64(len(want)) {
+		t.Fatalf("expected size %d, got %d", len(want), img.Size())
+	}
+	got := imagetest.ReadAll(t, img)
+	if !bytes.Equal(got, want) {
+		t.Fatal("unexpected data")
+	}
+	wantExtents := []image.Extent{
+		{Start: 0, Length: testGrainSize, Allocated: true},
+		{Start: 1 * testGrainSize, Length: testGrainSize, Allocated: true, Zero: true},
+		{Start: 2 * testGrainSize, Length: testGrainSize, Zero: true},
+		{Start: 3 * testGrainSize, Length: testGrainSize, Allocated: true},
+		{Start: 4 * testGrainSize, Length: zeroSize, Allocated: true, Zero: true},
+		{Start: 6 * testGrainSize, Length: 2 * testGrainSize, Allocated: true},
+		{Start: 8 * testGrainSize, Length: 2 * testGrainSize, Zero: true},
+		{Start: 10 * testGrainSize, Length: 2 * testGrainSize, Allocated: true},
+	}
+	if extents := imagetest.ReadExtents(t, img); !reflect.DeepEqual(extents, wantExtents) {
+		t.Fatalf("expected extents\n%+v\ngot\n%+v", wantExtents, extents)
+	}
+
+	delete(fsys, "vm/disk-s002.vmdk")
+	img, err = Open(bytes.NewReader(fsys["vm/disk.vmdk"].Data), WithFileResolver(image.FSFileResolver(fsys)), WithName("vm/disk.vmdk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Readable(); !errors.Is(err, ErrUnsupportedExtent) || !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected ErrUnsupportedExtent, got %v", err)
+	}
+
+	// Errors of the resolver are reported, e.g. for an open policy.
+	fsys["vm/outside.vmdk"] = &fstest.MapFile{Data: []byte(testDescriptor(0xfffffffe, noParentCID, "custom", "",
+		`RW 16 FLAT "../../secret.vmdk" 0`,
+	))}
+	img, err = Open(bytes.NewReader(fsys["vm/outside.vmdk"].Data), WithFileResolver(image.FSFileResolver(fsys)), WithName("vm/outside.vmdk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Readable(); !errors.Is(err, ErrUnsupportedExtent) || !errors.Is(err, image.ErrUnsafeFileName) {
+		t.Fatalf("expected ErrUnsupportedExtent and image.ErrUnsafeFileName, got %v", err)
+	}
+}
+
+func randomFlat(t *testing.T, n int) []byte {
+	r := rand.New(rand.NewSource(int64(n)))
+	b := make([]byte, n)
+	if _, err := r.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestParent(t *testing.T) {
+	const (
+		baseCID  = 0x1111
+		deltaCID = 0x2222
+	)
+	base, wantBase := createTestSparse(t, "ddud", false, false,
+		testDescriptor(baseCID, noParentCID, "monolithicSparse", "", `RW 32 SPARSE "base.vmdk"`))
+	// The delta image is split in a descriptor file and a sparse extent.
+	delta, wantDelta := createTestSparse(t, "uzdu", false, false, "")
+	fsys := fstest.MapFS{
+		"base/base.vmdk": &fstest.MapFile{Data: base},
+		"vm/disk-000001.vmdk": &fstest.MapFile{Data: []byte(testDescriptor(deltaCID, baseCID, "twoGbMaxExtentSparse", "../base/base.vmdk",
+			`RW 32 SPARSE "disk-000001-s001.vmdk"`))},
+		"vm/disk-000001-s001.vmdk": &fstest.MapFile{Data: delta},
+		"vm/disk-000002.vmdk": &fstest.MapFile{Data: []byte(testDescriptor(0x3333, deltaCID, "twoGbMaxExtentSparse", "disk-000001.vmdk",
+			`RW 32 SPARSE "disk-000001-s001.vmdk"`))},
+		"vm/modified.vmdk": &fstest.MapFile{Data: []byte(testDescriptor(0x4444, 0x9999, "twoGbMaxExtentSparse", "../base/base.vmdk",
+			`RW 32 SPARSE "disk-000001-s001.vmdk"`))},
+		"vm/loop.vmdk": &fstest.MapFile{Data: []byte(testDescriptor(0x5555, 0x5555, "twoGbMaxExtentSparse", "loop.vmdk",
+			`RW 32 SPARSE "disk-000001-s001.vmdk"`))},
+		"vm/outside.vmdk": &fstest.MapFile{Data: []byte(testDescriptor(0x6666, baseCID, "twoGbMaxExtentSparse", "../../secret.vmdk",
+			`RW 32 SPARSE "disk-000001-s001.vmdk"`))},
+	}
+	openFS := func(name string) *Vmdk {
+		t.Helper()
+		img, err := Open(bytes.NewReader(fsys[name].Data), WithFileResolver(image.FSFileResolver(fsys)), WithName(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = img.Close() })
+		return img
+	}
+
+	want := bytes.Clone(wantBase)
+	copy(want[1*testGrainSize:], wantDelta[1*testGrainSize:3*testGrainSize])
+	for _, name := range []string{"vm/disk-000001.vmdk", "vm/disk-000002.vmdk"} {
+		img := openFS(name)
+		if err := img.Readable(); err != nil {
+			t.Fatal(err)
+		}
+		got := imagetest.ReadAll(t, img)
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s: unexpected data", name)
+		}
+		wantExtents := []image.Extent{
+			{Start: 0, Length: testGrainSize, Allocated: true},
+			{Start: 1 * testGrainSize, Length: testGrainSize, Allocated: true, Zero: true},
+			{Start: 2 * testGrainSize, Length: 2 * testGrainSize, Allocated: true},
+		}
+		if extents := imagetest.ReadExtents(t, img); !reflect.DeepEqual(extents, wantExtents) {
+			t.Fatalf("%s: expected extents\n%+v\ngot\n%+v", name, wantExtents, extents)
+		}
+	}
+	if got := openFS("vm/disk-000001.vmdk").ParentFullPath; got != "base/base.vmdk" {
+		t.Fatalf("expected parent base/base.vmdk, got %q", got)
+	}
+
+	for _, name := range []string{"vm/modified.vmdk", "vm/loop.vmdk"} {
+		if err := openFS(name).Readable(); !errors.Is(err, ErrUnsupportedParent) {
+			t.Fatalf("%s: expected ErrUnsupportedParent, got %v", name, err)
+		}
+	}
+	// Errors of the resolver are reported, e.g. for an open policy.
+	if err := openFS("vm/outside.vmdk").Readable(); !errors.Is(err, ErrUnsupportedParent) || !errors.Is(err, image.ErrUnsafeFileName) {
+		t.Fatalf("expected ErrUnsupportedParent and image.ErrUnsafeFileName, got %v", err)
+	}
+}
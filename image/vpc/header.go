@@ -0,0 +1,175 @@
+package vpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf16"
+)
+
+const (
+	FooterCookie        = "conectix"
+	DynamicHeaderCookie = "cxsparse"
+
+	footerSize        = 512
+	dynamicHeaderSize = 1024
+)
+
+// Disk types.
+const (
+	DiskTypeFixed        = 2
+	DiskTypeDynamic      = 3
+	DiskTypeDifferencing = 4
+)
+
+// Parent locator platform codes.
+const (
+	// PlatformCodeW2ru is a relative Windows path in UTF-16LE.
+	PlatformCodeW2ru = "W2ru"
+	// PlatformCodeW2ku is an absolute Windows path in UTF-16LE.
+	PlatformCodeW2ku = "W2ku"
+	// PlatformCodeMacX is a file URL in UTF-8.
+	PlatformCodeMacX = "MacX"
+)
+
+// maxGeometrySectors is the size in sectors of the maximum CHS geometry
+// (65535 cylinders, 16 heads, 255 sectors per track).
+const maxGeometrySectors = 65535 * 16 * 255
+
+// Footer is the footer of a VHD image, at the end of the file. Dynamic and
+// differencing disks have a copy of the footer at the start of the file.
+type Footer struct {
+	Cookie             [8]byte  `json:"cookie"`
+	Features           uint32   `json:"features"`
+	FileFormatVersion  uint32   `json:"file_format_version"`
+	DataOffset         uint64   `json:"data_offset"`
+	TimeStamp          uint32   `json:"time_stamp"`
+	CreatorApplication [4]byte  `json:"creator_application"`
+	CreatorVersion     uint32   `json:"creator_version"`
+	CreatorHostOS      uint32   `json:"creator_host_os"`
+	OriginalSize       uint64   `json:"original_size"`
+	CurrentSize        uint64   `json:"current_size"`
+	Cylinders          uint16   `json:"cylinders"`
+	Heads              uint8    `json:"heads"`
+	SectorsPerTrack    uint8    `json:"sectors_per_track"`
+	DiskType           uint32   `json:"disk_type"`
+	Checksum           uint32   `json:"checksum"`
+	UniqueID           [16]byte `json:"unique_id"`
+	SavedState         uint8    `json:"saved_state"`
+}
+
+// ParentLocatorEntry locates the parent of a differencing disk.
+type ParentLocatorEntry struct {
+	PlatformCode       [4]byte `json:"platform_code"`
+	PlatformDataSpace  uint32  `json:"platform_data_space"`
+	PlatformDataLength uint32  `json:"platform_data_length"`
+	Reserved           uint32  `json:"-"`
+	PlatformDataOffset uint64  `json:"platform_data_offset"`
+}
+
+// DynamicHeader is the header of dynamic and differencing disks.
+type DynamicHeader struct {
+	Cookie               [8]byte               `json:"cookie"`
+	DataOffset           uint64                `json:"data_offset"`
+	TableOffset          uint64                `json:"table_offset"`
+	HeaderVersion        uint32                `json:"header_version"`
+	MaxTableEntries      uint32                `json:"max_table_entries"`
+	BlockSize            uint32                `json:"block_size"`
+	Checksum             uint32                `json:"checksum"`
+	ParentUniqueID       [16]byte              `json:"parent_unique_id"`
+	ParentTimeStamp      uint32                `json:"parent_time_stamp"`
+	Reserved             uint32                `json:"-"`
+	ParentUnicodeName    [512]byte             `json:"-"`
+	ParentLocatorEntries [8]ParentLocatorEntry `json:"parent_locator_entries"`
+}
+
+// ParentName returns the file name of the parent of a differencing disk.
+func (h *DynamicHeader) ParentName() string {
+	s := make([]uint16, 0, len(h.ParentUnicodeName)/2)
+	for i := 0; i < len(h.ParentUnicodeName); i += 2 {
+		c := binary.BigEndian.Uint16(h.ParentUnicodeName[i:])
+		if c == 0 {
+			break
+		}
+		s = append(s, c)
+	}
+	return string(utf16.Decode(s))
+}
+
+// checksum returns the one's complement of the sum of the bytes of b, skipping
+// the checksum field at off.
+func checksum(b []byte, off int) uint32 {
+	var sum uint32
+	for i, c := range b {
+		if i < off || i >= off+4 {
+			sum += uint32(c)
+		}
+	}
+	return ^sum
+}
+
+// readFooter reads a footer at off. Returns [ErrNotVpc] if the cookie does not
+// match.
+func readFooter(ra io.ReaderAt, off int64) (*Footer, error) {
+	b := make([]byte, footerSize)
+	if _, err := ra.ReadAt(b, off); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read the footer: %w", err)
+	}
+	if !bytes.HasPrefix(b, []byte(FooterCookie)) {
+		return nil, ErrNotVpc
+	}
+	var f Footer
+	if err := binary.Read(bytes.NewReader(b), binary.BigEndian, &f); err != nil {
+		return nil, err
+	}
+	if checksum(b, 64) != f.Checksum {
+		return &f, errInvalidChecksum
+	}
+	return &f, nil
+}
+
+var errInvalidChecksum = errors.New("invalid checksum")
+
+func readDynamicHeader(ra io.ReaderAt, off int64) (*DynamicHeader, error) {
+	b := make([]byte, dynamicHeaderSize)
+	if _, err := ra.ReadAt(b, off); err != nil {
+		return nil, fmt.Errorf("failed to read the dynamic header: %w", err)
+	}
+	if !bytes.HasPrefix(b, []byte(DynamicHeaderCookie)) {
+		return nil, errors.New("invalid dynamic header cookie")
+	}
+	var h DynamicHeader
+	if err := binary.Read(bytes.NewReader(b), binary.BigEndian, &h); err != nil {
+		return nil, err
+	}
+	if checksum(b, 36) != h.Checksum {
+		return nil, fmt.Errorf("dynamic header: %w", errInvalidChecksum)
+	}
+	return &h, nil
+}
+
+// usesGeometry returns true if the size of the disk is the size of the CHS
+// geometry rather than the current size, like qemu. Virtual PC and qemu (before
+// "qem2") use the geometry, while Hyper-V, Azure and other tools use the
+// current size.
+func (f *Footer) usesGeometry() bool {
+	switch string(f.CreatorApplication[:]) {
+	case "win ", "qem2", "d2v ", "CTXS", "tap\x00", "wa\x00\x00":
+		return false
+	}
+	return f.geometrySectors() != maxGeometrySectors
+}
+
+func (f *Footer) geometrySectors() int64 {
+	return int64(f.Cylinders) * int64(f.Heads) * int64(f.SectorsPerTrack)
+}
+
+// size returns the size of the disk in bytes.
+func (f *Footer) size() int64 {
+	if f.usesGeometry() {
+		return f.geometrySectors() * 512
+	}
+	return int64(f.CurrentSize)
+}
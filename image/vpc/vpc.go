@@ -1,15 +1,495 @@
 package vpc
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
+	"math"
+	"math/bits"
+	"slices"
+	"strings"
+	"unicode/utf16"
 
 	"github.com/lima-vm/go-qcow2reader/image"
-	"github.com/lima-vm/go-qcow2reader/image/stub"
+	"github.com/lima-vm/go-qcow2reader/log"
+	"github.com/lima-vm/go-qcow2reader/lru"
 )
 
 const Type = image.Type("vpc")
 
-// Open returns a stub.
-func Open(ra io.ReaderAt) (*stub.Stub, error) {
-	return stub.New(ra, Type, stub.SimpleProber([]byte("conectix")))
+// maxParentChainDepth is the maximum number of parent images below an image.
+const maxParentChainDepth = 64
+
+// maxParentLocatorSize is the maximum size of the data of a parent locator, a
+// file name or a file URL.
+const maxParentLocatorSize = 64 << 10
+
+// unallocatedBlock is the BAT entry of unallocated blocks.
+const unallocatedBlock = 0xffffffff
+
+var (
+	ErrNotVpc             = fmt.Errorf("%w: image is not %s", image.ErrWrongType, Type)
+	ErrUnsupportedFeature = errors.New("unsupported feature")
+	ErrUnsupportedParent  = errors.New("unsupported parent image")
+)
+
+// Vpc implements [image.Image] for VHD images.
+type Vpc struct {
+	ra     io.ReaderAt
+	Footer *Footer `json:"footer"`
+	// DynamicHeader is nil for fixed disks.
+	DynamicHeader  *DynamicHeader `json:"dynamic_header,omitempty"`
+	ParentFullPath string         `json:"parent_full_path,omitempty"`
+	parent         *Vpc
+	errUnreadable  error
+	size           int64
+	bat            []uint32
+	blockSize      int64
+	// bitmapSize is the size of the sector bitmap preceding the data of a
+	// block, padded to a sector.
+	bitmapSize  int64
+	bitmapCache *lru.Cache[int64, []byte]
+}
+
+// With the default block size (2 MiB), a block bitmap uses 512 bytes.
+const maxBitmaps = 256
+
+type Option func(*options)
+
+type options struct {
+	fileResolver image.FileResolver
+	name         string
+	depth        int
+	chain        []string
+}
+
+// WithFileResolver sets the [image.FileResolver] used to open parent images.
+// The default is [image.OSFileResolver].
+func WithFileResolver(r image.FileResolver) Option {
+	return func(o *options) {
+		o.fileResolver = r
+	}
+}
+
+// WithName sets the name of the image, used as base to resolve parent images.
+// By default, the name of the file is used if ra implements Name() and no
+// [image.FileResolver] is set.
+func WithName(name string) Option {
+	return func(o *options) {
+		o.name = name
+	}
+}
+
+// Open opens a VHD image (fixed, dynamic, or differencing disk).
+//
+// Fixed disks have no header; they are detected by the footer at the end of
+// the file, which requires ra to implement Stat() or Size().
+//
+// The parent image of a differencing disk is resolved from the parent locators
+// (see [WithFileResolver]), and closed with the image.
+func Open(ra io.ReaderAt, opts ...Option) (*Vpc, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.name == "" && o.fileResolver == nil {
+		if namer, ok := ra.(interface{ Name() string }); ok {
+			o.name = namer.Name()
+		}
+	}
+	if o.fileResolver == nil {
+		o.fileResolver = image.OSFileResolver
+	}
+	return open(ra, &o)
+}
+
+func open(ra io.ReaderAt, o *options) (*Vpc, error) {
+	footer, err := readFooter(ra, 0)
+	switch {
+	case errors.Is(err, ErrNotVpc):
+		// Fixed disks have only the footer at the end of the file. Require a
+		// valid checksum to avoid misdetecting raw images.
+		size := fileSize(ra)
+		if size < footerSize {
+			return nil, ErrNotVpc
+		}
+		if footer, err = readFooter(ra, size-footerSize); err != nil {
+			return nil, ErrNotVpc
+		}
+	case errors.Is(err, errInvalidChecksum):
+		// Use the copy at the end of the file.
+		if size := fileSize(ra); size >= footerSize {
+			if footerCopy, err := readFooter(ra, size-footerSize); err == nil {
+				log.Warnf("vpc: invalid footer checksum at the start of the file, using the footer at the end")
+				footer = footerCopy
+				break
+			}
+		}
+		return &Vpc{ra: ra, Footer: footer, size: -1, errUnreadable: fmt.Errorf("footer: %w", err)}, nil
+	case err != nil:
+		return nil, err
+	}
+	if !footer.usesGeometry() && footer.CurrentSize > math.MaxInt64 {
+		return &Vpc{ra: ra, Footer: footer, size: -1, errUnreadable: fmt.Errorf("invalid current size %d", footer.CurrentSize)}, nil
+	}
+	img := &Vpc{ra: ra, Footer: footer, size: footer.size()}
+	img.errUnreadable = img.load(o)
+	return img, nil
+}
+
+func (img *Vpc) load(o *options) error {
+	switch img.Footer.DiskType {
+	case DiskTypeFixed:
+		// The data is followed by the footer.
+		if size := fileSize(img.ra); size >= footerSize && img.size > size-footerSize {
+			img.size = size - footerSize
+		}
+		return nil
+	case DiskTypeDynamic, DiskTypeDifferencing:
+	default:
+		return fmt.Errorf("%w: disk type %d", ErrUnsupportedFeature, img.Footer.DiskType)
+	}
+
+	h, err := readDynamicHeader(img.ra, int64(img.Footer.DataOffset))
+	if err != nil {
+		return err
+	}
+	img.DynamicHeader = h
+	if h.BlockSize < 512 || bits.OnesCount32(h.BlockSize) != 1 {
+		return fmt.Errorf("invalid block size %d", h.BlockSize)
+	}
+	img.blockSize = int64(h.BlockSize)
+	// Only the entries of the blocks of the disk are read.
+	entries := (img.size + img.blockSize - 1) / img.blockSize
+	if int64(h.MaxTableEntries) < entries {
+		return fmt.Errorf("the BAT has %d entries of %d bytes, but the disk size is %d", h.MaxTableEntries, h.BlockSize, img.size)
+	}
+	if size := fileSize(img.ra); h.TableOffset > math.MaxInt64 || size >= 0 && int64(h.TableOffset)+entries*4 > size {
+		return fmt.Errorf("the BAT at offset %d is beyond the end of the file", h.TableOffset)
+	}
+	img.bitmapSize = (img.blockSize/512/8 + 511) / 512 * 512
+	img.bat = make([]uint32, entries)
+	if err := binary.Read(io.NewSectionReader(img.ra, int64(h.TableOffset), int64(len(img.bat))*4), binary.BigEndian, img.bat); err != nil {
+		return fmt.Errorf("failed to read the BAT: %w", err)
+	}
+	img.bitmapCache = lru.New[int64, []byte](maxBitmaps)
+	if img.Footer.DiskType == DiskTypeDifferencing {
+		return img.loadParent(o)
+	}
+	return nil
+}
+
+// parentNames returns the candidate names of the parent image, from the
+// parent locators and the parent name.
+func (img *Vpc) parentNames() []string {
+	var names []string
+	h := img.DynamicHeader
+	for _, code := range []string{PlatformCodeW2ru, PlatformCodeMacX, PlatformCodeW2ku} {
+		for _, e := range h.ParentLocatorEntries {
+			if string(e.PlatformCode[:]) != code || e.PlatformDataLength == 0 {
+				continue
+			}
+			if e.PlatformDataLength > maxParentLocatorSize {
+				log.Warnf("vpc: ignoring the %s parent locator of %d bytes", code, e.PlatformDataLength)
+				continue
+			}
+			b := make([]byte, e.PlatformDataLength)
+			if _, err := img.ra.ReadAt(b, int64(e.PlatformDataOffset)); err != nil {
+				log.Warnf("vpc: failed to read the %s parent locator: %v", code, err)
+				continue
+			}
+			var name string
+			if code == PlatformCodeMacX {
+				name = strings.TrimPrefix(strings.TrimPrefix(string(b), "file://"), "localhost")
+			} else {
+				name = decodeUTF16LE(b)
+			}
+			name = strings.ReplaceAll(strings.TrimRight(name, "\x00"), `\`, "/")
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	if name := h.ParentName(); name != "" {
+		names = append(names, name)
+	}
+	return names
+}
+
+func decodeUTF16LE(b []byte) string {
+	s := make([]uint16, len(b)/2)
+	for i := range s {
+		s[i] = binary.LittleEndian.Uint16(b[i*2:])
+	}
+	return string(utf16.Decode(s))
+}
+
+// loadParent opens the parent image of a differencing disk.
+func (img *Vpc) loadParent(o *options) error {
+	if o.depth >= maxParentChainDepth {
+		return fmt.Errorf("%w: parent chain too deep (more than %d images)", ErrUnsupportedParent, maxParentChainDepth)
+	}
+	var (
+		ra       io.ReaderAt
+		resolved string
+		errs     []error
+	)
+	for _, name := range img.parentNames() {
+		var err error
+		ra, resolved, err = o.fileResolver(o.name, name)
+		if err == nil {
+			break
+		}
+		errs = append(errs, fmt.Errorf("failed to open %q: %w", name, err))
+	}
+	if ra == nil {
+		if len(errs) == 0 {
+			return fmt.Errorf("%w: no parent locator", ErrUnsupportedParent)
+		}
+		return fmt.Errorf("%w: %w", ErrUnsupportedParent, errors.Join(errs...))
+	}
+	img.ParentFullPath = resolved
+	chain := o.chain
+	if o.name != "" {
+		chain = append(slices.Clip(chain), o.name)
+	}
+	if resolved != "" && slices.Contains(chain, resolved) {
+		closeReaderAt(ra)
+		return fmt.Errorf("%w: parent chain loop (file %q)", ErrUnsupportedParent, resolved)
+	}
+	parentOptions := *o
+	parentOptions.name = resolved
+	parentOptions.depth++
+	parentOptions.chain = chain
+	parent, err := open(ra, &parentOptions)
+	if err != nil {
+		closeReaderAt(ra)
+		return fmt.Errorf("%w (file %q): %w", ErrUnsupportedParent, resolved, err)
+	}
+	img.parent = parent
+	if err := parent.Readable(); err != nil {
+		return fmt.Errorf("%w (file %q): %w", ErrUnsupportedParent, resolved, err)
+	}
+	if parent.Footer.UniqueID != img.DynamicHeader.ParentUniqueID {
+		return fmt.Errorf("%w (file %q): the parent unique ID %x does not match %x", ErrUnsupportedParent, resolved, parent.Footer.UniqueID, img.DynamicHeader.ParentUniqueID)
+	}
+	return nil
+}
+
+// fileSize returns the size of ra, or -1 if the size is unknown.
+func fileSize(ra io.ReaderAt) int64 {
+	// Implemented by [os.File] and files of most [fs.FS] implementations.
+	if f, ok := ra.(interface{ Stat() (fs.FileInfo, error) }); ok {
+		if st, err := f.Stat(); err == nil {
+			return st.Size()
+		}
+	}
+	if s, ok := ra.(interface{ Size() int64 }); ok {
+		return s.Size()
+	}
+	return -1
+}
+
+func closeReaderAt(ra io.ReaderAt) {
+	if closer, ok := ra.(io.Closer); ok {
+		_ = closer.Close()
+	}
+}
+
+func (img *Vpc) Close() error {
+	var err error
+	if img.parent != nil {
+		err = img.parent.Close()
+	}
+	if closer, ok := img.ra.(io.Closer); ok {
+		if err2 := closer.Close(); err2 != nil {
+			if err != nil {
+				log.Warn(err)
+			}
+			err = err2
+		}
+	}
+	return err
+}
+
+func (img *Vpc) Type() image.Type {
+	return Type
+}
+
+func (img *Vpc) Size() int64 {
+	return img.size
+}
+
+// Readable returns nil if the image is readable, otherwise returns an error.
+func (img *Vpc) Readable() error {
+	return img.errUnreadable
+}
+
+// unit is a range of the image with the same status: the whole data of a fixed
+// disk, a block of a dynamic disk, or a run of sectors with the same bit in the
+// sector bitmap of a block of a differencing disk.
+type unit struct {
+	allocated bool
+	// offset is the file offset of the data.
+	offset int64
+	// length of the unit from the requested offset.
+	length int64
+}
+
+// unitAt returns the unit containing off.
+func (img *Vpc) unitAt(off int64) (unit, error) {
+	if img.DynamicHeader == nil {
+		return unit{allocated: true, offset: off, length: img.size - off}, nil
+	}
+	block := off / img.blockSize
+	inBlock := off % img.blockSize
+	u := unit{length: min(img.blockSize-inBlock, img.size-off)}
+	entry := img.bat[block]
+	if entry == unallocatedBlock {
+		return u, nil
+	}
+	dataOffset := int64(entry)*512 + img.bitmapSize
+	if img.Footer.DiskType == DiskTypeDifferencing {
+		// Sectors not present in the block are read from the parent. Dynamic
+		// disks also have sector bitmaps, but like qemu, allocated blocks are
+		// read entirely.
+		bitmap, err := img.sectorBitmap(block, entry)
+		if err != nil {
+			return u, err
+		}
+		sector := inBlock / 512
+		present := bitSet(bitmap, sector)
+		end := sector + 1
+		for end < img.blockSize/512 && bitSet(bitmap, end) == present {
+			end++
+		}
+		u.length = min(u.length, end*512-inBlock)
+		if !present {
+			return u, nil
+		}
+	}
+	u.allocated = true
+	u.offset = dataOffset + inBlock
+	return u, nil
+}
+
+// bitSet returns true if bit i is set. Bits are in big-endian order.
+func bitSet(bitmap []byte, i int64) bool {
+	return bitmap[i/8]&(0x80>>(i%8)) != 0
+}
+
+func (img *Vpc) sectorBitmap(block int64, entry uint32) ([]byte, error) {
+	if bitmap, ok := img.bitmapCache.Get(block); ok {
+		return bitmap, nil
+	}
+	bitmap := make([]byte, img.blockSize/512/8)
+	if _, err := img.ra.ReadAt(bitmap, int64(entry)*512); err != nil {
+		return nil, fmt.Errorf("failed to read the sector bitmap of block %d: %w", block, err)
+	}
+	img.bitmapCache.Add(block, bitmap)
+	return bitmap, nil
+}
+
+// ReadAt implements [io.ReaderAt].
+func (img *Vpc) ReadAt(p []byte, off int64) (int, error) {
+	if img.errUnreadable != nil {
+		return 0, img.errUnreadable
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= img.size {
+		return 0, io.EOF
+	}
+	var eof bool
+	if off+int64(len(p)) > img.size {
+		p = p[:img.size-off]
+		eof = true
+	}
+	var n int
+	for n < len(p) {
+		currentOff := off + int64(n)
+		u, err := img.unitAt(currentOff)
+		if err != nil {
+			return n, err
+		}
+		end := n + int(min(int64(len(p)-n), u.length))
+		if u.allocated {
+			if _, err := img.ra.ReadAt(p[n:end], u.offset); err != nil {
+				return n, fmt.Errorf("failed to read data at offset %d: %w", u.offset, err)
+			}
+		} else if err := img.readUnallocated(p[n:end], currentOff); err != nil {
+			return n, err
+		}
+		n = end
+	}
+	if eof {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readUnallocated reads unallocated data at off from the parent image.
+func (img *Vpc) readUnallocated(p []byte, off int64) error {
+	var n int
+	if img.parent != nil {
+		var err error
+		n, err = img.parent.ReadAt(p, off)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+	}
+	// Data beyond the end of the parent image is read as zeros.
+	clear(p[n:])
+	return nil
+}
+
+// Extent returns the next extent starting at start, with the same allocation
+// and zero status, limited to length.
+func (img *Vpc) Extent(start, length int64) (image.Extent, error) {
+	var current image.Extent
+	if img.errUnreadable != nil {
+		return current, img.errUnreadable
+	}
+	if start < 0 || start+length > img.size {
+		return current, errors.New("length out of bounds")
+	}
+	for length > 0 {
+		u, err := img.unitAt(start)
+		if err != nil {
+			return current, err
+		}
+		n := min(length, u.length)
+		status := image.Extent{Start: start, Length: n, Allocated: u.allocated}
+		if !u.allocated {
+			if img.parent == nil || start >= img.parent.Size() {
+				status.Zero = true
+			} else {
+				parent, err := img.parent.Extent(start, min(n, img.parent.Size()-start))
+				if err != nil {
+					return current, err
+				}
+				status.Allocated, status.Zero = parent.Allocated, parent.Zero
+				n = min(n, parent.Length)
+				status.Length = n
+			}
+		}
+		if current.Length == 0 {
+			current = status
+		} else if sameStatus(current, status) {
+			current.Length += n
+		} else {
+			break
+		}
+		start += n
+		length -= n
+	}
+	return current, nil
+}
+
+// Return true if extents have the same status.
+func sameStatus(a, b image.Extent) bool {
+	return a.Allocated == b.Allocated && a.Zero == b.Zero && a.Compressed == b.Compressed
 }
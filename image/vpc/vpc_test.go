@@ -0,0 +1,470 @@
+package vpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"os"
+	"reflect"
+	"testing"
+	"testing/fstest"
+	"unicode/utf16"
+
+	"github.com/lima-vm/go-qcow2reader/image"
+	"github.com/lima-vm/go-qcow2reader/test/imagetest"
+	"github.com/lima-vm/go-qcow2reader/test/qemuimg"
+)
+
+const testBlockSize = 64 << 10
+
+// Block states in test layouts.
+const (
+	blockAllocated   = 'a'
+	blockUnallocated = 'u'
+	// blockPartial has runs of 8 sectors alternating between present and not
+	// present in the sector bitmap.
+	blockPartial = 'p'
+)
+
+type testImage struct {
+	diskType uint32
+	// layout has a block state for each block of dynamic and differencing
+	// disks.
+	layout string
+	// size is the current size. Defaults to the size of the blocks in layout.
+	size int64
+	// creator defaults to "win ", using the current size.
+	creator string
+	// cylinders, heads and sectorsPerTrack describe the geometry.
+	cylinders       uint16
+	heads           uint8
+	sectorsPerTrack uint8
+	uniqueID        byte
+	parentUniqueID  byte
+	// locators maps platform codes to parent names.
+	locators   map[string]string
+	parentName string
+	seed       int64
+	// modify modifies the footer and the dynamic header before they are
+	// written.
+	modify func(*Footer, *DynamicHeader)
+}
+
+func testBitmapByte(i int) byte {
+	if i%2 == 0 {
+		return 0xff
+	}
+	return 0
+}
+
+func marshalTestStruct(t *testing.T, v any) []byte {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, v); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func padSector(b []byte) []byte {
+	return append(b, make([]byte, (512-len(b)%512)%512)...)
+}
+
+func encodeUTF16(s string, order binary.AppendByteOrder) []byte {
+	var b []byte
+	for _, c := range utf16.Encode([]rune(s)) {
+		b = order.AppendUint16(b, c)
+	}
+	return b
+}
+
+// createTestImage creates a VHD image. Returns the image and the expected data
+// of the image; data of sectors not present in differencing disks is zero.
+func createTestImage(t *testing.T, ti testImage) ([]byte, []byte) {
+	r := rand.New(rand.NewSource(ti.seed))
+	size := ti.size
+	if size == 0 {
+		size = int64(len(ti.layout)) * testBlockSize
+	}
+	footer := Footer{
+		Features:          2,
+		FileFormatVersion: 0x00010000,
+		DataOffset:        0xffffffffffffffff,
+		OriginalSize:      uint64(size),
+		CurrentSize:       uint64(size),
+		Cylinders:         ti.cylinders,
+		Heads:             ti.heads,
+		SectorsPerTrack:   ti.sectorsPerTrack,
+		DiskType:          ti.diskType,
+	}
+	copy(footer.Cookie[:], FooterCookie)
+	creator := ti.creator
+	if creator == "" {
+		creator = "win "
+	}
+	copy(footer.CreatorApplication[:], creator)
+	footer.UniqueID[0] = ti.uniqueID
+	marshalFooter := func() []byte {
+		b := padSector(marshalTestStruct(t, footer))
+		binary.BigEndian.PutUint32(b[64:], checksum(b, 64))
+		return b
+	}
+
+	if ti.diskType == DiskTypeFixed {
+		want := make([]byte, size)
+		if _, err := r.Read(want); err != nil {
+			t.Fatal(err)
+		}
+		return append(bytes.Clone(want), marshalFooter()...), want
+	}
+
+	// footer copy, dynamic header, BAT, parent locators, blocks, footer
+	const headerOffset = 512
+	const batOffset = headerOffset + dynamicHeaderSize
+	footer.DataOffset = headerOffset
+	h := DynamicHeader{
+		DataOffset:      0xffffffffffffffff,
+		TableOffset:     batOffset,
+		HeaderVersion:   0x00010000,
+		MaxTableEntries: uint32(len(ti.layout)),
+		BlockSize:       testBlockSize,
+	}
+	copy(h.Cookie[:], DynamicHeaderCookie)
+	h.ParentUniqueID[0] = ti.parentUniqueID
+	copy(h.ParentUnicodeName[:], encodeUTF16(ti.parentName, binary.BigEndian))
+	bat := make([]uint32, len(ti.layout))
+	next := int64(batOffset + len(padSector(marshalTestStruct(t, bat))))
+	var locatorData []byte
+	i := 0
+	for _, code := range []string{PlatformCodeW2ru, PlatformCodeW2ku, PlatformCodeMacX} {
+		name, ok := ti.locators[code]
+		if !ok {
+			continue
+		}
+		var b []byte
+		if code == PlatformCodeMacX {
+			b = []byte("file://" + name)
+		} else {
+			b = encodeUTF16(name, binary.LittleEndian)
+		}
+		e := &h.ParentLocatorEntries[i]
+		copy(e.PlatformCode[:], code)
+		e.PlatformDataSpace = uint32(len(padSector(b)) / 512)
+		e.PlatformDataLength = uint32(len(b))
+		e.PlatformDataOffset = uint64(next + int64(len(locatorData)))
+		locatorData = append(locatorData, padSector(b)...)
+		i++
+	}
+	next += int64(len(locatorData))
+
+	want := make([]byte, len(ti.layout)*testBlockSize)
+	var blocks []byte
+	const bitmapSize = 512
+	for i, c := range ti.layout {
+		if c == blockUnallocated {
+			bat[i] = unallocatedBlock
+			continue
+		}
+		bat[i] = uint32((next + int64(len(blocks))) / 512)
+		bitmap := make([]byte, bitmapSize)
+		data := want[i*testBlockSize:][:testBlockSize]
+		if _, err := r.Read(data); err != nil {
+			t.Fatal(err)
+		}
+		for j := range testBlockSize / 512 / 8 {
+			bitmap[j] = 0xff
+			if c == blockPartial {
+				bitmap[j] = testBitmapByte(j)
+			}
+		}
+		blocks = append(blocks, bitmap...)
+		blocks = append(blocks, data...)
+		if c == blockPartial {
+			for j := range testBlockSize / 512 / 8 {
+				if bitmap[j] == 0 {
+					clear(data[j*8*512:][:8*512])
+				}
+			}
+		}
+	}
+
+	if ti.modify != nil {
+		ti.modify(&footer, &h)
+	}
+	hb := marshalTestStruct(t, h)
+	hb = append(hb, make([]byte, dynamicHeaderSize-len(hb))...)
+	binary.BigEndian.PutUint32(hb[36:], checksum(hb, 36))
+	img := marshalFooter()
+	img = append(img, hb...)
+	img = append(img, padSector(marshalTestStruct(t, bat))...)
+	img = append(img, locatorData...)
+	img = append(img, blocks...)
+	img = append(img, marshalFooter()...)
+	return img, want[:size]
+}
+
+func TestDynamic(t *testing.T) {
+	const layout = "aauaau"
+	cases := []struct {
+		name string
+		ti   testImage
+		size int64
+	}{
+		{
+			name: "current size",
+			ti:   testImage{layout: layout, size: 5*testBlockSize + 4096, cylinders: 1, heads: 4, sectorsPerTrack: 17},
+			size: 5*testBlockSize + 4096,
+		},
+		{
+			// 9 cylinders, 4 heads, 17 sectors per track: 306 KiB.
+			name: "CHS geometry",
+			ti:   testImage{layout: layout, creator: "vpc ", cylinders: 9, heads: 4, sectorsPerTrack: 17},
+			size: 9 * 4 * 17 * 512,
+		},
+		{
+			name: "maximum CHS geometry",
+			ti:   testImage{layout: layout, creator: "vpc ", cylinders: 65535, heads: 16, sectorsPerTrack: 255},
+			size: int64(len(layout)) * testBlockSize,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.ti.diskType = DiskTypeDynamic
+			data, want := createTestImage(t, tc.ti)
+			img, err := Open(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := img.Readable(); err != nil {
+				t.Fatal(err)
+			}
+			if img.Size() != tc.size {
+				t.Fatalf("expected size %d, got %d", tc.size, img.Size())
+			}
+			want = append(want, make([]byte, max(0, tc.size-int64(len(want))))...)[:tc.size]
+			if !bytes.Equal(imagetest.ReadAll(t, img), want) {
+				t.Fatal("unexpected data")
+			}
+			var wantExtents []image.Extent
+			for i, c := range layout {
+				start := int64(i) * testBlockSize
+				if start >= tc.size {
+					break
+				}
+				e := image.Extent{Start: start, Length: min(testBlockSize, tc.size-start), Allocated: c != blockUnallocated, Zero: c == blockUnallocated}
+				if n := len(wantExtents); n > 0 && sameStatus(wantExtents[n-1], e) {
+					wantExtents[n-1].Length += e.Length
+				} else {
+					wantExtents = append(wantExtents, e)
+				}
+			}
+			if extents := imagetest.ReadExtents(t, img); !reflect.DeepEqual(extents, wantExtents) {
+				t.Fatalf("expected extents\n%+v\ngot\n%+v", wantExtents, extents)
+			}
+		})
+	}
+}
+
+func TestFixed(t *testing.T) {
+	const size = 3*testBlockSize + 512
+	data, want := createTestImage(t, testImage{diskType: DiskTypeFixed, size: size})
+	img, err := Open(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Readable(); err != nil {
+		t.Fatal(err)
+	}
+	if img.Size() != size {
+		t.Fatalf("expected size %d, got %d", size, img.Size())
+	}
+	if !bytes.Equal(imagetest.ReadAll(t, img), want) {
+		t.Fatal("unexpected data")
+	}
+	if extents := imagetest.ReadExtents(t, img); !reflect.DeepEqual(extents, []image.Extent{{Start: 0, Length: size, Allocated: true}}) {
+		t.Fatalf("unexpected extents %+v", extents)
+	}
+
+	// A raw image is not a fixed disk, even if it ends with a cookie.
+	raw := bytes.Clone(data)
+	raw[len(raw)-1]++
+	if _, err := Open(bytes.NewReader(raw)); !errors.Is(err, image.ErrWrongType) {
+		t.Fatalf("expected ErrWrongType, got %v", err)
+	}
+}
+
+func TestInvalidFooterChecksum(t *testing.T) {
+	data, want := createTestImage(t, testImage{diskType: DiskTypeDynamic, layout: "au"})
+	// Corrupt the copy of the footer at the start of the file.
+	data[100]++
+	img, err := Open(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Readable(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(imagetest.ReadAll(t, img), want) {
+		t.Fatal("unexpected data")
+	}
+
+	// Without the copy at the end.
+	img, err = Open(bytes.NewReader(data[:len(data)-footerSize]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	imagetest.CheckUnreadable(t, img, errInvalidChecksum)
+}
+
+func TestInvalidDynamicHeader(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		modify func(*Footer, *DynamicHeader)
+		ok     bool
+	}{
+		{name: "current size", modify: func(f *Footer, h *DynamicHeader) { f.CurrentSize = 1 << 63 }},
+		{name: "few table entries", modify: func(f *Footer, h *DynamicHeader) { h.MaxTableEntries = 2 }},
+		{name: "table offset", modify: func(f *Footer, h *DynamicHeader) { h.TableOffset = 1 << 62 }},
+		// Only the entries of the blocks of the disk are read.
+		{name: "many table entries", modify: func(f *Footer, h *DynamicHeader) { h.MaxTableEntries = 0xffffffff }, ok: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data, want := createTestImage(t, testImage{diskType: DiskTypeDynamic, layout: "aua", modify: tc.modify})
+			img, err := Open(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tc.ok {
+				if err := img.Readable(); err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err := img.Readable(); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(imagetest.ReadAll(t, img), want) {
+				t.Fatal("unexpected data")
+			}
+		})
+	}
+}
+
+func TestLargeParentLocator(t *testing.T) {
+	h := &DynamicHeader{}
+	copy(h.ParentUnicodeName[:], encodeUTF16("parent.vhd", binary.BigEndian))
+	e := &h.ParentLocatorEntries[0]
+	copy(e.PlatformCode[:], PlatformCodeW2ru)
+	e.PlatformDataLength = 0xffffffff
+	img := &Vpc{ra: bytes.NewReader(make([]byte, 4096)), DynamicHeader: h}
+	if names := img.parentNames(); !reflect.DeepEqual(names, []string{"parent.vhd"}) {
+		t.Fatalf("unexpected parent names %q", names)
+	}
+}
+
+// TestQemuImg reads images converted by qemu-img. Without force_size, the size
+// of the disk is the size of its CHS geometry.
+func TestQemuImg(t *testing.T) {
+	for _, options := range []string{"subformat=dynamic", "subformat=dynamic,force_size=on", "subformat=fixed,force_size=on"} {
+		t.Run(options, func(t *testing.T) {
+			path := imagetest.ConvertQemuImg(t, qemuimg.FormatVpc, 10<<20, options)
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close() //nolint:errcheck
+			img, err := Open(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			imagetest.CompareQemuImg(t, img, path)
+		})
+	}
+}
+
+func TestDifferencing(t *testing.T) {
+	parent, wantParent := createTestImage(t, testImage{diskType: DiskTypeDynamic, layout: "aaua", uniqueID: 1, seed: 1})
+	child, wantChild := createTestImage(t, testImage{
+		diskType:       DiskTypeDifferencing,
+		layout:         "puua",
+		uniqueID:       2,
+		parentUniqueID: 1,
+		locators:       map[string]string{PlatformCodeW2ru: `..\base\parent.vhd`, PlatformCodeW2ku: `C:\base\parent.vhd`},
+		parentName:     "parent.vhd",
+		seed:           2,
+	})
+	byName, _ := createTestImage(t, testImage{
+		diskType:       DiskTypeDifferencing,
+		layout:         "puua",
+		parentUniqueID: 1,
+		locators:       map[string]string{PlatformCodeW2ru: `missing.vhd`},
+		parentName:     "parent.vhd",
+		seed:           2,
+	})
+	modified, _ := createTestImage(t, testImage{
+		diskType:       DiskTypeDifferencing,
+		layout:         "puua",
+		parentUniqueID: 3,
+		locators:       map[string]string{PlatformCodeMacX: "../base/parent.vhd"},
+	})
+	outside, _ := createTestImage(t, testImage{
+		diskType:       DiskTypeDifferencing,
+		layout:         "puua",
+		parentUniqueID: 1,
+		locators:       map[string]string{PlatformCodeW2ru: `..\..\secret.vhd`},
+	})
+	fsys := fstest.MapFS{
+		"base/parent.vhd":    &fstest.MapFile{Data: parent},
+		"base/by-name.vhd":   &fstest.MapFile{Data: byName},
+		"vm/child.vhd":       &fstest.MapFile{Data: child},
+		"vm/modified.vhd":    &fstest.MapFile{Data: modified},
+		"vm/missing-par.vhd": &fstest.MapFile{Data: byName},
+		"vm/outside.vhd":     &fstest.MapFile{Data: outside},
+	}
+	openFS := func(name string) *Vpc {
+		t.Helper()
+		img, err := Open(bytes.NewReader(fsys[name].Data), WithFileResolver(image.FSFileResolver(fsys)), WithName(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = img.Close() })
+		return img
+	}
+
+	want := bytes.Clone(wantParent)
+	for j := range testBlockSize / 512 / 8 {
+		if testBitmapByte(j) != 0 {
+			copy(want[j*8*512:][:8*512], wantChild[j*8*512:])
+		}
+	}
+	copy(want[3*testBlockSize:], wantChild[3*testBlockSize:])
+	wantExtents := []image.Extent{
+		{Start: 0, Length: 2 * testBlockSize, Allocated: true},
+		{Start: 2 * testBlockSize, Length: testBlockSize, Zero: true},
+		{Start: 3 * testBlockSize, Length: testBlockSize, Allocated: true},
+	}
+	for _, name := range []string{"vm/child.vhd", "base/by-name.vhd"} {
+		img := openFS(name)
+		if err := img.Readable(); err != nil {
+			t.Fatal(err)
+		}
+		if img.ParentFullPath != "base/parent.vhd" {
+			t.Fatalf("%s: expected parent base/parent.vhd, got %q", name, img.ParentFullPath)
+		}
+		if !bytes.Equal(imagetest.ReadAll(t, img), want) {
+			t.Fatalf("%s: unexpected data", name)
+		}
+		if extents := imagetest.ReadExtents(t, img); !reflect.DeepEqual(extents, wantExtents) {
+			t.Fatalf("%s: expected extents\n%+v\ngot\n%+v", name, wantExtents, extents)
+		}
+	}
+	for _, name := range []string{"vm/modified.vhd", "vm/missing-par.vhd"} {
+		if err := openFS(name).Readable(); !errors.Is(err, ErrUnsupportedParent) {
+			t.Fatalf("%s: expected ErrUnsupportedParent, got %v", name, err)
+		}
+	}
+	// Errors of the resolver are reported, e.g. for an open policy.
+	if err := openFS("vm/outside.vhd").Readable(); !errors.Is(err, ErrUnsupportedParent) || !errors.Is(err, image.ErrUnsafeFileName) {
+		t.Fatalf("expected ErrUnsupportedParent and image.ErrUnsafeFileName, got %v", err)
+	}
+}
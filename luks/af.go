@@ -0,0 +1,61 @@
+package luks
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash"
+)
+
+// diffuse implements the LUKS anti-forensic diffusion function in place.
+func diffuse(d []byte, newHash func() hash.Hash) {
+	h := newHash()
+	ds := h.Size()
+	var iv [4]byte
+	for i := 0; i*ds < len(d); i++ {
+		block := d[i*ds : min((i+1)*ds, len(d))]
+		h.Reset()
+		binary.BigEndian.PutUint32(iv[:], uint32(i))
+		h.Write(iv[:])
+		h.Write(block)
+		copy(block, h.Sum(nil))
+	}
+}
+
+// afMerge recovers a key of keyLen bytes from the anti-forensic split material.
+func afMerge(material []byte, keyLen, stripes int, newHash func() hash.Hash) ([]byte, error) {
+	if stripes < 1 || len(material) < keyLen*stripes {
+		return nil, fmt.Errorf("invalid anti-forensic material (%d bytes for %d stripes of %d bytes)", len(material), stripes, keyLen)
+	}
+	d := make([]byte, keyLen)
+	for i := 0; i < stripes-1; i++ {
+		xorBytes(d, material[i*keyLen:(i+1)*keyLen])
+		diffuse(d, newHash)
+	}
+	xorBytes(d, material[(stripes-1)*keyLen:stripes*keyLen])
+	return d, nil
+}
+
+// afSplit is the inverse of [afMerge].
+func afSplit(key []byte, stripes int, newHash func() hash.Hash) ([]byte, error) {
+	keyLen := len(key)
+	material := make([]byte, keyLen*stripes)
+	if _, err := rand.Read(material[:keyLen*(stripes-1)]); err != nil {
+		return nil, err
+	}
+	d := make([]byte, keyLen)
+	for i := 0; i < stripes-1; i++ {
+		xorBytes(d, material[i*keyLen:(i+1)*keyLen])
+		diffuse(d, newHash)
+	}
+	last := material[(stripes-1)*keyLen:]
+	copy(last, d)
+	xorBytes(last, key)
+	return material, nil
+}
+
+func xorBytes(dst, src []byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
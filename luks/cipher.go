@@ -0,0 +1,249 @@
+package luks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+
+	"golang.org/x/crypto/cast5"
+	"golang.org/x/crypto/twofish"
+)
+
+// ErrUnsupportedCipher is returned for cipher specifications that are not
+// implemented. The supported block ciphers are aes, twofish and cast5; serpent
+// is not supported.
+var ErrUnsupportedCipher = errors.New("unsupported cipher")
+
+// newHashFunc returns the hash function for a LUKS hash specification, e.g.
+// "sha256".
+func newHashFunc(spec string) (func() hash.Hash, error) {
+	switch strings.ToLower(spec) {
+	case "sha1":
+		return sha1.New, nil
+	case "sha224":
+		return sha256.New224, nil
+	case "sha256":
+		return sha256.New, nil
+	case "sha384":
+		return sha512.New384, nil
+	case "sha512":
+		return sha512.New, nil
+	default:
+		return nil, fmt.Errorf("unsupported hash %q", spec)
+	}
+}
+
+func newBlock(name string, key []byte) (cipher.Block, error) {
+	switch strings.ToLower(name) {
+	case "aes":
+		return aes.NewCipher(key)
+	case "twofish":
+		return twofish.NewCipher(key)
+	case "cast5":
+		return cast5.NewCipher(key)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedCipher, name)
+	}
+}
+
+type ivGenerator func(iv []byte, sector uint64)
+
+func ivPlain(iv []byte, sector uint64) {
+	clear(iv)
+	binary.LittleEndian.PutUint32(iv, uint32(sector))
+}
+
+func ivPlain64(iv []byte, sector uint64) {
+	clear(iv)
+	binary.LittleEndian.PutUint64(iv, sector)
+}
+
+func ivPlain64BE(iv []byte, sector uint64) {
+	clear(iv)
+	binary.BigEndian.PutUint64(iv[len(iv)-8:], sector)
+}
+
+// newIVGenerator parses an IV generator specification such as "plain64" or
+// "essiv:sha256".
+func newIVGenerator(spec, cipherName string, key []byte) (ivGenerator, error) {
+	name, arg, _ := strings.Cut(spec, ":")
+	switch name {
+	case "plain":
+		return ivPlain, nil
+	case "plain64":
+		return ivPlain64, nil
+	case "plain64be":
+		return ivPlain64BE, nil
+	case "essiv":
+		newHash, err := newHashFunc(arg)
+		if err != nil {
+			return nil, fmt.Errorf("%w: essiv: %v", ErrUnsupportedCipher, err)
+		}
+		h := newHash()
+		h.Write(key)
+		essiv, err := newBlock(cipherName, h.Sum(nil))
+		if err != nil {
+			return nil, fmt.Errorf("essiv: %w", err)
+		}
+		return func(iv []byte, sector uint64) {
+			ivPlain64(iv, sector)
+			essiv.Encrypt(iv, iv)
+		}, nil
+	default:
+		return nil, fmt.Errorf("%w: IV generator %q", ErrUnsupportedCipher, spec)
+	}
+}
+
+// Cipher encrypts and decrypts data in units of sectors, as specified by a
+// dm-crypt style cipher specification (e.g. "aes" + "xts-plain64").
+// Safe for concurrent use by multiple goroutines.
+type Cipher struct {
+	mode       string
+	sectorSize int
+	block      cipher.Block
+	tweak      cipher.Block // xts only
+	ivgen      ivGenerator
+}
+
+// NewCipher returns a [Cipher] for the cipher name (e.g. "aes"), the cipher
+// mode (e.g. "xts-plain64", "cbc-essiv:sha256", "ecb"), the key and the
+// sector size in bytes.
+func NewCipher(name, mode string, key []byte, sectorSize int) (*Cipher, error) {
+	if sectorSize < 512 || sectorSize&(sectorSize-1) != 0 {
+		return nil, fmt.Errorf("invalid sector size %d", sectorSize)
+	}
+	chainMode, ivSpec, _ := strings.Cut(strings.ToLower(mode), "-")
+	c := &Cipher{mode: chainMode, sectorSize: sectorSize}
+	var err error
+	switch chainMode {
+	case "xts":
+		if len(key)%2 != 0 {
+			return nil, fmt.Errorf("invalid xts key length %d", len(key))
+		}
+		half := len(key) / 2
+		if c.block, err = newBlock(name, key[:half]); err != nil {
+			return nil, err
+		}
+		if c.tweak, err = newBlock(name, key[half:]); err != nil {
+			return nil, err
+		}
+		if c.block.BlockSize() != 16 {
+			return nil, fmt.Errorf("%w: xts requires a 128-bit block cipher", ErrUnsupportedCipher)
+		}
+	case "cbc", "ctr", "ecb":
+		if c.block, err = newBlock(name, key); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: mode %q", ErrUnsupportedCipher, mode)
+	}
+	if chainMode == "ecb" {
+		if ivSpec != "" {
+			return nil, fmt.Errorf("%w: ecb does not take an IV generator (%q)", ErrUnsupportedCipher, mode)
+		}
+		return c, nil
+	}
+	if ivSpec == "" {
+		return nil, fmt.Errorf("%w: mode %q lacks an IV generator", ErrUnsupportedCipher, mode)
+	}
+	if c.ivgen, err = newIVGenerator(ivSpec, name, key); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// SectorSize returns the encryption sector size in bytes.
+func (c *Cipher) SectorSize() int {
+	return c.sectorSize
+}
+
+// Decrypt decrypts p in place. len(p) must be a multiple of the sector size,
+// and sector is the number of the first sector in p.
+func (c *Cipher) Decrypt(p []byte, sector uint64) error {
+	return c.crypt(p, sector, false)
+}
+
+// Encrypt encrypts p in place. len(p) must be a multiple of the sector size,
+// and sector is the number of the first sector in p.
+func (c *Cipher) Encrypt(p []byte, sector uint64) error {
+	return c.crypt(p, sector, true)
+}
+
+func (c *Cipher) crypt(p []byte, sector uint64, encrypt bool) error {
+	if len(p)%c.sectorSize != 0 {
+		return fmt.Errorf("length %d is not aligned to sector size %d", len(p), c.sectorSize)
+	}
+	iv := make([]byte, c.block.BlockSize())
+	for ; len(p) > 0; p, sector = p[c.sectorSize:], sector+1 {
+		s := p[:c.sectorSize]
+		if c.ivgen != nil {
+			c.ivgen(iv, sector)
+		}
+		switch c.mode {
+		case "xts":
+			c.cryptXTS(s, iv, encrypt)
+		case "cbc":
+			if encrypt {
+				cipher.NewCBCEncrypter(c.block, iv).CryptBlocks(s, s)
+			} else {
+				cipher.NewCBCDecrypter(c.block, iv).CryptBlocks(s, s)
+			}
+		case "ctr":
+			cipher.NewCTR(c.block, iv).XORKeyStream(s, s)
+		case "ecb":
+			bs := c.block.BlockSize()
+			for i := 0; i < len(s); i += bs {
+				if encrypt {
+					c.block.Encrypt(s[i:i+bs], s[i:i+bs])
+				} else {
+					c.block.Decrypt(s[i:i+bs], s[i:i+bs])
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// cryptXTS implements XTS (IEEE 1619) for one sector. Sectors are always a
+// multiple of the block size, so ciphertext stealing is not needed.
+func (c *Cipher) cryptXTS(s, iv []byte, encrypt bool) {
+	var t [16]byte
+	c.tweak.Encrypt(t[:], iv)
+	for i := 0; i < len(s); i += 16 {
+		b := s[i : i+16]
+		xor16(b, t[:])
+		if encrypt {
+			c.block.Encrypt(b, b)
+		} else {
+			c.block.Decrypt(b, b)
+		}
+		xor16(b, t[:])
+		mul2(&t)
+	}
+}
+
+func xor16(dst, x []byte) {
+	for i := 0; i < 16; i++ {
+		dst[i] ^= x[i]
+	}
+}
+
+// mul2 multiplies the tweak by the primitive element of GF(2^128).
+func mul2(t *[16]byte) {
+	var carry byte
+	for i := 0; i < 16; i++ {
+		next := t[i] >> 7
+		t[i] = t[i]<<1 | carry
+		carry = next
+	}
+	if carry != 0 {
+		t[0] ^= 0x87
+	}
+}
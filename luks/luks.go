@@ -0,0 +1,637 @@
+// Package luks implements reading LUKS1 and LUKS2 headers and unlocking the
+// master key, as used by qcow2 images with "encrypt.format=luks".
+//
+// ref: https://gitlab.com/cryptsetup/cryptsetup/-/wikis/LUKS-standard/on-disk-format.pdf
+// ref: https://gitlab.com/cryptsetup/LUKS2-docs/-/blob/main/luks2_doc_wip.pdf
+package luks
+
+import (
+	"bytes"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Magic is the LUKS magic string.
+const Magic = "LUKS\xba\xbe"
+
+// SectorSize is the sector size used for key material and LUKS1 payloads.
+const SectorSize = 512
+
+var (
+	ErrNotLUKS           = errors.New("not a LUKS header")
+	ErrInvalidHeader     = errors.New("invalid LUKS header")
+	ErrInvalidPassphrase = errors.New("no key slot matches the passphrase")
+)
+
+// Limits of key slot parameters, as enforced by cryptsetup and qemu. They keep a
+// malformed header from making Unlock allocate or compute without bound.
+const (
+	// afStripes is the only number of anti-forensic stripes accepted.
+	afStripes = 4000
+	// maxKeyBytes is the largest key size of the supported ciphers
+	// (aes-xts-plain64 with a 512-bit key).
+	maxKeyBytes = 64
+	// maxPBKDF2Iterations bounds the work of a key slot to seconds. cryptsetup
+	// benchmarks PBKDF2 to take --iter-time (2 seconds by default), which is a
+	// few million iterations on current hardware; the limit allows several
+	// times that.
+	maxPBKDF2Iterations = 1 << 24
+	minArgon2Memory     = 32              // in KiB
+	maxArgon2Memory     = 4 * 1024 * 1024 // in KiB
+	maxArgon2Threads    = 4
+)
+
+func checkKeyBytes(n int) error {
+	if n < 1 || n > maxKeyBytes {
+		return fmt.Errorf("%w: key size %d", ErrInvalidHeader, n)
+	}
+	return nil
+}
+
+func checkStripes(n int) error {
+	if n != afStripes {
+		return fmt.Errorf("%w: %d anti-forensic stripes (expected %d)", ErrInvalidHeader, n, afStripes)
+	}
+	return nil
+}
+
+func checkPBKDF2Iterations(n int) error {
+	if n < 1 || int64(n) > maxPBKDF2Iterations {
+		return fmt.Errorf("%w: %d pbkdf2 iterations", ErrInvalidHeader, n)
+	}
+	return nil
+}
+
+func checkArgon2(kdf kdfV2) error {
+	switch {
+	case kdf.Time < 1:
+		return fmt.Errorf("%w: argon2 time %d", ErrInvalidHeader, kdf.Time)
+	case kdf.CPUs < 1 || kdf.CPUs > maxArgon2Threads:
+		return fmt.Errorf("%w: %d argon2 threads", ErrInvalidHeader, kdf.CPUs)
+	case kdf.Memory < minArgon2Memory || kdf.Memory > maxArgon2Memory:
+		return fmt.Errorf("%w: argon2 memory %d KiB", ErrInvalidHeader, kdf.Memory)
+	}
+	return nil
+}
+
+const (
+	keySlotsV1        = 8
+	keySlotEnabledV1  = 0x00ac71f3
+	keySlotDisabledV1 = 0x0000dead
+)
+
+type keySlotV1 struct {
+	Active            uint32
+	Iterations        uint32
+	Salt              [32]byte
+	KeyMaterialOffset uint32 // in sectors
+	Stripes           uint32
+}
+
+type headerV1 struct {
+	Magic         [6]byte
+	Version       uint16
+	CipherName    [32]byte
+	CipherMode    [32]byte
+	HashSpec      [32]byte
+	PayloadOffset uint32 // in sectors
+	KeyBytes      uint32
+	MKDigest      [20]byte
+	MKDigestSalt  [32]byte
+	MKDigestIter  uint32
+	UUID          [40]byte
+	KeySlots      [keySlotsV1]keySlotV1
+}
+
+type headerV2 struct {
+	Magic       [6]byte
+	Version     uint16
+	HdrSize     uint64
+	SeqID       uint64
+	Label       [48]byte
+	ChecksumAlg [32]byte
+	Salt        [64]byte
+	UUID        [40]byte
+	Subsystem   [48]byte
+	HdrOffset   uint64
+	Padding     [184]byte
+	Checksum    [64]byte
+	// Followed by 7*512 bytes of padding.
+}
+
+const binaryHeaderSizeV2 = 4096
+
+// Offsets of the secondary LUKS2 header, as probed by cryptsetup.
+var secondaryHeaderOffsetsV2 = []int64{
+	0x4000, 0x8000, 0x10000, 0x20000, 0x40000, 0x80000, 0x100000, 0x200000, 0x400000,
+}
+
+// jsonUint64 is an uint64 encoded as a JSON string, as used in LUKS2 metadata.
+type jsonUint64 uint64
+
+func (x *jsonUint64) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return err
+	}
+	*x = jsonUint64(v)
+	return nil
+}
+
+type kdfV2 struct {
+	Type       string `json:"type"`
+	Hash       string `json:"hash"`       // pbkdf2
+	Iterations int    `json:"iterations"` // pbkdf2
+	Time       uint32 `json:"time"`       // argon2
+	Memory     uint32 `json:"memory"`     // argon2, in KiB
+	CPUs       uint8  `json:"cpus"`       // argon2
+	Salt       []byte `json:"salt"`
+}
+
+type keySlotV2 struct {
+	Type     string `json:"type"`
+	KeySize  int    `json:"key_size"`
+	Priority *int   `json:"priority"`
+	AF       struct {
+		Type    string `json:"type"`
+		Stripes int    `json:"stripes"`
+		Hash    string `json:"hash"`
+	} `json:"af"`
+	Area struct {
+		Type       string     `json:"type"`
+		Offset     jsonUint64 `json:"offset"`
+		Size       jsonUint64 `json:"size"`
+		Encryption string     `json:"encryption"`
+		KeySize    int        `json:"key_size"`
+	} `json:"area"`
+	KDF kdfV2 `json:"kdf"`
+}
+
+type segmentV2 struct {
+	Type       string     `json:"type"`
+	Offset     jsonUint64 `json:"offset"`
+	IVTweak    jsonUint64 `json:"iv_tweak"`
+	Encryption string     `json:"encryption"`
+	SectorSize int        `json:"sector_size"`
+}
+
+type digestV2 struct {
+	Type       string   `json:"type"`
+	KeySlots   []string `json:"keyslots"`
+	Segments   []string `json:"segments"`
+	Hash       string   `json:"hash"`
+	Iterations int      `json:"iterations"`
+	Salt       []byte   `json:"salt"`
+	Digest     []byte   `json:"digest"`
+}
+
+type metadataV2 struct {
+	KeySlots map[string]keySlotV2 `json:"keyslots"`
+	Segments map[string]segmentV2 `json:"segments"`
+	Digests  map[string]digestV2  `json:"digests"`
+}
+
+// KeySlot describes an active key slot.
+type KeySlot struct {
+	ID  string `json:"id"`
+	KDF string `json:"kdf"`
+}
+
+// Header is a parsed LUKS header.
+type Header struct {
+	Version    int       `json:"version"`
+	UUID       string    `json:"uuid"`
+	CipherName string    `json:"cipher_name"`
+	CipherMode string    `json:"cipher_mode"`
+	KeyBytes   int       `json:"key_bytes"`
+	SectorSize int       `json:"sector_size"`
+	KeySlots   []KeySlot `json:"key_slots"`
+
+	ra       io.ReaderAt
+	v1       *headerV1
+	metadata *metadataV2
+	segment  string
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// ReadHeader reads a LUKS1 or LUKS2 header. Offsets in the header are relative
+// to the start of ra.
+func ReadHeader(ra io.ReaderAt) (*Header, error) {
+	var prefix [8]byte
+	if _, err := ra.ReadAt(prefix[:], 0); err != nil {
+		return nil, fmt.Errorf("%w (%v)", ErrNotLUKS, err)
+	}
+	if string(prefix[:6]) != Magic {
+		return nil, fmt.Errorf("%w (the header lacks magic %q)", ErrNotLUKS, Magic)
+	}
+	switch v := binary.BigEndian.Uint16(prefix[6:]); v {
+	case 1:
+		return readHeaderV1(ra)
+	case 2:
+		return readHeaderV2(ra)
+	default:
+		return nil, fmt.Errorf("unsupported LUKS version %d", v)
+	}
+}
+
+func readHeaderV1(ra io.ReaderAt) (*Header, error) {
+	var v1 headerV1
+	if err := binary.Read(io.NewSectionReader(ra, 0, int64(binary.Size(v1))), binary.BigEndian, &v1); err != nil {
+		return nil, fmt.Errorf("failed to read LUKS1 header: %w", err)
+	}
+	h := &Header{
+		Version:    1,
+		UUID:       cString(v1.UUID[:]),
+		CipherName: cString(v1.CipherName[:]),
+		CipherMode: cString(v1.CipherMode[:]),
+		KeyBytes:   int(v1.KeyBytes),
+		SectorSize: SectorSize,
+		ra:         ra,
+		v1:         &v1,
+	}
+	for i, slot := range v1.KeySlots {
+		if slot.Active == keySlotEnabledV1 {
+			h.KeySlots = append(h.KeySlots, KeySlot{ID: strconv.Itoa(i), KDF: "pbkdf2"})
+		}
+	}
+	return h, nil
+}
+
+func readBinaryHeaderV2(ra io.ReaderAt, off int64) (*headerV2, []byte, error) {
+	var v2 headerV2
+	if err := binary.Read(io.NewSectionReader(ra, off, int64(binary.Size(v2))), binary.BigEndian, &v2); err != nil {
+		return nil, nil, err
+	}
+	if string(v2.Magic[:4]) != "LUKS" && string(v2.Magic[:4]) != "SKUL" {
+		return nil, nil, ErrNotLUKS
+	}
+	if v2.Version != 2 {
+		return nil, nil, fmt.Errorf("unexpected LUKS2 header version %d", v2.Version)
+	}
+	if v2.HdrSize < binaryHeaderSizeV2 || v2.HdrSize > 4*1024*1024 {
+		return nil, nil, fmt.Errorf("invalid LUKS2 header size %d", v2.HdrSize)
+	}
+	if uint64(off) != v2.HdrOffset {
+		return nil, nil, fmt.Errorf("LUKS2 header at %d claims offset %d", off, v2.HdrOffset)
+	}
+	area := make([]byte, v2.HdrSize)
+	if _, err := ra.ReadAt(area, off); err != nil {
+		return nil, nil, err
+	}
+	switch alg := cString(v2.ChecksumAlg[:]); alg {
+	case "sha256":
+		// The checksum is calculated with the checksum field zeroed.
+		csumOff := binary.Size(v2) - len(v2.Checksum)
+		clear(area[csumOff : csumOff+len(v2.Checksum)])
+		sum := sha256.Sum256(area)
+		if !bytes.Equal(sum[:], v2.Checksum[:len(sum)]) {
+			return nil, nil, errors.New("LUKS2 header checksum mismatch")
+		}
+	default:
+		return nil, nil, fmt.Errorf("unsupported LUKS2 checksum algorithm %q", alg)
+	}
+	return &v2, area[binaryHeaderSizeV2:], nil
+}
+
+func readHeaderV2(ra io.ReaderAt) (*Header, error) {
+	v2, jsonArea, err := readBinaryHeaderV2(ra, 0)
+	if err != nil {
+		// Fall back to the secondary header.
+		var err2 error
+		for _, off := range secondaryHeaderOffsetsV2 {
+			if v2, jsonArea, err2 = readBinaryHeaderV2(ra, off); err2 == nil {
+				break
+			}
+		}
+		if err2 != nil {
+			return nil, fmt.Errorf("failed to read LUKS2 header: %w", err)
+		}
+	} else if s, sJSON, err := readBinaryHeaderV2(ra, int64(v2.HdrSize)); err == nil && s.SeqID > v2.SeqID {
+		// The secondary header directly follows the primary one, and is
+		// preferred if it is newer.
+		v2, jsonArea = s, sJSON
+	}
+	var metadata metadataV2
+	if err := json.Unmarshal(bytes.TrimRight(jsonArea, "\x00"), &metadata); err != nil {
+		return nil, fmt.Errorf("failed to parse LUKS2 metadata: %w", err)
+	}
+	h := &Header{
+		Version:  2,
+		UUID:     cString(v2.UUID[:]),
+		ra:       ra,
+		metadata: &metadata,
+	}
+	// Use the segment with the lowest ID, as cryptsetup does.
+	segmentIDs := sortedKeys(metadata.Segments)
+	if len(segmentIDs) == 0 {
+		return nil, errors.New("LUKS2 metadata has no segments")
+	}
+	h.segment = segmentIDs[0]
+	seg := metadata.Segments[h.segment]
+	if seg.Type != "crypt" {
+		return nil, fmt.Errorf("unsupported LUKS2 segment type %q", seg.Type)
+	}
+	h.CipherName, h.CipherMode, _ = strings.Cut(seg.Encryption, "-")
+	h.SectorSize = seg.SectorSize
+	for _, id := range sortedKeys(metadata.KeySlots) {
+		slot := metadata.KeySlots[id]
+		if h.KeyBytes == 0 {
+			h.KeyBytes = slot.KeySize
+		}
+		h.KeySlots = append(h.KeySlots, KeySlot{ID: id, KDF: slot.KDF.Type})
+	}
+	return h, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	// Keys are decimal numbers.
+	sort.Slice(keys, func(i, j int) bool {
+		a, _ := strconv.Atoi(keys[i])
+		b, _ := strconv.Atoi(keys[j])
+		return a < b
+	})
+	return keys
+}
+
+// Unlock tries the passphrase against all active key slots and returns the
+// [Cipher] for the payload. Key slots which cannot be used are skipped. Returns
+// [ErrInvalidPassphrase] if no key slot matches, or the error of the last
+// unusable key slot if no key slot could be used.
+func (h *Header) Unlock(passphrase []byte) (*Cipher, error) {
+	var (
+		masterKey []byte
+		err       error
+	)
+	if h.v1 != nil {
+		masterKey, err = h.unlockV1(passphrase)
+	} else {
+		masterKey, err = h.unlockV2(passphrase)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewCipher(h.CipherName, h.CipherMode, masterKey, h.SectorSize)
+}
+
+// readKeyMaterial reads and decrypts the anti-forensic key material at off.
+func (h *Header) readKeyMaterial(off int64, length int, cipherName, cipherMode string, key []byte) ([]byte, error) {
+	c, err := NewCipher(cipherName, cipherMode, key, SectorSize)
+	if err != nil {
+		return nil, err
+	}
+	material := make([]byte, (length+SectorSize-1)/SectorSize*SectorSize)
+	if _, err := h.ra.ReadAt(material, off); err != nil {
+		return nil, fmt.Errorf("failed to read key material at %d: %w", off, err)
+	}
+	if err := c.Decrypt(material, 0); err != nil {
+		return nil, err
+	}
+	return material[:length], nil
+}
+
+func (h *Header) unlockV1(passphrase []byte) ([]byte, error) {
+	v1 := h.v1
+	newHash, err := newHashFunc(cString(v1.HashSpec[:]))
+	if err != nil {
+		return nil, err
+	}
+	keyLen := int(v1.KeyBytes)
+	if err := checkKeyBytes(keyLen); err != nil {
+		return nil, err
+	}
+	if err := checkPBKDF2Iterations(int(v1.MKDigestIter)); err != nil {
+		return nil, fmt.Errorf("master key digest: %w", err)
+	}
+	// Like LUKS2, unusable key slots are skipped.
+	var (
+		tried   bool
+		lastErr error
+	)
+	for i, slot := range v1.KeySlots {
+		if slot.Active != keySlotEnabledV1 {
+			continue
+		}
+		candidate, err := h.unlockKeySlotV1(slot, passphrase, newHash, keyLen)
+		if err != nil {
+			lastErr = fmt.Errorf("key slot %d: %w", i, err)
+			continue
+		}
+		digest, err := pbkdf2.Key(newHash, string(candidate), v1.MKDigestSalt[:], int(v1.MKDigestIter), len(v1.MKDigest))
+		if err != nil {
+			return nil, err
+		}
+		if subtle.ConstantTimeCompare(digest, v1.MKDigest[:]) == 1 {
+			return candidate, nil
+		}
+		tried = true
+	}
+	if !tried && lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, ErrInvalidPassphrase
+}
+
+func (h *Header) unlockKeySlotV1(slot keySlotV1, passphrase []byte, newHash func() hash.Hash, keyLen int) ([]byte, error) {
+	if err := checkPBKDF2Iterations(int(slot.Iterations)); err != nil {
+		return nil, err
+	}
+	if err := checkStripes(int(slot.Stripes)); err != nil {
+		return nil, err
+	}
+	derived, err := pbkdf2.Key(newHash, string(passphrase), slot.Salt[:], int(slot.Iterations), keyLen)
+	if err != nil {
+		return nil, err
+	}
+	material, err := h.readKeyMaterial(int64(slot.KeyMaterialOffset)*SectorSize, keyLen*int(slot.Stripes), h.CipherName, h.CipherMode, derived)
+	if err != nil {
+		return nil, err
+	}
+	return afMerge(material, keyLen, int(slot.Stripes), newHash)
+}
+
+func deriveKeyV2(kdf kdfV2, passphrase []byte, keyLen int) ([]byte, error) {
+	if err := checkKeyBytes(keyLen); err != nil {
+		return nil, err
+	}
+	switch kdf.Type {
+	case "pbkdf2":
+		newHash, err := newHashFunc(kdf.Hash)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkPBKDF2Iterations(kdf.Iterations); err != nil {
+			return nil, err
+		}
+		return pbkdf2.Key(newHash, string(passphrase), kdf.Salt, kdf.Iterations, keyLen)
+	case "argon2i":
+		if err := checkArgon2(kdf); err != nil {
+			return nil, err
+		}
+		return argon2.Key(passphrase, kdf.Salt, kdf.Time, kdf.Memory, kdf.CPUs, uint32(keyLen)), nil
+	case "argon2id":
+		if err := checkArgon2(kdf); err != nil {
+			return nil, err
+		}
+		return argon2.IDKey(passphrase, kdf.Salt, kdf.Time, kdf.Memory, kdf.CPUs, uint32(keyLen)), nil
+	default:
+		return nil, fmt.Errorf("unsupported kdf %q", kdf.Type)
+	}
+}
+
+func verifyDigestV2(d digestV2, key []byte) (bool, error) {
+	if d.Type != "pbkdf2" {
+		return false, fmt.Errorf("unsupported digest type %q", d.Type)
+	}
+	newHash, err := newHashFunc(d.Hash)
+	if err != nil {
+		return false, err
+	}
+	if err := checkPBKDF2Iterations(d.Iterations); err != nil {
+		return false, err
+	}
+	// An empty digest would match any key.
+	if len(d.Digest) == 0 {
+		return false, fmt.Errorf("%w: empty digest", ErrInvalidHeader)
+	}
+	digest, err := pbkdf2.Key(newHash, string(key), d.Salt, d.Iterations, len(d.Digest))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(digest, d.Digest) == 1, nil
+}
+
+// unlockV2 tries the key slots of the digest of the segment in priority
+// order. Like cryptsetup, key slots which cannot be used (e.g. an unsupported
+// kdf) are skipped; their last error is returned if no key slot was tried.
+func (h *Header) unlockV2(passphrase []byte) ([]byte, error) {
+	md := h.metadata
+	var (
+		tried   bool
+		lastErr error
+	)
+	// Find the digest for the segment, and try the key slots assigned to it.
+	for _, digestID := range sortedKeys(md.Digests) {
+		d := md.Digests[digestID]
+		if !slices.Contains(d.Segments, h.segment) {
+			continue
+		}
+		for _, slotID := range md.keySlotsByPriority(d) {
+			masterKey, err := h.unlockKeySlotV2(md.KeySlots[slotID], passphrase)
+			if err != nil {
+				lastErr = fmt.Errorf("key slot %s: %w", slotID, err)
+				continue
+			}
+			ok, err := verifyDigestV2(d, masterKey)
+			if err != nil {
+				lastErr = fmt.Errorf("digest %s: %w", digestID, err)
+				continue
+			}
+			if ok {
+				return masterKey, nil
+			}
+			tried = true
+		}
+	}
+	if !tried && lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, ErrInvalidPassphrase
+}
+
+// Key slot priorities.
+const (
+	priorityIgnore = 0
+	priorityNormal = 1
+	priorityHigh   = 2
+)
+
+// keySlotsByPriority returns the luks2 key slots of the digest, high priority
+// key slots first, without the key slots ignored unless explicitly specified.
+func (md *metadataV2) keySlotsByPriority(d digestV2) []string {
+	priority := func(id string) int {
+		if p := md.KeySlots[id].Priority; p != nil {
+			return *p
+		}
+		return priorityNormal
+	}
+	var ids []string
+	for _, id := range d.KeySlots {
+		slot, ok := md.KeySlots[id]
+		if !ok || slot.Type != "luks2" || priority(id) == priorityIgnore {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	slices.SortStableFunc(ids, func(a, b string) int {
+		if pa, pb := priority(a) >= priorityHigh, priority(b) >= priorityHigh; pa != pb {
+			if pa {
+				return -1
+			}
+			return 1
+		}
+		ia, _ := strconv.Atoi(a)
+		ib, _ := strconv.Atoi(b)
+		return ia - ib
+	})
+	return ids
+}
+
+func (h *Header) unlockKeySlotV2(slot keySlotV2, passphrase []byte) ([]byte, error) {
+	if slot.AF.Type != "luks1" {
+		return nil, fmt.Errorf("unsupported anti-forensic splitter %q", slot.AF.Type)
+	}
+	if slot.Area.Type != "raw" {
+		return nil, fmt.Errorf("unsupported key slot area type %q", slot.Area.Type)
+	}
+	newHash, err := newHashFunc(slot.AF.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkKeyBytes(slot.KeySize); err != nil {
+		return nil, err
+	}
+	if err := checkStripes(slot.AF.Stripes); err != nil {
+		return nil, err
+	}
+	derived, err := deriveKeyV2(slot.KDF, passphrase, slot.Area.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	materialLen := slot.KeySize * slot.AF.Stripes
+	if uint64(materialLen) > uint64(slot.Area.Size) {
+		return nil, fmt.Errorf("key material (%d bytes) exceeds the area size %d", materialLen, slot.Area.Size)
+	}
+	cipherName, cipherMode, _ := strings.Cut(slot.Area.Encryption, "-")
+	material, err := h.readKeyMaterial(int64(slot.Area.Offset), materialLen, cipherName, cipherMode, derived)
+	if err != nil {
+		return nil, err
+	}
+	return afMerge(material, slot.KeySize, slot.AF.Stripes, newHash)
+}
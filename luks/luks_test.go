@@ -0,0 +1,492 @@
+package luks
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strconv"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/xts"
+)
+
+const (
+	testPassphrase = "secret"
+	testStripes    = 4000
+)
+
+func randomBytes(t *testing.T, n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// encryptKeyMaterial splits key and encrypts the material with the derived key.
+func encryptKeyMaterial(t *testing.T, key, derived []byte, cipherName, cipherMode string) []byte {
+	material, err := afSplit(key, testStripes, sha256.New)
+	if err != nil {
+		t.Fatal(err)
+	}
+	padded := make([]byte, (len(material)+SectorSize-1)/SectorSize*SectorSize)
+	copy(padded, material)
+	c, err := NewCipher(cipherName, cipherMode, derived, SectorSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Encrypt(padded, 0); err != nil {
+		t.Fatal(err)
+	}
+	return padded
+}
+
+func createLUKS1(t *testing.T, masterKey []byte, cipherName, cipherMode string) []byte {
+	var h headerV1
+	copy(h.Magic[:], Magic)
+	h.Version = 1
+	copy(h.CipherName[:], cipherName)
+	copy(h.CipherMode[:], cipherMode)
+	copy(h.HashSpec[:], "sha256")
+	h.KeyBytes = uint32(len(masterKey))
+	h.MKDigestIter = 1000
+	copy(h.MKDigestSalt[:], randomBytes(t, 32))
+	digest, err := pbkdf2.Key(sha256.New, string(masterKey), h.MKDigestSalt[:], int(h.MKDigestIter), len(h.MKDigest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(h.MKDigest[:], digest)
+	copy(h.UUID[:], "8f6b0c4e-0000-4000-8000-000000000000")
+	for i := range h.KeySlots {
+		h.KeySlots[i].Active = keySlotDisabledV1
+	}
+
+	// Key slot 1 is active. Key slot 0 is left disabled to test skipping.
+	slot := &h.KeySlots[1]
+	slot.Active = keySlotEnabledV1
+	slot.Iterations = 1000
+	slot.Stripes = testStripes
+	slot.KeyMaterialOffset = 8
+	copy(slot.Salt[:], randomBytes(t, 32))
+	derived, err := pbkdf2.Key(sha256.New, testPassphrase, slot.Salt[:], int(slot.Iterations), len(masterKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	material := encryptKeyMaterial(t, masterKey, derived, cipherName, cipherMode)
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, &h); err != nil {
+		t.Fatal(err)
+	}
+	img := make([]byte, int(slot.KeyMaterialOffset)*SectorSize+len(material))
+	copy(img, buf.Bytes())
+	copy(img[int(slot.KeyMaterialOffset)*SectorSize:], material)
+	return img
+}
+
+const testHdrSizeV2 = 16384
+
+func createLUKS2(t *testing.T, masterKey []byte, kdf kdfV2) []byte {
+	const areaOffset = 2 * testHdrSizeV2
+	areaKeySize := len(masterKey)
+	var (
+		derived []byte
+		err     error
+	)
+	switch kdf.Type {
+	case "pbkdf2":
+		derived, err = pbkdf2.Key(sha256.New, testPassphrase, kdf.Salt, kdf.Iterations, areaKeySize)
+	case "argon2id":
+		derived = argon2.IDKey([]byte(testPassphrase), kdf.Salt, kdf.Time, kdf.Memory, kdf.CPUs, uint32(areaKeySize))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	material := encryptKeyMaterial(t, masterKey, derived, "aes", "xts-plain64")
+	digestSalt := randomBytes(t, 32)
+	digest, err := pbkdf2.Key(sha256.New, string(masterKey), digestSalt, 1000, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kdfJSON := map[string]any{"type": kdf.Type, "salt": kdf.Salt}
+	if kdf.Type == "pbkdf2" {
+		kdfJSON["hash"] = kdf.Hash
+		kdfJSON["iterations"] = kdf.Iterations
+	} else {
+		kdfJSON["time"] = kdf.Time
+		kdfJSON["memory"] = kdf.Memory
+		kdfJSON["cpus"] = kdf.CPUs
+	}
+	metadata := map[string]any{
+		"keyslots": map[string]any{
+			"0": map[string]any{
+				"type":     "luks2",
+				"key_size": len(masterKey),
+				"af":       map[string]any{"type": "luks1", "stripes": testStripes, "hash": "sha256"},
+				"area": map[string]any{
+					"type":       "raw",
+					"offset":     strconv.Itoa(areaOffset),
+					"size":       strconv.Itoa(len(material)),
+					"encryption": "aes-xts-plain64",
+					"key_size":   areaKeySize,
+				},
+				"kdf": kdfJSON,
+			},
+		},
+		"segments": map[string]any{
+			"0": map[string]any{
+				"type":        "crypt",
+				"offset":      "16777216",
+				"size":        "dynamic",
+				"iv_tweak":    "0",
+				"encryption":  "aes-xts-plain64",
+				"sector_size": 4096,
+			},
+		},
+		"digests": map[string]any{
+			"0": map[string]any{
+				"type":       "pbkdf2",
+				"keyslots":   []string{"0"},
+				"segments":   []string{"0"},
+				"hash":       "sha256",
+				"iterations": 1000,
+				"salt":       digestSalt,
+				"digest":     digest,
+			},
+		},
+		"config": map[string]any{"json_size": "12288", "keyslots_size": strconv.Itoa(len(material))},
+	}
+	jsonArea, err := json.Marshal(metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img := make([]byte, areaOffset+len(material))
+	for i, off := range []int{0, testHdrSizeV2} {
+		h := headerV2{
+			Version:   2,
+			HdrSize:   testHdrSizeV2,
+			SeqID:     1,
+			HdrOffset: uint64(off),
+		}
+		if i == 0 {
+			copy(h.Magic[:], Magic)
+		} else {
+			copy(h.Magic[:], "SKUL\xba\xbe")
+		}
+		copy(h.ChecksumAlg[:], "sha256")
+		copy(h.UUID[:], "8f6b0c4e-0000-4000-8000-000000000000")
+		var buf bytes.Buffer
+		if err := binary.Write(&buf, binary.BigEndian, &h); err != nil {
+			t.Fatal(err)
+		}
+		hdr := img[off : off+testHdrSizeV2]
+		copy(hdr, buf.Bytes())
+		copy(hdr[binaryHeaderSizeV2:], jsonArea)
+		sum := sha256.Sum256(hdr)
+		copy(hdr[buf.Len()-len(h.Checksum):], sum[:])
+	}
+	copy(img[areaOffset:], material)
+	return img
+}
+
+// testUnlock verifies that the cipher returned by Unlock decrypts data
+// encrypted with the master key.
+func testUnlock(t *testing.T, img, masterKey []byte, cipherName, cipherMode string, sectorSize int) {
+	h, err := ReadHeader(bytes.NewReader(img))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.CipherName != cipherName || h.CipherMode != cipherMode {
+		t.Fatalf("expected %s-%s, got %s-%s", cipherName, cipherMode, h.CipherName, h.CipherMode)
+	}
+	if h.SectorSize != sectorSize {
+		t.Fatalf("expected sector size %d, got %d", sectorSize, h.SectorSize)
+	}
+	if _, err := h.Unlock([]byte("wrong")); !errors.Is(err, ErrInvalidPassphrase) {
+		t.Fatalf("expected %v, got %v", ErrInvalidPassphrase, err)
+	}
+	c, err := h.Unlock([]byte(testPassphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := NewCipher(cipherName, cipherMode, masterKey, sectorSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := randomBytes(t, 4*sectorSize)
+	data := bytes.Clone(plain)
+	if err := expected.Encrypt(data, 42); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Decrypt(data, 42); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, plain) {
+		t.Fatal("decrypted data does not match")
+	}
+}
+
+func TestLUKS1(t *testing.T) {
+	for _, tc := range []struct {
+		cipherName string
+		cipherMode string
+		keyLen     int
+	}{
+		{"aes", "xts-plain64", 64},
+		{"aes", "xts-plain64", 32},
+		{"aes", "cbc-essiv:sha256", 32},
+		{"aes", "cbc-plain64", 16},
+		{"aes", "ctr-plain64", 32},
+		{"aes", "ecb", 16},
+		{"twofish", "xts-plain64", 64},
+		{"twofish", "cbc-essiv:sha256", 32},
+		{"cast5", "cbc-plain64", 16},
+	} {
+		t.Run(tc.cipherName+"-"+tc.cipherMode+"-"+strconv.Itoa(tc.keyLen*8), func(t *testing.T) {
+			masterKey := randomBytes(t, tc.keyLen)
+			img := createLUKS1(t, masterKey, tc.cipherName, tc.cipherMode)
+			testUnlock(t, img, masterKey, tc.cipherName, tc.cipherMode, SectorSize)
+		})
+	}
+	// Serpent is not supported.
+	if _, err := NewCipher("serpent", "xts-plain64", randomBytes(t, 64), SectorSize); !errors.Is(err, ErrUnsupportedCipher) {
+		t.Fatalf("expected %v, got %v", ErrUnsupportedCipher, err)
+	}
+}
+
+func TestLUKS2(t *testing.T) {
+	for _, kdf := range []kdfV2{
+		{Type: "pbkdf2", Hash: "sha256", Iterations: 1000},
+		{Type: "argon2id", Time: 1, Memory: 64, CPUs: 1},
+	} {
+		t.Run(kdf.Type, func(t *testing.T) {
+			kdf.Salt = randomBytes(t, 32)
+			masterKey := randomBytes(t, 64)
+			img := createLUKS2(t, masterKey, kdf)
+			testUnlock(t, img, masterKey, "aes", "xts-plain64", 4096)
+
+			// Corrupt the primary header; the secondary header is used.
+			img[binaryHeaderSizeV2] ^= 0xff
+			testUnlock(t, img, masterKey, "aes", "xts-plain64", 4096)
+		})
+	}
+}
+
+// TestSkipKeySlots verifies that key slots which cannot be used do not prevent
+// unlocking with a later key slot.
+func TestSkipKeySlots(t *testing.T) {
+	masterKey := randomBytes(t, 32)
+	t.Run("luks1", func(t *testing.T) {
+		img := createLUKS1(t, masterKey, "aes", "xts-plain64")
+		var v1 headerV1
+		if err := binary.Read(bytes.NewReader(img), binary.BigEndian, &v1); err != nil {
+			t.Fatal(err)
+		}
+		v1.KeySlots[0] = v1.KeySlots[1]
+		v1.KeySlots[0].Stripes = 0
+		var buf bytes.Buffer
+		if err := binary.Write(&buf, binary.BigEndian, &v1); err != nil {
+			t.Fatal(err)
+		}
+		copy(img, buf.Bytes())
+		testUnlock(t, img, masterKey, "aes", "xts-plain64", SectorSize)
+	})
+
+	t.Run("luks2", func(t *testing.T) {
+		img := createLUKS2(t, masterKey, kdfV2{Type: "pbkdf2", Hash: "sha256", Iterations: 1000, Salt: randomBytes(t, 32)})
+		for name, modify := range map[string]func(slot *keySlotV2){
+			"kdf":  func(slot *keySlotV2) { slot.KDF.Type = "scrypt" },
+			"af":   func(slot *keySlotV2) { slot.AF.Type = "luks2" },
+			"area": func(slot *keySlotV2) { slot.Area.Offset = 1 << 40 },
+		} {
+			t.Run(name, func(t *testing.T) {
+				h, err := ReadHeader(bytes.NewReader(img))
+				if err != nil {
+					t.Fatal(err)
+				}
+				md := h.metadata
+				unusable := md.KeySlots["0"]
+				modify(&unusable)
+				md.KeySlots["1"] = md.KeySlots["0"]
+				md.KeySlots["0"] = unusable
+				d := md.Digests["0"]
+				d.KeySlots = []string{"0", "1"}
+				md.Digests["0"] = d
+				if _, err := h.Unlock([]byte("wrong")); !errors.Is(err, ErrInvalidPassphrase) {
+					t.Fatalf("expected %v, got %v", ErrInvalidPassphrase, err)
+				}
+				if _, err := h.Unlock([]byte(testPassphrase)); err != nil {
+					t.Fatal(err)
+				}
+			})
+		}
+	})
+}
+
+func TestKeySlotsByPriority(t *testing.T) {
+	priority := func(p int) *int { return &p }
+	md := &metadataV2{KeySlots: map[string]keySlotV2{
+		"0":  {Type: "luks2"},
+		"1":  {Type: "luks2", Priority: priority(priorityIgnore)},
+		"2":  {Type: "luks2", Priority: priority(priorityHigh)},
+		"3":  {Type: "luks2", Priority: priority(priorityNormal)},
+		"4":  {Type: "reencrypt"},
+		"10": {Type: "luks2", Priority: priority(priorityHigh)},
+	}}
+	d := digestV2{KeySlots: []string{"10", "3", "0", "1", "2", "4", "5"}}
+	want := []string{"2", "10", "0", "3"}
+	if got := md.keySlotsByPriority(d); !slices.Equal(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestCipherXTS(t *testing.T) {
+	key := randomBytes(t, 64)
+	c, err := NewCipher("aes", "xts-plain64", key, SectorSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reference, err := xts.NewCipher(aes.NewCipher, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := randomBytes(t, 8*SectorSize)
+	data := bytes.Clone(plain)
+	if err := c.Encrypt(data, 1000); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(plain)/SectorSize; i++ {
+		expected := make([]byte, SectorSize)
+		reference.Encrypt(expected, plain[i*SectorSize:(i+1)*SectorSize], uint64(1000+i))
+		if !bytes.Equal(data[i*SectorSize:(i+1)*SectorSize], expected) {
+			t.Fatalf("sector %d does not match the reference implementation", i)
+		}
+	}
+	if err := c.Decrypt(data, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, plain) {
+		t.Fatal("decrypted data does not match")
+	}
+}
+
+func TestMalformedHeader(t *testing.T) {
+	masterKey := randomBytes(t, 32)
+	t.Run("luks1", func(t *testing.T) {
+		for name, modify := range map[string]func(h *headerV1){
+			"zero key bytes":         func(h *headerV1) { h.KeyBytes = 0 },
+			"large key bytes":        func(h *headerV1) { h.KeyBytes = 1 << 20 },
+			"zero digest iterations": func(h *headerV1) { h.MKDigestIter = 0 },
+			"zero iterations":        func(h *headerV1) { h.KeySlots[1].Iterations = 0 },
+			"zero stripes":           func(h *headerV1) { h.KeySlots[1].Stripes = 0 },
+			"many stripes":           func(h *headerV1) { h.KeySlots[1].Stripes = 1 << 31 },
+		} {
+			t.Run(name, func(t *testing.T) {
+				img := createLUKS1(t, masterKey, "aes", "xts-plain64")
+				var v1 headerV1
+				if err := binary.Read(bytes.NewReader(img), binary.BigEndian, &v1); err != nil {
+					t.Fatal(err)
+				}
+				modify(&v1)
+				var buf bytes.Buffer
+				if err := binary.Write(&buf, binary.BigEndian, &v1); err != nil {
+					t.Fatal(err)
+				}
+				copy(img, buf.Bytes())
+				h, err := ReadHeader(bytes.NewReader(img))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := h.Unlock([]byte(testPassphrase)); !errors.Is(err, ErrInvalidHeader) {
+					t.Fatalf("expected %v, got %v", ErrInvalidHeader, err)
+				}
+			})
+		}
+	})
+
+	t.Run("luks2", func(t *testing.T) {
+		img := createLUKS2(t, masterKey, kdfV2{Type: "pbkdf2", Hash: "sha256", Iterations: 1000, Salt: randomBytes(t, 32)})
+		argon2 := kdfV2{Type: "argon2id", Time: 4, Memory: 1024, CPUs: 1, Salt: randomBytes(t, 32)}
+		for name, modify := range map[string]func(md *metadataV2){
+			"zero key size": func(md *metadataV2) {
+				slot := md.KeySlots["0"]
+				slot.KeySize = 0
+				md.KeySlots["0"] = slot
+			},
+			"large area key size": func(md *metadataV2) {
+				slot := md.KeySlots["0"]
+				slot.Area.KeySize = 1 << 30
+				md.KeySlots["0"] = slot
+			},
+			"many stripes": func(md *metadataV2) {
+				slot := md.KeySlots["0"]
+				slot.AF.Stripes = 1 << 30
+				md.KeySlots["0"] = slot
+			},
+			"zero iterations": func(md *metadataV2) {
+				slot := md.KeySlots["0"]
+				slot.KDF.Iterations = 0
+				md.KeySlots["0"] = slot
+			},
+			"many iterations": func(md *metadataV2) {
+				slot := md.KeySlots["0"]
+				slot.KDF.Iterations = maxPBKDF2Iterations + 1
+				md.KeySlots["0"] = slot
+			},
+			"zero argon2 time": func(md *metadataV2) {
+				slot := md.KeySlots["0"]
+				slot.KDF = argon2
+				slot.KDF.Time = 0
+				md.KeySlots["0"] = slot
+			},
+			"zero argon2 threads": func(md *metadataV2) {
+				slot := md.KeySlots["0"]
+				slot.KDF = argon2
+				slot.KDF.CPUs = 0
+				md.KeySlots["0"] = slot
+			},
+			"many argon2 threads": func(md *metadataV2) {
+				slot := md.KeySlots["0"]
+				slot.KDF = argon2
+				slot.KDF.CPUs = 255
+				md.KeySlots["0"] = slot
+			},
+			"zero argon2 memory": func(md *metadataV2) {
+				slot := md.KeySlots["0"]
+				slot.KDF = argon2
+				slot.KDF.Memory = 0
+				md.KeySlots["0"] = slot
+			},
+			"large argon2 memory": func(md *metadataV2) {
+				slot := md.KeySlots["0"]
+				slot.KDF = argon2
+				slot.KDF.Memory = maxArgon2Memory + 1
+				md.KeySlots["0"] = slot
+			},
+			"empty digest": func(md *metadataV2) {
+				d := md.Digests["0"]
+				d.Digest = nil
+				md.Digests["0"] = d
+			},
+		} {
+			t.Run(name, func(t *testing.T) {
+				h, err := ReadHeader(bytes.NewReader(img))
+				if err != nil {
+					t.Fatal(err)
+				}
+				modify(h.metadata)
+				if _, err := h.Unlock([]byte(testPassphrase)); !errors.Is(err, ErrInvalidHeader) {
+					t.Fatalf("expected %v, got %v", ErrInvalidHeader, err)
+				}
+			})
+		}
+	})
+}
@@ -0,0 +1,126 @@
+package qcow2reader
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/lima-vm/go-qcow2reader/image"
+)
+
+var (
+	ErrTypeRequired              = errors.New("image type required")
+	ErrAbsoluteBackingFile       = errors.New("absolute backing file name")
+	ErrBackingFileOutsideDir     = errors.New("backing file outside of the allowed directory")
+	ErrBackingFileFormatRequired = image.ErrBackingFileFormatRequired
+)
+
+// OpenOptions is a policy for opening images that may be written by a guest.
+//
+// Probing is unsafe for such images: a guest can write a qcow2 header into a
+// raw image, with a backing file referencing any file of the host.
+type OpenOptions struct {
+	// Type is the type of the image. If empty, the type is probed, unless
+	// RequireType is set.
+	Type image.Type
+	// RequireType refuses to probe the type of the image with
+	// [ErrTypeRequired].
+	RequireType bool
+	// BackingFileDir is the directory containing the files referenced by the
+	// image and its backing images, e.g. backing files, external data files,
+	// extent files and parent images. Other files are refused with
+	// [ErrBackingFileOutsideDir], including files reached by symbolic links
+	// escaping the directory.
+	BackingFileDir string
+	// RefuseAbsoluteBackingFile refuses absolute names of referenced files
+	// with [ErrAbsoluteBackingFile].
+	RefuseAbsoluteBackingFile bool
+	// RequireBackingFileFormat refuses backing files without an explicit
+	// format with [ErrBackingFileFormatRequired], instead of probing their
+	// format.
+	RequireBackingFileFormat bool
+}
+
+// OpenWithOptions opens an image with the policy o.
+//
+// Unlike [Open], violations of the policy by backing files are returned as
+// errors, and the image is closed. Relative backing file names are resolved
+// relative to the image, which must implement Name() (e.g. [os.File]).
+func OpenWithOptions(ra io.ReaderAt, o OpenOptions) (image.Image, error) {
+	if o.Type == "" && o.RequireType {
+		return nil, ErrTypeRequired
+	}
+	op := &opener{
+		fileResolver:             o.fileResolver(),
+		requireBackingFileFormat: o.RequireBackingFileFormat,
+	}
+	img, err := op.openWithType(ra, o.Type, nil)
+	if err != nil {
+		return img, err
+	}
+	if err := img.Readable(); err != nil {
+		for _, policyErr := range []error{ErrAbsoluteBackingFile, ErrBackingFileOutsideDir, ErrBackingFileFormatRequired} {
+			if errors.Is(err, policyErr) {
+				_ = img.Close()
+				return nil, err
+			}
+		}
+	}
+	return img, nil
+}
+
+// fileResolver returns the [image.FileResolver] enforcing the policy, or nil.
+func (o *OpenOptions) fileResolver() image.FileResolver {
+	if o.BackingFileDir == "" && !o.RefuseAbsoluteBackingFile {
+		return nil
+	}
+	return func(base, name string) (io.ReaderAt, string, error) {
+		if o.RefuseAbsoluteBackingFile && filepath.IsAbs(name) {
+			return nil, "", fmt.Errorf("%w: %w: %q", ErrAbsoluteBackingFile, image.ErrUnsafeFileName, name)
+		}
+		if o.BackingFileDir == "" {
+			return image.OSFileResolver(base, name)
+		}
+		return openInDir(o.BackingFileDir, base, name)
+	}
+}
+
+// openInDir opens name, relative to the directory of base, if it is in dir.
+func openInDir(dir, base, name string) (io.ReaderAt, string, error) {
+	resolved := name
+	if !filepath.IsAbs(name) {
+		if base == "" {
+			return nil, "", errors.New("the image name is unknown")
+		}
+		resolved = filepath.Join(filepath.Dir(base), name)
+	}
+	resolved, err := filepath.Abs(resolved)
+	if err != nil {
+		return nil, "", err
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	rel, err := filepath.Rel(dir, resolved)
+	if err != nil || !filepath.IsLocal(rel) {
+		return nil, "", fmt.Errorf("%w: %w: %q", ErrBackingFileOutsideDir, image.ErrUnsafeFileName, name)
+	}
+	// os.Root refuses symbolic links escaping dir.
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	defer root.Close()
+	f, err := root.Open(rel)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+			return nil, "", err
+		}
+		return nil, "", fmt.Errorf("%w: %w: %w", ErrBackingFileOutsideDir, image.ErrUnsafeFileName, err)
+	}
+	return f, resolved, nil
+}
@@ -0,0 +1,188 @@
+package qcow2reader_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/lima-vm/go-qcow2reader"
+	"github.com/lima-vm/go-qcow2reader/image"
+	"github.com/lima-vm/go-qcow2reader/image/qcow2"
+	"github.com/lima-vm/go-qcow2reader/image/qed"
+	"github.com/lima-vm/go-qcow2reader/image/raw"
+	"github.com/lima-vm/go-qcow2reader/image/vmdk"
+)
+
+// createQcow2 creates a qcow2 image of 1 MiB at path.
+func createQcow2(t *testing.T, path, backingFile string, backingFileFormat image.Type) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close() //nolint:errcheck
+	opts := qcow2.CreateOptions{Size: 1 << 20, BackingFile: backingFile, BackingFileFormat: backingFileFormat}
+	if err := qcow2.Create(f, opts); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// createQcow2DataFile creates a qcow2 image of 1 MiB at path, with an external
+// data file.
+func createQcow2DataFile(t *testing.T, path, dataFile string) {
+	createQcow2(t, path, "", "")
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close() //nolint:errcheck
+	var h struct {
+		qcow2.HeaderFieldsV2
+		qcow2.HeaderFieldsV3
+	}
+	if err := binary.Read(f, binary.BigEndian, &h); err != nil {
+		t.Fatal(err)
+	}
+	h.IncompatibleFeatures |= 1 << qcow2.IncompatibleFeaturesExternalDataFileBit
+	ext := binary.BigEndian.AppendUint32(nil, uint32(qcow2.HeaderExtensionTypeExternalDataFileNameString))
+	ext = binary.BigEndian.AppendUint32(ext, uint32(len(dataFile)))
+	ext = append(ext, dataFile...)
+	ext = append(ext, make([]byte, (8-len(dataFile)%8)%8+8)...) // padding and end of extensions
+	if _, err := f.WriteAt(ext, int64(h.HeaderLength)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := binary.Write(f, binary.BigEndian, &h); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// createVmdk creates a VMDK descriptor file of 1 MiB at path, with a flat
+// extent.
+func createVmdk(t *testing.T, path, extent string) {
+	descriptor := vmdk.DescriptorMagic + "\nversion=1\nCID=fffffffe\nparentCID=ffffffff\ncreateType=\"monolithicFlat\"\n\n" +
+		"# Extent description\nRW 2048 FLAT " + strconv.Quote(extent) + " 0\n"
+	if err := os.WriteFile(path, []byte(descriptor), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func openWithOptions(t *testing.T, path string, o qcow2reader.OpenOptions) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := qcow2reader.OpenWithOptions(f, o)
+	if img == nil {
+		_ = f.Close()
+	} else {
+		t.Cleanup(func() { _ = img.Close() })
+	}
+	return img, err
+}
+
+func TestOpenWithOptions(t *testing.T) {
+	dir := t.TempDir()
+	images := filepath.Join(dir, "images")
+	if err := os.Mkdir(images, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{filepath.Join(dir, "secret.raw"), filepath.Join(images, "base.raw")} {
+		if err := os.WriteFile(path, make([]byte, 1<<20), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("../secret.raw", filepath.Join(images, "link.raw")); err != nil {
+		t.Fatal(err)
+	}
+	createQcow2(t, filepath.Join(images, "ok.qcow2"), "base.raw", raw.Type)
+	createQcow2(t, filepath.Join(images, "absolute.qcow2"), filepath.Join(images, "base.raw"), raw.Type)
+	createQcow2(t, filepath.Join(images, "outside.qcow2"), "../secret.raw", raw.Type)
+	createQcow2(t, filepath.Join(images, "link.qcow2"), "link.raw", raw.Type)
+	createQcow2(t, filepath.Join(images, "probe.qcow2"), "base.raw", "")
+	// A guest disk with a qcow2 header.
+	createQcow2(t, filepath.Join(images, "guest.raw"), "../secret.raw", raw.Type)
+	createQcow2DataFile(t, filepath.Join(images, "data.qcow2"), "base.raw")
+	createQcow2DataFile(t, filepath.Join(images, "absolute-data.qcow2"), filepath.Join(images, "base.raw"))
+	createQcow2DataFile(t, filepath.Join(images, "outside-data.qcow2"), "../secret.raw")
+	createQed(t, filepath.Join(images, "ok.qed"), "base.raw", raw.Type)
+	createQed(t, filepath.Join(images, "absolute.qed"), filepath.Join(images, "base.raw"), raw.Type)
+	createQed(t, filepath.Join(images, "outside.qed"), "../secret.raw", raw.Type)
+	createQed(t, filepath.Join(images, "probe.qed"), "base.raw", "")
+	createVmdk(t, filepath.Join(images, "ok.vmdk"), "base.raw")
+	createVmdk(t, filepath.Join(images, "absolute.vmdk"), filepath.Join(images, "base.raw"))
+	createVmdk(t, filepath.Join(images, "outside.vmdk"), "../secret.raw")
+	// Policy violations below backing files of other formats.
+	createQcow2(t, filepath.Join(images, "outside-qed.qcow2"), "outside.qed", qed.Type)
+	createQcow2(t, filepath.Join(images, "outside-vmdk.qcow2"), "outside.vmdk", vmdk.Type)
+
+	policy := qcow2reader.OpenOptions{
+		RequireType:               true,
+		BackingFileDir:            images,
+		RefuseAbsoluteBackingFile: true,
+		RequireBackingFileFormat:  true,
+	}
+	cases := []struct {
+		name string
+		typ  image.Type
+		err  error
+	}{
+		{name: "ok.qcow2", typ: qcow2.Type},
+		{name: "guest.raw", typ: raw.Type},
+		{name: "guest.raw", err: qcow2reader.ErrTypeRequired},
+		{name: "absolute.qcow2", typ: qcow2.Type, err: qcow2reader.ErrAbsoluteBackingFile},
+		{name: "outside.qcow2", typ: qcow2.Type, err: qcow2reader.ErrBackingFileOutsideDir},
+		{name: "link.qcow2", typ: qcow2.Type, err: qcow2reader.ErrBackingFileOutsideDir},
+		{name: "probe.qcow2", typ: qcow2.Type, err: qcow2reader.ErrBackingFileFormatRequired},
+		{name: "data.qcow2", typ: qcow2.Type},
+		{name: "absolute-data.qcow2", typ: qcow2.Type, err: qcow2reader.ErrAbsoluteBackingFile},
+		{name: "outside-data.qcow2", typ: qcow2.Type, err: qcow2reader.ErrBackingFileOutsideDir},
+		{name: "ok.qed", typ: qed.Type},
+		{name: "absolute.qed", typ: qed.Type, err: qcow2reader.ErrAbsoluteBackingFile},
+		{name: "outside.qed", typ: qed.Type, err: qcow2reader.ErrBackingFileOutsideDir},
+		{name: "probe.qed", typ: qed.Type, err: qcow2reader.ErrBackingFileFormatRequired},
+		{name: "ok.vmdk", typ: vmdk.Type},
+		{name: "absolute.vmdk", typ: vmdk.Type, err: qcow2reader.ErrAbsoluteBackingFile},
+		{name: "outside.vmdk", typ: vmdk.Type, err: qcow2reader.ErrBackingFileOutsideDir},
+		{name: "outside-qed.qcow2", typ: qcow2.Type, err: qcow2reader.ErrBackingFileOutsideDir},
+		{name: "outside-vmdk.qcow2", typ: qcow2.Type, err: qcow2reader.ErrBackingFileOutsideDir},
+	}
+	for _, tc := range cases {
+		o := policy
+		o.Type = tc.typ
+		img, err := openWithOptions(t, filepath.Join(images, tc.name), o)
+		if tc.err != nil {
+			if !errors.Is(err, tc.err) || img != nil {
+				t.Fatalf("%s (%q): expected %v, got %v", tc.name, tc.typ, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s (%q): %v", tc.name, tc.typ, err)
+		}
+		if err := img.Readable(); err != nil {
+			t.Fatalf("%s (%q): %v", tc.name, tc.typ, err)
+		}
+		if img.Type() != tc.typ {
+			t.Fatalf("%s: expected type %q, got %q", tc.name, tc.typ, img.Type())
+		}
+	}
+
+	// Without a policy, the backing files are opened.
+	for _, name := range []string{
+		"absolute.qcow2", "outside.qcow2", "link.qcow2", "probe.qcow2", "absolute-data.qcow2", "outside-data.qcow2",
+		"absolute.qed", "outside.qed", "probe.qed", "absolute.vmdk", "outside.vmdk", "outside-qed.qcow2", "outside-vmdk.qcow2",
+	} {
+		img, err := openWithOptions(t, filepath.Join(images, name), qcow2reader.OpenOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := img.Readable(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+}
@@ -1,14 +1,19 @@
 package qcow2reader
 
 import (
+	"cmp"
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"slices"
+	"sync"
 
 	"github.com/lima-vm/go-qcow2reader/image"
 	"github.com/lima-vm/go-qcow2reader/image/asif"
 	"github.com/lima-vm/go-qcow2reader/image/parallels"
 	"github.com/lima-vm/go-qcow2reader/image/qcow2"
+	"github.com/lima-vm/go-qcow2reader/image/qed"
 	"github.com/lima-vm/go-qcow2reader/image/raw"
 	"github.com/lima-vm/go-qcow2reader/image/vdi"
 	"github.com/lima-vm/go-qcow2reader/image/vhdx"
@@ -16,9 +21,15 @@ import (
 	"github.com/lima-vm/go-qcow2reader/image/vpc"
 )
 
-// Types is the known image types.
+var (
+	ErrUnknownType  = errors.New("unknown type")
+	ErrDisabledType = errors.New("disabled type")
+)
+
+// Types is the built-in image types, registered by default in this order.
 var Types = []image.Type{
 	qcow2.Type,
+	qed.Type,
 	vmdk.Type,
 	vhdx.Type,
 	vdi.Type,
@@ -28,43 +39,269 @@ var Types = []image.Type{
 	raw.Type, // raw must be the last type
 }
 
-// Open opens an image.
+// Format is an image format known to [Open] and [OpenWithType].
+type Format struct {
+	Type image.Type
+	// Probe returns true if ra may be an image of this format. If Probe is
+	// nil, the format is probed with Open, which must return an error
+	// wrapping [image.ErrWrongType] for images of other formats.
+	Probe func(ra io.ReaderAt) bool
+	// Open opens an image of this format.
+	Open func(ra io.ReaderAt, o FormatOptions) (image.Image, error)
+	// Priority orders probing: formats with a higher priority are probed
+	// first, and formats with the same priority in registration order. The
+	// built-in formats have priority 0, except raw, probed last with priority
+	// [math.MinInt] as it matches any image.
+	Priority int
+}
+
+// FormatOptions are the options passed to [Format.Open]. Formats referencing
+// other files, e.g. backing files, must use them.
+type FormatOptions struct {
+	// OpenWithType opens backing files of any registered format, with the same
+	// options.
+	OpenWithType image.OpenWithType
+	// Name is the name of the image, used as base to resolve other files. It
+	// is set if ra implements Name().
+	Name string
+	// FileResolver opens files referenced by the image. If nil, the format
+	// opens files with [image.OSFileResolver].
+	FileResolver image.FileResolver
+	// RequireBackingFileFormat refuses backing files without an explicit
+	// format with [image.ErrBackingFileFormatRequired].
+	RequireBackingFileFormat bool
+	// BackingChain is the resolved names of the images above the image, from
+	// the top image, if the image is a backing file. Names are empty if
+	// unknown.
+	BackingChain []string
+	// OpenBackingFile is like OpenWithType, for formats opening backing files
+	// of their own format internally: it is passed the names of the images
+	// above the backing file, to limit the depth of the backing chain and
+	// detect loops across formats.
+	OpenBackingFile image.OpenBackingFile
+}
+
+var (
+	formatsMu sync.RWMutex
+	// formats is sorted by decreasing priority.
+	formats  []Format
+	disabled = map[image.Type]bool{}
+)
+
+func init() {
+	builtins := []Format{
+		{Type: qcow2.Type, Open: func(ra io.ReaderAt, o FormatOptions) (image.Image, error) {
+			opts := []qcow2.Option{
+				qcow2.WithName(o.Name),
+				qcow2.WithBackingChain(o.BackingChain),
+				qcow2.WithBackingFileOpener(o.OpenBackingFile),
+			}
+			if o.FileResolver != nil {
+				opts = append(opts, qcow2.WithBackingFileResolver(o.FileResolver))
+			}
+			if o.RequireBackingFileFormat {
+				opts = append(opts, qcow2.WithBackingFileFormatRequired())
+			}
+			return qcow2.Open(ra, o.OpenWithType, opts...)
+		}},
+		{Type: qed.Type, Open: func(ra io.ReaderAt, o FormatOptions) (image.Image, error) {
+			opts := []qed.Option{
+				qed.WithName(o.Name),
+				qed.WithBackingChain(o.BackingChain),
+				qed.WithBackingFileOpener(o.OpenBackingFile),
+			}
+			if o.FileResolver != nil {
+				opts = append(opts, qed.WithBackingFileResolver(o.FileResolver))
+			}
+			if o.RequireBackingFileFormat {
+				opts = append(opts, qed.WithBackingFileFormatRequired())
+			}
+			return qed.Open(ra, o.OpenWithType, opts...)
+		}},
+		{Type: vmdk.Type, Open: func(ra io.ReaderAt, o FormatOptions) (image.Image, error) {
+			opts := []vmdk.Option{vmdk.WithName(o.Name)}
+			if o.FileResolver != nil {
+				opts = append(opts, vmdk.WithFileResolver(o.FileResolver))
+			}
+			return vmdk.Open(ra, opts...)
+		}},
+		{Type: vhdx.Type, Open: func(ra io.ReaderAt, o FormatOptions) (image.Image, error) {
+			opts := []vhdx.Option{vhdx.WithName(o.Name)}
+			if o.FileResolver != nil {
+				opts = append(opts, vhdx.WithFileResolver(o.FileResolver))
+			}
+			return vhdx.Open(ra, opts...)
+		}},
+		{Type: vdi.Type, Open: func(ra io.ReaderAt, _ FormatOptions) (image.Image, error) {
+			return vdi.Open(ra)
+		}},
+		{Type: parallels.Type, Open: func(ra io.ReaderAt, o FormatOptions) (image.Image, error) {
+			opts := []parallels.Option{parallels.WithName(o.Name)}
+			if o.FileResolver != nil {
+				opts = append(opts, parallels.WithFileResolver(o.FileResolver))
+			}
+			return parallels.Open(ra, opts...)
+		}},
+		{Type: vpc.Type, Open: func(ra io.ReaderAt, o FormatOptions) (image.Image, error) {
+			opts := []vpc.Option{vpc.WithName(o.Name)}
+			if o.FileResolver != nil {
+				opts = append(opts, vpc.WithFileResolver(o.FileResolver))
+			}
+			return vpc.Open(ra, opts...)
+		}},
+		{Type: asif.Type, Open: func(ra io.ReaderAt, _ FormatOptions) (image.Image, error) {
+			return asif.Open(ra)
+		}},
+		{Type: raw.Type, Priority: math.MinInt, Open: func(ra io.ReaderAt, _ FormatOptions) (image.Image, error) {
+			return raw.Open(ra)
+		}},
+	}
+	for _, f := range builtins {
+		if err := Register(f); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Register registers an image format. Returns an error if the type is already
+// registered.
+func Register(f Format) error {
+	if f.Type == "" || f.Open == nil {
+		return errors.New("the format must have a type and an opener")
+	}
+	formatsMu.Lock()
+	defer formatsMu.Unlock()
+	if slices.ContainsFunc(formats, func(g Format) bool { return g.Type == f.Type }) {
+		return fmt.Errorf("type %q is already registered", f.Type)
+	}
+	formats = append(formats, f)
+	slices.SortStableFunc(formats, func(a, b Format) int {
+		return cmp.Compare(b.Priority, a.Priority)
+	})
+	return nil
+}
+
+// Disable disables the specified types. Disabled types are not probed by
+// [Open], and [OpenWithType] fails with [ErrDisabledType]. For example,
+// disabling raw refuses images of unknown formats, instead of reading them as
+// raw images.
+func Disable(types ...image.Type) {
+	formatsMu.Lock()
+	defer formatsMu.Unlock()
+	for _, t := range types {
+		disabled[t] = true
+	}
+}
+
+// Enable enables the specified types, disabled with [Disable].
+func Enable(types ...image.Type) {
+	formatsMu.Lock()
+	defer formatsMu.Unlock()
+	for _, t := range types {
+		delete(disabled, t)
+	}
+}
+
+// Formats returns the enabled formats, in probing order.
+func Formats() []Format {
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+	var res []Format
+	for _, f := range formats {
+		if !disabled[f.Type] {
+			res = append(res, f)
+		}
+	}
+	return res
+}
+
+// Open opens an image, probing the enabled formats. Images not matching any
+// other format are opened as raw images, unless raw is disabled.
+//
+// Open must not be used for images that may be written by a guest, see
+// [OpenWithOptions].
 func Open(ra io.ReaderAt) (image.Image, error) {
-	for _, t := range Types {
-		img, err := OpenWithType(ra, t)
+	return (&opener{}).open(ra, nil)
+}
+
+// OpenWithType open opens an image with the specified [image.Type]. The image
+// is probed with [Open] if the type is empty.
+func OpenWithType(ra io.ReaderAt, t image.Type) (image.Image, error) {
+	return (&opener{}).openWithType(ra, t, nil)
+}
+
+// opener opens images and their backing files with the same options.
+type opener struct {
+	fileResolver             image.FileResolver
+	requireBackingFileFormat bool
+}
+
+// formatOptions returns the options for the image ra, with the names of the
+// images above it in chain.
+func (op *opener) formatOptions(ra io.ReaderAt, chain []string) FormatOptions {
+	o := FormatOptions{
+		FileResolver:             op.fileResolver,
+		RequireBackingFileFormat: op.requireBackingFileFormat,
+		BackingChain:             chain,
+		OpenBackingFile:          op.openBackingFile,
+	}
+	if namer, ok := ra.(interface{ Name() string }); ok {
+		o.Name = namer.Name()
+	}
+	backingChain := append(slices.Clip(chain), o.Name)
+	o.OpenWithType = func(ra io.ReaderAt, t image.Type) (image.Image, error) {
+		return op.openBackingFile(ra, t, backingChain)
+	}
+	return o
+}
+
+// openBackingFile opens a backing file, below the images named in chain.
+func (op *opener) openBackingFile(ra io.ReaderAt, t image.Type, chain []string) (image.Image, error) {
+	if len(chain) > image.DefaultMaxBackingChainDepth {
+		return nil, fmt.Errorf("%w (more than %d images)", image.ErrBackingChainTooDeep, image.DefaultMaxBackingChainDepth)
+	}
+	if namer, ok := ra.(interface{ Name() string }); ok {
+		if name := namer.Name(); name != "" && slices.Contains(chain, name) {
+			return nil, fmt.Errorf("%w (file %q)", image.ErrBackingChainLoop, name)
+		}
+	}
+	return op.openWithType(ra, t, chain)
+}
+
+func (op *opener) open(ra io.ReaderAt, chain []string) (image.Image, error) {
+	for _, f := range Formats() {
+		if f.Probe != nil && !f.Probe(ra) {
+			continue
+		}
+		img, err := f.Open(ra, op.formatOptions(ra, chain))
 		if err == nil {
 			return img, nil
 		}
 		if !errors.Is(err, image.ErrWrongType) {
-			err = fmt.Errorf("failed to open the image as %q: %w", t, err)
+			err = fmt.Errorf("failed to open the image as %q: %w", f.Type, err)
 			return img, err
 		}
 	}
-	return OpenWithType(ra, raw.Type)
+	return nil, fmt.Errorf("%w: no enabled format matches the image", ErrUnknownType)
 }
 
-// OpenWithType open opens an image with the specified [image.Type].
-func OpenWithType(ra io.ReaderAt, t image.Type) (image.Image, error) {
-	switch t {
-	case "":
-		return Open(ra)
-	case qcow2.Type:
-		return qcow2.Open(ra, OpenWithType)
-	case vmdk.Type:
-		return vmdk.Open(ra)
-	case vhdx.Type:
-		return vhdx.Open(ra)
-	case vdi.Type:
-		return vdi.Open(ra)
-	case parallels.Type:
-		return parallels.Open(ra)
-	case vpc.Type:
-		return vpc.Open(ra)
-	case asif.Type:
-		return asif.Open(ra)
-	case raw.Type:
-		return raw.Open(ra)
-	default:
-		return nil, fmt.Errorf("unknown type: %q", t)
+func (op *opener) openWithType(ra io.ReaderAt, t image.Type, chain []string) (image.Image, error) {
+	if t == "" {
+		return op.open(ra, chain)
+	}
+	formatsMu.RLock()
+	i := slices.IndexFunc(formats, func(f Format) bool { return f.Type == t })
+	var f Format
+	if i >= 0 {
+		f = formats[i]
+	}
+	isDisabled := disabled[t]
+	formatsMu.RUnlock()
+	switch {
+	case i < 0:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownType, t)
+	case isDisabled:
+		return nil, fmt.Errorf("%w: %q", ErrDisabledType, t)
 	}
+	return f.Open(ra, op.formatOptions(ra, chain))
 }
@@ -2,17 +2,21 @@
 package qcow2reader_test
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"runtime"
 	"slices"
 	"testing"
 
 	"github.com/lima-vm/go-qcow2reader"
 	"github.com/lima-vm/go-qcow2reader/convert"
 	"github.com/lima-vm/go-qcow2reader/image"
+	"github.com/lima-vm/go-qcow2reader/image/qcow2"
 	"github.com/lima-vm/go-qcow2reader/test/qemuimg"
 	"github.com/lima-vm/go-qcow2reader/test/qemuio"
 )
@@ -146,6 +150,10 @@ func TestExtentsRaw(t *testing.T) {
 	if err := f.Truncate(size); err != nil {
 		t.Fatal(err)
 	}
+	// A hole, 1 MiB of data at 1 GiB, and a hole to the end of the image.
+	if _, err := f.WriteAt(bytes.Repeat([]byte{'x'}, int(MiB)), GiB); err != nil {
+		t.Fatal(err)
+	}
 	img, err := qcow2reader.Open(f)
 	if err != nil {
 		t.Fatal(err)
@@ -153,12 +161,38 @@ func TestExtentsRaw(t *testing.T) {
 	defer img.Close() //nolint:errcheck
 
 	t.Run("entire image", func(t *testing.T) {
-		actual, err := img.Extent(0, img.Size())
+		var actual []image.Extent
+		for start := int64(0); start < img.Size(); {
+			extent, err := img.Extent(start, img.Size()-start)
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual = append(actual, extent)
+			start += extent.Length
+		}
+		// Holes are detected with SEEK_DATA and SEEK_HOLE on Linux. Other
+		// systems report raw images as fully allocated.
+		expected := []image.Extent{{Start: 0, Length: size, Allocated: true}}
+		if runtime.GOOS == "linux" {
+			expected = []image.Extent{
+				{Start: 0, Length: GiB, Zero: true},
+				{Start: GiB, Length: MiB, Allocated: true},
+				{Start: GiB + MiB, Length: size - GiB - MiB, Zero: true},
+			}
+		}
+		if !slices.Equal(actual, expected) {
+			t.Fatalf("expected %+v, got %+v", expected, actual)
+		}
+	})
+	t.Run("limited length", func(t *testing.T) {
+		actual, err := img.Extent(GiB-MiB, 4*MiB)
 		if err != nil {
 			t.Fatal(err)
 		}
-		// Currently we always report raw images as fully allocated.
-		expected := image.Extent{Start: 0, Length: img.Size(), Allocated: true}
+		expected := image.Extent{Start: GiB - MiB, Length: 4 * MiB, Allocated: true}
+		if runtime.GOOS == "linux" {
+			expected = image.Extent{Start: GiB - MiB, Length: MiB, Zero: true}
+		}
 		if actual != expected {
 			t.Fatalf("expected %+v, got %+v", expected, actual)
 		}
@@ -534,6 +568,278 @@ func TestExtentsBackingFileShortUnaligned(t *testing.T) {
 	}
 }
 
+func TestEncryptedLUKS(t *testing.T) {
+	const (
+		size       = 16 * MiB
+		passphrase = "secret"
+	)
+	tmpDir := t.TempDir()
+	base := filepath.Join(tmpDir, "base.raw")
+	if err := createTestImage(base, size, 0.5); err != nil {
+		t.Fatal(err)
+	}
+	encrypted := filepath.Join(tmpDir, "encrypted.qcow2")
+	if err := qemuimg.ConvertEncrypted(base, encrypted, "luks", passphrase); err != nil {
+		t.Fatal(err)
+	}
+	expected, err := os.ReadFile(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close() //nolint:errcheck
+
+	t.Run("no key", func(t *testing.T) {
+		img, err := qcow2.Open(f, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := img.Readable(); !errors.Is(err, qcow2.ErrKeyRequired) {
+			t.Fatalf("expected %v, got %v", qcow2.ErrKeyRequired, err)
+		}
+	})
+	t.Run("wrong key", func(t *testing.T) {
+		img, err := qcow2.Open(f, nil, qcow2.WithKeyProvider(qcow2.Passphrase([]byte("wrong"))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := img.Readable(); err == nil {
+			t.Fatal("image with wrong key is readable")
+		}
+	})
+	t.Run("read", func(t *testing.T) {
+		img, err := qcow2.Open(f, nil, qcow2.WithKeyProvider(qcow2.Passphrase([]byte(passphrase))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := img.Readable(); err != nil {
+			t.Fatal(err)
+		}
+		actual := make([]byte, size)
+		if _, err := img.ReadAt(actual, 0); err != nil && !errors.Is(err, io.EOF) {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(expected, actual) {
+			t.Fatal("decrypted data does not match")
+		}
+		// Unaligned read crossing sector and cluster boundaries.
+		off := clusterSize - 1000
+		unaligned := make([]byte, 3000)
+		if _, err := img.ReadAt(unaligned, off); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(expected[off:off+3000], unaligned) {
+			t.Fatal("decrypted unaligned data does not match")
+		}
+	})
+}
+
+// TestCreate verifies that images created by qcow2.Create are accepted by
+// qemu-img.
+func TestCreate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts qcow2.CreateOptions
+	}{
+		{"default", qcow2.CreateOptions{Size: uint64(4 * GiB)}},
+		{"v2", qcow2.CreateOptions{Size: uint64(4 * GiB), Version: 2}},
+		{"refcount bits 1", qcow2.CreateOptions{Size: uint64(4 * GiB), RefcountBits: 1}},
+		{"extended L2", qcow2.CreateOptions{Size: uint64(4 * GiB), ExtendedL2: true, ClusterSize: 128 * 1024}},
+		{"zstd", qcow2.CreateOptions{Size: uint64(4 * GiB), CompressionType: qcow2.CompressionTypeZstd}},
+		{"metadata", qcow2.CreateOptions{Size: uint64(1 * GiB), ClusterSize: 4096, Preallocation: qcow2.PreallocationMetadata}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "image")
+			f, err := os.Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close() //nolint:errcheck
+			if err := qcow2.Create(f, tc.opts); err != nil {
+				t.Fatal(err)
+			}
+			if err := qemuimg.Check(path); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+	t.Run("backing file", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := qemuimg.Create(filepath.Join(dir, "base.qcow2"), qemuimg.FormatQcow2, 1*GiB, "", ""); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, "overlay.qcow2")
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close() //nolint:errcheck
+		opts := qcow2.CreateOptions{Size: uint64(1 * GiB), BackingFile: "base.qcow2", BackingFileFormat: "qcow2"}
+		if err := qcow2.Create(f, opts); err != nil {
+			t.Fatal(err)
+		}
+		if err := qemuimg.Check(path); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// TestConvertQcow2 converts a raw image to a qcow2 image with and without
+// compression. Compressed images are compared in size with qemu-img.
+func TestConvertQcow2(t *testing.T) {
+	const size = 32 * MiB
+	dir := t.TempDir()
+	source := filepath.Join(dir, "source.raw")
+	if err := createTestImage(source, size, 0.5); err != nil {
+		t.Fatal(err)
+	}
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compress=%v", compress), func(t *testing.T) {
+			f, err := os.Open(source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close() //nolint:errcheck
+			img, err := qcow2reader.Open(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer img.Close() //nolint:errcheck
+
+			target := filepath.Join(t.TempDir(), "target.qcow2")
+			dst, err := os.Create(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dst.Close() //nolint:errcheck
+			if err := qcow2.Create(dst, qcow2.CreateOptions{Size: uint64(img.Size())}); err != nil {
+				t.Fatal(err)
+			}
+			w, err := qcow2.OpenWritable(dst, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts := convert.Options{Compress: compress, SegmentSize: 4 * MiB}
+			if err := convert.Convert(w, img, opts); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			extents, err := listExtents(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var allocated int64
+			for _, extent := range extents {
+				if extent.Allocated {
+					allocated += extent.Length
+					if extent.Compressed != compress {
+						t.Errorf("unexpected extent %+v", extent)
+					}
+				}
+			}
+			// Half of the image is zeros.
+			if allocated != size/2 {
+				t.Errorf("expected a sparse image, allocated %d bytes", allocated)
+			}
+			if err := qemuimg.Check(target); err != nil {
+				t.Fatal(err)
+			}
+			if err := qemuimg.Compare(source, target); err != nil {
+				t.Fatal(err)
+			}
+			if compress {
+				// Compare the compression ratio with qemu.
+				expected := filepath.Join(t.TempDir(), "expected.qcow2")
+				if err := qemuimg.Convert(source, expected, qemuimg.FormatQcow2, qemuimg.CompressionZlib); err != nil {
+					t.Fatal(err)
+				}
+				targetInfo, err := os.Stat(target)
+				if err != nil {
+					t.Fatal(err)
+				}
+				expectedInfo, err := os.Stat(expected)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if targetInfo.Size() > expectedInfo.Size()*11/10 {
+					t.Errorf("compressed image of %d bytes is more than 10%% larger than qemu-img (%d bytes)", targetInfo.Size(), expectedInfo.Size())
+				}
+			}
+		})
+	}
+}
+
+// TestConvertQcow2Unaligned converts an image whose size is not a multiple of
+// 512 bytes to a compressed qcow2 image rounded up to 512 bytes, like
+// qemu-img.
+func TestConvertQcow2Unaligned(t *testing.T) {
+	dir := t.TempDir()
+	data := make([]byte, 1000)
+	if _, err := rand.New(rand.NewSource(1)).Read(data); err != nil {
+		t.Fatal(err)
+	}
+	source := filepath.Join(dir, "source.raw")
+	if err := os.WriteFile(source, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close() //nolint:errcheck
+	img, err := qcow2reader.Open(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close() //nolint:errcheck
+
+	target := filepath.Join(dir, "target.qcow2")
+	dst, err := os.Create(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close() //nolint:errcheck
+	if err := qcow2.Create(dst, qcow2.CreateOptions{Size: (uint64(img.Size()) + 511) &^ 511}); err != nil {
+		t.Fatal(err)
+	}
+	w, err := qcow2.OpenWritable(dst, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := convert.Convert(w, img, convert.Options{Compress: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := os.Open(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close() //nolint:errcheck
+	converted, err := qcow2reader.Open(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer converted.Close() //nolint:errcheck
+	want := make([]byte, 1024)
+	copy(want, data)
+	got, err := io.ReadAll(io.NewSectionReader(converted, 0, converted.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("unexpected data")
+	}
+}
+
 func compressed(extents []image.Extent) []image.Extent {
 	var res []image.Extent
 	for _, extent := range extents {
@@ -0,0 +1,130 @@
+package imagetest
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lima-vm/go-qcow2reader/image"
+	"github.com/lima-vm/go-qcow2reader/test/qemuimg"
+)
+
+// ReadExtents returns the extents of img, checking that they cover the image
+// without gaps.
+func ReadExtents(t testing.TB, img image.Image) []image.Extent {
+	t.Helper()
+	var res []image.Extent
+	for start := int64(0); start < img.Size(); {
+		e, err := img.Extent(start, img.Size()-start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Start != start || e.Length <= 0 {
+			t.Fatalf("unexpected extent %+v at %d", e, start)
+		}
+		res = append(res, e)
+		start += e.Length
+	}
+	return res
+}
+
+// ReadAll returns the data of img.
+func ReadAll(t testing.TB, img image.Image) []byte {
+	t.Helper()
+	b, err := io.ReadAll(io.NewSectionReader(img, 0, img.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// CheckUnreadable checks that img is not readable, and that reading img fails,
+// with an error matching target.
+func CheckUnreadable(t testing.TB, img image.Image, target error) {
+	t.Helper()
+	if err := img.Readable(); !errors.Is(err, target) {
+		t.Fatalf("expected %v, got %v", target, err)
+	}
+	if _, err := img.ReadAt(make([]byte, 512), 0); !errors.Is(err, target) {
+		t.Fatalf("expected %v when reading, got %v", target, err)
+	}
+}
+
+// ConvertQemuImg creates a raw image of size bytes with data, partial data,
+// zeros and holes in each MiB, converts it to format with qemu-img and the
+// creation options (e.g. "subformat=fixed"), and returns the path of the
+// converted image.
+func ConvertQemuImg(t testing.TB, format qemuimg.Format, size int64, options string) string {
+	t.Helper()
+	dir := t.TempDir()
+	src := filepath.Join(dir, "source.raw")
+	f, err := os.Create(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close() //nolint:errcheck
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	r := rand.New(rand.NewSource(size))
+	for off := int64(0); off < size; off += 1 << 20 {
+		var b []byte
+		switch off >> 20 % 4 {
+		case 0:
+			b = make([]byte, 1<<20)
+			_, _ = r.Read(b)
+		case 1:
+			// A hole.
+		case 2:
+			b = bytes.Repeat([]byte{byte(off >> 20)}, 1<<19)
+		case 3:
+			b = make([]byte, 1<<20)
+		}
+		if _, err := f.WriteAt(b[:min(int64(len(b)), size-off)], off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dst := filepath.Join(dir, "image."+string(format))
+	if err := qemuimg.ConvertWithOptions(src, dst, format, options); err != nil {
+		t.Fatal(err)
+	}
+	return dst
+}
+
+// CompareQemuImg checks that img reads the same data as qemu-img reads from the
+// image at path, and that zero extents of img are read as zeros.
+func CompareQemuImg(t testing.TB, img image.Image, path string) {
+	t.Helper()
+	if err := img.Readable(); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(t.TempDir(), "qemu-img.raw")
+	if err := qemuimg.Convert(path, dst, qemuimg.FormatRaw, qemuimg.CompressionNone); err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := ReadAll(t, img)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("unexpected data (size %d, qemu-img size %d)", len(got), len(want))
+	}
+	zero := make([]byte, 1<<20)
+	for _, e := range ReadExtents(t, img) {
+		if !e.Zero {
+			continue
+		}
+		for b := got[e.Start:][:e.Length]; len(b) > 0; {
+			n := min(len(b), len(zero))
+			if !bytes.Equal(b[:n], zero[:n]) {
+				t.Fatalf("unexpected data in zero extent %+v", e)
+			}
+			b = b[n:]
+		}
+	}
+}
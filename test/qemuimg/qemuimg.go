@@ -17,8 +17,14 @@ const (
 	CompressionZstd = CompressionType("zstd")
 
 	// Image formats.
-	FormatQcow2 = Format("qcow2")
-	FormatRaw   = Format("raw")
+	FormatQcow2     = Format("qcow2")
+	FormatRaw       = Format("raw")
+	FormatParallels = Format("parallels")
+	FormatQed       = Format("qed")
+	FormatVdi       = Format("vdi")
+	FormatVhdx      = Format("vhdx")
+	FormatVmdk      = Format("vmdk")
+	FormatVpc       = Format("vpc")
 )
 
 func Convert(src, dst string, dstFormat Format, compressionType CompressionType) error {
@@ -31,6 +37,44 @@ func Convert(src, dst string, dstFormat Format, compressionType CompressionType)
 	return err
 }
 
+// ConvertWithOptions converts src to dstFormat with the creation options of
+// the format, e.g. "subformat=streamOptimized".
+func ConvertWithOptions(src, dst string, dstFormat Format, options string) error {
+	args := []string{"convert", "-O", string(dstFormat)}
+	if options != "" {
+		args = append(args, "-o", options)
+	}
+	args = append(args, src, dst)
+	_, err := qemuImg(args)
+	return err
+}
+
+// ConvertEncrypted converts src to a qcow2 image encrypted with the specified
+// encryption format (e.g. "luks") and passphrase.
+func ConvertEncrypted(src, dst string, encryptFormat, passphrase string) error {
+	args := []string{
+		"convert", "-O", string(FormatQcow2),
+		"--object", "secret,id=sec0,data=" + passphrase,
+		"-o", "encrypt.format=" + encryptFormat + ",encrypt.key-secret=sec0",
+		src, dst,
+	}
+	_, err := qemuImg(args)
+	return err
+}
+
+// CreateEncrypted creates a qcow2 image encrypted with the specified encryption
+// format (e.g. "aes") and passphrase.
+func CreateEncrypted(path string, size int64, encryptFormat, passphrase string) error {
+	args := []string{
+		"create", "-f", string(FormatQcow2),
+		"--object", "secret,id=sec0,data=" + passphrase,
+		"-o", "encrypt.format=" + encryptFormat + ",encrypt.key-secret=sec0",
+		path, strconv.FormatInt(size, 10),
+	}
+	_, err := qemuImg(args)
+	return err
+}
+
 func Create(path string, format Format, size int64, backingFile string, backingFormat Format) error {
 	args := []string{"create", "-f", string(format)}
 	if backingFile != "" {
@@ -41,6 +85,33 @@ func Create(path string, format Format, size int64, backingFile string, backingF
 	return err
 }
 
+// Snapshot runs `qemu-img snapshot -c` to create an internal snapshot.
+func Snapshot(path, name string) error {
+	_, err := qemuImg([]string{"snapshot", "-c", name, path})
+	return err
+}
+
+// AddBitmap runs `qemu-img bitmap --add` to add an enabled persistent dirty
+// bitmap.
+func AddBitmap(path, name string) error {
+	_, err := qemuImg([]string{"bitmap", "--add", path, name})
+	return err
+}
+
+// Check runs `qemu-img check` and returns an error if the image has errors or
+// leaked clusters.
+func Check(path string) error {
+	_, err := qemuImg([]string{"check", path})
+	return err
+}
+
+// Compare runs `qemu-img compare` and returns an error if the images content
+// differ.
+func Compare(path1, path2 string) error {
+	_, err := qemuImg([]string{"compare", path1, path2})
+	return err
+}
+
 func qemuImg(args []string) ([]byte, error) {
 	cmd := exec.Command("qemu-img", args...)
 	var stderr bytes.Buffer